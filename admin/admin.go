@@ -0,0 +1,138 @@
+// Package admin serves a running store's live state on a local Unix
+// socket, so walrusctl can inspect a process that has no HTTP server
+// enabled.
+//
+// The protocol is one request line, "status", answered with one JSON
+// object, after which the server closes the connection.
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+// Status is what a running instance reports about itself.
+type Status struct {
+	PID     int
+	Started time.Time
+	Stats   store.Stats // includes WAL.SlowOps and the buffer state
+}
+
+type response struct {
+	Status *Status `json:",omitempty"`
+	Error  string  `json:",omitempty"`
+}
+
+// SocketPath is where the process with the given PID listens.
+func SocketPath(pid int) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("walrus-%d.sock", pid))
+}
+
+// Sockets returns the admin sockets in the temp directory, including
+// any left behind by processes that have exited.
+func Sockets() ([]string, error) {
+	return filepath.Glob(filepath.Join(os.TempDir(), "walrus-*.sock"))
+}
+
+type Server struct {
+	store   *store.Store
+	ln      net.Listener
+	started time.Time
+}
+
+// Listen opens the socket at path, replacing a stale one left by an
+// earlier process. Only the owner can connect.
+func Listen(path string, s *store.Store) (*Server, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return &Server{store: s, ln: ln, started: time.Now()}, nil
+}
+
+// Serve answers requests until Close.
+func (srv *Server) Serve() error {
+	for {
+		conn, err := srv.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go srv.handle(conn)
+	}
+}
+
+func (srv *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	var resp response
+	switch cmd := strings.TrimSpace(line); cmd {
+	case "status":
+		st, err := srv.store.Stats()
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		resp.Status = &Status{PID: os.Getpid(), Started: srv.started, Stats: st}
+	default:
+		resp.Error = fmt.Sprintf("unknown request %q", cmd)
+	}
+
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// Close stops the server and removes its socket.
+func (srv *Server) Close() error {
+	return srv.ln.Close()
+}
+
+// Query asks the instance listening at path for its Status.
+func Query(path string) (Status, error) {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return Status{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("status\n")); err != nil {
+		return Status{}, err
+	}
+
+	var resp response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return Status{}, err
+	}
+	if resp.Error != "" {
+		return Status{}, errors.New(resp.Error)
+	}
+	if resp.Status == nil {
+		return Status{}, errors.New("empty response")
+	}
+	return *resp.Status, nil
+}
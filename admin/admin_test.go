@@ -0,0 +1,49 @@
+package admin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+func TestStatus(t *testing.T) {
+	w, err := wal.Open(t.TempDir(), 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.New(w)
+	defer s.Close()
+
+	s.Set("a", "1")
+	_, cancel := s.Watch("")
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	os.WriteFile(path, nil, 0644) // stale from an earlier run
+
+	srv, err := Listen(path, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+
+	st, err := Query(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.PID != os.Getpid() || st.Stats.Keys != 1 || st.Stats.Watchers != 1 || st.Stats.WAL.Appends != 1 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	srv.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("expected Close to remove the socket")
+	}
+	if _, err := Query(path); err == nil {
+		t.Fatal("expected a query after Close to fail")
+	}
+}
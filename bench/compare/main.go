@@ -0,0 +1,130 @@
+// Command compare diffs two `go test -bench` outputs and fails when a
+// benchmark got slower than the allowed threshold:
+//
+//	go run ./bench/compare [-threshold 10] bench/baseline.txt bench/results/latest.txt
+//
+// Runs repeated with -count are averaged before comparing.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type result struct {
+	runs    int
+	nsPerOp float64
+	bPerOp  float64
+}
+
+func main() {
+	threshold := flag.Float64("threshold", 10, "percent slowdown in ns/op that counts as a regression")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: compare [-threshold pct] <baseline> <latest>")
+		os.Exit(2)
+	}
+
+	old, err := parse(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	cur, err := parse(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	names := make([]string, 0, len(cur))
+	for name := range cur {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	regressions := 0
+	fmt.Printf("%-40s %14s %14s %9s %9s\n", "benchmark", "old ns/op", "new ns/op", "delta", "B/op")
+	for _, name := range names {
+		n := cur[name]
+		o, ok := old[name]
+		if !ok {
+			fmt.Printf("%-40s %14s %14.0f %9s %9.0f\n", name, "-", n.nsPerOp, "new", n.bPerOp)
+			continue
+		}
+
+		delta := (n.nsPerOp - o.nsPerOp) / o.nsPerOp * 100
+		mark := ""
+		if delta > *threshold {
+			mark = "  REGRESSION"
+			regressions++
+		}
+		fmt.Printf("%-40s %14.0f %14.0f %+8.1f%% %9.0f%s\n", name, o.nsPerOp, n.nsPerOp, delta, n.bPerOp, mark)
+	}
+
+	if regressions > 0 {
+		fmt.Printf("\n%d benchmark(s) slower than %.0f%%\n", regressions, *threshold)
+		os.Exit(1)
+	}
+}
+
+// parse averages every benchmark line in a go test output file, keyed
+// by package and benchmark name.
+func parse(path string) (map[string]*result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	results := make(map[string]*result)
+	pkg := ""
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 && fields[0] == "pkg:" {
+			pkg = fields[1][strings.LastIndex(fields[1], "/")+1:]
+			continue
+		}
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+
+		// strip the -GOMAXPROCS suffix so runs on different machines line up
+		name := fields[0]
+		if i := strings.LastIndex(name, "-"); i > 0 {
+			if _, err := strconv.Atoi(name[i+1:]); err == nil {
+				name = name[:i]
+			}
+		}
+		name = pkg + "." + strings.TrimPrefix(name, "Benchmark")
+
+		r := results[name]
+		if r == nil {
+			r = &result{}
+			results[name] = r
+		}
+
+		for i := 2; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				continue
+			}
+			switch fields[i+1] {
+			case "ns/op":
+				r.nsPerOp = (r.nsPerOp*float64(r.runs) + v) / float64(r.runs+1)
+			case "B/op":
+				r.bPerOp = (r.bPerOp*float64(r.runs) + v) / float64(r.runs+1)
+			}
+		}
+		r.runs++
+	}
+
+	return results, sc.Err()
+}
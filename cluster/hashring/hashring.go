@@ -0,0 +1,122 @@
+// Package hashring places keys on a set of independent walrus nodes by
+// consistent hashing, for applications that shard across several
+// servers themselves. Every client built with the same nodes and Options
+// sends each key to the same node, and adding or removing a node moves
+// only the keys it gains or loses, which Rebalance copies across:
+//
+//	ring := hashring.New("a:7379", "b:7379", "c:7379")
+//	conn := conns[ring.Node(key)]
+//	...
+//	next := ring.With("d:7379")
+//	moved, err := hashring.Rebalance(ring, next, stores)
+package hashring
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/jerkeyray/walrus/hash"
+)
+
+// DefaultReplicas is how many points each node gets on the ring by
+// default: enough that three nodes hold within a few percent of a third
+// of the keys each.
+const DefaultReplicas = 160
+
+// Options configures a Ring. Every client of the same nodes must use the
+// same ones, or they place keys differently.
+type Options struct {
+	Replicas int          // points per node; 0 is DefaultReplicas
+	Hash     hash.Version // 0 is hash.Current, which may change; pin it
+}
+
+// Ring maps keys to nodes. It is never changed once made, so it can be
+// shared freely; With and Without return new rings.
+type Ring struct {
+	opts   Options
+	nodes  []string // sorted
+	points []point  // sorted by hash, then node
+}
+
+// point is one of a node's places on the ring. It owns the hashes after
+// the point before it, up to and including its own.
+type point struct {
+	hash uint64
+	node string
+}
+
+// New returns a ring of nodes with the default Options.
+func New(nodes ...string) *Ring {
+	r, _ := NewWithOptions(Options{}, nodes...)
+	return r
+}
+
+// NewWithOptions returns a ring of nodes. Names given twice count once.
+func NewWithOptions(opts Options, nodes ...string) (*Ring, error) {
+	if opts.Replicas < 0 {
+		return nil, fmt.Errorf("hashring: %d replicas", opts.Replicas)
+	}
+	if opts.Replicas == 0 {
+		opts.Replicas = DefaultReplicas
+	}
+	if opts.Hash == 0 {
+		opts.Hash = hash.Current
+	}
+	if !opts.Hash.Valid() {
+		return nil, fmt.Errorf("hashring: unknown hash version %d", opts.Hash)
+	}
+
+	r := &Ring{opts: opts, nodes: slices.Compact(slices.Sorted(slices.Values(nodes)))}
+	r.points = make([]point, 0, len(r.nodes)*opts.Replicas)
+	for _, node := range r.nodes {
+		for i := range opts.Replicas {
+			r.points = append(r.points, point{opts.Hash.String64(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b point) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.node, b.node))
+	})
+	return r, nil
+}
+
+// Node returns the node key belongs on, or "" if the ring has none.
+func (r *Ring) Node(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := r.opts.Hash.String64(key)
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p point, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+	if i == len(r.points) {
+		i = 0 // past the last point, round to the first
+	}
+	return r.points[i].node
+}
+
+// Nodes returns the ring's nodes, sorted.
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+// Options returns the options the ring was made with, defaults filled in.
+func (r *Ring) Options() Options {
+	return r.opts
+}
+
+// With returns a ring of r's nodes and nodes, with r's Options.
+func (r *Ring) With(nodes ...string) *Ring {
+	next, _ := NewWithOptions(r.opts, append(r.Nodes(), nodes...)...)
+	return next
+}
+
+// Without returns a ring of r's nodes except nodes, with r's Options.
+func (r *Ring) Without(nodes ...string) *Ring {
+	kept := slices.DeleteFunc(r.Nodes(), func(node string) bool {
+		return slices.Contains(nodes, node)
+	})
+	next, _ := NewWithOptions(r.opts, kept...)
+	return next
+}
@@ -0,0 +1,129 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/hash"
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+func keys(n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = fmt.Sprintf("user:%d", i)
+	}
+	return out
+}
+
+// Test that keys spread evenly and the same way on every ring of the
+// same nodes, and that changing the nodes moves only the keys they gain
+// or lose
+func TestRing(t *testing.T) {
+	ring := New("a", "b", "c")
+	same, _ := NewWithOptions(Options{Replicas: DefaultReplicas, Hash: hash.Current}, "c", "b", "a", "a")
+
+	counts := make(map[string]int)
+	for _, key := range keys(30000) {
+		node := ring.Node(key)
+		if node != same.Node(key) {
+			t.Fatalf("expected rings of the same nodes to agree on %s", key)
+		}
+		counts[node]++
+	}
+	for node, n := range counts {
+		if n < 8500 || n > 11500 {
+			t.Fatalf("expected about 10000 keys on %s, got %d", node, n)
+		}
+	}
+
+	grown := ring.With("d")
+	moved := 0
+	for _, key := range keys(30000) {
+		if from, to := ring.Node(key), grown.Node(key); from != to {
+			if to != "d" {
+				t.Fatalf("expected %s to move to d only, went %s to %s", key, from, to)
+			}
+			moved++
+		}
+	}
+	if moved < 6000 || moved > 9000 {
+		t.Fatalf("expected about a quarter of the keys to move, got %d", moved)
+	}
+
+	shrunk := ring.Without("b")
+	for _, key := range keys(30000) {
+		if from, to := ring.Node(key), shrunk.Node(key); from != to && from != "b" {
+			t.Fatalf("expected only b's keys to move, %s went %s to %s", key, from, to)
+		}
+	}
+	if got := shrunk.Nodes(); len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Fatalf("expected a and c left, got %v", got)
+	}
+
+	if New().Node("x") != "" {
+		t.Fatal("expected an empty ring to place nothing")
+	}
+	if _, err := NewWithOptions(Options{Hash: 99}, "a"); err == nil {
+		t.Fatal("expected an unknown hash version to fail")
+	}
+}
+
+// Test that Rebalance leaves every key on the node the new ring places it
+// on, with its value and expiry, and no copy behind
+func TestRebalance(t *testing.T) {
+	stores := make(map[string]Node)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		w, err := wal.Open(t.TempDir(), 10*time.Millisecond, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := store.New(w)
+		t.Cleanup(func() { s.Close() })
+		stores[name] = s
+	}
+	node := func(name string) *store.Store { return stores[name].(*store.Store) }
+
+	old := New("a", "b", "c")
+	all := keys(2000)
+	for _, key := range all {
+		node(old.Node(key)).SetWithTTL(key, "v-"+key, time.Hour)
+	}
+	node("a").Set("stray", "1") // not a's by the ring, so left alone
+	b, _ := node("b").Bucket("sessions")
+	b.Set("x", "1")
+
+	next := old.With("d").Without("b")
+	moved, err := Rebalance(old, next, stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := 0
+	for _, key := range all {
+		if old.Node(key) != next.Node(key) {
+			want++
+		}
+		for name := range stores {
+			v, ok := node(name).Get(key)
+			if on := name == next.Node(key); ok != on || on && v != "v-"+key {
+				t.Fatalf("expected %s only on %s, got %q, %v on %s", key, next.Node(key), v, ok, name)
+			}
+		}
+		if ttl, ok := node(next.Node(key)).TTL(key); !ok || ttl <= 0 {
+			t.Fatalf("expected %s to keep its expiry, got %v, %v", key, ttl, ok)
+		}
+	}
+	if moved != want {
+		t.Fatalf("expected %d keys moved, got %d", want, moved)
+	}
+	if !node("a").Has("stray") || !b.Has("x") {
+		t.Fatal("expected the stray key and the bucket left where they were")
+	}
+
+	if _, err := Rebalance(old, next, map[string]Node{"a": stores["a"]}); err == nil {
+		t.Fatal("expected Rebalance to fail without every node")
+	}
+}
@@ -0,0 +1,183 @@
+package hashring
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+// deleteBatch is how many moved keys Rebalance deletes per DeleteMany.
+const deleteBatch = 1000
+
+// Node is what Rebalance needs of a walrus node: the export and import of
+// its keys, and deleting them. *store.Store is one; for a server, wrap a
+// client to it.
+type Node interface {
+	Export(out io.Writer, format store.Format) error
+	Import(in io.Reader, format store.Format) error
+	DeleteMany(keys []string) error
+}
+
+var _ Node = (*store.Store)(nil)
+
+// Rebalance moves the keys that change nodes going from ring old to ring
+// next: for each node of old, it streams an export of the node, imports
+// the keys next places elsewhere into their new nodes as it goes, and
+// once every import has gone through, deletes them from the node. It
+// returns how many keys moved. A key found on a node old doesn't place
+// it on is left there, as are keys in buckets, which the ring doesn't
+// place. Values keep their expiry.
+//
+// It doesn't coordinate with writers: writes to the keys that move
+// should wait until it returns, and then go by next, or they can be
+// lost. An error leaves the node it was moving as it was, bar copies of
+// its keys already on their new nodes, so running it again finishes the
+// job. nodes must have every node of old and next.
+func Rebalance(old, next *Ring, nodes map[string]Node) (int, error) {
+	for _, ring := range []*Ring{old, next} {
+		for _, name := range ring.nodes {
+			if nodes[name] == nil {
+				return 0, fmt.Errorf("hashring: no node %q to rebalance", name)
+			}
+		}
+	}
+
+	total := 0
+	for _, name := range old.nodes {
+		moved, err := rebalanceNode(old, next, name, nodes)
+		total += moved
+		if err != nil {
+			return total, fmt.Errorf("hashring: moving keys off %q: %w", name, err)
+		}
+	}
+	return total, nil
+}
+
+// rebalanceNode is Rebalance for the keys on one node, returning how
+// many it moved.
+func rebalanceNode(old, next *Ring, name string, nodes map[string]Node) (int, error) {
+	src := nodes[name]
+	pr, pw := io.Pipe()
+	defer pr.Close() // stops the export early on an error
+	go func() { pw.CloseWithError(src.Export(pw, store.FormatNDJSON)) }()
+
+	imports := make(map[string]*importer)
+	var moved []string
+	err := eachEntry(bufio.NewReader(pr), func(line []byte, key string) error {
+		if old.Node(key) != name {
+			return nil
+		}
+		to := next.Node(key)
+		if to == name {
+			return nil
+		}
+		imp := imports[to]
+		if imp == nil {
+			imp = startImport(nodes[to])
+			imports[to] = imp
+		}
+		if _, err := imp.w.Write(line); err != nil {
+			return fmt.Errorf("importing into %q: %w", to, imp.wait(err))
+		}
+		moved = append(moved, key)
+		return nil
+	})
+
+	for to, imp := range imports {
+		if ierr := imp.wait(err); ierr != nil && err == nil {
+			err = fmt.Errorf("importing into %q: %w", to, ierr)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < len(moved); i += deleteBatch {
+		if err := src.DeleteMany(moved[i:min(i+deleteBatch, len(moved))]); err != nil {
+			return 0, err
+		}
+	}
+	return len(moved), nil
+}
+
+// importer feeds an Import on a node through a pipe.
+type importer struct {
+	w    *io.PipeWriter
+	done chan error
+}
+
+func startImport(node Node) *importer {
+	pr, pw := io.Pipe()
+	imp := &importer{w: pw, done: make(chan error, 1)}
+	go func() {
+		err := node.Import(pr, store.FormatNDJSON)
+		pr.CloseWithError(err)
+		imp.done <- err
+	}()
+	return imp
+}
+
+// wait ends the import, aborting it if cause is set, and returns its
+// error.
+func (imp *importer) wait(cause error) error {
+	if cause != nil {
+		imp.w.CloseWithError(cause)
+	} else {
+		imp.w.Close()
+	}
+	err := <-imp.done
+	imp.done <- err // for a second wait
+	return err
+}
+
+// entry is the part of an NDJSON export line that names the key.
+type entry struct {
+	Bucket    string  `json:"bucket"`
+	Key       *string `json:"key"`
+	KeyBase64 string  `json:"key_base64"`
+}
+
+// eachEntry calls fn with every line of an NDJSON export outside any
+// bucket, and the key it holds.
+func eachEntry(r *bufio.Reader, fn func(line []byte, key string) error) error {
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var e entry
+			if jerr := json.Unmarshal(line, &e); jerr != nil {
+				return jerr
+			}
+			key, kerr := e.key()
+			if kerr != nil {
+				return kerr
+			}
+			if e.Bucket == "" {
+				if ferr := fn(line, key); ferr != nil {
+					return ferr
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (e entry) key() (string, error) {
+	switch {
+	case e.Key != nil:
+		return *e.Key, nil
+	case e.KeyBase64 != "":
+		k, err := base64.StdEncoding.DecodeString(e.KeyBase64)
+		return string(k), err
+	}
+	return "", errors.New("export entry without a key")
+}
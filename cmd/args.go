@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// splitArgs splits a REPL line into arguments. Double-quoted arguments
+// keep their whitespace and understand Go escapes such as \n, \t and
+// \x00, so binary values can be typed; single quotes are taken verbatim.
+// With a session, $ references outside single quotes are expanded; their
+// values are never split further.
+func splitArgs(line string, sess *session) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+
+		case c == '"':
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+
+			s, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted string %s", line[i:end+1])
+			}
+			if s, err = sess.expand(s); err != nil {
+				return nil, err
+			}
+			cur.WriteString(s)
+			inArg = true
+			i = end
+
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			cur.WriteString(line[i+1 : i+1+end])
+			inArg = true
+			i += end + 1
+
+		case c == '$' && sess != nil:
+			v, next, err := sess.expandAt(line, i)
+			if err != nil {
+				return nil, err
+			}
+			cur.WriteString(v)
+			inArg = true
+			i = next - 1
+
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// splitCommands splits a line such as `SET a 1; GET a` at the semicolons
+// outside quotes. Quotes are left in place for splitArgs.
+func splitCommands(line string) []string {
+	var cmds []string
+	start := 0
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ';':
+			cmds = append(cmds, line[start:i])
+			start = i + 1
+		}
+	}
+	return append(cmds, line[start:])
+}
+
+// displayValue prints text values as they are and anything else as a
+// quoted Go string, so binary values don't garble the terminal.
+func displayValue(v string) string {
+	for _, r := range v {
+		if r == utf8.RuneError || !strconv.IsPrint(r) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// runBackup implements `walrus backup <dest.tar>`.
+func runBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: walrus backup <dest.tar>")
+	}
+
+	// read-only, so a walrus running on the directory can carry on
+	w, err := wal.OpenReadOnly(wal.Options{Dir: dataDir, EncryptionKeys: encryptionKeys()})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer w.Close()
+
+	f, err := os.OpenFile(fs.Arg(0), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := w.Backup(f); err != nil {
+		f.Close()
+		os.Remove(fs.Arg(0))
+		log.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	printSuccess("OK (backed up " + dataDir + " to " + fs.Arg(0) + ")")
+}
+
+// runRestore implements `walrus restore <src.tar>`. The data directory
+// must not hold a log yet.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: walrus restore <src.tar>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := wal.RestoreInto(dataDir, f); err != nil {
+		log.Fatal(err)
+	}
+
+	printSuccess("OK (restored " + fs.Arg(0) + " into " + dataDir + ")")
+}
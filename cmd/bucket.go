@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+// keyspace is what the key commands run against: the store itself or,
+// after USE, one of its buckets.
+type keyspace interface {
+	Set(key, value string) error
+	SetWithTTL(key, value string, ttl time.Duration) error
+	Get(key string) (string, bool)
+	GetWithMeta(key string) (store.Meta, bool)
+	History(key string, limit int) ([]store.Revision, error)
+	TTL(key string) (time.Duration, bool)
+	Incr(key string, delta int64) (int64, error)
+	Delete(key string) error
+	DeleteMany(keys []string) error
+	Has(key string) bool
+	Keys() []string
+	Scan(prefix string) []store.Entry
+	Len() int
+	EstimateCount(prefix string) (int, bool)
+	SetJSON(key string, v any) error
+	JSONGet(key, path string) (json.RawMessage, bool, error)
+	JSONSet(key, path string, v any) error
+}
+
+var (
+	_ keyspace = (*store.Store)(nil)
+	_ keyspace = (*store.Bucket)(nil)
+)
+
+func (sess *session) keyspace() keyspace {
+	if sess.bucket != nil {
+		return sess.bucket
+	}
+	return sess.store
+}
+
+func (sess *session) prompt() string {
+	if sess.bucket != nil {
+		return colorPurple + "walrus:" + sess.bucket.Name() + "> " + colorReset
+	}
+	return colorPurple + "walrus> " + colorReset
+}
+
+// use implements `USE <bucket>`, and USE alone to go back to the keys
+// outside any bucket.
+func (sess *session) use(parts []string) result {
+	if len(parts) == 1 {
+		sess.bucket = nil
+		printSuccess("OK (using the default keyspace)")
+		return cmdOK
+	}
+	if len(parts) != 2 {
+		printError("Usage: USE [bucket]")
+		return cmdFailed
+	}
+
+	b, err := sess.store.Bucket(parts[1])
+	if err != nil {
+		printError(fmt.Sprintf("Error: %v", err))
+		return cmdFailed
+	}
+	sess.bucket = b
+	printSuccess(fmt.Sprintf("OK (using bucket '%s')", b.Name()))
+	return cmdOK
+}
+
+// buckets implements BUCKETS.
+func buckets(s *store.Store) result {
+	names := s.Buckets()
+	if len(names) == 0 {
+		printWarning("No buckets")
+		return cmdNotFound
+	}
+
+	fmt.Printf("%sBuckets (%d total):%s\n", colorBold, len(names), colorReset)
+	for _, name := range names {
+		b, _ := s.Bucket(name)
+		fmt.Printf("  %s %s(%d keys)%s\n", name, colorGray, b.Len(), colorReset)
+	}
+	return cmdOK
+}
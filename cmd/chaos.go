@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// How often --chaos holds up reads and writes on client connections, for
+// how long at most, and how often it cuts them off instead.
+const (
+	chaosDelayRate = 0.05
+	chaosMaxDelay  = 500 * time.Millisecond
+	chaosDropRate  = 0.005
+)
+
+// chaosFaults is what --chaos injects into the WAL: a slow disk that
+// fails some of the flushes writers wait on.
+var chaosFaults = wal.Faults{
+	WriteLatency: time.Millisecond,
+	SyncLatency:  5 * time.Millisecond,
+	Jitter:       50 * time.Millisecond,
+	FlushErrors:  0.02,
+}
+
+var errChaosDropped = errors.New("chaos: connection dropped")
+
+// hiddenFlags are left out of the usage.
+var hiddenFlags = map[string]bool{"chaos": true}
+
+// usage is the flag package's usage message without hiddenFlags.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+
+	shown := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	shown.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			shown.Var(f.Value, f.Name, f.Usage)
+			shown.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	shown.PrintDefaults()
+}
+
+// faults returns chaosFaults under --chaos.
+func faults() wal.Faults {
+	if !chaos {
+		return wal.Faults{}
+	}
+	log.Printf("chaos mode: slowing the disk and failing %g%% of the flushes writers wait on", chaosFaults.FlushErrors*100)
+	return chaosFaults
+}
+
+// listen is net.Listen on tcp, made to misbehave under --chaos.
+func listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || !chaos {
+		return l, err
+	}
+	log.Printf("chaos mode: holding up and dropping connections on %s", addr)
+	return chaosListener{l}, nil
+}
+
+// chaosListener hands out connections that misbehave.
+type chaosListener struct {
+	net.Listener
+}
+
+func (l chaosListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return chaosConn{conn}, nil
+}
+
+// chaosConn holds up chaosDelayRate of its reads and writes by up to
+// chaosMaxDelay, and closes itself instead of chaosDropRate of them.
+type chaosConn struct {
+	net.Conn
+}
+
+func (c chaosConn) Read(b []byte) (int, error) {
+	if err := c.misbehave(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c chaosConn) Write(b []byte) (int, error) {
+	if err := c.misbehave(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c chaosConn) misbehave() error {
+	switch p := rand.Float64(); {
+	case p < chaosDropRate:
+		c.Conn.Close()
+		return errChaosDropped
+	case p < chaosDropRate+chaosDelayRate:
+		time.Sleep(rand.N(chaosMaxDelay))
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+// check implements CHECK.
+func check(s *store.Store) result {
+	r, err := s.SelfCheck()
+	if err != nil {
+		printError(fmt.Sprintf("Error: %v", err))
+		return cmdFailed
+	}
+
+	if r.OK() {
+		printSuccess(fmt.Sprintf("OK (%d keys match %d replayed records, %v)", r.Keys, r.Records, r.Duration.Round(time.Millisecond)))
+		return cmdOK
+	}
+
+	printError(fmt.Sprintf("%d key(s) differ from a replay of the log:", r.Divergent))
+	for _, d := range r.Divergences {
+		switch d.Reason {
+		case "index":
+			fmt.Printf("  %sindex%s   sorted index does not match the stored keys\n", colorYellow, colorReset)
+		case "missing":
+			fmt.Printf("  %smissing%s %s (log has %s)\n", colorYellow, colorReset, d.Key, displayValue(d.Log))
+		case "extra":
+			fmt.Printf("  %sextra%s   %s = %s (not in the log)\n", colorYellow, colorReset, d.Key, displayValue(d.Memory))
+		default:
+			fmt.Printf("  %s%-7s%s %s = %s (log has %s)\n", colorYellow, d.Reason, colorReset, d.Key, displayValue(d.Memory), displayValue(d.Log))
+		}
+	}
+	if n := r.Divergent - len(r.Divergences); n > 0 {
+		fmt.Printf("  %s... and %d more%s\n", colorGray, n, colorReset)
+	}
+	return cmdFailed
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// previewLimit is how many matching keys DELETE --match lists.
+const previewLimit = 20
+
+// del implements `DELETE <key>...`, deleting the keys that exist in one
+// batch, and `DELETE --match <glob>`, which lists the keys the glob
+// matches and deletes them only when run again with --yes.
+func (sess *session) del(parts []string) result {
+	const usage = "Usage: DELETE <key>... or DELETE --match <glob> [--yes]"
+	if len(parts) < 2 {
+		printError(usage)
+		return cmdFailed
+	}
+	if parts[1] == "--match" {
+		if len(parts) < 3 || len(parts) > 4 || len(parts) == 4 && parts[3] != "--yes" {
+			printError(usage)
+			return cmdFailed
+		}
+		return sess.deleteMatching(parts[2], len(parts) == 4)
+	}
+
+	ks := sess.keyspace()
+	keys := parts[1:]
+	var found []string
+	for _, key := range keys {
+		if ks.Has(key) {
+			found = append(found, key)
+		}
+	}
+	if len(found) == 0 {
+		if len(keys) == 1 {
+			printWarning(fmt.Sprintf("Key '%s' does not exist", keys[0]))
+		} else {
+			printWarning(fmt.Sprintf("None of the %d keys exist", len(keys)))
+		}
+		return cmdNotFound
+	}
+
+	if err := ks.DeleteMany(found); err != nil {
+		printError(fmt.Sprintf("Error: %v", err))
+		return cmdFailed
+	}
+	if len(keys) == 1 {
+		printSuccess(fmt.Sprintf("OK (deleted '%s')", keys[0]))
+	} else {
+		printSuccess(fmt.Sprintf("OK (deleted %d of %d keys)", len(found), len(keys)))
+	}
+	return cmdOK
+}
+
+func (sess *session) deleteMatching(glob string, confirmed bool) result {
+	ks := sess.keyspace()
+
+	// the part before the first wildcard narrows the scan
+	prefix := glob
+	if i := strings.IndexAny(glob, `*?\`); i >= 0 {
+		prefix = glob[:i]
+	}
+	var keys []string
+	for _, e := range ks.Scan(prefix) {
+		if matchGlob(glob, e.Key) {
+			keys = append(keys, e.Key)
+		}
+	}
+	if len(keys) == 0 {
+		printWarning(fmt.Sprintf("No keys match '%s'", glob))
+		return cmdNotFound
+	}
+
+	if !confirmed {
+		fmt.Printf("%sKeys matching '%s' (%d total):%s\n", colorBold, glob, len(keys), colorReset)
+		for i, key := range keys {
+			if i == previewLimit {
+				fmt.Printf("  %s... and %d more%s\n", colorGray, len(keys)-previewLimit, colorReset)
+				break
+			}
+			fmt.Printf("  %s\n", key)
+		}
+		printInfo(fmt.Sprintf("Run DELETE --match '%s' --yes to delete them", glob))
+		return cmdOK
+	}
+
+	if err := ks.DeleteMany(keys); err != nil {
+		printError(fmt.Sprintf("Error: %v", err))
+		return cmdFailed
+	}
+	printSuccess(fmt.Sprintf("OK (deleted %d keys matching '%s')", len(keys), glob))
+	return cmdOK
+}
+
+// matchGlob reports whether key matches glob, where * matches any run of
+// characters, ? any one and \ makes the next character literal. Unlike
+// path.Match, * crosses '/', which keys use like any other character.
+func matchGlob(glob, key string) bool {
+	// on a mismatch, retry from the last * with it taking one more byte
+	star, starKey := -1, 0
+	g, k := 0, 0
+	for k < len(key) {
+		switch {
+		case g < len(glob) && glob[g] == '*':
+			star, starKey = g, k
+			g++
+			continue
+		case g < len(glob) && glob[g] == '?':
+			g++
+			k++
+			continue
+		case g < len(glob):
+			c := glob[g]
+			next := g + 1
+			if c == '\\' && next < len(glob) {
+				c, next = glob[next], next+1
+			}
+			if c == key[k] {
+				g, k = next, k+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starKey++
+		g, k = star+1, starKey
+	}
+	for g < len(glob) && glob[g] == '*' {
+		g++
+	}
+	return g == len(glob)
+}
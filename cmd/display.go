@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// displayMode is how GET and SCAN show values.
+type displayMode int
+
+const (
+	displayAuto   displayMode = iota // text as is, anything else quoted
+	displayHex                       // hexdump -C style
+	displayBase64                    // standard base64
+)
+
+func (m displayMode) String() string {
+	switch m {
+	case displayHex:
+		return "hex"
+	case displayBase64:
+		return "base64"
+	}
+	return "auto"
+}
+
+func parseDisplayMode(s string) (displayMode, error) {
+	switch strings.ToLower(s) {
+	case "auto", "text":
+		return displayAuto, nil
+	case "hex":
+		return displayHex, nil
+	case "base64":
+		return displayBase64, nil
+	}
+	return 0, fmt.Errorf("unknown display mode %q (auto, hex or base64)", s)
+}
+
+// format renders v in mode m. Hex dumps span several lines and end with
+// a newline, which is trimmed.
+func (m displayMode) format(v string) string {
+	switch m {
+	case displayHex:
+		if v == "" {
+			return "(empty)"
+		}
+		return strings.TrimSuffix(hex.Dump([]byte(v)), "\n")
+	case displayBase64:
+		return base64.StdEncoding.EncodeToString([]byte(v))
+	}
+	return displayValue(v)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+// runExport implements `walrus export [--format json|ndjson|csv] [dest]`,
+// writing to stdout when no destination is given.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	formatName := fs.String("format", "json", "file `format`: json, ndjson or csv")
+	fs.Parse(args)
+	flagsFromEnv(fs)
+	if fs.NArg() > 1 {
+		log.Fatal("usage: walrus export [--format json|ndjson|csv] [dest]")
+	}
+	format, err := store.ParseFormat(*formatName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, _ := openStore()
+	defer s.Close()
+
+	var out io.Writer = os.Stdout
+	if fs.NArg() == 1 {
+		f, err := os.OpenFile(fs.Arg(0), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if err := s.Export(out, format); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runImport implements `walrus import [--format json|ndjson|csv]
+// [--replace] <src>`, reading stdin when src is "-". Keys in the file
+// overwrite those already stored; with --replace, keys not in the file
+// are deleted too.
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	formatName := fs.String("format", "json", "file `format`: json, ndjson or csv")
+	replace := fs.Bool("replace", false, "delete the keys that aren't in the file")
+	fs.Parse(args)
+	flagsFromEnv(fs)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: walrus import [--format json|ndjson|csv] [--replace] <src>")
+	}
+	format, err := store.ParseFormat(*formatName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	s, _ := openStore()
+	defer s.Close()
+
+	opts := store.ImportOptions{Format: format}
+	if *replace {
+		opts.Mode = store.ImportReplace
+	}
+	if err := s.ImportWithOptions(in, opts); err != nil {
+		log.Fatal(err)
+	}
+
+	printSuccess("OK (imported " + fs.Arg(0) + " into " + dataDir + ")")
+}
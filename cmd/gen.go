@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+// writes per batch while generating, so a large GEN doesn't build one
+// huge record
+const genBatchSize = 1000
+
+// gen implements `GEN <n> <key-template> <value-template>`, writing n
+// keys whose names and values come from the templates; see
+// expandTemplate.
+func gen(s *store.Store, parts []string) result {
+	if len(parts) < 4 {
+		printError("Usage: GEN <n> <key-template> <value-template>")
+		return cmdFailed
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n <= 0 {
+		printError("Usage: GEN <n> <key-template> <value-template> (n must be a positive integer)")
+		return cmdFailed
+	}
+	keyTmpl, valueTmpl := parts[2], strings.Join(parts[3:], " ")
+
+	// check both templates before writing anything
+	if _, err := expandTemplate(keyTmpl, 1, nil); err != nil {
+		printError(fmt.Sprintf("Error: %v", err))
+		return cmdFailed
+	}
+	if _, err := expandTemplate(valueTmpl, 1, nil); err != nil {
+		printError(fmt.Sprintf("Error: %v", err))
+		return cmdFailed
+	}
+
+	start := time.Now()
+	rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	b := &store.WriteBatch{}
+	for i := 1; i <= n; i++ {
+		key, _ := expandTemplate(keyTmpl, i, rng)
+		value, _ := expandTemplate(valueTmpl, i, rng)
+		b.Set(key, value)
+
+		if b.Len() == genBatchSize || i == n {
+			if err := s.Write(b); err != nil {
+				printError(fmt.Sprintf("Error after %d key(s): %v", i-b.Len(), err))
+				return cmdFailed
+			}
+			b = &store.WriteBatch{}
+		}
+	}
+
+	printSuccess(fmt.Sprintf("OK (generated %d key(s) in %v)", n, time.Since(start).Round(time.Millisecond)))
+	return cmdOK
+}
+
+// expandTemplate fills in the placeholders of a GEN template for the
+// i-th key:
+//
+//	{i}         i, counting from 1
+//	{i:N}       i zero-padded to N digits
+//	{rand:N}    a random integer in [0, N)
+//	{hex:N}     N random hex digits
+//	{pick:a|b}  one of the alternatives, at random
+//
+// Other braces are kept as they are, so JSON templates work. A nil rng
+// only validates the template.
+func expandTemplate(tmpl string, i int, rng *rand.Rand) (string, error) {
+	var b strings.Builder
+
+	for {
+		open := strings.IndexByte(tmpl, '{')
+		if open < 0 {
+			b.WriteString(tmpl)
+			return b.String(), nil
+		}
+		b.WriteString(tmpl[:open])
+		tmpl = tmpl[open:]
+
+		if !isPlaceholder(tmpl[1:]) {
+			b.WriteByte('{')
+			tmpl = tmpl[1:]
+			continue
+		}
+
+		end := strings.IndexByte(tmpl, '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated %s in template", tmpl)
+		}
+		v, err := placeholder(tmpl[1:end], i, rng)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+		tmpl = tmpl[end+1:]
+	}
+}
+
+// isPlaceholder reports whether text just after a '{' names a
+// placeholder.
+func isPlaceholder(text string) bool {
+	for _, name := range []string{"i", "rand", "hex", "pick"} {
+		if rest, ok := strings.CutPrefix(text, name); ok && (strings.HasPrefix(rest, "}") || strings.HasPrefix(rest, ":")) {
+			return true
+		}
+	}
+	return false
+}
+
+func placeholder(p string, i int, rng *rand.Rand) (string, error) {
+	name, arg, hasArg := strings.Cut(p, ":")
+
+	if name == "pick" {
+		choices := strings.Split(arg, "|")
+		if !hasArg || arg == "" {
+			return "", fmt.Errorf("{pick:...} needs alternatives separated by |")
+		}
+		if rng == nil {
+			return "", nil
+		}
+		return choices[rng.IntN(len(choices))], nil
+	}
+
+	if name == "i" && !hasArg {
+		return strconv.Itoa(i), nil
+	}
+
+	n, err := strconv.Atoi(arg)
+	if err != nil || n <= 0 {
+		return "", fmt.Errorf("{%s} needs a positive number, as in {%s:8}", p, name)
+	}
+
+	switch name {
+	case "i":
+		return fmt.Sprintf("%0*d", n, i), nil
+	case "rand":
+		if rng == nil {
+			return "", nil
+		}
+		return strconv.Itoa(rng.IntN(n)), nil
+	case "hex":
+		const digits = "0123456789abcdef"
+		if n > 64 {
+			return "", fmt.Errorf("{hex:%d} is longer than 64 digits", n)
+		}
+		buf := make([]byte, n)
+		for j := range buf {
+			if rng != nil {
+				buf[j] = digits[rng.IntN(16)]
+			}
+		}
+		return string(buf), nil
+	}
+
+	return "", fmt.Errorf("{%s} is not a placeholder", p)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// prettyJSON indents and colorizes v if it is a JSON object or array.
+func prettyJSON(v string) (string, bool) {
+	trimmed := strings.TrimSpace(v)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return "", false
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(trimmed), "", "  "); err != nil {
+		return "", false
+	}
+	return colorizeJSON(buf.String()), true
+}
+
+// colorizeJSON colors the tokens of valid, indented JSON: keys blue,
+// strings green, numbers yellow, and true, false and null purple.
+func colorizeJSON(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+
+			color := colorGreen
+			if rest := strings.TrimLeft(s[end:], " "); strings.HasPrefix(rest, ":") {
+				color = colorBlue
+			}
+			b.WriteString(color + s[i:end] + colorReset)
+			i = end
+
+		case c == '-' || c >= '0' && c <= '9':
+			end := i + 1
+			for end < len(s) && strings.IndexByte("+-.eE0123456789", s[end]) >= 0 {
+				end++
+			}
+			b.WriteString(colorYellow + s[i:end] + colorReset)
+			i = end
+
+		case c == 't' || c == 'f' || c == 'n':
+			end := i + 1
+			for end < len(s) && s[end] >= 'a' && s[end] <= 'z' {
+				end++
+			}
+			b.WriteString(colorPurple + s[i:end] + colorReset)
+			i = end
+
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// jsonPath extracts the part of the JSON document v named by path, such
+// as .user.name or .items[0].id. Strings come back unquoted, anything
+// else as JSON.
+func jsonPath(v, path string) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(v))
+	dec.UseNumber()
+
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return "", fmt.Errorf("value is not JSON: %v", err)
+	}
+
+	steps, err := parsePath(path)
+	if err != nil {
+		return "", err
+	}
+
+	cur := doc
+	for _, step := range steps {
+		switch node := cur.(type) {
+		case map[string]any:
+			next, ok := node[step]
+			if !ok {
+				return "", fmt.Errorf("no field %q in %s", step, path)
+			}
+			cur = next
+
+		case []any:
+			idx, err := strconv.Atoi(step)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return "", fmt.Errorf("no index %s in %s", step, path)
+			}
+			cur = node[idx]
+
+		default:
+			return "", fmt.Errorf("%s goes past a %T", path, cur)
+		}
+	}
+
+	if s, ok := cur.(string); ok {
+		return s, nil
+	}
+	out, err := json.Marshal(cur)
+	return string(out), err
+}
+
+// parsePath splits .a.b[2] into a, b and 2.
+func parsePath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, ".") {
+		return nil, fmt.Errorf("path %q must start with '.'", path)
+	}
+
+	var steps []string
+	for _, part := range strings.Split(path[1:], ".") {
+		if part == "" {
+			continue
+		}
+		name, rest, indexed := strings.Cut(part, "[")
+		if name != "" {
+			steps = append(steps, name)
+		}
+		for indexed {
+			idx, after, ok := strings.Cut(rest, "]")
+			if !ok {
+				return nil, fmt.Errorf("unterminated [ in %q", path)
+			}
+			steps = append(steps, idx)
+			if rest, indexed = strings.CutPrefix(after, "["); !indexed && rest != "" {
+				return nil, fmt.Errorf("unexpected %q after ] in %q", rest, path)
+			}
+		}
+	}
+	return steps, nil
+}
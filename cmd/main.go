@@ -1,272 +1,401 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
-	"time"
+	"syscall"
 
 	"github.com/chzyer/readline"
+	"github.com/jerkeyray/walrus/config"
+	"github.com/jerkeyray/walrus/replication"
 	"github.com/jerkeyray/walrus/store"
 	"github.com/jerkeyray/walrus/wal"
 )
 
-// ANSI color codes
-const (
-	colorReset  = "\033[0m"
-	colorRed    = "\033[31m"
-	colorGreen  = "\033[32m"
-	colorYellow = "\033[33m"
-	colorBlue   = "\033[34m"
-	colorPurple = "\033[35m"
-	colorCyan   = "\033[36m"
-	colorGray   = "\033[37m"
-	colorBold   = "\033[1m"
+var (
+	// configPath is walrus.toml or walrus.yaml, see config.Find, unless
+	// --config names another file.
+	configPath string
+
+	// dataDir is the data_dir setting, read once at startup.
+	dataDir string
+
+	// readOnly opens dataDir without writing to it, see --read-only.
+	readOnly bool
+
+	// chaos makes the servers misbehave on purpose, see --chaos, so
+	// clients can be tested against one that does. The flag is left out
+	// of the usage, being no way to run for real.
+	chaos bool
+
+	// backgroundRecovery has loadStore return before replay is done,
+	// see walrus serve --background-recovery. recovered then delivers
+	// the outcome.
+	backgroundRecovery bool
+	recovered          <-chan error
+
+	// overrides are the settings given as flags, which win over the
+	// config file, reloads included.
+	overrides []setting
 )
 
-func printSuccess(msg string) {
-	fmt.Printf("%s%s%s\n", colorGreen, msg, colorReset)
+type setting struct{ key, value string }
+
+// settingFlag defines a flag for a config file setting, checked as it is
+// parsed.
+func settingFlag(name, key, usage string) {
+	flag.Func(name, usage, func(value string) error {
+		var scratch config.Config
+		if err := scratch.Set(key, value); err != nil {
+			return err
+		}
+		overrides = append(overrides, setting{key, value})
+		return nil
+	})
 }
 
-func printError(msg string) {
-	fmt.Printf("%s%s%s\n", colorRed, msg, colorReset)
+// loadConfig reads the config file with the environment applied over
+// it, and the flags over that.
+func loadConfig() (config.Config, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return cfg, err
+	}
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return cfg, err
+	}
+	for _, o := range overrides {
+		cfg.Set(o.key, o.value)
+	}
+	return cfg, nil
 }
 
-func printInfo(msg string) {
-	fmt.Printf("%s%s%s\n", colorCyan, msg, colorReset)
+// reloadConfig re-reads the config file and applies its tunables to the
+// running WAL, so settings can change without a restart or replay.
+func reloadConfig(w *wal.WAL) (config.Config, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, w.Reload(tunables(cfg))
 }
 
-func printWarning(msg string) {
-	fmt.Printf("%s%s%s\n", colorYellow, msg, colorReset)
+func tunables(cfg config.Config) wal.Tunables {
+	return wal.Tunables{
+		FlushEvery:     cfg.FlushInterval,
+		MaxSegmentSize: cfg.MaxSegmentSize,
+		MaxSegmentAge:  cfg.MaxSegmentAge,
+		SyncPolicy:     cfg.SyncPolicy,
+	}
 }
 
-func printBanner() {
-	banner := `	
- ___       __   ________  ___       ________  ___  ___  ________      
-|\  \     |\  \|\   __  \|\  \     |\   __  \|\  \|\  \|\   ____\     
-\ \  \    \ \  \ \  \|\  \ \  \    \ \  \|\  \ \  \\\  \ \  \___|_    
- \ \  \  __\ \  \ \   __  \ \  \    \ \   _  _\ \  \\\  \ \_____  \   
-  \ \  \|\__\_\  \ \  \ \  \ \  \____\ \  \\  \\ \  \\\  \|____|\  \  
-   \ \____________\ \__\ \__\ \_______\ \__\\ _\\ \_______\____\_\  \ 
-    \|____________|\|__|\|__|\|_______|\|__|\|__|\|_______|\_________\
-                                                          \|_________|
-
-
-`
-	fmt.Print(colorCyan + banner + colorReset)
-	fmt.Println(colorGray + "A simple persistent key-value store with WAL" + colorReset)
-	fmt.Println(colorGray + "Type 'help' for available commands" + colorReset)
-	fmt.Println()
+// encryptionKeys returns the keys from WALRUS_ENCRYPTION_KEYS, if any.
+// Keys are kept out of walrus.toml so the config file can't leak them.
+func encryptionKeys() []wal.EncryptionKey {
+	keys, err := wal.EncryptionKeysFromEnv()
+	if err != nil {
+		log.Fatalf("%s: %v", wal.EncryptionKeysEnv, err)
+	}
+	return keys
 }
 
-func printHelp() {
-	help := `
-` + colorBold + "Available Commands:" + colorReset + `
-
-  ` + colorGreen + `SET` + colorReset + ` <key> <value>     Store a key-value pair
-  ` + colorGreen + `GET` + colorReset + ` <key>             Retrieve value for a key
-  ` + colorGreen + `DELETE` + colorReset + ` <key>          Remove a key
-  ` + colorGreen + `HAS` + colorReset + ` <key>             Check if key exists
-  ` + colorGreen + `KEYS` + colorReset + `                  List all keys
-  ` + colorGreen + `LEN` + colorReset + `                   Show number of keys
-  ` + colorGreen + `COMMIT` + colorReset + `                Flush all pending writes
-  ` + colorGreen + `CLEAR` + colorReset + `                 Clear the screen
-  ` + colorGreen + `HELP` + colorReset + `                  Show this help message
-  ` + colorGreen + `EXIT` + colorReset + `                  Exit the CLI
-
-` + colorBold + "Examples:" + colorReset + `
-  walrus> SET name jerk
-  walrus> GET name
-  walrus> DELETE name
-  walrus> KEYS
-`
-	fmt.Println(help)
+// openStore opens the WAL in dataDir with the tunables from the config
+// file, recovers the store and reloads tunables on SIGHUP.
+func openStore() (*store.Store, *wal.WAL) {
+	s, w, err := loadStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s, w
 }
 
-func handleCommand(s *store.Store, parts []string) {
-	if len(parts) == 0 {
-		return
+// loadStore is openStore returning its error, for callers that report
+// it their own way.
+func loadStore() (*store.Store, *wal.WAL, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	if readOnly {
+		return openReadOnly(cfg)
 	}
 
-	cmd := strings.ToUpper(parts[0])
+	w, err := wal.OpenWithOptions(wal.Options{
+		Dir:            dataDir,
+		FlushEvery:     cfg.FlushInterval,
+		MaxSegmentSize: cfg.MaxSegmentSize,
+		MaxSegmentAge:  cfg.MaxSegmentAge,
+		SyncPolicy:     cfg.SyncPolicy,
+		Preallocate:    cfg.PreallocateSegments,
+		MaxRecordSize:  cfg.MaxRecordSize,
+		Origin:         cfg.Origin,
+
+		MaxBufferedBytes: int(cfg.MaxBufferedBytes),
+		BufferPolicy:     cfg.BufferPolicy,
+		StallTimeout:     cfg.StallTimeout,
+
+		Compression:    cfg.Compression,
+		EncryptionKeys: encryptionKeys(),
+		Recovery:       cfg.RecoveryMode,
+		Faults:         faults(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	switch cmd {
-	case "SET":
-		if len(parts) < 3 {
-			printError("Usage: SET <key> <value>")
-			return
+	// SIGHUP reloads tunables in place
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := reloadConfig(w); err != nil {
+				printError(fmt.Sprintf("Reload failed: %v", err))
+				continue
+			}
+			printInfo("Config reloaded")
 		}
-		key := parts[1]
-		value := strings.Join(parts[2:], " ")
+	}()
 
-		if err := s.Set(key, value); err != nil {
-			printError(fmt.Sprintf("Error: %v", err))
-			return
-		}
-		printSuccess(fmt.Sprintf("OK (set '%s' = '%s')", key, value))
+	s := store.New(w)
 
-	case "GET":
-		if len(parts) < 2 {
-			printError("Usage: GET <key>")
-			return
-		}
-		key := parts[1]
+	// Recover existing data
+	opts := store.RecoverOptions{
+		MaxMemory:       cfg.RecoveryMemoryLimit,
+		DeadLetterPath:  cfg.DeadLetter,
+		CheckAfterCrash: cfg.CheckAfterCrash,
+	}
+	if backgroundRecovery {
+		done := make(chan error, 1)
+		recovered = done
+		go func() {
+			err := <-s.RecoverInBackground(opts)
+			if err != nil {
+				err = fmt.Errorf("recovery: %w", err)
+			} else {
+				err = afterRecovery(s, cfg)
+			}
+			done <- err
+		}()
+		return s, w, nil
+	}
+	if err := s.RecoverWithOptions(opts); err != nil {
+		w.Close()
+		return nil, nil, fmt.Errorf("recovery: %w", err)
+	}
+	if err := afterRecovery(s, cfg); err != nil {
+		w.Close()
+		return nil, nil, err
+	}
 
-		value, ok := s.Get(key)
-		if !ok {
-			printWarning(fmt.Sprintf("Key '%s' not found", key))
-			return
-		}
-		printInfo(fmt.Sprintf("%s", value))
+	return s, w, nil
+}
 
-	case "DELETE", "DEL":
-		if len(parts) < 2 {
-			printError("Usage: DELETE <key>")
-			return
+// onSignal calls stop on the first SIGINT or SIGTERM until the returned
+// func is called, for the modes that serve no connections to shut down.
+func onSignal(stop func(os.Signal)) (cancel func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-ch:
+			stop(sig)
+		case <-done:
 		}
-		key := parts[1]
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
 
-		if !s.Has(key) {
-			printWarning(fmt.Sprintf("Key '%s' does not exist", key))
-			return
+// exitOnSignal is the stop for onSignal when nothing blocked can be woken
+// up: it closes the store, flushing and syncing its writes, and exits
+// with the shell's code for the signal.
+func exitOnSignal(s *store.Store, cleanup func()) func(os.Signal) {
+	return func(sig os.Signal) {
+		cleanup()
+		s.Close()
+		code := 1
+		if n, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(n)
 		}
+		os.Exit(code)
+	}
+}
 
-		if err := s.Delete(key); err != nil {
-			printError(fmt.Sprintf("Error: %v", err))
-			return
+// afterRecovery applies the settings that work on the recovered keys.
+func afterRecovery(s *store.Store, cfg config.Config) error {
+	if cfg.BucketIdleTTL > 0 {
+		if err := s.SetBucketIdleTTL(cfg.BucketIdleTTL, filepath.Join(dataDir, "buckets")); err != nil {
+			return err
 		}
-		printSuccess(fmt.Sprintf("OK (deleted '%s')", key))
-
-	case "HAS", "EXISTS":
-		if len(parts) < 2 {
-			printError("Usage: HAS <key>")
-			return
+	}
+	if cfg.ColdKeyTTL > 0 {
+		if err := s.SetColdTTL(cfg.ColdKeyTTL, store.DirTier(filepath.Join(dataDir, "cold"))); err != nil {
+			return err
 		}
-		key := parts[1]
+	}
+	limit, err := memoryLimit(cfg)
+	if err != nil {
+		return err
+	}
+	return s.SetMemoryLimit(limit)
+}
 
-		if s.Has(key) {
-			printSuccess(fmt.Sprintf("Key '%s' exists", key))
-		} else {
-			printWarning(fmt.Sprintf("Key '%s' does not exist", key))
-		}
+// memoryLimit returns the store memory limit cfg asks for, working out a
+// percentage from GOMEMLIMIT.
+func memoryLimit(cfg config.Config) (int64, error) {
+	if cfg.MemoryLimitFraction == 0 {
+		return cfg.MemoryLimit, nil
+	}
+	goLimit := store.GoMemoryLimit()
+	if goLimit == 0 {
+		return 0, fmt.Errorf("memory_limit of %g%% needs GOMEMLIMIT set", cfg.MemoryLimitFraction*100)
+	}
+	return int64(cfg.MemoryLimitFraction * float64(goLimit)), nil
+}
+
+// openReadOnly is loadStore for --read-only: it loads dataDir as it is,
+// for looking into the data of a walrus still running on it, and leaves
+// out whatever writes, reloads and dead letters included.
+func openReadOnly(cfg config.Config) (*store.Store, *wal.WAL, error) {
+	w, err := wal.OpenReadOnly(wal.Options{Dir: dataDir, EncryptionKeys: encryptionKeys(), Recovery: cfg.RecoveryMode, MaxRecordSize: cfg.MaxRecordSize})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := store.New(w)
+	s.SetReadOnly(true)
+	if err := s.RecoverWithOptions(store.RecoverOptions{MaxMemory: cfg.RecoveryMemoryLimit}); err != nil {
+		w.Close()
+		return nil, nil, fmt.Errorf("recovery: %w", err)
+	}
+	return s, w, nil
+}
 
-	case "KEYS":
-		keys := s.Keys()
-		if len(keys) == 0 {
-			printWarning("No keys stored")
+// flagsFromEnv sets each flag of fs not given on the command line from
+// its environment variable, if set: WALRUS_ and the flag's name in upper
+// case with '_' for '-', as in WALRUS_SERVE or WALRUS_DATA_DIR. That
+// lets a container set up walrus through its environment alone.
+func flagsFromEnv(fs *flag.FlagSet) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	fs.VisitAll(func(f *flag.Flag) {
+		name := config.EnvName(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok || given[f.Name] {
 			return
 		}
-
-		fmt.Printf("%sKeys (%d total):%s\n", colorBold, len(keys), colorReset)
-		for i, key := range keys {
-			fmt.Printf("  %s%d.%s %s\n", colorGray, i+1, colorReset, key)
+		if err := fs.Set(f.Name, value); err != nil {
+			log.Fatalf("%s: %v", name, err)
 		}
+	})
+}
 
-	case "LEN", "COUNT":
-		count := s.Len()
-		printInfo(fmt.Sprintf("Total keys: %d", count))
-
-	case "COMMIT":
-		s.Commit()
-		printSuccess("OK (all writes flushed to disk)")
-
-	case "CLEAR", "CLS":
-		fmt.Print("\033[H\033[2J")
-		printBanner()
-
-	case "HELP", "?":
-		printHelp()
-
-	case "EXIT", "QUIT", "Q":
-		printInfo("Goodbye!")
-		os.Exit(0)
-
-	default:
-		printError(fmt.Sprintf("Unknown command: %s", cmd))
-		fmt.Println("Type 'help' for available commands")
-	}
+// subcommands run instead of the REPL when named as the first argument
+// after the flags; any other is run as a REPL command, see runCommands
+var subcommands = map[string]func(args []string){
+	"serve":       runServe,
+	"healthcheck": runHealthcheck,
+	"serve-http":  runServeHTTP,
+	"serve-grpc":  runServeGRPC,
+	"preview":     runPreview,
+	"backup":      runBackup,
+	"restore":     runRestore,
+	"repair":      runRepair,
+	"export":      runExport,
+	"import":      runImport,
 }
 
 func main() {
-	// open WAL with 100ms flush interval and 10MB max segment size
-	w, err := wal.Open("./walrus-data", 100*time.Millisecond, 10*1024*1024)
+	flag.StringVar(&configPath, "config", config.Find("."), "read settings from `file`, TOML or YAML")
+	settingFlag("data-dir", "data_dir", "keep the WAL in `dir` (default ./walrus-data)")
+	settingFlag("flush-interval", "flush_interval", "flush writes to disk every `interval`, such as 100ms")
+	settingFlag("max-segment-size", "max_segment_size", "rotate WAL segments at this `size`, such as 10MB")
+	serveAddr := flag.String("serve", "", "serve the store over the redis protocol on `addr` instead of starting the REPL")
+	replicateAddr := flag.String("replicate", "", "stream the WAL to followers connecting on `addr`")
+	followAddr := flag.String("follow", "", "run read-only, replicating from the primary at `addr`")
+	metricsAddr := flag.String("metrics", "", "serve /metrics and /debug/vars on `addr`")
+	adminSocket := flag.Bool("admin", true, "answer walrusctl status on a local socket")
+	script := flag.String("c", "", "run the `commands`, separated by ';', instead of starting the REPL")
+	flag.BoolVar(&readOnly, "read-only", false, "open the data dir without writing to it, to inspect one another walrus has open")
+	flag.BoolVar(&quietOutput, "quiet", false, "don't print OK for each command run from the command line or stdin")
+	flag.BoolVar(&chaos, "chaos", false, "inject latency, dropped connections and flush errors, to test clients")
+	flag.Usage = usage
+	flag.Parse()
+	flagsFromEnv(flag.CommandLine)
+
+	cfg, err := loadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer w.Close()
-
-	s := store.New(w)
+	dataDir = cfg.DataDir
 
-	// Recover existing data
-	if err := s.Recover(); err != nil {
-		log.Fatal(err)
+	if run, ok := subcommands[flag.Arg(0)]; ok {
+		run(flag.Args()[1:])
+		return
 	}
 
-	// print banner
-	printBanner()
+	s, w := openStore()
+	defer s.Close()
 
-	// show recovered data stats
-	if s.Len() > 0 {
-		printInfo(fmt.Sprintf("Recovered %d key(s) from disk", s.Len()))
-		fmt.Println()
+	// `walrus get foo` or `walrus -c "..."`: run and exit with the result
+	if flag.NArg() > 0 || *script != "" {
+		onSignal(exitOnSignal(s, func() {}))
+		r := runCommands(s, w, *script, flag.Args())
+		s.Close()
+		os.Exit(int(r))
 	}
-
-	// setup readline with auto-complete
-	completer := readline.NewPrefixCompleter(
-		readline.PcItem("SET"),
-		readline.PcItem("GET"),
-		readline.PcItem("DELETE"),
-		readline.PcItem("DEL"),
-		readline.PcItem("HAS"),
-		readline.PcItem("EXISTS"),
-		readline.PcItem("KEYS"),
-		readline.PcItem("LEN"),
-		readline.PcItem("COUNT"),
-		readline.PcItem("COMMIT"),
-		readline.PcItem("CLEAR"),
-		readline.PcItem("CLS"),
-		readline.PcItem("HELP"),
-		readline.PcItem("EXIT"),
-		readline.PcItem("QUIT"),
-	)
-
-	rl, err := readline.NewEx(&readline.Config{
-		Prompt:          colorPurple + "walrus> " + colorReset,
-		HistoryFile:     ".walrus_history",
-		AutoComplete:    completer,
-		InterruptPrompt: "^C",
-		EOFPrompt:       "exit",
-	})
-	if err != nil {
-		log.Fatal(err)
+	serveMetrics(s, *metricsAddr)
+	closeAdmin := serveAdmin(s, *adminSocket)
+	defer closeAdmin()
+
+	if *replicateAddr != "" {
+		p := replication.NewPrimary(w)
+		p.SetBootstrap(s)
+		defer p.Close()
+
+		go func() {
+			if err := p.ListenAndServe(*replicateAddr); err != nil && err != replication.ErrPrimaryClosed {
+				log.Fatal(err)
+			}
+		}()
 	}
-	defer rl.Close()
-
-	// REPL loop
-	for {
-		line, err := rl.Readline()
-		if err == readline.ErrInterrupt {
-			if len(line) == 0 {
-				printInfo("Goodbye!")
-				break
-			} else {
-				continue
+
+	if *followAddr != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		f := replication.NewFollower(s, *followAddr)
+		go func() {
+			if err := f.Run(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("replication stopped: %v", err)
 			}
-		} else if err == io.EOF {
-			break
-		}
+		}()
+	}
 
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+	if *serveAddr != "" {
+		serve(s, *serveAddr)
+		return
+	}
 
-		parts := strings.Fields(line)
-		handleCommand(s, parts)
+	// `cat ops.txt | walrus`
+	if !readline.IsTerminal(int(os.Stdin.Fd())) {
+		onSignal(exitOnSignal(s, closeAdmin))
+		r := runPipe(s, w, os.Stdin, quietOutput)
+		closeAdmin()
+		s.Close()
+		os.Exit(int(r))
 	}
 
-	// final commit before exit
-	s.Commit()
+	runREPL(s, w)
 }
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// TestMain runs main instead of the tests when runWalrus starts the test
+// binary as walrus.
+func TestMain(m *testing.M) {
+	if os.Getenv("WALRUS_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runWalrus runs walrus with args on the data in dir, with stdin as its
+// input, and returns what it printed and its exit code.
+func runWalrus(t *testing.T, dir, stdin string, args ...string) (string, int) {
+	t.Helper()
+
+	args = append([]string{"--config", filepath.Join(dir, "walrus.toml"), "--data-dir", filepath.Join(dir, "data")}, args...)
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "WALRUS_TEST_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	return string(out), cmd.ProcessState.ExitCode()
+}
+
+func newTestStore(t *testing.T) (*store.Store, *wal.WAL) {
+	t.Helper()
+
+	w, err := wal.Open(t.TempDir(), 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.New(w)
+	t.Cleanup(func() { s.Close() })
+	return s, w
+}
+
+// Test that splitArgs splits on whitespace, keeps quoted whitespace,
+// understands Go escapes in double quotes only, and rejects quotes that
+// don't close
+func TestSplitArgs(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want []string
+		err  string
+	}{
+		{"SET a b", []string{"SET", "a", "b"}, ""},
+		{"  SET \t a   b  ", []string{"SET", "a", "b"}, ""},
+		{"", nil, ""},
+		{`SET k "hello world"`, []string{"SET", "k", "hello world"}, ""},
+		{`SET k 'hello world'`, []string{"SET", "k", "hello world"}, ""},
+		{`SET k "a\nb\t\x00"`, []string{"SET", "k", "a\nb\t\x00"}, ""},
+		{`SET k 'a\nb'`, []string{"SET", "k", `a\nb`}, ""},
+		{`SET k "say \"hi\""`, []string{"SET", "k", `say "hi"`}, ""},
+		{`SET k "it's"`, []string{"SET", "k", "it's"}, ""},
+		{`SET k '"quoted"'`, []string{"SET", "k", `"quoted"`}, ""},
+		{`SET k x"a b"'c d'y`, []string{"SET", "k", "xa bc dy"}, ""},
+		{`SET k ""`, []string{"SET", "k", ""}, ""},
+		{`SET k "a;b"`, []string{"SET", "k", "a;b"}, ""},
+		{`SET k $id`, []string{"SET", "k", "$id"}, ""},
+		{`SET k "abc`, nil, "unterminated quote"},
+		{`SET k "abc\"`, nil, "unterminated quote"},
+		{`SET k 'abc`, nil, "unterminated quote"},
+		{`SET k "\q"`, nil, "bad quoted string"},
+	} {
+		got, err := splitArgs(tc.line, nil)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("splitArgs(%q): expected an error containing %q, got %q, %v", tc.line, tc.err, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("splitArgs(%q): expected %q, got %q, %v", tc.line, tc.want, got, err)
+		}
+	}
+}
+
+// Test that splitCommands splits only at the semicolons outside quotes,
+// leaving the quotes for splitArgs
+func TestSplitCommands(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want []string
+	}{
+		{"GET a", []string{"GET a"}},
+		{"SET a 1; GET a", []string{"SET a 1", " GET a"}},
+		{"SET a 1;;GET a;", []string{"SET a 1", "", "GET a", ""}},
+		{`SET a "x;y"; GET a`, []string{`SET a "x;y"`, " GET a"}},
+		{`SET a 'x;y'; GET a`, []string{`SET a 'x;y'`, " GET a"}},
+		{`SET a "x\";y"; GET a`, []string{`SET a "x\";y"`, " GET a"}},
+		{`SET a 'x\'; GET a`, []string{`SET a 'x\'`, " GET a"}},
+		{`SET a "it's;"; GET a`, []string{`SET a "it's;"`, " GET a"}},
+		{`SET a "x; GET a`, []string{`SET a "x; GET a`}},
+		{"", []string{""}},
+	} {
+		if got := splitCommands(tc.line); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("splitCommands(%q): expected %q, got %q", tc.line, tc.want, got)
+		}
+	}
+}
+
+// Test that $name, ${name} and $(command) expand outside single quotes,
+// that their values are never split, and that substitutions nest
+func TestExpand(t *testing.T) {
+	s, _ := newTestStore(t)
+	s.Set("k", "v")
+	s.Set("ptr", "k")
+	s.Set("spaced", "a b")
+	sess := newSession(s)
+	sess.vars["id"] = "42"
+	sess.vars["name"] = "a b"
+
+	for _, tc := range []struct {
+		line string
+		want []string
+		err  string
+	}{
+		{"SET user:$id:seen true", []string{"SET", "user:42:seen", "true"}, ""},
+		{"SET ${id}x 1", []string{"SET", "42x", "1"}, ""},
+		{"SET k $name", []string{"SET", "k", "a b"}, ""},
+		{`SET k "$id!" '$id'`, []string{"SET", "k", "42!", "$id"}, ""},
+		{`SET k "${name}"`, []string{"SET", "k", "a b"}, ""},
+		{"SET k $ a$", []string{"SET", "k", "$", "a$"}, ""},
+		{"SET k $(GET k)", []string{"SET", "k", "v"}, ""},
+		{"SET k $(GET spaced)", []string{"SET", "k", "a b"}, ""},
+		{`SET k "<$(GET k)>"`, []string{"SET", "k", "<v>"}, ""},
+		{"SET k $(GET $(GET ptr))", []string{"SET", "k", "v"}, ""},
+		{"SET k $(HAS ${name})", []string{"SET", "k", "false"}, ""},
+		{"SET k $(LEN)", []string{"SET", "k", "3"}, ""},
+		{`SET k '$(GET k)'`, []string{"SET", "k", "$(GET k)"}, ""},
+		{"SET k $missing", nil, "undefined variable $missing"},
+		{"SET k ${id", nil, "unterminated ${"},
+		{"SET k $(GET k", nil, "unterminated $("},
+		{"SET k $(GET $(GET ptr)", nil, "unterminated $("},
+		{"SET k $()", nil, "empty $()"},
+		{"SET k $(GET nope)", nil, "key 'nope' not found"},
+		{"SET k $(GET $(GET nope))", nil, "key 'nope' not found"},
+		{"SET k $(SET a b)", nil, "runs only GET"},
+		{`SET k "$missing"`, nil, "undefined variable $missing"},
+	} {
+		got, err := splitArgs(tc.line, sess)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("splitArgs(%q): expected an error containing %q, got %q, %v", tc.line, tc.err, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("splitArgs(%q): expected %q, got %q, %v", tc.line, tc.want, got, err)
+		}
+	}
+}
+
+// Test that LET sets a variable to text or to the result of a query, and
+// that a bad name or a query that fails sets nothing
+func TestLet(t *testing.T) {
+	s, _ := newTestStore(t)
+	s.Set("user:last", "7")
+	s.SetWithTTL("session", "x", time.Hour)
+	sess := newSession(s)
+
+	if r := handleCommand(sess, nil, []string{"LET"}); r != cmdNotFound {
+		t.Fatalf("expected LET with no variables to find none, got %d", r)
+	}
+
+	for _, tc := range []struct {
+		line string
+		name string
+		want string
+		r    result
+	}{
+		{"LET greeting = hello  world", "greeting", "hello world", cmdOK},
+		{`LET quoted = "a  b"`, "quoted", "a  b", cmdOK},
+		{"LET id = GET user:last", "id", "7", cmdOK},
+		{"LET seen = user:$id:seen", "seen", "user:7:seen", cmdOK},
+		{"LET copy = $(GET user:last)", "copy", "7", cmdOK},
+		{"LET n = LEN", "n", "2", cmdOK},
+		{"LET has = HAS user:last", "has", "true", cmdOK},
+		{"LET ttl = TTL session", "ttl", "3600", cmdOK},
+		{"LET missing = GET nope", "missing", "", cmdFailed},
+		{"LET ttl2 = TTL user:last", "ttl2", "", cmdFailed},
+		{"LET bad = GET", "bad", "", cmdFailed},
+		{"LET 1x = a", "1x", "", cmdFailed},
+		{"LET a-b = a", "a-b", "", cmdFailed},
+		{"LET x 1", "x", "", cmdFailed},
+		{"LET x =", "x", "", cmdFailed},
+	} {
+		parts, err := splitArgs(tc.line, sess)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := handleCommand(sess, nil, parts); r != tc.r {
+			t.Fatalf("%s: expected result %d, got %d", tc.line, tc.r, r)
+		}
+		if v, ok := sess.vars[tc.name]; v != tc.want || ok != (tc.r == cmdOK) {
+			t.Fatalf("%s: expected $%s = %q, got %q (set %v)", tc.line, tc.name, tc.want, v, ok)
+		}
+	}
+
+	if r := handleCommand(sess, nil, []string{"LET"}); r != cmdOK {
+		t.Fatalf("expected LET to list the variables, got %d", r)
+	}
+}
+
+// Test that expandTemplate fills in each placeholder, keeps other braces,
+// and rejects bad placeholders whether or not it is given an rng
+func TestExpandTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		tmpl string
+		want string // with a nil rng, which leaves random output empty or zero
+		err  string
+	}{
+		{"plain", "plain", ""},
+		{"user:{i}", "user:7", ""},
+		{"user:{i:4}", "user:0007", ""},
+		{"user:{i:1}", "user:7", ""},
+		{"{rand:100}", "", ""},
+		{"{hex:4}", "\x00\x00\x00\x00", ""},
+		{"{pick:a|b}", "", ""},
+		{`{"id":{i},"tags":{}}`, `{"id":7,"tags":{}}`, ""},
+		{"{ i}{id}{x:1}}{i", "{ i}{id}{x:1}}{i", ""},
+		{"user:{i:4", "", "unterminated {i:4"},
+		{"a{rand:5", "", "unterminated {rand:5"},
+		{"{i:}", "", "needs a positive number"},
+		{"{i:0}", "", "needs a positive number"},
+		{"{rand}", "", "needs a positive number"},
+		{"{rand:-3}", "", "needs a positive number"},
+		{"{rand:x}", "", "needs a positive number"},
+		{"{hex:65}", "", "longer than 64 digits"},
+		{"{pick}", "", "needs alternatives"},
+		{"{pick:}", "", "needs alternatives"},
+	} {
+		got, err := expandTemplate(tc.tmpl, 7, nil)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expandTemplate(%q): expected an error containing %q, got %q, %v", tc.tmpl, tc.err, got, err)
+			}
+			if _, err := expandTemplate(tc.tmpl, 7, rand.New(rand.NewPCG(1, 2))); err == nil {
+				t.Fatalf("expandTemplate(%q) with an rng: expected an error", tc.tmpl)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Fatalf("expandTemplate(%q): expected %q, got %q, %v", tc.tmpl, tc.want, got, err)
+		}
+	}
+
+	// with an rng, the random placeholders are drawn from it in order
+	const tmpl = `user:{i:3}:{hex:6} {"plan":"{pick:free|pro|team}","score":{rand:100}}`
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i, want := range []string{
+		`user:001:0c8a0c {"plan":"pro","score":44}`,
+		`user:002:90fabd {"plan":"pro","score":78}`,
+		`user:003:729e97 {"plan":"free","score":2}`,
+	} {
+		if got, err := expandTemplate(tmpl, i+1, rng); err != nil || got != want {
+			t.Fatalf("key %d: expected %q, got %q, %v", i+1, want, got, err)
+		}
+	}
+}
+
+// Test that GEN writes n keys from its templates, and writes nothing when
+// a template is bad
+func TestGen(t *testing.T) {
+	s, _ := newTestStore(t)
+
+	for _, tc := range []struct {
+		parts []string
+		r     result
+	}{
+		{[]string{"GEN", "3", "user:{i:2}"}, cmdFailed},
+		{[]string{"GEN", "0", "user:{i}", "v"}, cmdFailed},
+		{[]string{"GEN", "many", "user:{i}", "v"}, cmdFailed},
+		{[]string{"GEN", "3", "user:{i:4", "v"}, cmdFailed},
+		{[]string{"GEN", "3", "user:{i}", "{rand:0}"}, cmdFailed},
+	} {
+		if r := handleCommand(newSession(s), nil, tc.parts); r != tc.r {
+			t.Fatalf("%q: expected result %d, got %d", tc.parts, tc.r, r)
+		}
+	}
+	if n := s.Len(); n != 0 {
+		t.Fatalf("expected bad GENs to write nothing, got %d key(s)", n)
+	}
+
+	if r := handleCommand(newSession(s), nil, []string{"GEN", "1500", "user:{i:4}", "plan", "{pick:free|pro}"}); r != cmdOK {
+		t.Fatalf("expected GEN to succeed, got %d", r)
+	}
+	if n := s.Len(); n != 1500 {
+		t.Fatalf("expected 1500 keys, got %d", n)
+	}
+	for _, key := range []string{"user:0001", "user:1500"} {
+		if v, ok := s.Get(key); !ok || v != "plan free" && v != "plan pro" {
+			t.Fatalf("expected %s to be a plan, got %q, %v", key, v, ok)
+		}
+	}
+}
+
+// Test that commands given as arguments or with -c run without the REPL,
+// print plain output and exit 0 on success, 1 if a key wasn't found and
+// 2 on an error, a script stopping at its first error
+func TestRunCommands(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, tc := range []struct {
+		args []string
+		out  string
+		code int
+	}{
+		{[]string{"set", "foo", "bar"}, "OK (set 'foo' = 'bar')\n", 0},
+		{[]string{"get", "foo"}, "bar\n", 0},
+		{[]string{"GET", "nope"}, "Key 'nope' not found\n", 1},
+		{[]string{"get"}, "Usage: GET <key> [--pretty|--hex|--base64] [.path]\n", 2},
+		{[]string{"bogus"}, "Unknown command: BOGUS\nType 'help' for available commands\n", 2},
+		{[]string{"exit"}, "", 0},
+		{[]string{"--quiet", "set", "q", "1"}, "", 0},
+		{[]string{"-c", "SET a 1; GET a"}, "OK (set 'a' = '1')\n1\n", 0},
+		{[]string{"-c", `SET a "x;y"; GET a`}, "OK (set 'a' = 'x;y')\nx;y\n", 0},
+		{[]string{"-c", "LET v = GET foo; SET copy $v; GET copy"}, "OK ($v = 'bar')\nOK (set 'copy' = 'bar')\nbar\n", 0},
+		{[]string{"-c", "GET nope"}, "Key 'nope' not found\n", 1},
+		{[]string{"-c", "GET nope; GET foo"}, "Key 'nope' not found\nbar\n", 0},
+		{[]string{"-c", "SET b 1; INCR foo; SET c 1"}, "OK (set 'b' = '1')\nError: value is not an integer: \"foo\"\n", 2},
+		{[]string{"-c", `SET d "x`}, "Error: unterminated quote\n", 2},
+		{[]string{"-c", "GET $undefined"}, "Error: undefined variable $undefined\n", 2},
+		{[]string{"-c", "SET e 1; exit; SET f 1"}, "OK (set 'e' = '1')\n", 0},
+		{[]string{"-c", ";  ;"}, "", 0},
+	} {
+		out, code := runWalrus(t, dir, "", tc.args...)
+		if code != tc.code || out != tc.out {
+			t.Fatalf("walrus %q: expected exit %d and %q, got %d and %q", tc.args, tc.code, tc.out, code, out)
+		}
+	}
+
+	// a failed command ends the script, and the writes before it stay
+	for key, want := range map[string]int{"q": 0, "b": 0, "c": 1, "e": 0, "f": 1} {
+		if _, code := runWalrus(t, dir, "", "get", key); code != want {
+			t.Fatalf("get %s: expected exit %d, got %d", key, want, code)
+		}
+	}
+}
+
+// Test that DELETE deletes the given keys that exist, and that DELETE
+// --match only lists what it matches until run again with --yes
+func TestDelete(t *testing.T) {
+	dir := t.TempDir()
+	if out, code := runWalrus(t, dir, "", "--quiet", "-c", "GEN 22 user:{i:2} v; SET user:*x 1; SET order:1 a; SET a 1; SET b 2"); code != 0 {
+		t.Fatalf("expected the keys to be set, got exit %d and %q", code, out)
+	}
+
+	preview := "Keys matching 'user:*' (23 total):\n  user:*x\n"
+	for i := 1; i <= 19; i++ {
+		preview += fmt.Sprintf("  user:%02d\n", i)
+	}
+	preview += "  ... and 3 more\nRun DELETE --match 'user:*' --yes to delete them\n"
+
+	for _, tc := range []struct {
+		cmd  string
+		out  string
+		code int
+	}{
+		{"DELETE", "Usage: DELETE <key>... or DELETE --match <glob> [--yes]\n", 2},
+		{"DELETE --match", "Usage: DELETE <key>... or DELETE --match <glob> [--yes]\n", 2},
+		{"DELETE --match user:* yes", "Usage: DELETE <key>... or DELETE --match <glob> [--yes]\n", 2},
+		{"DELETE --match user:* --yes now", "Usage: DELETE <key>... or DELETE --match <glob> [--yes]\n", 2},
+		{"DELETE nope", "Key 'nope' does not exist\n", 1},
+		{"DELETE nope never", "None of the 2 keys exist\n", 1},
+		{"DELETE --match nope*", "No keys match 'nope*'\n", 1},
+		{"DELETE a", "OK (deleted 'a')\n", 0},
+		{"DELETE b order:1 nope", "OK (deleted 2 of 3 keys)\n", 0},
+		{"DELETE --match user:*", preview, 0},
+		{"DELETE --match 'user:?1'", "Keys matching 'user:?1' (3 total):\n  user:01\n  user:11\n  user:21\nRun DELETE --match 'user:?1' --yes to delete them\n", 0},
+		{"DELETE --match 'user:?1' --yes", "OK (deleted 3 keys matching 'user:?1')\n", 0},
+		{`DELETE --match 'user:\*x' --yes`, "OK (deleted 1 keys matching 'user:\\*x')\n", 0},
+		{"LEN", "Total keys: 19\n", 0},
+		{"DEL --match user:* --yes", "OK (deleted 19 keys matching 'user:*')\n", 0},
+		{"KEYS", "No keys stored\n", 1},
+	} {
+		if out, code := runWalrus(t, dir, "", "-c", tc.cmd); code != tc.code || out != tc.out {
+			t.Fatalf("%s: expected exit %d and %q, got %d and %q", tc.cmd, tc.code, tc.out, code, out)
+		}
+	}
+}
+
+// Test that in a glob * matches any run of characters, '/' and ':'
+// included, ? any one, and \ makes the next character literal
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		glob, key string
+		want      bool
+	}{
+		{"user:*", "user:1", true},
+		{"user:*", "user:", true},
+		{"user:*", "users:1", false},
+		{"*", "", true},
+		{"*:seen", "user:1:seen", true},
+		{"*:seen", "user:1:seen:x", false},
+		{"a*b*c", "a/x/b/y/c", true},
+		{"a*b*c", "acb", false},
+		{"user:?", "user:1", true},
+		{"user:?", "user:12", false},
+		{"user:??", "user:1", false},
+		{`user:\*`, "user:*", true},
+		{`user:\*`, "user:1", false},
+		{`user:\?`, "user:1", false},
+		{`a\`, `a\`, true},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	} {
+		if got := matchGlob(tc.glob, tc.key); got != tc.want {
+			t.Fatalf("matchGlob(%q, %q): expected %v, got %v", tc.glob, tc.key, tc.want, got)
+		}
+	}
+}
+
+// Test that commands read from stdin run one per line with plain output,
+// carry on past failures and exit with the worst result, and that
+// --quiet leaves out the OK lines for a summary at the end
+func TestPipe(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, tc := range []struct {
+		args  []string
+		stdin string
+		out   string
+		code  int
+	}{
+		{nil, "SET a 1\n\nGET a\n  GET a  \n", "OK (set 'a' = '1')\n1\n1\n", 0},
+		{nil, "GET nope\nGET a", "Key 'nope' not found\n1\n", 1},
+		{nil, "SET b \"x\nBOGUS\nGET nope\nSET b 2\n", "Line 1: unterminated quote\nUnknown command: BOGUS\nType 'help' for available commands\nKey 'nope' not found\nOK (set 'b' = '2')\n", 2},
+		{nil, "SET c 1\nexit\nSET d 1\n", "OK (set 'c' = '1')\n", 0},
+		{nil, "", "", 0},
+		{[]string{"--quiet"}, "SET e 1\nSET f 2\nGET f\nGET nope\nINCR a\n", "2\nKey 'nope' not found\n2\n5 command(s) in 0s: 4 ok, 1 not found, 0 failed\n", 1},
+		{[]string{"--quiet"}, "SET g 1\nDELETE\n", "Usage: DELETE <key>... or DELETE --match <glob> [--yes]\n2 command(s) in 0s: 1 ok, 0 not found, 1 failed\n", 2},
+	} {
+		out, code := runWalrus(t, dir, tc.stdin, append([]string{"--admin=false"}, tc.args...)...)
+		out = regexp.MustCompile(` in [0-9.]+[mµn]?s:`).ReplaceAllString(out, " in 0s:")
+		if code != tc.code || out != tc.out {
+			t.Fatalf("%q with %q: expected exit %d and %q, got %d and %q", tc.args, tc.stdin, tc.code, tc.out, code, out)
+		}
+	}
+
+	for key, want := range map[string]int{"b": 0, "c": 0, "d": 1, "e": 0} {
+		if _, code := runWalrus(t, dir, "", "get", key); code != want {
+			t.Fatalf("get %s: expected exit %d, got %d", key, want, code)
+		}
+	}
+}
+
+// Test that GET shows values in the session's display mode or the one it
+// is given, pretty-prints JSON on request and extracts JSON paths
+func TestGetDisplay(t *testing.T) {
+	dir := t.TempDir()
+	if out, code := runWalrus(t, dir, "", "--quiet", "-c", `SET bin "a\x00b"; SET text hi; JSET doc '{"user":{"name":"ann","tags":["a","b"],"age":30}}'`); code != 0 {
+		t.Fatalf("expected the keys to be set, got exit %d and %q", code, out)
+	}
+
+	const binHex = "00000000  61 00 62                                          |a.b|\n"
+	for _, tc := range []struct {
+		cmd  string
+		out  string
+		code int
+	}{
+		{"GET bin", `"a\x00b"` + "\n", 0},
+		{"GET text", "hi\n", 0},
+		{"GET bin --hex", binHex, 0},
+		{"GET bin --base64", "YQBi\n", 0},
+		{"GET bin --bogus", "Usage: GET <key> [--pretty|--hex|--base64] [.path]\n", 2},
+		{"DISPLAY", "Values are shown as auto\n", 0},
+		{"DISPLAY hex; GET bin; SCAN bi", "Values are shown as hex\n" + binHex + "Matches (1 total):\n  1. bin =\n" + binHex, 0},
+		{"DISPLAY base64; GET text; SCAN te; GET text --hex", "Values are shown as base64\naGk=\nMatches (1 total):\n  1. text = aGk=\n00000000  68 69                                             |hi|\n", 0},
+		{"DISPLAY bogus", "Error: unknown display mode \"bogus\" (auto, hex or base64)\n", 2},
+		{"GET doc", `{"user":{"name":"ann","tags":["a","b"],"age":30}}` + "\n", 0},
+		{"GET doc .user.name", "ann\n", 0},
+		{"GET doc .user.tags[1]", "b\n", 0},
+		{"GET doc .user.tags", `["a","b"]` + "\n", 0},
+		{"GET doc .user.age", "30\n", 0},
+		{"GET doc .user", `{"age":30,"name":"ann","tags":["a","b"]}` + "\n", 0},
+		{"GET doc .user.tags --pretty", "[\n  \"a\",\n  \"b\"\n]\n", 0},
+		{"PRETTY on; GET doc .user.tags; PRETTY off; GET doc .user.tags", "JSON values are pretty-printed\n[\n  \"a\",\n  \"b\"\n]\nJSON values are shown as stored\n" + `["a","b"]` + "\n", 0},
+		{"GET doc .user.name --pretty", "ann\n", 0},
+		{"GET doc .user.age --base64", "MzA=\n", 0},
+		{"GET doc .nope", "Error: no field \"nope\" in .nope\n", 2},
+		{"GET doc .user.tags[5]", "Error: no index 5 in .user.tags[5]\n", 2},
+		{"GET doc .user.name.x", "Error: .user.name.x goes past a string\n", 2},
+		{"GET doc .user[", "Error: unterminated [ in \".user[\"\n", 2},
+		{"GET doc .user.tags[0", "Error: unterminated [ in \".user.tags[0\"\n", 2},
+		{"GET doc .user.tags[0][", "Error: unterminated [ in \".user.tags[0][\"\n", 2},
+		{"GET doc .user.tags[0]x", "Error: unexpected \"x\" after ] in \".user.tags[0]x\"\n", 2},
+		{"GET doc .user .age", "Usage: GET <key> [--pretty|--hex|--base64] [.path]\n", 2},
+		{"GET text .x", "Error: value is not JSON: invalid character 'h' looking for beginning of value\n", 2},
+		{"GET nope .x", "Key 'nope' not found\n", 1},
+	} {
+		if out, code := runWalrus(t, dir, "", "-c", tc.cmd); code != tc.code || out != tc.out {
+			t.Fatalf("%s: expected exit %d and %q, got %d and %q", tc.cmd, tc.code, tc.out, code, out)
+		}
+	}
+}
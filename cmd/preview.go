@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// runPreview implements `walrus preview [dir]`: it reports what recovery
+// would find in a data directory without changing it.
+func runPreview(args []string) {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	fs.Parse(args)
+
+	dir := dataDir
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
+	}
+
+	// an empty directory is more likely a wrong path than an empty store
+	if files, _ := filepath.Glob(filepath.Join(dir, "wal-*.log")); len(files) == 0 {
+		log.Fatalf("no WAL segments in %s", dir)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	w, err := wal.OpenReadOnly(wal.Options{Dir: dir, EncryptionKeys: encryptionKeys(), Recovery: cfg.RecoveryMode, MaxRecordSize: cfg.MaxRecordSize})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer w.Close()
+
+	r, err := store.New(w).RecoverDryRun()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%s%s%s\n", colorBold, dir, colorReset)
+	fmt.Printf("  %d key(s) from %d record(s) in %d segment(s), %d bytes\n", r.Keys, r.Records, r.Segments, r.Bytes)
+	fmt.Printf("  replayed in %v, peak memory ~%d bytes\n", r.Duration.Round(time.Microsecond), r.PeakMemory)
+
+	if r.Resyncs > 0 {
+		printWarning(fmt.Sprintf("  %d corrupt byte(s) would be skipped, replay picking up again after %d corrupt stretch(es)", r.CorruptBytes, r.Resyncs))
+	} else if r.CorruptBytes > 0 {
+		printWarning(fmt.Sprintf("  %d corrupt byte(s) at segment tails would be skipped; walrus repair or recovery_mode = \"salvage\" may save records among them", r.CorruptBytes))
+	}
+	if r.Unappliable > 0 {
+		printWarning(fmt.Sprintf("  %d record(s) could not be applied; recovery needs dead_letter set", r.Unappliable))
+	}
+
+	if len(r.TopPrefixes) > 0 {
+		fmt.Printf("%sTop prefixes:%s\n", colorBold, colorReset)
+		for _, p := range r.TopPrefixes {
+			prefix := p.Prefix
+			if prefix == "" {
+				prefix = "(none)"
+			}
+			fmt.Printf("  %s%8d%s  %s\n", colorGray, p.Keys, colorReset, prefix)
+		}
+	}
+}
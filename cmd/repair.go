@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// runRepair implements `walrus repair [dir] [--out dir]`: it copies what
+// is still intact in a damaged data directory into a new one, leaving
+// the original as it was.
+func runRepair(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	out := fs.String("out", "", "write the repaired log to `dir` (default <dir>.repaired)")
+	fs.Parse(args)
+
+	dir := dataDir
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
+	}
+	if *out == "" {
+		*out = filepath.Clean(dir) + ".repaired"
+	}
+
+	report, err := wal.Repair(dir, *out)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	records, damaged := 0, 0
+	for _, seg := range report {
+		records += seg.Records
+		if seg.Regions == 0 {
+			continue
+		}
+		damaged++
+		printWarning(fmt.Sprintf("  %s: skipped %d corrupt region(s), %d bytes; kept %d record(s)", seg.Name, seg.Regions, seg.Skipped, seg.Records))
+	}
+
+	printSuccess(fmt.Sprintf("OK (%d record(s) from %d segment(s) into %s, %d damaged)", records, len(report), *out, damaged))
+	if damaged > 0 {
+		printInfo(fmt.Sprintf("Check it with walrus preview %s, then move it in place of %s", *out, dir))
+	}
+}
@@ -0,0 +1,717 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// ANSI color codes, cleared by plainOutput
+var (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorBlue   = "\033[34m"
+	colorPurple = "\033[35m"
+	colorCyan   = "\033[36m"
+	colorGray   = "\033[37m"
+	colorBold   = "\033[1m"
+)
+
+// plainOutput turns colors off, for output going to a file or pipe.
+func plainOutput() {
+	colorReset, colorRed, colorGreen, colorYellow = "", "", "", ""
+	colorBlue, colorPurple, colorCyan, colorGray, colorBold = "", "", "", "", ""
+}
+
+// result is how a command went, and the exit code when it runs from the
+// command line.
+type result int
+
+const (
+	cmdOK       result = 0
+	cmdNotFound result = 1 // key missing, nothing matched
+	cmdFailed   result = 2 // bad usage or an error
+)
+
+// quietOutput leaves out the OK lines, for --quiet.
+var quietOutput bool
+
+func printSuccess(msg string) {
+	if quietOutput {
+		return
+	}
+	fmt.Printf("%s%s%s\n", colorGreen, msg, colorReset)
+}
+
+func printError(msg string) {
+	fmt.Printf("%s%s%s\n", colorRed, msg, colorReset)
+}
+
+func printInfo(msg string) {
+	fmt.Printf("%s%s%s\n", colorCyan, msg, colorReset)
+}
+
+func printWarning(msg string) {
+	fmt.Printf("%s%s%s\n", colorYellow, msg, colorReset)
+}
+
+func printBanner() {
+	banner := `	
+ ___       __   ________  ___       ________  ___  ___  ________      
+|\  \     |\  \|\   __  \|\  \     |\   __  \|\  \|\  \|\   ____\     
+\ \  \    \ \  \ \  \|\  \ \  \    \ \  \|\  \ \  \\\  \ \  \___|_    
+ \ \  \  __\ \  \ \   __  \ \  \    \ \   _  _\ \  \\\  \ \_____  \   
+  \ \  \|\__\_\  \ \  \ \  \ \  \____\ \  \\  \\ \  \\\  \|____|\  \  
+   \ \____________\ \__\ \__\ \_______\ \__\\ _\\ \_______\____\_\  \ 
+    \|____________|\|__|\|__|\|_______|\|__|\|__|\|_______|\_________\
+                                                          \|_________|
+
+
+`
+	fmt.Print(colorCyan + banner + colorReset)
+	fmt.Println(colorGray + "A simple persistent key-value store with WAL" + colorReset)
+	fmt.Println(colorGray + "Type 'help' for available commands" + colorReset)
+	fmt.Println()
+}
+
+// printRecovery shows what startup replay did, so a damaged log is
+// noticed at startup instead of as missing keys later.
+func printRecovery(r store.RecoveryStats) {
+	if r.Records == 0 && r.CorruptBytes == 0 && r.TailDropped == 0 {
+		return
+	}
+
+	printInfo(fmt.Sprintf("Recovered %d key(s) from disk", r.Keys))
+	if r.Crashed {
+		printWarning("  The last run did not shut down cleanly")
+	}
+	fmt.Printf("%s  %d segment(s), %d record(s), %d bytes replayed in %v, peak memory ~%d bytes%s\n",
+		colorGray, r.Segments, r.Records, r.Bytes, r.Duration.Round(time.Microsecond), r.PeakMemory, colorReset)
+
+	if r.Resyncs > 0 {
+		printWarning(fmt.Sprintf("  %d corrupt byte(s) were skipped, replay picking up again after %d corrupt stretch(es)", r.CorruptBytes, r.Resyncs))
+	} else if r.CorruptBytes > 0 {
+		printWarning(fmt.Sprintf("  %d corrupt byte(s) at segment tails were skipped", r.CorruptBytes))
+	}
+	if r.TailDropped > 0 {
+		printWarning(fmt.Sprintf("  %d byte(s) of a torn write were cut off the end of the log", r.TailDropped))
+	}
+	if r.DeadLetters > 0 {
+		printWarning(fmt.Sprintf("  %d record(s) could not be applied and were written to the dead-letter file", r.DeadLetters))
+	}
+	fmt.Println()
+}
+
+func printHelp() {
+	help := `
+` + colorBold + "Available Commands:" + colorReset + `
+
+  ` + colorGreen + `SET` + colorReset + ` <key> <value>     Store a key-value pair
+  ` + colorGreen + `SETEX` + colorReset + ` <key> <sec> <val> Store a key that expires after <sec> seconds
+  ` + colorGreen + `GET` + colorReset + ` <key>             Retrieve value for a key; add --pretty or a .path for JSON,
+                        or --hex or --base64 for binary values
+  ` + colorGreen + `JSET` + colorReset + ` <key> [.path] <json>
+                        Store a JSON document, or set the part of one at .path
+  ` + colorGreen + `JGET` + colorReset + ` <key> [.path]    Show a JSON document, or the part of it at .path
+  ` + colorGreen + `GETMETA` + colorReset + ` <key>         Show a value with when it was last written and its version
+  ` + colorGreen + `HISTORY` + colorReset + ` <key> [n]     List the last n (default 10, 0 for all) writes to a key in the log
+  ` + colorGreen + `TTL` + colorReset + ` <key>             Show time left before a key expires
+  ` + colorGreen + `INCR` + colorReset + ` <key>            Add 1 to an integer value (DECR subtracts 1)
+  ` + colorGreen + `INCRBY` + colorReset + ` <key> <n>      Add n, which may be negative, to an integer value
+  ` + colorGreen + `DELETE` + colorReset + ` <key>...       Remove keys, in one batch
+  ` + colorGreen + `DELETE` + colorReset + ` --match <g>    List the keys matching glob g (* and ?); add --yes to remove them
+  ` + colorGreen + `HAS` + colorReset + ` <key>             Check if key exists
+  ` + colorGreen + `KEYS` + colorReset + `                  List all keys
+  ` + colorGreen + `TOMBSTONES` + colorReset + `            List recently deleted keys and when they were deleted
+  ` + colorGreen + `SCAN` + colorReset + ` <prefix>          List keys and values starting with <prefix>
+  ` + colorGreen + `TREE` + colorReset + ` [sep] [depth]     Group keys on sep (default ':'), depth levels deep
+  ` + colorGreen + `USE` + colorReset + ` [bucket]          Run the key commands in a bucket; USE alone leaves it
+  ` + colorGreen + `BUCKETS` + colorReset + `               List buckets and their key counts
+  ` + colorGreen + `LET` + colorReset + ` <name> = <x>      Set $name to text or to a GET/HAS/TTL/LEN/KEYS result
+  ` + colorGreen + `GEN` + colorReset + ` <n> <key> <val>   Write n keys from templates with {i}, {i:N}, {rand:N}, {hex:N}, {pick:a|b}
+  ` + colorGreen + `LEN` + colorReset + `                   Show number of keys
+  ` + colorGreen + `COUNT <prefix>` + colorReset + `        Estimate the keys starting with prefix
+  ` + colorGreen + `PRETTY` + colorReset + ` [on|off]       Pretty-print JSON values in every GET
+  ` + colorGreen + `DISPLAY` + colorReset + ` [mode]        Show values as auto (text or quoted), hex or base64
+  ` + colorGreen + `STATS` + colorReset + `                 Show key count, disk usage, WAL state and uptime
+  ` + colorGreen + `CHECK` + colorReset + `                 Verify memory against a fresh replay of the log
+  ` + colorGreen + `COMMIT` + colorReset + `                Flush all pending writes
+  ` + colorGreen + `RELOAD` + colorReset + `                Re-read walrus.toml (same as SIGHUP)
+  ` + colorGreen + `CLEAR` + colorReset + `                 Clear the screen
+  ` + colorGreen + `HELP` + colorReset + `                  Show this help message
+  ` + colorGreen + `EXIT` + colorReset + `                  Exit the CLI
+
+` + colorBold + "Examples:" + colorReset + `
+  walrus> SET name jerk
+  walrus> SET blob "\x00\x01 two  spaces"
+  walrus> GET name
+  walrus> GET profile .user.name
+  walrus> DELETE name
+  walrus> KEYS
+  walrus> LET id = GET user:last
+  walrus> SET user:$id:seen $(LEN)
+  walrus> GEN 1000 user:{i:4} '{"plan":"{pick:free|pro}","score":{rand:100}}'
+`
+	fmt.Println(help)
+}
+
+func handleCommand(sess *session, w *wal.WAL, parts []string) result {
+	if len(parts) == 0 {
+		return cmdOK
+	}
+
+	s, ks := sess.store, sess.keyspace()
+	cmd := strings.ToUpper(parts[0])
+
+	switch cmd {
+	case "SET":
+		if len(parts) < 3 {
+			printError("Usage: SET <key> <value>")
+			return cmdFailed
+		}
+		key := parts[1]
+		value := strings.Join(parts[2:], " ")
+
+		if err := ks.Set(key, value); err != nil {
+			printError(fmt.Sprintf("Error: %v", err))
+			return cmdFailed
+		}
+		printSuccess(fmt.Sprintf("OK (set '%s' = '%s')", key, displayValue(value)))
+
+	case "SETEX":
+		if len(parts) < 4 {
+			printError("Usage: SETEX <key> <seconds> <value>")
+			return cmdFailed
+		}
+		key := parts[1]
+		secs, err := strconv.Atoi(parts[2])
+		if err != nil || secs <= 0 {
+			printError("Usage: SETEX <key> <seconds> <value> (seconds must be a positive integer)")
+			return cmdFailed
+		}
+		value := strings.Join(parts[3:], " ")
+
+		if err := ks.SetWithTTL(key, value, time.Duration(secs)*time.Second); err != nil {
+			printError(fmt.Sprintf("Error: %v", err))
+			return cmdFailed
+		}
+		printSuccess(fmt.Sprintf("OK (set '%s' = '%s', expires in %ds)", key, displayValue(value), secs))
+
+	case "INCR", "DECR", "INCRBY":
+		usage := fmt.Sprintf("Usage: %s <key>", cmd)
+		if cmd == "INCRBY" {
+			usage = "Usage: INCRBY <key> <delta>"
+		}
+		if len(parts) != 2 && !(cmd == "INCRBY" && len(parts) == 3) {
+			printError(usage)
+			return cmdFailed
+		}
+		key := parts[1]
+
+		delta := int64(1)
+		if cmd == "INCRBY" {
+			d, err := strconv.ParseInt(parts[2], 10, 64)
+			if err != nil {
+				printError(usage + " (delta must be an integer)")
+				return cmdFailed
+			}
+			delta = d
+		}
+		if cmd == "DECR" {
+			delta = -1
+		}
+
+		n, err := ks.Incr(key, delta)
+		if err != nil {
+			printError(fmt.Sprintf("Error: %v", err))
+			return cmdFailed
+		}
+		printInfo(strconv.FormatInt(n, 10))
+
+	case "TTL":
+		if len(parts) < 2 {
+			printError("Usage: TTL <key>")
+			return cmdFailed
+		}
+		key := parts[1]
+
+		if !ks.Has(key) {
+			printWarning(fmt.Sprintf("Key '%s' not found", key))
+			return cmdNotFound
+		}
+		ttl, ok := ks.TTL(key)
+		if !ok {
+			printInfo(fmt.Sprintf("Key '%s' does not expire", key))
+			return cmdOK
+		}
+		printInfo(fmt.Sprintf("%v", ttl.Round(time.Second)))
+
+	case "GET":
+		if len(parts) < 2 {
+			printError("Usage: GET <key> [--pretty|--hex|--base64] [.path]")
+			return cmdFailed
+		}
+		key := parts[1]
+
+		pretty, path, mode := sess.pretty, "", sess.display
+		for _, arg := range parts[2:] {
+			switch {
+			case arg == "--pretty":
+				pretty = true
+			case arg == "--hex":
+				mode = displayHex
+			case arg == "--base64":
+				mode = displayBase64
+			case strings.HasPrefix(arg, ".") && path == "":
+				path = arg
+			default:
+				printError("Usage: GET <key> [--pretty|--hex|--base64] [.path]")
+				return cmdFailed
+			}
+		}
+
+		value, ok := ks.Get(key)
+		if !ok {
+			printWarning(fmt.Sprintf("Key '%s' not found", key))
+			return cmdNotFound
+		}
+
+		if path != "" {
+			v, err := jsonPath(value, path)
+			if err != nil {
+				printError(fmt.Sprintf("Error: %v", err))
+				return cmdFailed
+			}
+			value = v
+		}
+		if pretty && mode == displayAuto {
+			if out, ok := prettyJSON(value); ok {
+				fmt.Println(out)
+				return cmdOK
+			}
+		}
+		printInfo(mode.format(value))
+
+	case "JSET":
+		path := ""
+		if len(parts) >= 4 && strings.HasPrefix(parts[2], ".") {
+			path = parts[2]
+		}
+		if len(parts) < 3 || path != "" && len(parts) < 4 {
+			printError("Usage: JSET <key> [.path] <json>")
+			return cmdFailed
+		}
+		key := parts[1]
+		value := strings.Join(parts[2:], " ")
+		if path != "" {
+			value = strings.Join(parts[3:], " ")
+		}
+		if !json.Valid([]byte(value)) {
+			printError("Error: not JSON (quote strings as '\"text\"')")
+			return cmdFailed
+		}
+
+		var err error
+		if path == "" {
+			err = ks.SetJSON(key, json.RawMessage(value))
+		} else {
+			err = ks.JSONSet(key, path, json.RawMessage(value))
+		}
+		if err != nil {
+			printError(fmt.Sprintf("Error: %v", err))
+			return cmdFailed
+		}
+		if path != "" {
+			printSuccess(fmt.Sprintf("OK (set %s in '%s')", path, key))
+		} else {
+			printSuccess(fmt.Sprintf("OK (set '%s')", key))
+		}
+
+	case "JGET":
+		if len(parts) < 2 || len(parts) > 3 {
+			printError("Usage: JGET <key> [.path]")
+			return cmdFailed
+		}
+		key, path := parts[1], ""
+		if len(parts) == 3 {
+			path = parts[2]
+		}
+
+		v, ok, err := ks.JSONGet(key, path)
+		if err != nil {
+			printError(fmt.Sprintf("Error: %v", err))
+			return cmdFailed
+		}
+		if !ok {
+			printWarning(fmt.Sprintf("'%s%s' not found", key, path))
+			return cmdNotFound
+		}
+		if out, ok := prettyJSON(string(v)); ok {
+			fmt.Println(out)
+			return cmdOK
+		}
+		printInfo(string(v))
+
+	case "GETMETA":
+		if len(parts) < 2 {
+			printError("Usage: GETMETA <key>")
+			return cmdFailed
+		}
+		key := parts[1]
+
+		m, ok := ks.GetWithMeta(key)
+		if !ok {
+			printWarning(fmt.Sprintf("Key '%s' not found", key))
+			return cmdNotFound
+		}
+
+		modified, expires := "unknown", "never"
+		if !m.Modified.IsZero() {
+			modified = fmt.Sprintf("%s %s(%v ago)%s", m.Modified.Format(time.DateTime), colorGray, time.Since(m.Modified).Round(time.Second), colorReset)
+		}
+		if !m.Expires.IsZero() {
+			expires = fmt.Sprintf("in %v", time.Until(m.Expires).Round(time.Second))
+		}
+		fmt.Printf("  %-9s %s\n", "value", sess.display.format(m.Value))
+		fmt.Printf("  %-9s %s\n", "modified", modified)
+		fmt.Printf("  %-9s %d\n", "version", m.Version)
+		fmt.Printf("  %-9s %s\n", "expires", expires)
+
+	case "HISTORY":
+		if len(parts) != 2 && len(parts) != 3 {
+			printError("Usage: HISTORY <key> [n]")
+			return cmdFailed
+		}
+		key, limit := parts[1], 10
+		if len(parts) == 3 {
+			n, err := strconv.Atoi(parts[2])
+			if err != nil || n < 0 {
+				printError("Usage: HISTORY <key> [n] (n must be a non-negative integer)")
+				return cmdFailed
+			}
+			limit = n
+		}
+
+		revs, err := ks.History(key, limit)
+		if err != nil {
+			printError(fmt.Sprintf("Error: %v", err))
+			return cmdFailed
+		}
+		if len(revs) == 0 {
+			printWarning(fmt.Sprintf("No writes to '%s' in the log", key))
+			return cmdNotFound
+		}
+
+		fmt.Printf("%sWrites to '%s' (%d, most recent first):%s\n", colorBold, key, len(revs), colorReset)
+		for _, rev := range revs {
+			when := "unknown time"
+			if !rev.Modified.IsZero() {
+				when = rev.Modified.Format(time.DateTime)
+			}
+			value := sess.display.format(rev.Value)
+			if rev.Deleted {
+				value = colorYellow + "(deleted)" + colorReset
+			}
+			fmt.Printf("  %s#%d %s%s  %s\n", colorGray, rev.Version, when, colorReset, value)
+		}
+
+	case "DISPLAY":
+		if len(parts) > 1 {
+			mode, err := parseDisplayMode(parts[1])
+			if err != nil {
+				printError(fmt.Sprintf("Error: %v", err))
+				return cmdFailed
+			}
+			sess.display = mode
+		}
+		printInfo(fmt.Sprintf("Values are shown as %v", sess.display))
+
+	case "PRETTY":
+		if len(parts) > 1 {
+			switch strings.ToLower(parts[1]) {
+			case "on":
+				sess.pretty = true
+			case "off":
+				sess.pretty = false
+			default:
+				printError("Usage: PRETTY [on|off]")
+				return cmdFailed
+			}
+		}
+		if sess.pretty {
+			printInfo("JSON values are pretty-printed")
+		} else {
+			printInfo("JSON values are shown as stored")
+		}
+
+	case "DELETE", "DEL":
+		return sess.del(parts)
+
+	case "HAS", "EXISTS":
+		if len(parts) < 2 {
+			printError("Usage: HAS <key>")
+			return cmdFailed
+		}
+		key := parts[1]
+
+		if ks.Has(key) {
+			printSuccess(fmt.Sprintf("Key '%s' exists", key))
+		} else {
+			printWarning(fmt.Sprintf("Key '%s' does not exist", key))
+			return cmdNotFound
+		}
+
+	case "KEYS":
+		keys := ks.Keys()
+		if len(keys) == 0 {
+			printWarning("No keys stored")
+			return cmdNotFound
+		}
+
+		fmt.Printf("%sKeys (%d total):%s\n", colorBold, len(keys), colorReset)
+		for i, key := range keys {
+			fmt.Printf("  %s%d.%s %s\n", colorGray, i+1, colorReset, key)
+		}
+
+	case "TOMBSTONES":
+		tombs := s.Tombstones()
+		if len(tombs) == 0 {
+			printWarning("No recently deleted keys")
+			return cmdNotFound
+		}
+
+		fmt.Printf("%sDeleted keys (%d, most recent first):%s\n", colorBold, len(tombs), colorReset)
+		for _, tomb := range tombs {
+			fmt.Printf("  %s %s(%v ago)%s\n", tomb.Key, colorGray, time.Since(tomb.DeletedAt).Round(time.Second), colorReset)
+		}
+
+	case "SCAN":
+		if len(parts) < 2 {
+			printError("Usage: SCAN <prefix>")
+			return cmdFailed
+		}
+		prefix := parts[1]
+
+		entries := ks.Scan(prefix)
+		if len(entries) == 0 {
+			printWarning(fmt.Sprintf("No keys starting with '%s'", prefix))
+			return cmdNotFound
+		}
+
+		fmt.Printf("%sMatches (%d total):%s\n", colorBold, len(entries), colorReset)
+		for i, e := range entries {
+			if sess.display == displayHex {
+				fmt.Printf("  %s%d.%s %s =\n%s\n", colorGray, i+1, colorReset, e.Key, sess.display.format(e.Value))
+				continue
+			}
+			fmt.Printf("  %s%d.%s %s = %s\n", colorGray, i+1, colorReset, e.Key, sess.display.format(e.Value))
+		}
+
+	case "TREE":
+		sep, depth := ":", 3
+		if len(parts) > 1 {
+			sep = parts[1]
+		}
+		if len(parts) > 2 {
+			d, err := strconv.Atoi(parts[2])
+			if err != nil || d <= 0 {
+				printError("Usage: TREE [sep] [depth] (depth must be a positive integer)")
+				return cmdFailed
+			}
+			depth = d
+		}
+
+		root := s.Tree(sep)
+		if root.Keys == 0 {
+			printWarning("No keys stored")
+			return cmdNotFound
+		}
+
+		fmt.Printf("%sKeys (%d total):%s\n", colorBold, root.Keys, colorReset)
+		printTree(root.Children, "  ", depth)
+
+	case "USE":
+		return sess.use(parts)
+
+	case "BUCKETS":
+		return buckets(s)
+
+	case "LET":
+		return sess.let(parts)
+
+	case "GEN":
+		return gen(s, parts)
+
+	case "LEN", "COUNT":
+		if len(parts) > 1 {
+			n, exact := ks.EstimateCount(parts[1])
+			if exact {
+				printInfo(fmt.Sprintf("Keys starting with '%s': %d", parts[1], n))
+			} else {
+				printInfo(fmt.Sprintf("Keys starting with '%s': about %d (estimated)", parts[1], n))
+			}
+			return cmdOK
+		}
+		count := ks.Len()
+		printInfo(fmt.Sprintf("Total keys: %d", count))
+
+	case "STATS", "INFO":
+		printStats(s)
+
+	case "CHECK":
+		return check(s)
+
+	case "COMMIT":
+		s.Commit()
+		printSuccess("OK (all writes flushed to disk)")
+
+	case "RELOAD":
+		cfg, err := reloadConfig(w)
+		if err != nil {
+			printError(fmt.Sprintf("Error: %v", err))
+			return cmdFailed
+		}
+		printSuccess(fmt.Sprintf("OK (flush interval %v, max segment size %d bytes, sync %v)", cfg.FlushInterval, cfg.MaxSegmentSize, cfg.SyncPolicy))
+
+	case "CLEAR", "CLS":
+		fmt.Print("\033[H\033[2J")
+		printBanner()
+
+	case "HELP", "?":
+		printHelp()
+
+	default:
+		printError(fmt.Sprintf("Unknown command: %s", cmd))
+		fmt.Println("Type 'help' for available commands")
+		return cmdFailed
+	}
+	return cmdOK
+}
+
+// printTree prints branches with their key counts, stopping depth levels
+// down so a large keyspace stays readable.
+func printTree(nodes []*store.TreeNode, indent string, depth int) {
+	for _, n := range nodes {
+		if len(n.Children) == 0 {
+			fmt.Printf("%s%s\n", indent, n.Name)
+			continue
+		}
+
+		fmt.Printf("%s%s %s(%d)%s\n", indent, n.Name, colorGray, n.Keys, colorReset)
+		if depth > 1 {
+			printTree(n.Children, indent+"  ", depth-1)
+		}
+	}
+}
+
+// runREPL runs the interactive shell until EXIT or EOF.
+func runREPL(s *store.Store, w *wal.WAL) {
+	// print banner
+	printBanner()
+
+	printRecovery(s.LastRecovery())
+
+	// setup readline with auto-complete
+	completer := readline.NewPrefixCompleter(
+		readline.PcItem("SET"),
+		readline.PcItem("SETEX"),
+		readline.PcItem("GET"),
+		readline.PcItem("JSET"),
+		readline.PcItem("JGET"),
+		readline.PcItem("GETMETA"),
+		readline.PcItem("HISTORY"),
+		readline.PcItem("TTL"),
+		readline.PcItem("INCR"),
+		readline.PcItem("DECR"),
+		readline.PcItem("INCRBY"),
+		readline.PcItem("DELETE"),
+		readline.PcItem("DEL"),
+		readline.PcItem("HAS"),
+		readline.PcItem("EXISTS"),
+		readline.PcItem("KEYS"),
+		readline.PcItem("TOMBSTONES"),
+		readline.PcItem("SCAN"),
+		readline.PcItem("TREE"),
+		readline.PcItem("USE"),
+		readline.PcItem("BUCKETS"),
+		readline.PcItem("LET"),
+		readline.PcItem("GEN"),
+		readline.PcItem("LEN"),
+		readline.PcItem("COUNT"),
+		readline.PcItem("PRETTY", readline.PcItem("on"), readline.PcItem("off")),
+		readline.PcItem("DISPLAY", readline.PcItem("auto"), readline.PcItem("hex"), readline.PcItem("base64")),
+		readline.PcItem("STATS"),
+		readline.PcItem("INFO"),
+		readline.PcItem("CHECK"),
+		readline.PcItem("COMMIT"),
+		readline.PcItem("RELOAD"),
+		readline.PcItem("CLEAR"),
+		readline.PcItem("CLS"),
+		readline.PcItem("HELP"),
+		readline.PcItem("EXIT"),
+		readline.PcItem("QUIT"),
+	)
+
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:          colorPurple + "walrus> " + colorReset, // see session.prompt
+		HistoryFile:     ".walrus_history",
+		AutoComplete:    completer,
+		InterruptPrompt: "^C",
+		EOFPrompt:       "exit",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rl.Close()
+
+	// closing rl ends the loop, so main's deferred closes run as on EXIT
+	defer onSignal(func(os.Signal) { rl.Close() })()
+
+	sess := newSession(s)
+
+	// REPL loop
+	for {
+		line, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			if len(line) == 0 {
+				printInfo("Goodbye!")
+				break
+			} else {
+				continue
+			}
+		} else if err == io.EOF {
+			break
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts, err := splitArgs(line, sess)
+		if err != nil {
+			printError(fmt.Sprintf("Error: %v", err))
+			continue
+		}
+		if isExit(parts[0]) {
+			printInfo("Goodbye!")
+			break
+		}
+		handleCommand(sess, w, parts)
+		rl.SetPrompt(sess.prompt())
+	}
+
+	// final commit before exit
+	s.Commit()
+}
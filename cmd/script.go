@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// runCommands runs commands from the command line instead of the REPL:
+// args as one command, as in `walrus get foo`, or script as commands
+// separated by ';', as in `walrus -c "SET a 1; GET a"`. It stops at the
+// first command that fails and returns the result of the last one run,
+// so the exit code is 0 on success, 1 if a key wasn't found and 2 on an
+// error.
+func runCommands(s *store.Store, w *wal.WAL, script string, args []string) result {
+	if !readline.IsTerminal(int(os.Stdout.Fd())) {
+		plainOutput()
+	}
+
+	sess := newSession(s)
+	if len(args) > 0 {
+		if isExit(args[0]) {
+			return cmdOK
+		}
+		return handleCommand(sess, w, args)
+	}
+
+	r := cmdOK
+	for _, line := range splitCommands(script) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts, err := splitArgs(line, sess)
+		if err != nil {
+			printError(fmt.Sprintf("Error: %v", err))
+			return cmdFailed
+		}
+		if isExit(parts[0]) {
+			break
+		}
+		if r = handleCommand(sess, w, parts); r == cmdFailed {
+			break
+		}
+	}
+	return r
+}
+
+// isExit reports whether cmd is EXIT, which ends the REPL or a script
+// here rather than in handleCommand so the caller still closes the store.
+func isExit(cmd string) bool {
+	switch strings.ToUpper(cmd) {
+	case "EXIT", "QUIT", "Q":
+		return true
+	}
+	return false
+}
+
+// runPipe runs the commands read from in, one per line as typed at the
+// REPL, for `cat ops.txt | walrus`. Unlike a script it carries on past
+// failures, as a bulk load shouldn't stop at one bad line, and returns
+// the worst result. With quiet set it prints a summary at the end, since
+// quiet leaves out each command's OK line.
+func runPipe(s *store.Store, w *wal.WAL, in io.Reader, quiet bool) result {
+	plainOutput()
+
+	start := time.Now()
+	sess := newSession(s)
+	var counts [cmdFailed + 1]int
+	br := bufio.NewReader(in)
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			r := cmdFailed
+			parts, perr := splitArgs(line, sess)
+			switch {
+			case perr != nil:
+				printError(fmt.Sprintf("Line %d: %v", lineNo, perr))
+			case isExit(parts[0]):
+				err = io.EOF
+				r = cmdOK
+			default:
+				r = handleCommand(sess, w, parts)
+			}
+			counts[r]++
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			printError(fmt.Sprintf("Error: %v", err))
+			counts[cmdFailed]++
+			break
+		}
+	}
+
+	if quiet {
+		printInfo(fmt.Sprintf("%d command(s) in %v: %d ok, %d not found, %d failed",
+			counts[cmdOK]+counts[cmdNotFound]+counts[cmdFailed], time.Since(start).Round(time.Millisecond),
+			counts[cmdOK], counts[cmdNotFound], counts[cmdFailed]))
+	}
+
+	switch {
+	case counts[cmdFailed] > 0:
+		return cmdFailed
+	case counts[cmdNotFound] > 0:
+		return cmdNotFound
+	}
+	return cmdOK
+}
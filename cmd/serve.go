@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jerkeyray/walrus/admin"
+	"github.com/jerkeyray/walrus/grpcapi"
+	"github.com/jerkeyray/walrus/httpapi"
+	"github.com/jerkeyray/walrus/metrics"
+	"github.com/jerkeyray/walrus/server"
+	"github.com/jerkeyray/walrus/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serveMetrics serves Prometheus metrics on /metrics and expvar on
+// /debug/vars at addr, in the background. An empty addr does nothing.
+func serveMetrics(s *store.Store, addr string) {
+	if addr == "" {
+		return
+	}
+
+	prometheus.MustRegister(metrics.NewCollector(s))
+	metrics.PublishExpvar("walrus", s)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	go func() {
+		log.Printf("metrics on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// serveAdmin answers walrusctl on this process's admin socket, in the
+// background. A socket that can't be opened is only logged, since the
+// store works without it. The returned func removes the socket.
+func serveAdmin(s *store.Store, enabled bool) func() {
+	if !enabled {
+		return func() {}
+	}
+
+	srv, err := admin.Listen(admin.SocketPath(os.Getpid()), s)
+	if err != nil {
+		log.Printf("admin socket: %v", err)
+		return func() {}
+	}
+	go srv.Serve()
+
+	return func() { srv.Close() }
+}
+
+// serve runs the RESP server until SIGINT or SIGTERM.
+func serve(s *store.Store, addr string) {
+	srv := server.New(s)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		srv.Close()
+	}()
+
+	l, err := listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("walrus listening on %s (redis protocol)", addr)
+	if err := srv.Serve(l); err != nil && err != server.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	s.Commit()
+}
+
+// runServeHTTP implements `walrus serve-http --addr :8080`.
+func runServeHTTP(args []string) {
+	fs := flag.NewFlagSet("serve-http", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "listen `address`")
+	metricsAddr := fs.String("metrics", "", "serve /metrics and /debug/vars on `address`")
+	fs.Parse(args)
+	flagsFromEnv(fs)
+
+	s, _ := openStore()
+	defer s.Close()
+	serveMetrics(s, *metricsAddr)
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: httpapi.New(s),
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		srv.Shutdown(context.Background())
+	}()
+
+	l, err := listen(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("walrus listening on %s (http)", *addr)
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	s.Commit()
+}
+
+// runServeGRPC implements `walrus serve-grpc --addr :9090`.
+func runServeGRPC(args []string) {
+	fs := flag.NewFlagSet("serve-grpc", flag.ExitOnError)
+	addr := fs.String("addr", ":9090", "listen `address`")
+	metricsAddr := fs.String("metrics", "", "serve /metrics and /debug/vars on `address`")
+	fs.Parse(args)
+	flagsFromEnv(fs)
+
+	s, _ := openStore()
+	defer s.Close()
+	serveMetrics(s, *metricsAddr)
+
+	l, err := listen(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	gs := grpcapi.NewServer(s)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		gs.GracefulStop()
+	}()
+
+	log.Printf("walrus listening on %s (grpc)", *addr)
+	if err := gs.Serve(l); err != nil {
+		log.Fatal(err)
+	}
+
+	s.Commit()
+}
+
+// runServe implements `walrus serve`, the RESP server set up for running
+// in a container: it logs JSON lines to stdout, takes its settings from
+// WALRUS_* variables as well as flags, answers /healthz for the
+// container's health check and exits 1 if the store can't be recovered.
+// With --background-recovery it serves reads while it replays, and holds
+// writes until it is done.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":6379", "listen `address`")
+	healthAddr := fs.String("health-addr", ":8081", "serve /healthz on `address`")
+	metricsAddr := fs.String("metrics", "", "serve /metrics and /debug/vars on `address`")
+	fs.BoolVar(&backgroundRecovery, "background-recovery", false, "serve reads while the log replays, holding writes until it is done")
+	fs.Parse(args)
+	flagsFromEnv(fs)
+
+	// log.Printf goes through the same handler from here on
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	s, _, err := loadStore()
+	if err != nil {
+		slog.Error("cannot open the store", "dir", dataDir, "err", err)
+		os.Exit(1)
+	}
+	defer s.Close()
+
+	logRecovered := func() {
+		st, _ := s.Stats()
+		slog.Info("recovered", "dir", dataDir, "keys", st.Keys, "duration", st.Recovery.Duration, "crashed", st.Recovery.Crashed)
+	}
+	if recovered == nil {
+		logRecovered()
+	} else {
+		slog.Info("recovering in the background", "dir", dataDir)
+		go func() {
+			if err := <-recovered; err != nil {
+				slog.Error("cannot open the store", "dir", dataDir, "err", err)
+				os.Exit(1)
+			}
+			logRecovered()
+		}()
+	}
+
+	serveMetrics(s, *metricsAddr)
+	serveHealth(s, *healthAddr)
+	serve(s, *addr)
+	slog.Info("shut down")
+}
+
+// serveHealth answers GET /healthz at addr, in the background: 200 while
+// the store and its WAL can be read, with a status of "catching_up"
+// during a background recovery, and 503 with the error once they can't.
+func serveHealth(s *store.Store, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		st, err := s.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		status := "ok"
+		if s.CatchingUp() {
+			status = "catching_up"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"status": status, "keys": st.Keys})
+	})
+
+	go func() {
+		log.Printf("health checks on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// runHealthcheck implements `walrus healthcheck`, which exits 0 if the
+// walrus serve in this container answers /healthz and 1 otherwise, for
+// a HEALTHCHECK in images without curl.
+func runHealthcheck(args []string) {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	healthAddr := fs.String("health-addr", ":8081", "`address` walrus serve answers /healthz on")
+	timeout := fs.Duration("timeout", 2*time.Second, "give up after this `long`")
+	fs.Parse(args)
+	flagsFromEnv(fs)
+
+	host, port, err := net.SplitHostPort(*healthAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+
+	client := http.Client{Timeout: *timeout}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + "/healthz")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Fatalf("unhealthy: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+// started is when the process started, for STATS' uptime.
+var started = time.Now()
+
+// printStats implements STATS.
+func printStats(s *store.Store) {
+	st, err := s.Stats()
+	if err != nil {
+		printError(fmt.Sprintf("Error: %v", err))
+		return
+	}
+	size, err := dirSize(dataDir)
+	if err != nil {
+		printError(fmt.Sprintf("Error: %v", err))
+		return
+	}
+
+	lastFlush := "never"
+	if !st.WAL.LastFlush.IsZero() {
+		lastFlush = fmt.Sprintf("%v ago", time.Since(st.WAL.LastFlush).Round(time.Millisecond))
+	}
+
+	row := func(name, value string) {
+		fmt.Printf("  %s%-14s%s %s\n", colorGray, name, colorReset, value)
+	}
+
+	fmt.Printf("%sStats:%s\n", colorBold, colorReset)
+	row("keys", fmt.Sprintf("%d (~%s in memory)", st.Keys, formatBytes(st.Memory)))
+	row("data dir", fmt.Sprintf("%s, %s", dataDir, formatBytes(size)))
+	row("segments", fmt.Sprintf("%d", st.WAL.Segments))
+	row("buffered", formatBytes(int64(st.WAL.BufferedBytes)))
+	row("written", fmt.Sprintf("%s in %d flush(es), %d fsync(s)", formatBytes(st.WAL.BytesWritten), st.WAL.Flushes, st.WAL.Syncs))
+	row("last flush", lastFlush)
+	row("ops", fmt.Sprintf("%d get, %d scan, %d set, %d delete, %d batch", st.Ops.Gets, st.Ops.Scans, st.Ops.Sets, st.Ops.Deletes, st.Ops.Batches))
+	row("recovery", st.Recovery.Duration.Round(time.Microsecond).String())
+	row("uptime", time.Since(started).Round(time.Second).String())
+}
+
+// dirSize adds up the sizes of the files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+// session is the REPL state that outlives a single line: the variables
+// set with LET, which $name, ${name} and $(command) expand in later
+// lines, and display settings.
+type session struct {
+	store  *store.Store
+	bucket *store.Bucket // set by USE, nil for the default keyspace
+	vars   map[string]string
+	pretty bool // GET pretty-prints JSON values, see PRETTY
+
+	display displayMode // how GET and SCAN show values, see DISPLAY
+}
+
+func newSession(s *store.Store) *session {
+	return &session{store: s, vars: make(map[string]string)}
+}
+
+// let implements `LET name = value` and `LET name = <query>`: the
+// variable gets the result of GET, HAS, TTL, LEN or KEYS, or the text
+// after '=' as is. With no arguments it lists the variables.
+func (sess *session) let(parts []string) result {
+	if len(parts) == 1 {
+		if len(sess.vars) == 0 {
+			printWarning("No variables set")
+			return cmdNotFound
+		}
+		names := make([]string, 0, len(sess.vars))
+		for name := range sess.vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %s$%s%s = %s\n", colorGray, name, colorReset, displayValue(sess.vars[name]))
+		}
+		return cmdOK
+	}
+
+	if len(parts) < 4 || parts[2] != "=" || !validVarName(parts[1]) {
+		printError("Usage: LET <name> = <value or query>")
+		return cmdFailed
+	}
+	name, rhs := parts[1], parts[3:]
+
+	value := strings.Join(rhs, " ")
+	if isQuery(rhs[0]) {
+		v, err := sess.query(rhs)
+		if err != nil {
+			printError(fmt.Sprintf("Error: %v", err))
+			return cmdFailed
+		}
+		value = v
+	}
+
+	sess.vars[name] = value
+	printSuccess(fmt.Sprintf("OK ($%s = '%s')", name, displayValue(value)))
+	return cmdOK
+}
+
+func isQuery(cmd string) bool {
+	switch strings.ToUpper(cmd) {
+	case "GET", "HAS", "EXISTS", "TTL", "LEN", "COUNT", "KEYS":
+		return true
+	}
+	return false
+}
+
+// query runs a read-only command and returns its result as text, for
+// LET and $(...). A missing key is an error so that a script never
+// carries on with an empty value by accident.
+func (sess *session) query(parts []string) (string, error) {
+	s := sess.keyspace()
+	cmd := strings.ToUpper(parts[0])
+
+	switch cmd {
+	case "GET", "HAS", "EXISTS", "TTL":
+		if len(parts) != 2 {
+			return "", fmt.Errorf("usage: %s <key>", cmd)
+		}
+		key := parts[1]
+
+		switch cmd {
+		case "GET":
+			v, ok := s.Get(key)
+			if !ok {
+				return "", fmt.Errorf("key '%s' not found", key)
+			}
+			return v, nil
+		case "TTL":
+			ttl, ok := s.TTL(key)
+			if !ok {
+				return "", fmt.Errorf("key '%s' has no TTL", key)
+			}
+			return strconv.FormatInt(int64(ttl.Round(time.Second)/time.Second), 10), nil
+		}
+		return strconv.FormatBool(s.Has(key)), nil
+
+	case "LEN", "COUNT":
+		return strconv.Itoa(s.Len()), nil
+
+	case "KEYS":
+		return strings.Join(s.Keys(), " "), nil
+	}
+
+	return "", fmt.Errorf("$(...) runs only GET, HAS, TTL, LEN and KEYS, not %s", cmd)
+}
+
+func validVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isVarByte(name[i]) || (i == 0 && name[i] >= '0' && name[i] <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isVarByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// expandAt expands the $ reference starting at text[i], returning its
+// value and the index just past it. A '$' not followed by a name is
+// kept as it is.
+func (sess *session) expandAt(text string, i int) (string, int, error) {
+	rest := text[i+1:]
+
+	switch {
+	case strings.HasPrefix(rest, "("):
+		depth, end := 0, -1
+		for j := 0; j < len(rest) && end < 0; j++ {
+			switch rest[j] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					end = j
+				}
+			}
+		}
+		if end < 0 {
+			return "", 0, fmt.Errorf("unterminated $(")
+		}
+
+		parts, err := splitArgs(rest[1:end], sess)
+		if err != nil {
+			return "", 0, err
+		}
+		if len(parts) == 0 {
+			return "", 0, fmt.Errorf("empty $()")
+		}
+		v, err := sess.query(parts)
+		return v, i + 1 + end + 1, err
+
+	case strings.HasPrefix(rest, "{"):
+		end := strings.IndexByte(rest, '}')
+		if end < 0 {
+			return "", 0, fmt.Errorf("unterminated ${")
+		}
+		v, err := sess.lookup(rest[1:end])
+		return v, i + 1 + end + 1, err
+	}
+
+	n := 0
+	for n < len(rest) && isVarByte(rest[n]) {
+		n++
+	}
+	if n == 0 {
+		return "$", i + 1, nil
+	}
+	v, err := sess.lookup(rest[:n])
+	return v, i + 1 + n, err
+}
+
+func (sess *session) lookup(name string) (string, error) {
+	v, ok := sess.vars[name]
+	if !ok {
+		return "", fmt.Errorf("undefined variable $%s", name)
+	}
+	return v, nil
+}
+
+// expand expands every $ reference in text.
+func (sess *session) expand(text string) (string, error) {
+	if sess == nil || !strings.Contains(text, "$") {
+		return text, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		if text[i] != '$' {
+			b.WriteByte(text[i])
+			i++
+			continue
+		}
+
+		v, next, err := sess.expandAt(text, i)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+		i = next
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,282 @@
+// Command walrusctl inspects running walrus instances through their
+// admin socket, and data directories ahead of a restart, and moves keys
+// between servers:
+//
+//	walrusctl status [--pid p] [--json]
+//	walrusctl estimate-recovery [--sample size] [--max-record-size size] <dir>
+//	walrusctl verify-restore --backup <archive> --dir <dir> [--max-record-size size]
+//	walrusctl migrate --from <addr> --to <addr> [--prefix p] [--yes] [--delete]
+//
+// Without --pid status talks to the only instance running, and lists
+// them if there is more than one. migrate talks to the servers' gRPC
+// addresses. --max-record-size is the server's max_record_size, for a
+// log written with it above the default.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jerkeyray/walrus/admin"
+	"github.com/jerkeyray/walrus/config"
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+const usage = "usage: walrusctl status [--pid p] [--json]\n" +
+	"       walrusctl estimate-recovery [--sample size] [--max-record-size size] <dir>\n" +
+	"       walrusctl verify-restore --backup <archive> --dir <dir> [--max-record-size size]\n" +
+	"       walrusctl migrate --from <addr> --to <addr> [--prefix p] [--yes] [--delete]"
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+	switch os.Args[1] {
+	case "status":
+		runStatus(os.Args[2:])
+	case "estimate-recovery":
+		runEstimate(os.Args[2:])
+	case "verify-restore":
+		runVerifyRestore(os.Args[2:])
+	case "migrate":
+		runMigrate(os.Args[2:])
+	default:
+		log.Fatal(usage)
+	}
+}
+
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	pid := fs.Int("pid", 0, "query the walrus process with this `pid`")
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	fs.Parse(args)
+
+	st, err := query(*pid)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(st)
+		return
+	}
+	printStatus(st)
+}
+
+// query asks the process with pid, or the only one answering if pid is 0.
+func query(pid int) (admin.Status, error) {
+	if pid != 0 {
+		st, err := admin.Query(admin.SocketPath(pid))
+		if err != nil {
+			return st, fmt.Errorf("pid %d: %w", pid, err)
+		}
+		return st, nil
+	}
+
+	paths, err := admin.Sockets()
+	if err != nil {
+		return admin.Status{}, err
+	}
+
+	// sockets of processes that exited without closing them don't answer
+	var found []admin.Status
+	for _, path := range paths {
+		if st, err := admin.Query(path); err == nil {
+			found = append(found, st)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return admin.Status{}, fmt.Errorf("no running walrus found")
+	case 1:
+		return found[0], nil
+	}
+	msg := "several walrus processes are running, pick one with --pid:"
+	for _, st := range found {
+		msg += fmt.Sprintf("\n  %d (up %v, %d keys)", st.PID, time.Since(st.Started).Round(time.Second), st.Stats.Keys)
+	}
+	return admin.Status{}, fmt.Errorf("%s", msg)
+}
+
+func printStatus(st admin.Status) {
+	row := func(name, value string) {
+		fmt.Printf("  %-14s %s\n", name, value)
+	}
+
+	ws := st.Stats.WAL
+	lastFlush := "never"
+	if !ws.LastFlush.IsZero() {
+		lastFlush = fmt.Sprintf("%v ago", time.Since(ws.LastFlush).Round(time.Millisecond))
+	}
+
+	fmt.Printf("walrus %d:\n", st.PID)
+	row("uptime", time.Since(st.Started).Round(time.Second).String())
+	row("keys", fmt.Sprintf("%d (~%d bytes in memory)", st.Stats.Keys, st.Stats.Memory))
+	row("watchers", fmt.Sprint(st.Stats.Watchers))
+	row("buffered", fmt.Sprintf("%d bytes", ws.BufferedBytes))
+	row("segments", fmt.Sprint(ws.Segments))
+	row("written", fmt.Sprintf("%d bytes in %d flush(es), %d fsync(s)", ws.BytesWritten, ws.Flushes, ws.Syncs))
+	row("last flush", lastFlush)
+	row("stalls", fmt.Sprintf("%d, %v waiting, %d timed out", ws.Stalls, ws.StallTime.Round(time.Millisecond), ws.StallTimeouts))
+	if rec := st.Stats.Recovery; rec.Records > 0 {
+		row("recovery", fmt.Sprintf("%v for %d record(s), %d bytes", rec.Duration.Round(time.Millisecond), rec.Records, rec.Bytes))
+	}
+	ops := st.Stats.Ops
+	row("ops", fmt.Sprintf("%d get, %d scan, %d set, %d delete, %d batch", ops.Gets, ops.Scans, ops.Sets, ops.Deletes, ops.Batches))
+
+	if len(ws.SlowOps) == 0 {
+		row("slow ops", "none")
+		return
+	}
+	row("slow ops", fmt.Sprintf("%d most recent:", len(ws.SlowOps)))
+	for i := len(ws.SlowOps) - 1; i >= 0; i-- {
+		op := ws.SlowOps[i]
+		fmt.Printf("    %s %-5s %v (%d bytes)\n", op.At.Format(time.TimeOnly), op.Op, op.Duration.Round(time.Millisecond), op.Bytes)
+	}
+}
+
+// runEstimate times replay of the start of the log in dir and projects
+// the whole recovery from it. It opens the log read-only, so it can be
+// pointed at the directory of a running instance.
+func runEstimate(args []string) {
+	fs := flag.NewFlagSet("estimate-recovery", flag.ExitOnError)
+	sample := fs.String("sample", "64MB", "replay this `size` of the log to measure")
+	maxRecord := maxRecordFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal(usage)
+	}
+	size, err := config.ParseSize(*sample)
+	if err != nil {
+		log.Fatalf("--sample: %v", err)
+	}
+
+	keys, err := wal.EncryptionKeysFromEnv()
+	if err != nil {
+		log.Fatalf("%s: %v", wal.EncryptionKeysEnv, err)
+	}
+	w, err := wal.OpenReadOnly(wal.Options{Dir: fs.Arg(0), EncryptionKeys: keys, MaxRecordSize: maxRecord()})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer w.Close()
+
+	est, err := store.New(w).EstimateRecovery(size)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if est.SampleBytes == 0 {
+		fmt.Println("the log is empty, recovery is immediate")
+		return
+	}
+
+	rate := float64(est.SampleBytes) / est.SampleTime.Seconds() / (1 << 20)
+	fmt.Printf("replayed %d record(s), %d of %d bytes, in %v (%.1f MB/s)\n",
+		est.SampleRecords, est.SampleBytes, est.LogBytes, est.SampleTime.Round(time.Millisecond), rate)
+	fmt.Printf("estimated recovery: %v\n", est.Estimate.Round(time.Millisecond))
+}
+
+// runVerifyRestore checks that a backup restores: it replays the archive
+// in a scratch directory, restores it into dir as `walrus restore`
+// would, recovers that the way walrus does at startup and compares the
+// two stores' digests. dir is left holding the restored log.
+func runVerifyRestore(args []string) {
+	fs := flag.NewFlagSet("verify-restore", flag.ExitOnError)
+	archive := fs.String("backup", "", "the backup `archive` to verify")
+	dir := fs.String("dir", "", "restore into this `dir`, which must not hold a log")
+	maxRecord := maxRecordFlag(fs)
+	fs.Parse(args)
+	if *archive == "" || *dir == "" || fs.NArg() != 0 {
+		log.Fatal(usage)
+	}
+
+	keys, err := wal.EncryptionKeysFromEnv()
+	if err != nil {
+		log.Fatalf("%s: %v", wal.EncryptionKeysEnv, err)
+	}
+
+	scratch, err := os.MkdirTemp("", "walrus-verify-*")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(scratch)
+
+	// replayed read-only, so nothing but the archive decides what it holds
+	if err := restore(*archive, scratch); err != nil {
+		log.Fatalf("replaying the backup: %v", err)
+	}
+	w, err := wal.OpenReadOnly(wal.Options{Dir: scratch, EncryptionKeys: keys, MaxRecordSize: maxRecord()})
+	if err != nil {
+		log.Fatalf("replaying the backup: %v", err)
+	}
+	want, n, err := digest(w)
+	w.Close()
+	if err != nil {
+		log.Fatalf("replaying the backup: %v", err)
+	}
+
+	if err := restore(*archive, *dir); err != nil {
+		log.Fatalf("restoring into %s: %v", *dir, err)
+	}
+	w, err = wal.OpenWithOptions(wal.Options{Dir: *dir, EncryptionKeys: keys, MaxRecordSize: maxRecord()})
+	if err != nil {
+		log.Fatalf("opening %s: %v", *dir, err)
+	}
+	got, _, err := digest(w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatalf("recovering %s: %v", *dir, err)
+	}
+
+	if got != want {
+		log.Fatalf("%s does not match the backup: digest %x, the backup's %x", *dir, got, want)
+	}
+	fmt.Printf("OK (%s restores into %s: %d key(s), digest %x)\n", *archive, *dir, n, got)
+}
+
+func restore(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return wal.RestoreInto(dir, f)
+}
+
+// digest recovers a store from w and returns its digest and size.
+func digest(w *wal.WAL) ([32]byte, int, error) {
+	s := store.New(w)
+	if err := s.Recover(); err != nil {
+		return [32]byte{}, 0, err
+	}
+	sum, err := s.Digest()
+	return sum, s.Len(), err
+}
+
+// maxRecordFlag adds --max-record-size to fs and returns its value once
+// parsed, 0 for the WAL's default, so records the server takes read back
+// here too.
+func maxRecordFlag(fs *flag.FlagSet) func() int64 {
+	size := fs.String("max-record-size", "", "the server's max_record_size `size`, if it isn't the default")
+	return func() int64 {
+		if *size == "" {
+			return 0
+		}
+		n, err := config.ParseSize(*size)
+		if err != nil {
+			log.Fatalf("--max-record-size: %v", err)
+		}
+		return n
+	}
+}
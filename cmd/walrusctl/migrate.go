@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jerkeyray/walrus/grpcapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	// migrateBatch is how many keys migrate writes, or deletes, per Batch.
+	migrateBatch = 500
+
+	// catchupPasses bounds the copies of what changed meanwhile that
+	// migrate makes before the cutover, to keep the last one small.
+	catchupPasses = 3
+)
+
+// runMigrate copies the keys under a prefix from one server to another
+// while writes to them go on, then, at the cutover, once the writers to
+// the prefix are paused, copies what changed since for the last time and
+// deletes the keys deleted meanwhile, so the two agree when they resume
+// against the new server. Reads may go on against the old one
+// throughout.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "", "gRPC `addr` of the server to move the keys off")
+	to := fs.String("to", "", "gRPC `addr` of the server to move them to")
+	prefix := fs.String("prefix", "", "move the keys starting with `p`; all of them if empty")
+	yes := fs.Bool("yes", false, "cut over without asking, the writers being paused already")
+	del := fs.Bool("delete", false, "delete the keys from the old server after the cutover")
+	fs.Parse(args)
+	if *from == "" || *to == "" || fs.NArg() != 0 {
+		log.Fatal(usage)
+	}
+	if *from == *to {
+		log.Fatal("--from and --to are the same server")
+	}
+
+	src, closeSrc := dial(*from)
+	defer closeSrc()
+	dst, closeDst := dial(*to)
+	defer closeDst()
+	m := &migration{prefix: *prefix, src: src, dst: dst, copied: make(map[string]bool)}
+	ctx := context.Background()
+
+	n, err := m.pass(ctx)
+	if err != nil {
+		log.Fatalf("copying %q: %v", *prefix, err)
+	}
+	fmt.Printf("copied %d key(s) from %s to %s\n", n, *from, *to)
+	for i := 0; i < catchupPasses && n > 0; i++ {
+		if n, err = m.pass(ctx); err != nil {
+			log.Fatalf("copying %q: %v", *prefix, err)
+		}
+		fmt.Printf("copied %d key(s) written meanwhile\n", n)
+	}
+
+	if !*yes {
+		fmt.Printf("pause writes to %q, then press Enter to cut over to %s: ", *prefix, *to)
+		if _, err := bufio.NewReader(os.Stdin).ReadString('\n'); err != nil {
+			log.Fatal("cutover not confirmed; run again to finish")
+		}
+	}
+	n, err = m.pass(ctx)
+	if err != nil {
+		log.Fatalf("cutting over: %v", err)
+	}
+	live, err := src.Keys(ctx, *prefix)
+	if err != nil {
+		log.Fatalf("cutting over: %v", err)
+	}
+	gone := m.gone(live)
+	if err := deleteKeys(ctx, dst, gone); err != nil {
+		log.Fatalf("cutting over: %v", err)
+	}
+	fmt.Printf("cut over: copied %d key(s) and deleted %d; %d key(s) under %q now on %s\n", n, len(gone), len(live), *prefix, *to)
+
+	if *del {
+		if err := deleteKeys(ctx, src, live); err != nil {
+			log.Fatalf("deleting from %s: %v", *from, err)
+		}
+		fmt.Printf("deleted %d key(s) from %s\n", len(live), *from)
+	}
+}
+
+// dial connects to the gRPC server at addr.
+func dial(addr string) (*grpcapi.Client, func()) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("%s: %v", addr, err)
+	}
+	return grpcapi.NewClient(conn), func() { conn.Close() }
+}
+
+// migration is a migrate in progress.
+type migration struct {
+	prefix   string
+	src, dst *grpcapi.Client
+	since    uint64          // the LSN the last pass started at
+	copied   map[string]bool // every key copied so far
+}
+
+// pass copies the keys written since the last pass, or all of them the
+// first time, with their TTLs, and returns how many it copied.
+func (m *migration) pass(ctx context.Context) (int, error) {
+	n := 0
+	var muts []*grpcapi.Mutation
+	flush := func() error {
+		if len(muts) == 0 {
+			return nil
+		}
+		err := m.dst.Batch(ctx, muts...)
+		muts = muts[:0]
+		return err
+	}
+
+	lsn, err := m.src.Scan(ctx, m.prefix, m.since, func(e *grpcapi.Entry) error {
+		muts = append(muts, &grpcapi.Mutation{Type: grpcapi.MutationSet, Key: e.Key, Value: e.Value, TTLMs: e.TTLMs})
+		m.copied[e.Key] = true
+		n++
+		if len(muts) == migrateBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return n, err
+	}
+	m.since = lsn
+	return n, nil
+}
+
+// gone returns the keys copied that are no longer in live, the keys now
+// on the old server, as they were deleted or expired there meanwhile.
+func (m *migration) gone(live []string) []string {
+	left := make(map[string]bool, len(live))
+	for _, key := range live {
+		left[key] = true
+	}
+	var gone []string
+	for key := range m.copied {
+		if !left[key] {
+			gone = append(gone, key)
+		}
+	}
+	return gone
+}
+
+// deleteKeys deletes keys from c, migrateBatch at a time.
+func deleteKeys(ctx context.Context, c *grpcapi.Client, keys []string) error {
+	for i := 0; i < len(keys); i += migrateBatch {
+		var muts []*grpcapi.Mutation
+		for _, key := range keys[i:min(i+migrateBatch, len(keys))] {
+			muts = append(muts, &grpcapi.Mutation{Type: grpcapi.MutationDelete, Key: key})
+		}
+		if err := c.Batch(ctx, muts...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// Config holds the tunables read from walrus.toml or walrus.yaml. Only a
+// flat `key = value` subset of TOML, or `key: value` of YAML, is
+// understood, which is all walrus needs.
+type Config struct {
+	// DataDir holds the WAL. It only applies at startup.
+	DataDir string
+
+	FlushInterval  time.Duration
+	MaxSegmentSize int64
+	MaxSegmentAge  time.Duration // 0 rotates on size alone
+	SyncPolicy     wal.SyncPolicy
+
+	// MaxRecordSize bounds one logged record; see wal.Options. It only
+	// applies at startup.
+	MaxRecordSize int64
+
+	// PreallocateSegments creates segments at their full size and reuses
+	// deleted ones; see wal.Options.Preallocate. It only applies at
+	// startup.
+	PreallocateSegments bool
+
+	// MaxBufferedBytes, BufferPolicy and StallTimeout turn on flow
+	// control; see wal.Options. They only apply at startup.
+	MaxBufferedBytes int64
+	BufferPolicy     wal.BufferPolicy
+	StallTimeout     time.Duration
+
+	// Origin tags every record this instance writes; see wal.Options.
+	Origin string
+
+	// Compression applies to records written from startup on.
+	Compression wal.Compression
+
+	// RecoveryMemoryLimit caps the memory recovery may use; 0 is no limit.
+	// It only applies at startup.
+	RecoveryMemoryLimit int64
+
+	// RecoveryMode is what recovery does at a corrupt record; see
+	// wal.RecoveryMode. It only applies at startup.
+	RecoveryMode wal.RecoveryMode
+
+	// CheckAfterCrash has startup recovery verify the recovered store
+	// when the last run didn't shut down cleanly; see
+	// store.RecoverOptions.
+	CheckAfterCrash bool
+
+	// DeadLetter is where startup recovery puts records it can't apply,
+	// instead of refusing to start. Empty keeps the refusal.
+	DeadLetter string
+
+	// BucketIdleTTL moves buckets unused for this long out of memory; see
+	// store.SetBucketIdleTTL. 0 keeps every bucket in memory.
+	BucketIdleTTL time.Duration
+
+	// ColdKeyTTL moves the values of keys unread for this long out of
+	// memory; see store.SetColdTTL. 0 keeps every value in memory.
+	ColdKeyTTL time.Duration
+
+	// MemoryLimit caps the store's estimated memory; see
+	// store.SetMemoryLimit. A value like 80% sets MemoryLimitFraction
+	// instead, a share of GOMEMLIMIT. Both 0 is no limit. They only apply
+	// at startup.
+	MemoryLimit         int64
+	MemoryLimitFraction float64
+}
+
+// Default returns the settings walrus uses when no config file exists.
+func Default() Config {
+	return Config{
+		DataDir:        "./walrus-data",
+		FlushInterval:  100 * time.Millisecond,
+		MaxSegmentSize: 10 * 1024 * 1024,
+	}
+}
+
+// Files are the config files looked for by Find, in order.
+var Files = []string{"walrus.toml", "walrus.yaml", "walrus.yml"}
+
+// Find returns the first of Files that exists in dir, or the first of
+// them if none does, which Load takes as no config file.
+func Find(dir string) string {
+	for _, name := range Files {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(dir, Files[0])
+}
+
+// Load reads the config file at path on top of the defaults, as YAML if
+// path ends in .yaml or .yml and TOML otherwise. A missing file is not an
+// error, so the file stays optional.
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	sep, form := "=", "key = value"
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		sep, form = ":", "key: value"
+	}
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, sep)
+		if !ok {
+			return cfg, fmt.Errorf("%s:%d: expected %s", path, lineNo, form)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+
+		if err := cfg.Set(key, value); err != nil {
+			return cfg, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+	}
+
+	return cfg, scanner.Err()
+}
+
+// Settings names every setting Set takes.
+var Settings = []string{
+	"data_dir", "flush_interval", "max_segment_size", "max_segment_age",
+	"sync_policy", "max_buffered_bytes", "buffer_policy", "stall_timeout", "origin",
+	"compression", "recovery_memory_limit", "dead_letter", "bucket_idle_ttl",
+	"cold_key_ttl", "memory_limit", "recovery_mode", "check_after_crash", "preallocate_segments",
+	"max_record_size",
+}
+
+// EnvPrefix starts the environment variable of each setting, which is
+// the setting's name in upper case, as in WALRUS_FLUSH_INTERVAL.
+const EnvPrefix = "WALRUS_"
+
+// EnvName returns the environment variable ApplyEnv reads for a setting.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(key)
+}
+
+// ApplyEnv applies the settings given as environment variables, found
+// with lookup, typically os.LookupEnv. They are meant to go over the
+// config file, for containers that are configured through the
+// environment.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	for _, key := range Settings {
+		value, ok := lookup(EnvName(key))
+		if !ok {
+			continue
+		}
+		if err := c.Set(key, value); err != nil {
+			return fmt.Errorf("%s: %v", EnvName(key), err)
+		}
+	}
+	return nil
+}
+
+// Set applies one setting, named and written as in the config file.
+func (c *Config) Set(key, value string) error {
+	switch key {
+	case "data_dir":
+		if value == "" {
+			return fmt.Errorf("data_dir must not be empty")
+		}
+		c.DataDir = value
+
+	case "flush_interval":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("flush_interval: %v", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("flush_interval must not be negative")
+		}
+		c.FlushInterval = d
+
+	case "max_segment_size":
+		n, err := ParseSize(value)
+		if err != nil {
+			return fmt.Errorf("max_segment_size: %v", err)
+		}
+		c.MaxSegmentSize = n
+
+	case "max_segment_age":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("max_segment_age: %v", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("max_segment_age must not be negative")
+		}
+		c.MaxSegmentAge = d
+
+	case "max_record_size":
+		n, err := ParseSize(value)
+		if err != nil {
+			return fmt.Errorf("max_record_size: %v", err)
+		}
+		if n > math.MaxUint32 {
+			return fmt.Errorf("max_record_size must be under 4GB")
+		}
+		c.MaxRecordSize = n
+
+	case "sync_policy":
+		p, err := wal.ParseSyncPolicy(value)
+		if err != nil {
+			return err
+		}
+		c.SyncPolicy = p
+
+	case "max_buffered_bytes":
+		n, err := ParseSize(value)
+		if err != nil {
+			return fmt.Errorf("max_buffered_bytes: %v", err)
+		}
+		c.MaxBufferedBytes = n
+
+	case "buffer_policy":
+		p, err := wal.ParseBufferPolicy(value)
+		if err != nil {
+			return err
+		}
+		c.BufferPolicy = p
+
+	case "stall_timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("stall_timeout: %v", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("stall_timeout must not be negative")
+		}
+		c.StallTimeout = d
+
+	case "origin":
+		c.Origin = value
+
+	case "compression":
+		comp, err := wal.ParseCompression(value)
+		if err != nil {
+			return err
+		}
+		c.Compression = comp
+
+	case "recovery_memory_limit":
+		n, err := ParseSize(value)
+		if err != nil {
+			return fmt.Errorf("recovery_memory_limit: %v", err)
+		}
+		c.RecoveryMemoryLimit = n
+
+	case "recovery_mode":
+		mode, err := wal.ParseRecoveryMode(value)
+		if err != nil {
+			return err
+		}
+		c.RecoveryMode = mode
+
+	case "check_after_crash":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("check_after_crash must be true or false")
+		}
+		c.CheckAfterCrash = b
+
+	case "preallocate_segments":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("preallocate_segments must be true or false")
+		}
+		c.PreallocateSegments = b
+
+	case "dead_letter":
+		c.DeadLetter = value
+
+	case "bucket_idle_ttl":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("bucket_idle_ttl: %v", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("bucket_idle_ttl must not be negative")
+		}
+		c.BucketIdleTTL = d
+
+	case "cold_key_ttl":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("cold_key_ttl: %v", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("cold_key_ttl must not be negative")
+		}
+		c.ColdKeyTTL = d
+
+	case "memory_limit":
+		if pct, ok := strings.CutSuffix(strings.TrimSpace(value), "%"); ok {
+			f, err := strconv.ParseFloat(strings.TrimSpace(pct), 64)
+			if err != nil || f <= 0 || f > 100 {
+				return fmt.Errorf("memory_limit: expected a size or a percentage of GOMEMLIMIT up to 100%%")
+			}
+			c.MemoryLimit, c.MemoryLimitFraction = 0, f/100
+			break
+		}
+		n, err := ParseSize(value)
+		if err != nil {
+			return fmt.Errorf("memory_limit: %v", err)
+		}
+		c.MemoryLimit, c.MemoryLimitFraction = n, 0
+
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+
+	return nil
+}
+
+// ParseSize parses a byte count with an optional KB/MB/GB suffix.
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("size must be positive")
+	}
+
+	return n * mult, nil
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "walrus.toml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadMissingFileUsesDefaults(t *testing.T) {
+	cfg, err := Load(filepath.Join(t.TempDir(), "nope.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg != Default() {
+		t.Fatalf("expected defaults, got %+v", cfg)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+# tunables
+flush_interval = "250ms"
+max_segment_size = 4MB
+max_segment_age = "1h"
+max_buffered_bytes = 8MB
+buffer_policy = "fail"
+max_record_size = 16MB
+stall_timeout = "2s"
+sync_policy = "interval:1s"
+recovery_memory_limit = 512MB
+origin = "node-a"
+dead_letter = "walrus-data/dead.log"
+compression = "zstd"
+bucket_idle_ttl = "10m"
+cold_key_ttl = "720h"
+memory_limit = 1GB
+recovery_mode = "salvage"
+check_after_crash = true
+preallocate_segments = true
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.FlushInterval != 250*time.Millisecond {
+		t.Fatalf("expected 250ms, got %v", cfg.FlushInterval)
+	}
+
+	if cfg.MaxSegmentSize != 4*1024*1024 {
+		t.Fatalf("expected 4MB, got %d", cfg.MaxSegmentSize)
+	}
+
+	if cfg.MaxSegmentAge != time.Hour {
+		t.Fatalf("expected 1h max segment age, got %v", cfg.MaxSegmentAge)
+	}
+
+	if cfg.MaxBufferedBytes != 8*1024*1024 || cfg.StallTimeout != 2*time.Second {
+		t.Fatalf("expected an 8MB buffer limit and a 2s stall timeout, got %d and %v", cfg.MaxBufferedBytes, cfg.StallTimeout)
+	}
+	if cfg.BufferPolicy != wal.BufferFail {
+		t.Fatalf("expected the fail buffer policy, got %v", cfg.BufferPolicy)
+	}
+	if cfg.MaxRecordSize != 16*1024*1024 {
+		t.Fatalf("expected a 16MB record limit, got %d", cfg.MaxRecordSize)
+	}
+
+	if cfg.SyncPolicy.Mode != wal.SyncInterval || cfg.SyncPolicy.Interval != time.Second {
+		t.Fatalf("expected interval:1s sync policy, got %v", cfg.SyncPolicy)
+	}
+
+	if cfg.Origin != "node-a" {
+		t.Fatalf("expected origin node-a, got %q", cfg.Origin)
+	}
+
+	if cfg.RecoveryMemoryLimit != 512*1024*1024 {
+		t.Fatalf("expected 512MB recovery limit, got %d", cfg.RecoveryMemoryLimit)
+	}
+
+	if cfg.Compression != wal.CompressionZstd {
+		t.Fatalf("expected zstd compression, got %v", cfg.Compression)
+	}
+
+	if cfg.DeadLetter != "walrus-data/dead.log" {
+		t.Fatalf("expected dead letter path, got %q", cfg.DeadLetter)
+	}
+
+	if cfg.BucketIdleTTL != 10*time.Minute {
+		t.Fatalf("expected a 10m bucket idle ttl, got %v", cfg.BucketIdleTTL)
+	}
+	if cfg.ColdKeyTTL != 720*time.Hour {
+		t.Fatalf("expected a 720h cold key ttl, got %v", cfg.ColdKeyTTL)
+	}
+
+	if cfg.RecoveryMode != wal.RecoverySalvage || !cfg.CheckAfterCrash {
+		t.Fatalf("expected salvage recovery checked after a crash, got %v, %v", cfg.RecoveryMode, cfg.CheckAfterCrash)
+	}
+	if !cfg.PreallocateSegments {
+		t.Fatal("expected preallocated segments")
+	}
+
+	if cfg.MemoryLimit != 1<<30 || cfg.MemoryLimitFraction != 0 {
+		t.Fatalf("expected a 1GB memory limit, got %d", cfg.MemoryLimit)
+	}
+	if err := cfg.Set("memory_limit", "80%"); err != nil || cfg.MemoryLimit != 0 || cfg.MemoryLimitFraction != 0.8 {
+		t.Fatalf("expected 80%% to replace the size with a fraction, got %d, %v (%v)", cfg.MemoryLimit, cfg.MemoryLimitFraction, err)
+	}
+}
+
+func TestLoadYAML(t *testing.T) {
+	dir := t.TempDir()
+	if got := Find(dir); got != filepath.Join(dir, "walrus.toml") {
+		t.Fatalf("expected walrus.toml with no config file, got %s", got)
+	}
+
+	path := filepath.Join(dir, "walrus.yaml")
+	contents := `
+# comments work in YAML too
+data_dir: /var/lib/walrus
+flush_interval: "250ms"
+sync_policy: interval:1s
+`
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := Find(dir); got != path {
+		t.Fatalf("expected Find to pick up walrus.yaml, got %s", got)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DataDir != "/var/lib/walrus" || cfg.FlushInterval != 250*time.Millisecond || cfg.SyncPolicy.Interval != time.Second {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	if err := os.WriteFile(path, []byte("flush_interval = 250ms\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatal("expected TOML syntax in a YAML file to fail")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"WALRUS_DATA_DIR":        "/data",
+		"WALRUS_SYNC_POLICY":     "always",
+		"WALRUS_BUCKET_IDLE_TTL": "5m",
+		"WALRUS_SERVE":           ":6380", // a flag, not a setting
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	cfg := Default()
+	if err := cfg.ApplyEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DataDir != "/data" || cfg.SyncPolicy.Mode != wal.SyncAlways || cfg.BucketIdleTTL != 5*time.Minute {
+		t.Fatalf("expected the environment applied, got %+v", cfg)
+	}
+	if cfg.FlushInterval != Default().FlushInterval {
+		t.Fatal("expected settings missing from the environment to stay")
+	}
+
+	env["WALRUS_FLUSH_INTERVAL"] = "soon"
+	if err := cfg.ApplyEnv(lookup); err == nil || !strings.Contains(err.Error(), "WALRUS_FLUSH_INTERVAL") {
+		t.Fatalf("expected an error naming the variable, got %v", err)
+	}
+
+	// every setting has a variable
+	for _, key := range Settings {
+		var c Config
+		if err := c.Set(key, ""); err != nil && strings.Contains(err.Error(), "unknown setting") {
+			t.Fatalf("Settings lists %s, which Set doesn't take", key)
+		}
+	}
+}
+
+func TestLoadRejectsBadInput(t *testing.T) {
+	for _, contents := range []string{
+		"flush_interval",
+		"flush_interval = soon",
+		"flush_interval = -1s",
+		"max_segment_size = 0",
+		"max_segment_age = -1h",
+		"max_buffered_bytes = 0",
+		"max_record_size = 8GB",
+		"stall_timeout = -1s",
+		"buffer_policy = drop",
+		"bucket_idle_ttl = -1m",
+		"cold_key_ttl = 30d",
+		"colour = blue",
+		"sync_policy = sometimes",
+		"recovery_memory_limit = lots",
+		"compression = lz4",
+		"memory_limit = 150%",
+		"recovery_mode = lenient",
+		"check_after_crash = sometimes",
+		"preallocate_segments = 1GB",
+	} {
+		if _, err := Load(writeConfig(t, contents)); err == nil {
+			t.Fatalf("expected error for %q", contents)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package grpcapi
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Client calls the Walrus service over an existing connection:
+//
+//	conn, err := grpc.NewClient("localhost:9090",
+//		grpc.WithTransportCredentials(insecure.NewCredentials()))
+//	c := grpcapi.NewClient(conn)
+//	err = c.Set(ctx, "name", "jerk", 0)
+type Client struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewClient(cc grpc.ClientConnInterface) *Client {
+	return &Client{cc: cc}
+}
+
+func (c *Client) invoke(ctx context.Context, method string, in, out message) error {
+	return c.cc.Invoke(ctx, "/"+serviceName+"/"+method, in, out, grpc.ForceCodecV2(codec{}))
+}
+
+// WithIdempotencyKey returns a context whose Set, Delete and Batch calls
+// carry key, so retrying them after a lost response cannot apply the
+// write twice. Use a fresh key per logical write and the same key for its
+// retries.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, idempotencyKeyMD, key)
+}
+
+// WithCaller returns a context whose Set, Delete and Batch calls are
+// logged as made for c, as store.Caller attributes them.
+func WithCaller(ctx context.Context, c store.Caller) context.Context {
+	if c.User != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, userMD, c.User)
+	}
+	if c.Request != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, requestMD, c.Request)
+	}
+	return ctx
+}
+
+// Set stores value under key. A ttl of 0 means the key never expires.
+func (c *Client) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	in := &setRequest{Key: key, Value: []byte(value), TTLMs: ttl.Milliseconds()}
+	return c.invoke(ctx, "Set", in, &empty{})
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, bool, error) {
+	return c.GetFrom(ctx, "", key)
+}
+
+// GetFrom is Get from the named snapshot; see CreateSnapshot. An empty
+// name reads the live store.
+func (c *Client) GetFrom(ctx context.Context, snapshot, key string) (string, bool, error) {
+	out := &getResponse{}
+	if err := c.invoke(ctx, "Get", &getRequest{Key: key, Snapshot: snapshot}, out); err != nil {
+		return "", false, err
+	}
+	return string(out.Value), out.Found, nil
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.invoke(ctx, "Delete", &keyRequest{Key: key}, &empty{})
+}
+
+func (c *Client) Has(ctx context.Context, key string) (bool, error) {
+	return c.HasFrom(ctx, "", key)
+}
+
+// HasFrom is Has in the named snapshot.
+func (c *Client) HasFrom(ctx context.Context, snapshot, key string) (bool, error) {
+	out := &hasResponse{}
+	if err := c.invoke(ctx, "Has", &keyRequest{Key: key, Snapshot: snapshot}, out); err != nil {
+		return false, err
+	}
+	return out.Found, nil
+}
+
+// Keys returns every key starting with prefix, sorted. The server streams
+// them in chunks; Keys collects the whole stream.
+func (c *Client) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return c.KeysFrom(ctx, "", prefix)
+}
+
+// KeysFrom is Keys in the named snapshot.
+func (c *Client) KeysFrom(ctx context.Context, snapshot, prefix string) ([]string, error) {
+	stream, err := c.cc.NewStream(ctx, &serviceDesc.Streams[0], "/"+serviceName+"/Keys", grpc.ForceCodecV2(codec{}))
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&keysRequest{Prefix: prefix, Snapshot: snapshot}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for {
+		out := &keysResponse{}
+		err := stream.RecvMsg(out)
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, out.Keys...)
+	}
+}
+
+// Scan calls fn with every key starting with prefix, outside buckets,
+// sorted, that was written after the record with LSN since, or every one
+// if since is 0, as the server streams them. It returns the store's last
+// LSN when the scan started: every write up to it is in the scan, so
+// Scan since it finds what changed afterwards. The scan isn't a snapshot
+// as of that LSN, though: each key is read as it is when the server gets
+// to it, so writes made meanwhile may show for some keys and not others.
+// Keys deleted meanwhile aren't found; compare Keys for those.
+func (c *Client) Scan(ctx context.Context, prefix string, since uint64, fn func(*Entry) error) (uint64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // ends the stream early if fn fails
+
+	stream, err := c.cc.NewStream(ctx, &serviceDesc.Streams[1], "/"+serviceName+"/Scan", grpc.ForceCodecV2(codec{}))
+	if err != nil {
+		return 0, err
+	}
+	if err := stream.SendMsg(&scanRequest{Prefix: prefix, Since: since}); err != nil {
+		return 0, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return 0, err
+	}
+
+	var lsn uint64
+	for {
+		out := &scanResponse{}
+		err := stream.RecvMsg(out)
+		if err == io.EOF {
+			return lsn, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if out.LSN != 0 {
+			lsn = out.LSN
+		}
+		for _, e := range out.Entries {
+			if err := fn(e); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// CreateSnapshot freezes the store as it is now under name, for GetFrom,
+// HasFrom and KeysFrom to read while writes carry on. It fails with
+// codes.AlreadyExists if the name is taken.
+func (c *Client) CreateSnapshot(ctx context.Context, name string) error {
+	return c.invoke(ctx, "CreateSnapshot", &snapshotRequest{Name: name}, &empty{})
+}
+
+func (c *Client) DropSnapshot(ctx context.Context, name string) error {
+	return c.invoke(ctx, "DropSnapshot", &snapshotRequest{Name: name}, &empty{})
+}
+
+// Batch applies mutations atomically.
+func (c *Client) Batch(ctx context.Context, mutations ...*Mutation) error {
+	return c.invoke(ctx, "Batch", &batchRequest{Mutations: mutations}, &empty{})
+}
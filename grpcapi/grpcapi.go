@@ -0,0 +1,389 @@
+// Package grpcapi serves a Store over gRPC using the Walrus service in
+// walrus.proto, and provides a matching Go client.
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const serviceName = "walrus.v1.Walrus"
+
+// keys sent per KeysResponse
+const keysChunkSize = 500
+
+// value bytes after which a ScanResponse is sent, short of keysChunkSize
+// entries, to keep it well under gRPC's message size limit
+const scanChunkBytes = 1 << 20
+
+// Metadata keys for idempotent writes. Set, Delete and Batch calls that
+// carry an idempotency key apply at most once per key within
+// store.DefaultIdempotencyWindow; a retry writes nothing and gets the
+// replayed header back. See WithIdempotencyKey.
+const (
+	idempotencyKeyMD = "idempotency-key"
+	replayedMD       = "idempotent-replayed"
+)
+
+// Metadata keys naming who a write is made for, logged with Set, Delete
+// and Batch as their store.Caller. They are taken as sent. See
+// WithCaller.
+const (
+	userMD    = "x-user-id"
+	requestMD = "x-request-id"
+)
+
+// walrusServer is the handler type registered for the service.
+type walrusServer interface {
+	set(ctx context.Context, in *setRequest) (message, error)
+	get(ctx context.Context, in *getRequest) (message, error)
+	delete(ctx context.Context, in *keyRequest) (message, error)
+	has(ctx context.Context, in *keyRequest) (message, error)
+	keys(in *keysRequest, stream grpc.ServerStream) error
+	scan(in *scanRequest, stream grpc.ServerStream) error
+	batch(ctx context.Context, in *batchRequest) (message, error)
+	createSnapshot(ctx context.Context, in *snapshotRequest) (message, error)
+	dropSnapshot(ctx context.Context, in *snapshotRequest) (message, error)
+}
+
+type service struct {
+	store *store.Store
+}
+
+// NewServer returns a gRPC server with the Walrus service registered
+// against s. Extra options (TLS, interceptors, ...) are passed through,
+// and other services, such as health checks, can be registered on it.
+func NewServer(s *store.Store, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ForceServerCodecV2(codec{}))
+
+	gs := grpc.NewServer(opts...)
+	gs.RegisterService(&serviceDesc, &service{store: s})
+	return gs
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*walrusServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("Set", walrusServer.set),
+		unary("Get", walrusServer.get),
+		unary("Delete", walrusServer.delete),
+		unary("Has", walrusServer.has),
+		unary("Batch", walrusServer.batch),
+		unary("CreateSnapshot", walrusServer.createSnapshot),
+		unary("DropSnapshot", walrusServer.dropSnapshot),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Keys",
+			Handler:       keysHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Scan",
+			Handler:       scanHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "walrus.proto",
+}
+
+// unary builds the method descriptor gRPC code generators would emit for
+// a unary RPC.
+func unary[Req any, PReq interface {
+	*Req
+	message
+}](name string, call func(walrusServer, context.Context, PReq) (message, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			in := PReq(new(Req))
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+
+			handler := func(ctx context.Context, req any) (any, error) {
+				return call(srv.(walrusServer), ctx, req.(PReq))
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + name}
+			return interceptor(ctx, in, info, handler)
+		},
+	}
+}
+
+func keysHandler(srv any, stream grpc.ServerStream) error {
+	in := new(keysRequest)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	return srv.(walrusServer).keys(in, stream)
+}
+
+func scanHandler(srv any, stream grpc.ServerStream) error {
+	in := new(scanRequest)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	return srv.(walrusServer).scan(in, stream)
+}
+
+func (s *service) set(ctx context.Context, in *setRequest) (message, error) {
+	ctx = withCaller(ctx)
+	if in.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key must not be empty")
+	}
+	if in.TTLMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_ms must not be negative")
+	}
+
+	ttl := time.Duration(in.TTLMs) * time.Millisecond
+	if idemKey := idempotencyKey(ctx); idemKey != "" {
+		b := &store.WriteBatch{}
+		b.SetWithTTL(in.Key, string(in.Value), ttl)
+		return s.writeOnce(ctx, idemKey, b)
+	}
+
+	if err := s.store.SetWithTTLCtx(ctx, in.Key, string(in.Value), ttl); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &empty{}, nil
+}
+
+// source is what the reads run against: the store or a snapshot.
+type source interface {
+	Get(key string) (string, bool)
+	Has(key string) bool
+	Keys() []string
+}
+
+// source returns the snapshot called name, or the store if name is empty.
+func (s *service) source(name string) (source, error) {
+	if name == "" {
+		return s.store, nil
+	}
+
+	sn, err := s.store.Snapshot(name)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "snapshot %q not found", name)
+	}
+	return sn, nil
+}
+
+func (s *service) get(ctx context.Context, in *getRequest) (message, error) {
+	src, err := s.source(in.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := src.Get(in.Key)
+	return &getResponse{Value: []byte(value), Found: ok}, nil
+}
+
+func (s *service) delete(ctx context.Context, in *keyRequest) (message, error) {
+	ctx = withCaller(ctx)
+	if in.Snapshot != "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshots are read-only")
+	}
+	if idemKey := idempotencyKey(ctx); idemKey != "" {
+		b := &store.WriteBatch{}
+		b.Delete(in.Key)
+		return s.writeOnce(ctx, idemKey, b)
+	}
+
+	if err := s.store.DeleteCtx(ctx, in.Key); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &empty{}, nil
+}
+
+func (s *service) has(ctx context.Context, in *keyRequest) (message, error) {
+	src, err := s.source(in.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return &hasResponse{Found: src.Has(in.Key)}, nil
+}
+
+func (s *service) keys(in *keysRequest, stream grpc.ServerStream) error {
+	src, err := s.source(in.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for _, key := range src.Keys() {
+		if strings.HasPrefix(key, in.Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for len(keys) > 0 {
+		n := min(len(keys), keysChunkSize)
+		if err := stream.SendMsg(&keysResponse{Keys: keys[:n]}); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// scan sends the first message with the store's last LSN from before
+// the barrier, so every write up to it is in this scan, and a later scan
+// since it misses none. It is not a snapshot: the keys are listed after
+// the barrier and each read as it is when reached, so entries from the
+// same scan may be from different moments past the LSN, and a key
+// written meanwhile may be sent again by the next scan.
+func (s *service) scan(in *scanRequest, stream grpc.ServerStream) error {
+	lsn := s.store.LastLSN()
+	if err := s.store.BarrierCtx(stream.Context(), false); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	var keys []string
+	for _, key := range s.store.Keys() {
+		if strings.HasPrefix(key, in.Prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	out, size := &scanResponse{LSN: lsn}, 0
+	for _, key := range keys {
+		m, ok := s.store.GetWithMeta(key)
+		if !ok || in.Since > 0 && m.Version <= in.Since {
+			continue
+		}
+		e := &Entry{Key: key, Value: []byte(m.Value), Version: m.Version}
+		if !m.Expires.IsZero() {
+			ttl := time.Until(m.Expires).Milliseconds()
+			if ttl <= 0 {
+				continue
+			}
+			e.TTLMs = ttl
+		}
+
+		out.Entries = append(out.Entries, e)
+		size += len(e.Value)
+		if len(out.Entries) == keysChunkSize || size >= scanChunkBytes {
+			if err := stream.SendMsg(out); err != nil {
+				return err
+			}
+			out, size = &scanResponse{}, 0
+		}
+	}
+	if len(out.Entries) > 0 || out.LSN != 0 {
+		return stream.SendMsg(out)
+	}
+	return nil
+}
+
+func (s *service) batch(ctx context.Context, in *batchRequest) (message, error) {
+	ctx = withCaller(ctx)
+	b := &store.WriteBatch{}
+
+	for _, m := range in.Mutations {
+		if m.Key == "" {
+			return nil, status.Error(codes.InvalidArgument, "key must not be empty")
+		}
+
+		switch m.Type {
+		case MutationSet:
+			if m.TTLMs < 0 {
+				return nil, status.Error(codes.InvalidArgument, "ttl_ms must not be negative")
+			}
+			b.SetWithTTL(m.Key, string(m.Value), time.Duration(m.TTLMs)*time.Millisecond)
+		case MutationDelete:
+			b.Delete(m.Key)
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown mutation type %d", m.Type)
+		}
+	}
+
+	if idemKey := idempotencyKey(ctx); idemKey != "" {
+		return s.writeOnce(ctx, idemKey, b)
+	}
+
+	if err := s.store.WriteCtx(ctx, b); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &empty{}, nil
+}
+
+func (s *service) createSnapshot(ctx context.Context, in *snapshotRequest) (message, error) {
+	if _, err := s.store.CreateSnapshot(in.Name); err != nil {
+		switch {
+		case errors.Is(err, store.ErrSnapshotExists):
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		case errors.Is(err, store.ErrSnapshotName):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &empty{}, nil
+}
+
+func (s *service) dropSnapshot(ctx context.Context, in *snapshotRequest) (message, error) {
+	if err := s.store.DropSnapshot(in.Name); err != nil {
+		return nil, status.Errorf(codes.NotFound, "snapshot %q not found", in.Name)
+	}
+	return &empty{}, nil
+}
+
+// writeOnce applies b unless a call with idemKey already was, telling the
+// caller which through the replayed header.
+func (s *service) writeOnce(ctx context.Context, idemKey string, b *store.WriteBatch) (message, error) {
+	applied, err := s.store.WriteIdempotentCtx(ctx, idemKey, 0, b)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !applied {
+		grpc.SetHeader(ctx, metadata.Pairs(replayedMD, "true"))
+	}
+	return &empty{}, nil
+}
+
+// idempotencyKey returns the idempotency key the caller sent, if any.
+func idempotencyKey(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if v := md.Get(idempotencyKeyMD); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// withCaller attaches the Caller named in the call's metadata to ctx, if
+// it names one.
+func withCaller(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	var c store.Caller
+	if v := md.Get(userMD); len(v) > 0 {
+		c.User = v[0]
+	}
+	if v := md.Get(requestMD); len(v) > 0 {
+		c.Request = v[0]
+	}
+	if c == (store.Caller{}) {
+		return ctx
+	}
+	return store.WithCaller(ctx, c)
+}
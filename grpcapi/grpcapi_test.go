@@ -0,0 +1,260 @@
+package grpcapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestClient(t *testing.T) (*Client, *store.Store) {
+	t.Helper()
+
+	w, err := wal.Open(t.TempDir(), 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.New(w)
+
+	l := bufconn.Listen(1024 * 1024)
+	gs := NewServer(s)
+	healthpb.RegisterHealthServer(gs, health.NewServer())
+	go gs.Serve(l)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		gs.Stop()
+		s.Close()
+	})
+
+	return NewClient(conn), s
+}
+
+func TestSetGetDelete(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "name", "jerk", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	v, ok, err := c.Get(ctx, "name")
+	if err != nil || !ok || v != "jerk" {
+		t.Fatalf("expected jerk, got %q %v %v", v, ok, err)
+	}
+
+	if err := c.Delete(ctx, "name"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := c.Has(ctx, "name"); err != nil || ok {
+		t.Fatalf("expected key to be gone, got %v %v", ok, err)
+	}
+
+	err = c.Set(ctx, "", "v", 0)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for empty key, got %v", err)
+	}
+}
+
+func TestKeysStreamsInChunks(t *testing.T) {
+	c, s := newTestClient(t)
+
+	for i := 0; i < keysChunkSize*2+10; i++ {
+		s.Set(fmt.Sprintf("user:%04d", i), "v")
+	}
+	s.Set("order:1", "v")
+
+	keys, err := c.Keys(context.Background(), "user:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != keysChunkSize*2+10 {
+		t.Fatalf("expected %d keys, got %d", keysChunkSize*2+10, len(keys))
+	}
+	if keys[0] != "user:0000" || keys[len(keys)-1] != fmt.Sprintf("user:%04d", len(keys)-1) {
+		t.Fatal("expected keys in sorted order")
+	}
+}
+
+// Test that Scan streams a prefix with TTLs, in chunks, and that a scan
+// since the LSN one returns finds only the keys written after it
+func TestScan(t *testing.T) {
+	c, s := newTestClient(t)
+	ctx := context.Background()
+
+	for i := 0; i < keysChunkSize+10; i++ {
+		s.Set(fmt.Sprintf("user:%04d", i), "v")
+	}
+	s.SetWithTTL("user:ttl", "v", time.Hour)
+	s.Set("order:1", "v")
+
+	var got []*Entry
+	lsn, err := c.Scan(ctx, "user:", 0, func(e *Entry) error {
+		got = append(got, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != keysChunkSize+11 || got[0].Key != "user:0000" || string(got[0].Value) != "v" {
+		t.Fatalf("expected every user: key in order, got %d", len(got))
+	}
+	if last := got[len(got)-1]; last.Key != "user:ttl" || last.TTLMs <= 0 || last.TTLMs > time.Hour.Milliseconds() {
+		t.Fatalf("expected user:ttl with its TTL last, got %+v", last)
+	}
+	if lsn != s.LastLSN() {
+		t.Fatalf("expected LSN %d, got %d", s.LastLSN(), lsn)
+	}
+
+	s.Set("user:0003", "w")
+	s.Set("user:new", "v")
+	s.Set("order:2", "v")
+	got = nil
+	if _, err := c.Scan(ctx, "user:", lsn, func(e *Entry) error {
+		got = append(got, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Key != "user:0003" || string(got[0].Value) != "w" || got[1].Key != "user:new" || got[0].Version <= lsn {
+		t.Fatalf("expected the two user: keys written since, got %v", got)
+	}
+
+	stop := fmt.Errorf("stop")
+	if _, err := c.Scan(ctx, "", 0, func(*Entry) error { return stop }); err != stop {
+		t.Fatalf("expected fn's error back, got %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	c, s := newTestClient(t)
+	ctx := context.Background()
+
+	s.Set("old", "x")
+
+	err := c.Batch(ctx,
+		&Mutation{Type: MutationSet, Key: "a", Value: []byte("1")},
+		&Mutation{Type: MutationSet, Key: "b", Value: []byte("2"), TTLMs: 60000},
+		&Mutation{Type: MutationDelete, Key: "old"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := s.Get("a"); v != "1" {
+		t.Fatalf("expected a=1, got %q", v)
+	}
+	if _, ok := s.TTL("b"); !ok {
+		t.Fatal("expected b to carry a ttl")
+	}
+	if s.Has("old") {
+		t.Fatal("expected old to be deleted")
+	}
+
+	// a bad mutation rejects the whole batch
+	err = c.Batch(ctx,
+		&Mutation{Type: MutationSet, Key: "c", Value: []byte("3")},
+		&Mutation{Type: MutationSet},
+	)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	if s.Has("c") {
+		t.Fatal("expected rejected batch to write nothing")
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	c, s := newTestClient(t)
+	ctx := context.Background()
+
+	s.Set("user:1", "a")
+	if err := c.CreateSnapshot(ctx, "june"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateSnapshot(ctx, "june"); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists, got %v", err)
+	}
+	s.Set("user:1", "changed")
+	s.Set("user:2", "b")
+
+	if v, ok, err := c.GetFrom(ctx, "june", "user:1"); err != nil || !ok || v != "a" {
+		t.Fatalf("expected user:1 = a in the snapshot, got %q, %v, %v", v, ok, err)
+	}
+	if ok, err := c.HasFrom(ctx, "june", "user:2"); err != nil || ok {
+		t.Fatalf("expected user:2 not in the snapshot, got %v, %v", ok, err)
+	}
+	keys, err := c.KeysFrom(ctx, "june", "user:")
+	if err != nil || len(keys) != 1 || keys[0] != "user:1" {
+		t.Fatalf("expected [user:1] in the snapshot, got %v, %v", keys, err)
+	}
+	if v, _, _ := c.Get(ctx, "user:1"); v != "changed" {
+		t.Fatalf("expected the live store at head, got %q", v)
+	}
+
+	if err := c.DropSnapshot(ctx, "june"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.GetFrom(ctx, "june", "user:1"); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound after the drop, got %v", err)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	c, s := newTestClient(t)
+	ctx := WithIdempotencyKey(context.Background(), "batch-1")
+
+	if err := c.Batch(ctx, &Mutation{Type: MutationSet, Key: "a", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	s.Set("a", "2")
+
+	// the retry is acknowledged but not applied again
+	if err := c.Batch(ctx, &Mutation{Type: MutationSet, Key: "a", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("a"); v != "2" {
+		t.Fatalf("retried batch was applied: a=%q", v)
+	}
+
+	if err := c.Set(WithIdempotencyKey(context.Background(), "set-1"), "b", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Applied("set-1") {
+		t.Fatal("expected Set to log its idempotency key")
+	}
+}
+
+// Test that a generated service registered beside Walrus keeps working
+// with the standard proto codec
+func TestOtherServices(t *testing.T) {
+	c, _ := newTestClient(t)
+
+	resp, err := healthpb.NewHealthClient(c.cc).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("expected the health check to serve, got %v, %v", resp, err)
+	}
+}
@@ -0,0 +1,521 @@
+package grpcapi
+
+import (
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Messages from walrus.proto, encoded by hand with protowire so the
+// package needs no generated code. Field numbers must match the .proto.
+
+type message interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+// codec is gRPC's proto codec with this service's messages encoded by
+// hand. It keeps the "proto" name so the wire format is plain protobuf,
+// and hands every other message to the standard codec, so services
+// registered beside this one, such as health checks and reflection,
+// work as they would on any server.
+type codec struct{}
+
+func (codec) Marshal(v any) (mem.BufferSlice, error) {
+	m, ok := v.(message)
+	if !ok {
+		return encoding.GetCodecV2(proto.Name).Marshal(v)
+	}
+	return mem.BufferSlice{mem.SliceBuffer(m.marshal())}, nil
+}
+
+func (codec) Unmarshal(data mem.BufferSlice, v any) error {
+	m, ok := v.(message)
+	if !ok {
+		return encoding.GetCodecV2(proto.Name).Unmarshal(data, v)
+	}
+	return m.unmarshal(data.Materialize())
+}
+
+func (codec) Name() string { return proto.Name }
+
+type empty struct{}
+
+func (*empty) marshal() []byte { return nil }
+
+func (*empty) unmarshal(b []byte) error {
+	return readFields(b, func(protowire.Number, protowire.Type, []byte) int { return 0 })
+}
+
+type setRequest struct {
+	Key   string
+	Value []byte
+	TTLMs int64
+}
+
+func (m *setRequest) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Key)
+	b = appendBytes(b, 2, m.Value)
+	b = appendVarint(b, 3, uint64(m.TTLMs))
+	return b
+}
+
+func (m *setRequest) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Key)
+		case 2:
+			return consumeBytes(typ, b, &m.Value)
+		case 3:
+			var v uint64
+			n := consumeVarint(typ, b, &v)
+			m.TTLMs = int64(v)
+			return n
+		}
+		return 0
+	})
+}
+
+type getRequest struct {
+	Key      string
+	Snapshot string
+}
+
+func (m *getRequest) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Key)
+	b = appendString(b, 2, m.Snapshot)
+	return b
+}
+
+func (m *getRequest) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Key)
+		case 2:
+			return consumeString(typ, b, &m.Snapshot)
+		}
+		return 0
+	})
+}
+
+type getResponse struct {
+	Value []byte
+	Found bool
+}
+
+func (m *getResponse) marshal() []byte {
+	var b []byte
+	b = appendBytes(b, 1, m.Value)
+	b = appendBool(b, 2, m.Found)
+	return b
+}
+
+func (m *getResponse) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeBytes(typ, b, &m.Value)
+		case 2:
+			return consumeBool(typ, b, &m.Found)
+		}
+		return 0
+	})
+}
+
+type keyRequest struct {
+	Key      string
+	Snapshot string // Has only
+}
+
+func (m *keyRequest) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Key)
+	b = appendString(b, 2, m.Snapshot)
+	return b
+}
+
+func (m *keyRequest) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Key)
+		case 2:
+			return consumeString(typ, b, &m.Snapshot)
+		}
+		return 0
+	})
+}
+
+type hasResponse struct {
+	Found bool
+}
+
+func (m *hasResponse) marshal() []byte {
+	return appendBool(nil, 1, m.Found)
+}
+
+func (m *hasResponse) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeBool(typ, b, &m.Found)
+		}
+		return 0
+	})
+}
+
+type keysRequest struct {
+	Prefix   string
+	Snapshot string
+}
+
+func (m *keysRequest) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Prefix)
+	b = appendString(b, 2, m.Snapshot)
+	return b
+}
+
+func (m *keysRequest) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Prefix)
+		case 2:
+			return consumeString(typ, b, &m.Snapshot)
+		}
+		return 0
+	})
+}
+
+type snapshotRequest struct {
+	Name string
+}
+
+func (m *snapshotRequest) marshal() []byte {
+	return appendString(nil, 1, m.Name)
+}
+
+func (m *snapshotRequest) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeString(typ, b, &m.Name)
+		}
+		return 0
+	})
+}
+
+type keysResponse struct {
+	Keys []string
+}
+
+func (m *keysResponse) marshal() []byte {
+	var b []byte
+	for _, k := range m.Keys {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, k)
+	}
+	return b
+}
+
+func (m *keysResponse) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			var k string
+			n := consumeString(typ, b, &k)
+			if n > 0 {
+				m.Keys = append(m.Keys, k)
+			}
+			return n
+		}
+		return 0
+	})
+}
+
+type scanRequest struct {
+	Prefix string
+	Since  uint64
+}
+
+func (m *scanRequest) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Prefix)
+	b = appendVarint(b, 2, m.Since)
+	return b
+}
+
+func (m *scanRequest) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Prefix)
+		case 2:
+			return consumeVarint(typ, b, &m.Since)
+		}
+		return 0
+	})
+}
+
+// Entry is a key Scan streams, with its value, the milliseconds left of
+// its TTL, 0 if it has none, and its version, the LSN of the record that
+// last wrote it.
+type Entry struct {
+	Key     string
+	Value   []byte
+	TTLMs   int64
+	Version uint64
+}
+
+func (m *Entry) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Key)
+	b = appendBytes(b, 2, m.Value)
+	b = appendVarint(b, 3, uint64(m.TTLMs))
+	b = appendVarint(b, 4, m.Version)
+	return b
+}
+
+func (m *Entry) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		var v uint64
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Key)
+		case 2:
+			return consumeBytes(typ, b, &m.Value)
+		case 3:
+			n := consumeVarint(typ, b, &v)
+			m.TTLMs = int64(v)
+			return n
+		case 4:
+			return consumeVarint(typ, b, &m.Version)
+		}
+		return 0
+	})
+}
+
+type scanResponse struct {
+	Entries []*Entry
+	LSN     uint64
+}
+
+func (m *scanResponse) marshal() []byte {
+	var b []byte
+	for _, e := range m.Entries {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, e.marshal())
+	}
+	b = appendVarint(b, 2, m.LSN)
+	return b
+}
+
+func (m *scanResponse) unmarshal(b []byte) error {
+	var err error
+	perr := readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			var raw []byte
+			n := consumeBytes(typ, b, &raw)
+			if n > 0 {
+				e := &Entry{}
+				if uerr := e.unmarshal(raw); uerr != nil && err == nil {
+					err = uerr
+				}
+				m.Entries = append(m.Entries, e)
+			}
+			return n
+		case 2:
+			return consumeVarint(typ, b, &m.LSN)
+		}
+		return 0
+	})
+	if perr != nil {
+		return perr
+	}
+	return err
+}
+
+// MutationType says what a Mutation does.
+type MutationType int32
+
+const (
+	MutationSet    MutationType = 0
+	MutationDelete MutationType = 1
+)
+
+// Mutation is one write in a Batch. TTLMs only applies to sets; 0 means
+// no expiry.
+type Mutation struct {
+	Type  MutationType
+	Key   string
+	Value []byte
+	TTLMs int64
+}
+
+func (m *Mutation) marshal() []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(m.Type))
+	b = appendString(b, 2, m.Key)
+	b = appendBytes(b, 3, m.Value)
+	b = appendVarint(b, 4, uint64(m.TTLMs))
+	return b
+}
+
+func (m *Mutation) unmarshal(b []byte) error {
+	return readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		var v uint64
+		switch num {
+		case 1:
+			n := consumeVarint(typ, b, &v)
+			m.Type = MutationType(v)
+			return n
+		case 2:
+			return consumeString(typ, b, &m.Key)
+		case 3:
+			return consumeBytes(typ, b, &m.Value)
+		case 4:
+			n := consumeVarint(typ, b, &v)
+			m.TTLMs = int64(v)
+			return n
+		}
+		return 0
+	})
+}
+
+type batchRequest struct {
+	Mutations []*Mutation
+}
+
+func (m *batchRequest) marshal() []byte {
+	var b []byte
+	for _, mut := range m.Mutations {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, mut.marshal())
+	}
+	return b
+}
+
+func (m *batchRequest) unmarshal(b []byte) error {
+	var err error
+	perr := readFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num != 1 {
+			return 0
+		}
+		var raw []byte
+		n := consumeBytes(typ, b, &raw)
+		if n > 0 {
+			mut := &Mutation{}
+			if e := mut.unmarshal(raw); e != nil && err == nil {
+				err = e
+			}
+			m.Mutations = append(m.Mutations, mut)
+		}
+		return n
+	})
+	if perr != nil {
+		return perr
+	}
+	return err
+}
+
+// readFields calls field for each field in b. field returns how many
+// bytes of the value it consumed, 0 to skip the field as unknown, or a
+// negative protowire error.
+func readFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n = field(num, typ, b)
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeString(typ protowire.Type, b []byte, dst *string) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+	v, n := protowire.ConsumeString(b)
+	if n >= 0 {
+		*dst = v
+	}
+	return n
+}
+
+func consumeBytes(typ protowire.Type, b []byte, dst *[]byte) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n >= 0 {
+		*dst = append([]byte(nil), v...)
+	}
+	return n
+}
+
+func consumeVarint(typ protowire.Type, b []byte, dst *uint64) int {
+	if typ != protowire.VarintType {
+		return 0
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n >= 0 {
+		*dst = v
+	}
+	return n
+}
+
+func consumeBool(typ protowire.Type, b []byte, dst *bool) int {
+	var v uint64
+	n := consumeVarint(typ, b, &v)
+	if n > 0 {
+		*dst = v != 0
+	}
+	return n
+}
+
+// proto3 leaves fields at their zero value off the wire
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarint(b, num, 1)
+}
@@ -0,0 +1,104 @@
+// Package hash is the hash of keys that walrus keeps or compares beyond
+// one process, such as shard placement, bloom filters and per-key
+// digests, so that they agree with one another and with what earlier
+// versions wrote. Each function is a Version, which whatever persists a
+// hash records next to it:
+//
+//	h := hash.Current
+//	idx.Version, idx.Sum = h, h.String64(k)
+//	...
+//	ok := idx.Version.String64(k) == idx.Sum // however old the index
+//
+// A Version's function never changes; a better one comes as a new
+// Version and becomes Current, and the old ones keep working for data
+// written under them. Tables that never leave the process, like the
+// store's conflict slots, are better off with hash/maphash, and
+// Store.Digest, which must not collide even when made to, is SHA-256.
+package hash
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Version names a hash function. The numbers are persisted and never
+// reused.
+type Version uint8
+
+const (
+	FNV1a Version = 1 // 64-bit FNV-1a
+	XXH64 Version = 2 // xxHash64 with seed 0
+
+	// Current is what new data is hashed with.
+	Current = XXH64
+)
+
+// Sum64 returns the hash of b. It panics on a Version not listed above,
+// which Parse and Valid keep out of the way of persisted data.
+func (v Version) Sum64(b []byte) uint64 {
+	switch v {
+	case FNV1a:
+		h := fnv.New64a()
+		h.Write(b)
+		return h.Sum64()
+	case XXH64:
+		return xxhash.Sum64(b)
+	}
+	panic(fmt.Sprintf("hash: unknown version %d", v))
+}
+
+// String64 is Sum64 of s, without copying it.
+func (v Version) String64(s string) uint64 {
+	if v == XXH64 {
+		return xxhash.Sum64String(s)
+	}
+	return v.Sum64([]byte(s))
+}
+
+// Shard returns which of n shards key belongs to, in [0, n), by jump
+// consistent hashing: going from n to n+1 shards moves only the keys
+// that land on the new one, about 1/(n+1) of them.
+func (v Version) Shard(key string, n int) int {
+	if n <= 0 {
+		panic(fmt.Sprintf("hash: %d shards", n))
+	}
+	h := v.String64(key)
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		h = h*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(1<<31) / float64(h>>33+1)))
+	}
+	return int(b)
+}
+
+// Valid reports whether v is a Version this build knows.
+func (v Version) Valid() bool {
+	return v == FNV1a || v == XXH64
+}
+
+func (v Version) String() string {
+	switch v {
+	case FNV1a:
+		return "fnv1a"
+	case XXH64:
+		return "xxhash"
+	}
+	return fmt.Sprintf("version(%d)", uint8(v))
+}
+
+// Parse parses "fnv1a" or "xxhash"; empty is Current.
+func Parse(s string) (Version, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return Current, nil
+	case "fnv1a", "fnv":
+		return FNV1a, nil
+	case "xxhash", "xxh64":
+		return XXH64, nil
+	}
+	return 0, fmt.Errorf("unknown hash %q", s)
+}
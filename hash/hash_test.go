@@ -0,0 +1,62 @@
+package hash
+
+import (
+	"testing"
+)
+
+// Test that every version hashes to the values it always has, as these
+// are persisted
+func TestVersionsAreStable(t *testing.T) {
+	for _, tc := range []struct {
+		v    Version
+		in   string
+		want uint64
+	}{
+		{FNV1a, "", 0xcbf29ce484222325},
+		{FNV1a, "a", 0xaf63dc4c8601ec8c},
+		{XXH64, "", 0xef46db3751d8e999},
+		{XXH64, "a", 0xd24ec4f1a98c6e5b},
+	} {
+		if got := tc.v.String64(tc.in); got != tc.want {
+			t.Fatalf("%v(%q): expected %#x, got %#x", tc.v, tc.in, tc.want, got)
+		}
+		if got := tc.v.Sum64([]byte(tc.in)); got != tc.want {
+			t.Fatalf("%v(%q) of bytes: expected %#x, got %#x", tc.v, tc.in, tc.want, got)
+		}
+	}
+}
+
+// Test that adding a shard only moves keys onto it
+func TestShard(t *testing.T) {
+	moved := 0
+	for i := range 10000 {
+		key := "user:" + string(rune('a'+i%26)) + string(rune(i))
+		before, after := Current.Shard(key, 10), Current.Shard(key, 11)
+		if before < 0 || before >= 10 {
+			t.Fatalf("expected a shard in [0, 10), got %d", before)
+		}
+		if before != after {
+			if after != 10 {
+				t.Fatalf("expected %q to stay on %d or move to 10, got %d", key, before, after)
+			}
+			moved++
+		}
+	}
+	if moved < 600 || moved > 1200 {
+		t.Fatalf("expected about 1/11 of the keys to move, got %d of 10000", moved)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for in, want := range map[string]Version{"": Current, "fnv1a": FNV1a, "XXHash": XXH64} {
+		if v, err := Parse(in); err != nil || v != want {
+			t.Fatalf("Parse(%q): expected %v, got %v, %v", in, want, v, err)
+		}
+	}
+	if _, err := Parse("md5"); err == nil {
+		t.Fatal("expected an unknown hash to be rejected")
+	}
+	if Version(9).Valid() || !Current.Valid() {
+		t.Fatal("expected only known versions to be valid")
+	}
+}
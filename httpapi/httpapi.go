@@ -0,0 +1,275 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+// largest value accepted in a PUT body
+const maxValueSize = 32 * 1024 * 1024
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	replayedHeader       = "Idempotent-Replayed"
+)
+
+// Headers naming who a write is made for, logged with it as its
+// store.Caller. They are taken as sent, so a server exposed to untrusted
+// clients should sit behind a proxy that sets them.
+const (
+	userHeader    = "X-User-ID"
+	requestHeader = "X-Request-ID"
+)
+
+// Handler serves a Store over HTTP:
+//
+//	GET    /keys/{key}   value as the response body, 404 if missing
+//	PUT    /keys/{key}   request body becomes the value; ?ttl=30s expires it
+//	DELETE /keys/{key}   204, or 404 if missing
+//	GET    /keys         JSON array of keys, optionally ?prefix=
+//	POST   /commit       flush buffered writes to disk
+//
+//	PUT    /snapshots/{name}   freeze the store as it is now, 409 if taken
+//	DELETE /snapshots/{name}   204, or 404 if missing
+//	GET    /snapshots          JSON array of snapshots, oldest first
+//
+// The GETs of /keys read a snapshot instead of the live store with
+// ?snapshot=name, and answer 404 if there is no such snapshot.
+//
+// PUT and DELETE accept an Idempotency-Key header. A retry carrying the
+// same key within store.DefaultIdempotencyWindow is answered 204 with
+// Idempotent-Replayed: true and writes nothing.
+//
+// PUT and DELETE log the X-User-ID and X-Request-ID headers, when sent,
+// with their writes; see store.Caller.
+type Handler struct {
+	store *store.Store
+	mux   *http.ServeMux
+}
+
+func New(s *store.Store) *Handler {
+	h := &Handler{
+		store: s,
+		mux:   http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("GET /keys/{key}", h.get)
+	h.mux.HandleFunc("PUT /keys/{key}", h.put)
+	h.mux.HandleFunc("DELETE /keys/{key}", h.delete)
+	h.mux.HandleFunc("GET /keys", h.list)
+	h.mux.HandleFunc("POST /commit", h.commit)
+	h.mux.HandleFunc("PUT /snapshots/{name}", h.createSnapshot)
+	h.mux.HandleFunc("DELETE /snapshots/{name}", h.dropSnapshot)
+	h.mux.HandleFunc("GET /snapshots", h.listSnapshots)
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := store.Caller{User: r.Header.Get(userHeader), Request: r.Header.Get(requestHeader)}
+	if c != (store.Caller{}) {
+		r = r.WithContext(store.WithCaller(r.Context(), c))
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// source is what the reads run against: the store or a snapshot.
+type source interface {
+	Get(key string) (string, bool)
+	Keys() []string
+}
+
+// source returns the snapshot named by ?snapshot=, or the store without
+// one. It answers the request itself if the snapshot doesn't exist.
+func (h *Handler) source(w http.ResponseWriter, r *http.Request) (source, bool) {
+	name := r.URL.Query().Get("snapshot")
+	if name == "" {
+		return h.store, true
+	}
+
+	sn, err := h.store.Snapshot(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "snapshot not found")
+		return nil, false
+	}
+	return sn, true
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	src, ok := h.source(w, r)
+	if !ok {
+		return
+	}
+
+	value, ok := src.Get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, "key not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.WriteString(w, value)
+}
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	var ttl time.Duration
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "ttl must be a positive duration such as 30s")
+			return
+		}
+		ttl = d
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "value too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if idemKey := r.Header.Get(idempotencyKeyHeader); idemKey != "" {
+		b := &store.WriteBatch{}
+		b.SetWithTTL(key, string(body), ttl)
+		h.writeOnce(w, r, idemKey, b)
+		return
+	}
+
+	if err := h.store.SetWithTTLCtx(r.Context(), key, string(body), ttl); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) delete(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	idemKey := r.Header.Get(idempotencyKeyHeader)
+
+	// a retry of a delete that worked must not turn into a 404
+	if idemKey != "" && h.store.Applied(idemKey) {
+		w.Header().Set(replayedHeader, "true")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !h.store.Has(key) {
+		writeError(w, http.StatusNotFound, "key not found")
+		return
+	}
+
+	if idemKey != "" {
+		b := &store.WriteBatch{}
+		b.Delete(key)
+		h.writeOnce(w, r, idemKey, b)
+		return
+	}
+
+	if err := h.store.DeleteCtx(r.Context(), key); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeOnce applies b unless a request with idemKey already was, and
+// answers 204 either way.
+func (h *Handler) writeOnce(w http.ResponseWriter, r *http.Request, idemKey string, b *store.WriteBatch) {
+	applied, err := h.store.WriteIdempotentCtx(r.Context(), idemKey, 0, b)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !applied {
+		w.Header().Set(replayedHeader, "true")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	src, ok := h.source(w, r)
+	if !ok {
+		return
+	}
+
+	keys := []string{}
+	for _, key := range src.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func (h *Handler) commit(w http.ResponseWriter, r *http.Request) {
+	h.store.Commit()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) createSnapshot(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.store.CreateSnapshot(r.PathValue("name")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrSnapshotExists) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) dropSnapshot(w http.ResponseWriter, r *http.Request) {
+	if err := h.store.DropSnapshot(r.PathValue("name")); err != nil {
+		writeError(w, http.StatusNotFound, "snapshot not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type snapshotInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Keys    int       `json:"keys"`
+}
+
+func (h *Handler) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	list := []snapshotInfo{}
+	for _, sn := range h.store.Snapshots() {
+		list = append(list, snapshotInfo{Name: sn.Name(), Created: sn.Created(), Keys: sn.Len()})
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,237 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+func newTestHandler(t *testing.T) (*httptest.Server, *store.Store) {
+	t.Helper()
+
+	w, err := wal.Open(t.TempDir(), 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.New(w)
+
+	ts := httptest.NewServer(New(s))
+	t.Cleanup(func() {
+		ts.Close()
+		s.Close()
+	})
+
+	return ts, s
+}
+
+func request(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(data)
+}
+
+func TestPutGetDelete(t *testing.T) {
+	ts, _ := newTestHandler(t)
+
+	if code, _ := request(t, "PUT", ts.URL+"/keys/name", "jerk"); code != http.StatusNoContent {
+		t.Fatalf("PUT: expected 204, got %d", code)
+	}
+
+	code, body := request(t, "GET", ts.URL+"/keys/name", "")
+	if code != http.StatusOK || body != "jerk" {
+		t.Fatalf("GET: expected 200 jerk, got %d %q", code, body)
+	}
+
+	if code, _ := request(t, "DELETE", ts.URL+"/keys/name", ""); code != http.StatusNoContent {
+		t.Fatalf("DELETE: expected 204, got %d", code)
+	}
+
+	if code, _ := request(t, "GET", ts.URL+"/keys/name", ""); code != http.StatusNotFound {
+		t.Fatalf("GET after delete: expected 404, got %d", code)
+	}
+
+	if code, _ := request(t, "DELETE", ts.URL+"/keys/name", ""); code != http.StatusNotFound {
+		t.Fatalf("DELETE missing: expected 404, got %d", code)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	ts, s := newTestHandler(t)
+
+	s.Set("user:2", "b")
+	s.Set("user:1", "a")
+	s.Set("order:1", "c")
+
+	code, body := request(t, "GET", ts.URL+"/keys?prefix=user:", "")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	var keys []string
+	if err := json.Unmarshal([]byte(body), &keys); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(keys, ",") != "user:1,user:2" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestPutWithTTLAndCommit(t *testing.T) {
+	ts, s := newTestHandler(t)
+
+	if code, _ := request(t, "PUT", ts.URL+"/keys/s?ttl=1h", "v"); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+
+	if _, ok := s.TTL("s"); !ok {
+		t.Fatal("expected ttl to be applied")
+	}
+
+	if code, _ := request(t, "PUT", ts.URL+"/keys/s?ttl=soon", "v"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad ttl, got %d", code)
+	}
+
+	if code, _ := request(t, "POST", ts.URL+"/commit", ""); code != http.StatusNoContent {
+		t.Fatalf("expected 204 from commit, got %d", code)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ts, s := newTestHandler(t)
+
+	send := func(method, path, body, key string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := send("PUT", "/keys/name", "jerk", "put-1")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first PUT: got %d replayed=%q", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+
+	// a retry with the same key must not overwrite a later write
+	s.Set("name", "changed")
+	resp = send("PUT", "/keys/name", "jerk", "put-1")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retried PUT: got %d replayed=%q", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+	if v, _ := s.Get("name"); v != "changed" {
+		t.Fatalf("retried PUT was applied: %q", v)
+	}
+
+	if resp := send("DELETE", "/keys/name", "", "del-1"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE: expected 204, got %d", resp.StatusCode)
+	}
+	resp = send("DELETE", "/keys/name", "", "del-1")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retried DELETE: got %d replayed=%q", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+	if resp := send("DELETE", "/keys/name", "", "del-2"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("DELETE missing with a new key: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+// Test that the caller headers are logged with the writes they come with
+func TestCallerHeaders(t *testing.T) {
+	ts, s := newTestHandler(t)
+
+	req, err := http.NewRequest("PUT", ts.URL+"/keys/name", strings.NewReader("jerk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "alice")
+	req.Header.Set("X-Request-ID", "req-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	revs, err := s.History("name", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (store.Caller{User: "alice", Request: "req-1"}); len(revs) != 1 || revs[0].Caller != want {
+		t.Fatalf("expected one revision by %+v, got %+v", want, revs)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	ts, s := newTestHandler(t)
+
+	s.Set("user:1", "a")
+	if code, _ := request(t, "PUT", ts.URL+"/snapshots/june", ""); code != http.StatusNoContent {
+		t.Fatalf("PUT snapshot: expected 204, got %d", code)
+	}
+	if code, _ := request(t, "PUT", ts.URL+"/snapshots/june", ""); code != http.StatusConflict {
+		t.Fatalf("PUT existing snapshot: expected 409, got %d", code)
+	}
+	s.Set("user:1", "changed")
+	s.Set("user:2", "b")
+
+	if code, body := request(t, "GET", ts.URL+"/keys/user:1?snapshot=june", ""); code != http.StatusOK || body != "a" {
+		t.Fatalf("GET from snapshot: expected 200 a, got %d %q", code, body)
+	}
+	if code, body := request(t, "GET", ts.URL+"/keys/user:1", ""); body != "changed" {
+		t.Fatalf("GET from head: expected changed, got %d %q", code, body)
+	}
+	if code, _ := request(t, "GET", ts.URL+"/keys/user:2?snapshot=june", ""); code != http.StatusNotFound {
+		t.Fatalf("GET key newer than the snapshot: expected 404, got %d", code)
+	}
+	if _, body := request(t, "GET", ts.URL+"/keys?prefix=user:&snapshot=june", ""); strings.TrimSpace(body) != `["user:1"]` {
+		t.Fatalf("unexpected snapshot keys %s", body)
+	}
+	if code, _ := request(t, "GET", ts.URL+"/keys?snapshot=nope", ""); code != http.StatusNotFound {
+		t.Fatalf("GET unknown snapshot: expected 404, got %d", code)
+	}
+
+	var list []snapshotInfo
+	_, body := request(t, "GET", ts.URL+"/snapshots", "")
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "june" || list[0].Keys != 1 {
+		t.Fatalf("unexpected snapshots %s", body)
+	}
+
+	if code, _ := request(t, "DELETE", ts.URL+"/snapshots/june", ""); code != http.StatusNoContent {
+		t.Fatalf("DELETE snapshot: expected 204, got %d", code)
+	}
+	if code, _ := request(t, "DELETE", ts.URL+"/snapshots/june", ""); code != http.StatusNotFound {
+		t.Fatalf("DELETE missing snapshot: expected 404, got %d", code)
+	}
+}
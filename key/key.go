@@ -0,0 +1,216 @@
+// Package key builds store keys out of tuples, such as ("user", 42,
+// "profile"), encoded so that keys sort the way their tuples do: element
+// by element, numbers by value rather than by their digits. Scans and
+// ranges over structured keys then return them in order, and the key of
+// a tuple is a prefix of the keys of every longer tuple that starts with
+// it:
+//
+//	s.Set(key.Encode("user", 42, "profile"), profile)
+//	s.Scan(key.Encode("user", 42))   // every key under user 42
+//	s.Range(key.Range("user"))       // every user, in id order
+//
+// Elements may be nil, string, []byte, bool, float32, float64 and any
+// integer type. Elements of different types sort by type, in that order,
+// with every integer type sorting as one.
+package key
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Type tags, in the order the types sort. None is 0, as keys starting
+// with a NUL are reserved by the store.
+const (
+	tagNil    byte = 0x01
+	tagBytes  byte = 0x02
+	tagString byte = 0x03
+	tagInt    byte = 0x15 // [8B big-endian, sign bit flipped]
+	tagUint   byte = 0x16 // [8B big-endian], only above math.MaxInt64
+	tagFloat  byte = 0x21 // [8B IEEE 754, ordered, see floatBits]
+	tagFalse  byte = 0x26
+	tagTrue   byte = 0x27
+)
+
+var ErrInvalid = errors.New("key: not a tuple key")
+
+// Encode returns the key of the tuple parts. It panics on an element of
+// a type it doesn't encode, as that is a mistake in the calling code
+// rather than in its data.
+func Encode(parts ...any) string {
+	var b strings.Builder
+	for _, p := range parts {
+		appendElem(&b, p)
+	}
+	return b.String()
+}
+
+// Range returns the bounds of the keys of every tuple that starts with
+// parts, longer ones included, for Store.Range. Range() bounds every
+// tuple key.
+func Range(parts ...any) (start, end string) {
+	start = Encode(parts...)
+	return start, start + "\xff" // above the tag of any next element
+}
+
+func appendElem(b *strings.Builder, p any) {
+	switch v := p.(type) {
+	case nil:
+		b.WriteByte(tagNil)
+	case []byte:
+		b.WriteByte(tagBytes)
+		appendEscaped(b, string(v))
+	case string:
+		b.WriteByte(tagString)
+		appendEscaped(b, v)
+	case bool:
+		if v {
+			b.WriteByte(tagTrue)
+		} else {
+			b.WriteByte(tagFalse)
+		}
+	case float32:
+		appendFloat(b, float64(v))
+	case float64:
+		appendFloat(b, v)
+	case int:
+		appendInt(b, int64(v))
+	case int8:
+		appendInt(b, int64(v))
+	case int16:
+		appendInt(b, int64(v))
+	case int32:
+		appendInt(b, int64(v))
+	case int64:
+		appendInt(b, v)
+	case uint:
+		appendUint(b, uint64(v))
+	case uint8:
+		appendUint(b, uint64(v))
+	case uint16:
+		appendUint(b, uint64(v))
+	case uint32:
+		appendUint(b, uint64(v))
+	case uint64:
+		appendUint(b, v)
+	default:
+		panic(fmt.Sprintf("key: cannot encode %T", p))
+	}
+}
+
+// appendEscaped writes s ended by a NUL, with the NULs in it written as
+// NUL 0xFF, so a string sorts before every string it is a prefix of.
+func appendEscaped(b *strings.Builder, s string) {
+	for {
+		i := strings.IndexByte(s, 0)
+		if i < 0 {
+			break
+		}
+		b.WriteString(s[:i+1])
+		b.WriteByte(0xff)
+		s = s[i+1:]
+	}
+	b.WriteString(s)
+	b.WriteByte(0)
+}
+
+func appendInt(b *strings.Builder, v int64) {
+	b.WriteByte(tagInt)
+	b.Write(binary.BigEndian.AppendUint64(nil, uint64(v)^(1<<63)))
+}
+
+func appendUint(b *strings.Builder, v uint64) {
+	if v <= math.MaxInt64 {
+		appendInt(b, int64(v))
+		return
+	}
+	b.WriteByte(tagUint)
+	b.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func appendFloat(b *strings.Builder, v float64) {
+	b.WriteByte(tagFloat)
+	b.Write(binary.BigEndian.AppendUint64(nil, floatBits(v)))
+}
+
+// floatBits maps a float's bits so they compare as unsigned integers in
+// the order of the floats: negative ones have every bit flipped, the
+// rest only the sign bit.
+func floatBits(v float64) uint64 {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		return ^bits
+	}
+	return bits | 1<<63
+}
+
+// Decode returns the tuple k is the key of. Integers come back as int64,
+// or uint64 above math.MaxInt64, and floats as float64.
+func Decode(k string) ([]any, error) {
+	var parts []any
+	for len(k) > 0 {
+		tag := k[0]
+		k = k[1:]
+
+		switch tag {
+		case tagNil:
+			parts = append(parts, nil)
+		case tagFalse, tagTrue:
+			parts = append(parts, tag == tagTrue)
+		case tagBytes, tagString:
+			s, rest, ok := cutEscaped(k)
+			if !ok {
+				return nil, ErrInvalid
+			}
+			if tag == tagBytes {
+				parts = append(parts, []byte(s))
+			} else {
+				parts = append(parts, s)
+			}
+			k = rest
+		case tagInt, tagUint, tagFloat:
+			if len(k) < 8 {
+				return nil, ErrInvalid
+			}
+			n := binary.BigEndian.Uint64([]byte(k[:8]))
+			switch tag {
+			case tagInt:
+				parts = append(parts, int64(n^(1<<63)))
+			case tagUint:
+				parts = append(parts, n)
+			default:
+				if n&(1<<63) != 0 {
+					n &^= 1 << 63
+				} else {
+					n = ^n
+				}
+				parts = append(parts, math.Float64frombits(n))
+			}
+			k = k[8:]
+		default:
+			return nil, ErrInvalid
+		}
+	}
+	return parts, nil
+}
+
+// cutEscaped reads a string written by appendEscaped off the front of k.
+func cutEscaped(k string) (s, rest string, ok bool) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(k, 0)
+		if i < 0 {
+			return "", "", false
+		}
+		b.WriteString(k[:i])
+		if i+1 < len(k) && k[i+1] == 0xff {
+			b.WriteByte(0)
+			k = k[i+2:]
+			continue
+		}
+		return b.String(), k[i+1:], true
+	}
+}
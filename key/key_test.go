@@ -0,0 +1,105 @@
+package key
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Test that keys sort in the order of their tuples
+func TestOrder(t *testing.T) {
+	// each sorts after the one before it
+	tuples := [][]any{
+		{},
+		{nil},
+		{[]byte("a")},
+		{""},
+		{"a"},
+		{"a", nil},
+		{"a", "b"},
+		{"a\x00"},
+		{"a\x00", "b"},
+		{"ab"},
+		{"b"},
+		{math.MinInt64},
+		{-1000},
+		{-1},
+		{0},
+		{uint8(1)},
+		{2},
+		{256},
+		{math.MaxInt64},
+		{uint64(math.MaxInt64 + 1)},
+		{uint64(math.MaxUint64)},
+		{math.Inf(-1)},
+		{-2.5},
+		{-0.5},
+		{0.0},
+		{0.5},
+		{float32(2.5)},
+		{math.Inf(1)},
+		{false},
+		{true},
+		{true, "x"},
+	}
+
+	for i := 1; i < len(tuples); i++ {
+		prev, cur := Encode(tuples[i-1]...), Encode(tuples[i]...)
+		if prev >= cur {
+			t.Fatalf("expected %v to sort before %v, got %q >= %q", tuples[i-1], tuples[i], prev, cur)
+		}
+	}
+}
+
+// Test that Decode returns what Encode was given, and rejects other keys
+func TestDecode(t *testing.T) {
+	want := []any{"user", int64(-42), []byte("a\x00b"), nil, 1.5, uint64(math.MaxUint64), true}
+
+	got, err := Decode(Encode(want...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	for _, bad := range []string{"\x00", "\x03abc", "\x15\x00", "plain"} {
+		if _, err := Decode(bad); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected ErrInvalid for %q, got %v", bad, err)
+		}
+	}
+}
+
+// Test that a tuple's key and range cover the longer tuples starting with
+// it and no others
+func TestRange(t *testing.T) {
+	start, end := Range("user", 42)
+
+	for _, in := range [][]any{{"user", 42}, {"user", 42, "profile"}, {"user", 42, true, 7}} {
+		k := Encode(in...)
+		if k < start || k >= end || !strings.HasPrefix(k, start) {
+			t.Fatalf("expected %v inside the range", in)
+		}
+	}
+	for _, out := range [][]any{{"user", 41, "x"}, {"user", 43}, {"user", "42"}, {"users", 42}} {
+		if k := Encode(out...); k >= start && k < end {
+			t.Fatalf("expected %v outside the range", out)
+		}
+	}
+
+	// keys starting with NUL are reserved for the store
+	if k := Encode(nil); k[0] == 0 {
+		t.Fatal("expected no key to start with NUL")
+	}
+}
+
+func TestEncodePanicsOnUnknownType(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	Encode(struct{}{})
+}
@@ -0,0 +1,256 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+var ErrClosed = errors.New("manager is closed")
+
+// Manager supervises several named stores in one process. Each store
+// lives in its own directory under the root, with its own segments, so
+// one can be backed up, restored or dropped without touching the rest;
+// all of their WALs are flushed by one shared scheduler.
+type Manager struct {
+	mu     sync.Mutex
+	root   string
+	opts   wal.Options // template for every store's WAL
+	sched  *wal.Scheduler
+	stores map[string]*store.Store
+	closed bool
+}
+
+// New creates a manager rooted at root. opts is used for every store's
+// WAL; its Dir and Scheduler are filled in by the manager.
+func New(root string, opts wal.Options) (*Manager, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	sched, err := wal.NewScheduler(opts.FlushEvery)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manager{
+		root:   root,
+		opts:   opts,
+		sched:  sched,
+		stores: make(map[string]*store.Store),
+	}, nil
+}
+
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid store name %q", name)
+	}
+
+	return nil
+}
+
+// Open returns the named store, opening and recovering it on first use.
+func (m *Manager) Open(name string) (*store.Store, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	if s, ok := m.stores[name]; ok {
+		return s, nil
+	}
+
+	opts := m.opts
+	opts.Dir = filepath.Join(m.root, name)
+	opts.Scheduler = m.sched
+
+	w, err := wal.OpenWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := store.New(w)
+	if err := s.Recover(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("recover %s: %w", name, err)
+	}
+
+	m.stores[name] = s
+	return s, nil
+}
+
+// Get returns an already open store.
+func (m *Manager) Get(name string) (*store.Store, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.stores[name]
+	return s, ok
+}
+
+// Names returns the open stores in sorted order.
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.stores))
+	for name := range m.stores {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// CloseStore flushes and closes one store. Its data stays on disk and
+// the store can be opened again later.
+func (m *Manager) CloseStore(name string) error {
+	m.mu.Lock()
+	s, ok := m.stores[name]
+	delete(m.stores, name)
+	m.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("store %q is not open", name)
+	}
+
+	return s.Close()
+}
+
+// Backup writes a point-in-time archive of one store's log, the same as
+// store.Backup, without touching the others. A store that isn't open is
+// opened first.
+func (m *Manager) Backup(name string, out io.Writer) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+
+	s, ok := m.Get(name)
+	if !ok {
+		if _, err := os.Stat(filepath.Join(m.root, name)); err != nil {
+			return fmt.Errorf("store %q: %w", name, err)
+		}
+		var err error
+		if s, err = m.Open(name); err != nil {
+			return err
+		}
+	}
+
+	return s.Backup(out)
+}
+
+// Restore unpacks an archive taken by Backup as the named store, which
+// must not be open or hold a log already. The next Open recovers it.
+func (m *Manager) Restore(name string, in io.Reader) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+	if _, ok := m.stores[name]; ok {
+		return fmt.Errorf("store %q is open", name)
+	}
+
+	return wal.RestoreInto(filepath.Join(m.root, name), in)
+}
+
+// Drop closes the named store if it is open and deletes its directory,
+// purging its data for good. The manager's lock is held until the
+// directory is gone, so an Open of the same name can't reopen the store
+// part way through.
+func (m *Manager) Drop(name string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+	if s, ok := m.stores[name]; ok {
+		delete(m.stores, name)
+		if err := s.Close(); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(m.root, name))
+}
+
+// Close closes every store and stops the shared scheduler.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	stores := m.stores
+	m.stores = nil
+	m.mu.Unlock()
+
+	var firstErr error
+	for _, s := range stores {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	m.sched.Stop()
+	return firstErr
+}
+
+// StoreStats is the per-store part of Stats.
+type StoreStats struct {
+	Keys     int
+	Recovery store.RecoveryStats
+}
+
+// Stats aggregates the open stores.
+type Stats struct {
+	Stores   int
+	Keys     int
+	PerStore map[string]StoreStats
+}
+
+func (m *Manager) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := Stats{
+		Stores:   len(m.stores),
+		PerStore: make(map[string]StoreStats, len(m.stores)),
+	}
+
+	for name, s := range m.stores {
+		ss := StoreStats{
+			Keys:     s.Len(),
+			Recovery: s.LastRecovery(),
+		}
+
+		st.Keys += ss.Keys
+		st.PerStore[name] = ss
+	}
+
+	return st
+}
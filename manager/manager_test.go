@@ -0,0 +1,181 @@
+package manager
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+func newTestManager(t *testing.T, root string) *Manager {
+	t.Helper()
+
+	m, err := New(root, wal.Options{
+		FlushEvery:     10 * time.Millisecond,
+		MaxSegmentSize: 1 * 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestOpenIsolatesStores(t *testing.T) {
+	m := newTestManager(t, t.TempDir())
+	defer m.Close()
+
+	a, err := m.Open("tenant-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := m.Open("tenant-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Set("k", "from-a")
+	b.Set("k", "from-b")
+
+	if v, _ := a.Get("k"); v != "from-a" {
+		t.Fatalf("tenant-a sees %q", v)
+	}
+
+	if v, _ := b.Get("k"); v != "from-b" {
+		t.Fatalf("tenant-b sees %q", v)
+	}
+
+	again, err := m.Open("tenant-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != a {
+		t.Fatal("expected Open to return the already open store")
+	}
+
+	if _, err := m.Open("../escape"); err == nil {
+		t.Fatal("expected error for a name with a path separator")
+	}
+}
+
+func TestStatsAndReopen(t *testing.T) {
+	root := t.TempDir()
+	m := newTestManager(t, root)
+
+	a, _ := m.Open("a")
+	b, _ := m.Open("b")
+
+	a.Set("1", "x")
+	a.Set("2", "y")
+	b.Set("3", "z")
+
+	st := m.Stats()
+	if st.Stores != 2 || st.Keys != 3 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	if st.PerStore["a"].Keys != 2 {
+		t.Fatalf("expected 2 keys in a, got %d", st.PerStore["a"].Keys)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Open("a"); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	// data written through the shared scheduler survives a restart
+	m2 := newTestManager(t, root)
+	defer m2.Close()
+
+	a2, err := m2.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := a2.Get("2"); !ok || v != "y" {
+		t.Fatal("store a was not recovered")
+	}
+}
+
+func TestBackupRestoreDrop(t *testing.T) {
+	m := newTestManager(t, t.TempDir())
+	defer m.Close()
+
+	a, _ := m.Open("a")
+	b, _ := m.Open("b")
+	a.Set("k", "from-a")
+	b.Set("k", "from-b")
+
+	var archive bytes.Buffer
+	if err := m.Backup("a", &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Drop("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Get("a"); ok {
+		t.Fatal("expected a dropped store to be closed")
+	}
+	if err := m.Backup("a", io.Discard); err == nil {
+		t.Fatal("expected no backup of a dropped store")
+	}
+
+	if err := m.Restore("b", bytes.NewReader(archive.Bytes())); err == nil {
+		t.Fatal("expected restoring over an open store to fail")
+	}
+	if err := m.Restore("a", &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := m.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := a.Get("k"); v != "from-a" {
+		t.Fatalf("expected the restored store to hold its own data, got %q", v)
+	}
+	if v, _ := b.Get("k"); v != "from-b" {
+		t.Fatalf("expected store b untouched, got %q", v)
+	}
+}
+
+// Test that a store opened while another of its name is being dropped
+// keeps its directory
+func TestDropRacingOpen(t *testing.T) {
+	root := t.TempDir()
+	m := newTestManager(t, root)
+	defer m.Close()
+
+	for range 20 {
+		a, _ := m.Open("a")
+		a.Set("k", "v")
+
+		opened := make(chan error)
+		go func() {
+			_, err := m.Open("a")
+			opened <- err
+		}()
+		if err := m.Drop("a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-opened; err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := m.Get("a"); ok {
+			if _, err := os.Stat(filepath.Join(root, "a")); err != nil {
+				t.Fatalf("expected an open store to keep its directory: %v", err)
+			}
+		}
+		m.Drop("a")
+	}
+}
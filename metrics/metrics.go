@@ -0,0 +1,128 @@
+// Package metrics exports a Store's Stats to Prometheus and expvar.
+package metrics
+
+import (
+	"expvar"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "walrus"
+
+var (
+	opsDesc = prometheus.NewDesc(namespace+"_ops_total",
+		"Operations served, by type.", []string{"op"}, nil)
+	keysDesc = prometheus.NewDesc(namespace+"_keys",
+		"Live keys in the store.", nil, nil)
+	memoryDesc = prometheus.NewDesc(namespace+"_memory_bytes",
+		"Estimated bytes held by keys and values.", nil, nil)
+	memoryLimitDesc = prometheus.NewDesc(namespace+"_memory_limit_bytes",
+		"Limit on the estimated memory, 0 for none.", nil, nil)
+	memoryRejectedDesc = prometheus.NewDesc(namespace+"_memory_rejected_total",
+		"Writes refused for taking the store past its memory limit.", nil, nil)
+	recoveryDesc = prometheus.NewDesc(namespace+"_recovery_duration_seconds",
+		"How long the last recovery took.", nil, nil)
+
+	appendsDesc = prometheus.NewDesc(namespace+"_wal_appends_total",
+		"Records appended to the WAL.", nil, nil)
+	bytesDesc = prometheus.NewDesc(namespace+"_wal_written_bytes_total",
+		"Bytes written to WAL segments.", nil, nil)
+	bufferedDesc = prometheus.NewDesc(namespace+"_wal_buffered_bytes",
+		"Bytes appended but not yet written.", nil, nil)
+	segmentsDesc = prometheus.NewDesc(namespace+"_wal_segments",
+		"Segment files on disk.", nil, nil)
+	flushDesc = prometheus.NewDesc(namespace+"_wal_flush_duration_seconds",
+		"Time to write the WAL buffer to the OS.", nil, nil)
+	syncDesc = prometheus.NewDesc(namespace+"_wal_sync_duration_seconds",
+		"Time to fsync the active segment.", nil, nil)
+	stallsDesc = prometheus.NewDesc(namespace+"_wal_stalls_total",
+		"Appends held up by a full WAL buffer.", nil, nil)
+	stallTimeDesc = prometheus.NewDesc(namespace+"_wal_stall_seconds_total",
+		"Time appends spent waiting for room in the WAL buffer.", nil, nil)
+	stallTimeoutsDesc = prometheus.NewDesc(namespace+"_wal_stall_timeouts_total",
+		"Appends that gave up with ErrWriteStall.", nil, nil)
+)
+
+// Collector is a prometheus.Collector that reads Store.Stats on every
+// scrape. Counters are totals, so rate() gives ops per second:
+//
+//	prometheus.MustRegister(metrics.NewCollector(s))
+//	http.Handle("/metrics", promhttp.Handler())
+type Collector struct {
+	store *store.Store
+}
+
+func NewCollector(s *store.Store) *Collector {
+	return &Collector{store: s}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		opsDesc, keysDesc, memoryDesc, memoryLimitDesc, memoryRejectedDesc, recoveryDesc,
+		appendsDesc, bytesDesc, bufferedDesc, segmentsDesc, flushDesc, syncDesc,
+		stallsDesc, stallTimeDesc, stallTimeoutsDesc,
+	} {
+		ch <- d
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	st, err := c.store.Stats()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(segmentsDesc, err)
+		return
+	}
+
+	for op, n := range map[string]uint64{
+		"get":    st.Ops.Gets,
+		"scan":   st.Ops.Scans,
+		"set":    st.Ops.Sets,
+		"delete": st.Ops.Deletes,
+		"batch":  st.Ops.Batches,
+		"reset":  st.Ops.Resets,
+	} {
+		ch <- prometheus.MustNewConstMetric(opsDesc, prometheus.CounterValue, float64(n), op)
+	}
+
+	ch <- prometheus.MustNewConstMetric(keysDesc, prometheus.GaugeValue, float64(st.Keys))
+	ch <- prometheus.MustNewConstMetric(memoryDesc, prometheus.GaugeValue, float64(st.Memory))
+	ch <- prometheus.MustNewConstMetric(memoryLimitDesc, prometheus.GaugeValue, float64(st.MemoryLimit))
+	ch <- prometheus.MustNewConstMetric(memoryRejectedDesc, prometheus.CounterValue, float64(st.MemoryRejected))
+	ch <- prometheus.MustNewConstMetric(recoveryDesc, prometheus.GaugeValue, st.Recovery.Duration.Seconds())
+
+	ch <- prometheus.MustNewConstMetric(appendsDesc, prometheus.CounterValue, float64(st.WAL.Appends))
+	ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.CounterValue, float64(st.WAL.BytesWritten))
+	ch <- prometheus.MustNewConstMetric(bufferedDesc, prometheus.GaugeValue, float64(st.WAL.BufferedBytes))
+	ch <- prometheus.MustNewConstMetric(segmentsDesc, prometheus.GaugeValue, float64(st.WAL.Segments))
+	ch <- histogram(flushDesc, st.WAL.FlushLatency)
+	ch <- histogram(syncDesc, st.WAL.SyncLatency)
+	ch <- prometheus.MustNewConstMetric(stallsDesc, prometheus.CounterValue, float64(st.WAL.Stalls))
+	ch <- prometheus.MustNewConstMetric(stallTimeDesc, prometheus.CounterValue, st.WAL.StallTime.Seconds())
+	ch <- prometheus.MustNewConstMetric(stallTimeoutsDesc, prometheus.CounterValue, float64(st.WAL.StallTimeouts))
+}
+
+// histogram converts a wal.Histogram, whose buckets don't overlap, into
+// Prometheus' cumulative ones.
+func histogram(desc *prometheus.Desc, h wal.Histogram) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.Bounds))
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		buckets[bound.Seconds()] = cumulative
+	}
+	return prometheus.MustNewConstHistogram(desc, h.Count, h.Sum.Seconds(), buckets)
+}
+
+// PublishExpvar publishes s.Stats under name on /debug/vars. Like
+// expvar.Publish it panics if name is already taken.
+func PublishExpvar(name string, s *store.Store) {
+	expvar.Publish(name, expvar.Func(func() any {
+		st, err := s.Stats()
+		if err != nil {
+			return map[string]string{"error": err.Error()}
+		}
+		return st
+	}))
+}
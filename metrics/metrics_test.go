@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	w, err := wal.Open(t.TempDir(), 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.New(w)
+	defer s.Close()
+
+	s.Set("a", "1")
+	s.Set("b", "2")
+	s.Commit()
+
+	c := NewCollector(s)
+	if err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP walrus_keys Live keys in the store.
+# TYPE walrus_keys gauge
+walrus_keys 2
+# HELP walrus_wal_appends_total Records appended to the WAL.
+# TYPE walrus_wal_appends_total counter
+walrus_wal_appends_total 2
+# HELP walrus_wal_stalls_total Appends held up by a full WAL buffer.
+# TYPE walrus_wal_stalls_total counter
+walrus_wal_stalls_total 0
+`), "walrus_keys", "walrus_wal_appends_total", "walrus_wal_stalls_total"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := testutil.CollectAndCount(c, "walrus_ops_total"); n != 6 {
+		t.Fatalf("expected a series per op type, got %d", n)
+	}
+	if problems, err := testutil.CollectAndLint(c); err != nil || len(problems) > 0 {
+		t.Fatalf("lint: %v %v", problems, err)
+	}
+}
@@ -0,0 +1,125 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// ErrLSNUnavailable is why a follower stops when the primary has deleted
+// the records it would resume from and doesn't bootstrap followers. Its
+// store has to be started over, by bootstrapping or from a backup.
+var ErrLSNUnavailable = errors.New("replication: the primary no longer has the LSN to resume from")
+
+// DefaultRetryInterval is how long a follower waits before reconnecting
+// to a primary it lost.
+const DefaultRetryInterval = time.Second
+
+// Follower applies a primary's records to a local store, which it keeps
+// read-only while running. The store's records keep the primary's LSNs,
+// so a restarted follower resumes where its own log ends. One with
+// nothing logged yet asks to bootstrap from a snapshot, which a primary
+// may send rather than its whole log. It should have a data directory of
+// its own that nothing else writes to.
+type Follower struct {
+	store *store.Store
+	addr  string
+	retry time.Duration
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+func NewFollower(s *store.Store, addr string) *Follower {
+	return &Follower{
+		store: s,
+		addr:  addr,
+		retry: DefaultRetryInterval,
+	}
+}
+
+// Run follows the primary until ctx is done, reconnecting whenever the
+// stream breaks, and returns ctx's error. A record the store can't apply
+// stops replication, since skipping it would let the follower diverge,
+// and so does ErrLSNUnavailable, with which reconnecting won't help.
+func (f *Follower) Run(ctx context.Context) error {
+	f.store.SetReadOnly(true)
+
+	for {
+		err := f.follow(ctx)
+		if errors.Is(err, store.ErrUnappliable) || errors.Is(err, ErrLSNUnavailable) {
+			f.setErr(err)
+			return err
+		}
+		f.setErr(err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(f.retry):
+		}
+	}
+}
+
+// Err returns why the last connection to the primary ended, if it has.
+func (f *Follower) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.lastErr
+}
+
+func (f *Follower) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lastErr = err
+}
+
+// follow streams from the primary once, until the connection drops.
+func (f *Follower) follow(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", f.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// 0 asks for a bootstrap, which comes as records without an LSN but
+	// the last
+	var hello [8]byte
+	next := f.store.LastLSN() + 1
+	if next > 1 {
+		binary.BigEndian.PutUint64(hello[:], next)
+	}
+	if _, err := conn.Write(hello[:]); err != nil {
+		return err
+	}
+
+	in := bufio.NewReader(conn)
+	status, err := in.ReadByte()
+	if err != nil {
+		return err
+	}
+	if status == statusUnavailable {
+		return fmt.Errorf("%w: %d", ErrLSNUnavailable, next)
+	}
+
+	return wal.ReadRecords(in, func(rec *wal.Record) error {
+		if rec.LSN != 0 && rec.LSN <= f.store.LastLSN() {
+			return nil // resent after a reconnect
+		}
+		return f.store.ApplyReplicated(rec)
+	})
+}
@@ -0,0 +1,251 @@
+// Package replication ships a WAL to followers over TCP. It is
+// asynchronous: the primary sends records once they have been flushed
+// to its segments, and a follower may lag behind by however much is in
+// flight.
+//
+// A follower opens a connection and sends the LSN it wants to resume
+// from as 8 big-endian bytes. The primary answers with a status byte and,
+// unless that is statusUnavailable, streams every record from that LSN
+// on, framed as by wal.WriteRecord, until either side hangs up.
+//
+// A follower with nothing logged sends 0 instead. A primary bootstrapping
+// followers (see SetBootstrap) answers with the records of
+// store.Bootstrap, a snapshot of its state, and streams on from the LSN
+// after it; otherwise 0 streams the whole log. One asking for records the
+// primary has deleted is bootstrapped the same way, the snapshot's reset
+// replacing what it had, or without bootstrapping answered with
+// statusUnavailable, and gets ErrLSNUnavailable.
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+var ErrPrimaryClosed = errors.New("primary closed")
+
+// The status byte answering a follower's hello.
+const (
+	statusStreaming   byte = 0 // the records follow
+	statusUnavailable byte = 1 // the log no longer has the LSN asked for
+)
+
+// DefaultPollInterval is how often a caught-up follower's stream looks
+// for newly flushed records.
+const DefaultPollInterval = 50 * time.Millisecond
+
+// Primary serves a WAL to followers.
+type Primary struct {
+	wal  *wal.WAL
+	poll time.Duration
+	boot *store.Store // see SetBootstrap
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewPrimary(w *wal.WAL) *Primary {
+	return &Primary{
+		wal:   w,
+		poll:  DefaultPollInterval,
+		conns: make(map[net.Conn]struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// SetBootstrap has followers starting from nothing bootstrap from a
+// snapshot of s, the store over the primary's WAL, instead of replaying
+// the whole log over the network. Call it before Serve.
+func (p *Primary) SetBootstrap(s *store.Store) {
+	p.boot = s
+}
+
+func (p *Primary) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return p.Serve(l)
+}
+
+// Serve accepts followers on l until Close is called, then returns
+// ErrPrimaryClosed. It fails with wal.ErrLSNsShared for a WAL other logs
+// share LSNs with, such as a store's with SetBucketFamilies on, as the
+// followers would never see those logs' records.
+func (p *Primary) Serve(l net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		l.Close()
+		return ErrPrimaryClosed
+	}
+	if err := p.wal.LSNs().Stream(); err != nil {
+		p.mu.Unlock()
+		l.Close()
+		return err
+	}
+	p.listener = l
+	p.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+
+			if closed {
+				return ErrPrimaryClosed
+			}
+			return err
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			conn.Close()
+			return ErrPrimaryClosed
+		}
+		p.conns[conn] = struct{}{}
+		p.wg.Add(1)
+		p.mu.Unlock()
+
+		go p.handle(conn)
+	}
+}
+
+// Close stops accepting, drops followers and waits for their streams to
+// end. The WAL itself is left open.
+func (p *Primary) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return err
+}
+
+func (p *Primary) handle(conn net.Conn) {
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+		conn.Close()
+	}()
+
+	var hello [8]byte
+	if _, err := io.ReadFull(conn, hello[:]); err != nil {
+		return
+	}
+
+	// the follower never sends again, so a read returning means it left
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	out := bufio.NewWriter(conn)
+	r, err := p.start(out, binary.BigEndian.Uint64(hello[:]))
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	p.stream(out, r, gone)
+}
+
+// start answers a follower asking for the records from next on, and
+// returns the Reader tailing the log from where it is to stream on.
+func (p *Primary) start(out *bufio.Writer, next uint64) (*wal.Reader, error) {
+	r, err := p.wal.Tail(next)
+	switch {
+	case p.boot != nil && (next == 0 || errors.Is(err, wal.ErrTruncated)):
+		if r != nil {
+			r.Close()
+		}
+		if err := out.WriteByte(statusStreaming); err != nil {
+			return nil, err
+		}
+		lsn, err := p.boot.Bootstrap(func(rec *wal.Record) error {
+			return wal.WriteRecord(out, rec)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return p.wal.Tail(lsn + 1)
+	case errors.Is(err, wal.ErrTruncated):
+		out.WriteByte(statusUnavailable)
+		out.Flush()
+		return nil, err
+	case err != nil:
+		return nil, err
+	}
+
+	if err := out.WriteByte(statusStreaming); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// stream writes the records r has to out, then keeps polling it for new
+// ones until the follower goes or the primary closes. A Reader that fails
+// ends the stream, and the follower reconnects.
+func (p *Primary) stream(out *bufio.Writer, r *wal.Reader, gone <-chan struct{}) {
+	ticker := time.NewTicker(p.poll)
+	defer ticker.Stop()
+
+	for {
+		for {
+			rec, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return
+			}
+			if err := wal.WriteRecord(out, rec); err != nil {
+				return
+			}
+		}
+
+		if err := out.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-gone:
+			return
+		case <-p.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+func openStore(t *testing.T, dir string) (*store.Store, *wal.WAL) {
+	t.Helper()
+
+	w, err := wal.Open(dir, 5*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.New(w)
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	return s, w
+}
+
+// startPrimary serves w, bootstrapping followers from boot if it is set.
+func startPrimary(t *testing.T, w *wal.WAL, boot *store.Store) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPrimary(w)
+	p.poll = 5 * time.Millisecond
+	if boot != nil {
+		p.SetBootstrap(boot)
+	}
+	go p.Serve(l)
+	t.Cleanup(func() { p.Close() })
+
+	return l.Addr().String()
+}
+
+// follow runs a follower until the returned stop is called.
+func follow(s *store.Store, addr string) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := NewFollower(s, addr)
+	f.retry = 10 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		f.Run(ctx)
+		close(done)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFollowerReplicates(t *testing.T) {
+	primary, pw := openStore(t, t.TempDir())
+	defer primary.Close()
+	addr := startPrimary(t, pw, nil)
+
+	for i := 0; i < 50; i++ {
+		primary.Set(fmt.Sprintf("k%d", i), "v")
+	}
+	primary.Delete("k0")
+
+	followerDir := t.TempDir()
+	follower, _ := openStore(t, followerDir)
+	stop := follow(follower, addr)
+
+	waitFor(t, "initial sync", func() bool { return follower.Len() == 49 })
+
+	// later writes stream in while connected
+	primary.SetWithTTL("session", "abc", time.Hour)
+	waitFor(t, "live write", func() bool { return follower.Has("session") })
+
+	if err := follower.Set("x", "y"); !errors.Is(err, store.ErrReadOnly) {
+		t.Fatalf("expected follower writes to fail with ErrReadOnly, got %v", err)
+	}
+	if _, ok := follower.TTL("session"); !ok {
+		t.Fatal("expected the TTL to replicate")
+	}
+
+	stop()
+	follower.Close()
+
+	// a restarted follower resumes from its own log
+	primary.Set("after", "restart")
+
+	follower, _ = openStore(t, followerDir)
+	defer follower.Close()
+	if follower.LastLSN() == 0 || follower.Len() != 50 {
+		t.Fatalf("expected follower to recover 50 keys under primary LSNs, got %d at LSN %d", follower.Len(), follower.LastLSN())
+	}
+
+	stop = follow(follower, addr)
+	defer stop()
+
+	waitFor(t, "resume", func() bool { return follower.Has("after") })
+	waitFor(t, "matching LSNs", func() bool { return follower.LastLSN() == primary.LastLSN() })
+}
+
+// records counts the records in w's log.
+func records(t *testing.T, w *wal.WAL) int {
+	t.Helper()
+
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	n := 0
+	for {
+		if _, err := r.Next(); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+// Test that a new follower bootstraps from a snapshot of the primary's
+// state rather than its whole log, then tails the log from there
+func TestFollowerBootstraps(t *testing.T) {
+	primary, pw := openStore(t, t.TempDir())
+	defer primary.Close()
+	addr := startPrimary(t, pw, primary)
+
+	for i := 0; i < 500; i++ {
+		primary.Set(fmt.Sprintf("k%d", i%10), fmt.Sprint(i))
+	}
+	primary.SetWithTTL("session", "abc", time.Hour)
+	primary.Commit()
+
+	followerDir := t.TempDir()
+	follower, fw := openStore(t, followerDir)
+	stop := follow(follower, addr)
+
+	waitFor(t, "bootstrap", func() bool { return follower.LastLSN() == primary.LastLSN() })
+	if v, _ := follower.Get("k9"); v != "499" || follower.Len() != 11 {
+		t.Fatalf("expected the primary's state, got k9 %q and %d keys", v, follower.Len())
+	}
+	if _, ok := follower.TTL("session"); !ok {
+		t.Fatal("expected the TTL to bootstrap")
+	}
+
+	primary.Set("live", "1")
+	waitFor(t, "live write", func() bool { return follower.Has("live") })
+	fw.Flush()
+	if n := records(t, fw); n != 2 {
+		t.Fatalf("expected the bootstrap and the live write in the follower's log, got %d records", n)
+	}
+
+	stop()
+	follower.Close()
+
+	// a restarted follower resumes after the snapshot
+	primary.Set("after", "restart")
+
+	follower, _ = openStore(t, followerDir)
+	defer follower.Close()
+	if follower.Len() != 12 || follower.Has("after") {
+		t.Fatalf("expected the follower to recover 12 keys, got %d", follower.Len())
+	}
+
+	stop = follow(follower, addr)
+	defer stop()
+
+	waitFor(t, "resume", func() bool { return follower.Has("after") })
+	waitFor(t, "matching LSNs", func() bool { return follower.LastLSN() == primary.LastLSN() })
+}
+
+// Test that a follower whose next records the primary has deleted stops
+// with ErrLSNUnavailable rather than skipping them, and that a primary
+// bootstrapping followers starts it over instead
+func TestFollowerLSNUnavailable(t *testing.T) {
+	primary, pw := openStore(t, t.TempDir())
+	defer primary.Close()
+	addr := startPrimary(t, pw, nil)
+
+	primary.Set("gone", "1")
+	primary.Set("kept", "1")
+	follower, _ := openStore(t, t.TempDir())
+	defer follower.Close()
+	stop := follow(follower, addr)
+	waitFor(t, "initial sync", func() bool { return follower.LastLSN() == primary.LastLSN() })
+	stop()
+
+	// the delete is in the segment deleted
+	primary.Delete("gone")
+	id, err := pw.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary.Set("after", "1")
+	primary.Commit()
+	if err := pw.RemoveSegmentsBefore(id); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f := NewFollower(follower, addr)
+	f.retry = 10 * time.Millisecond
+	if err := f.Run(ctx); !errors.Is(err, ErrLSNUnavailable) {
+		t.Fatalf("expected ErrLSNUnavailable, got %v", err)
+	}
+	if follower.Has("after") || !follower.Has("gone") {
+		t.Fatal("expected the follower left as it was")
+	}
+
+	stop = follow(follower, startPrimary(t, pw, primary))
+	defer stop()
+	waitFor(t, "bootstrap", func() bool { return follower.LastLSN() == primary.LastLSN() })
+	if follower.Has("gone") || !follower.Has("kept") || !follower.Has("after") {
+		t.Fatalf("expected the primary's state, got %d keys", follower.Len())
+	}
+}
+
+// Test that a primary refuses a WAL whose store logs buckets in families
+// of their own, which the stream would leave out
+func TestPrimaryRefusesBucketFamilies(t *testing.T) {
+	w, err := wal.Open(t.TempDir(), 5*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.New(w)
+	defer s.Close()
+	if err := s.SetBucketFamilies(wal.Options{Dir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := s.Bucket("b")
+	b.Set("k", "v")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPrimary(w)
+	defer p.Close()
+	if err := p.Serve(l); !errors.Is(err, wal.ErrLSNsShared) {
+		t.Fatalf("expected ErrLSNsShared, got %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+// Server exposes a Store over the redis protocol (RESP), so redis-cli and
+// redis client libraries can talk to walrus.
+type Server struct {
+	store *store.Store
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func New(s *store.Store) *Server {
+	return &Server{
+		store: s,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+func (srv *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called, then returns
+// ErrServerClosed.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	srv.listener = l
+	srv.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		srv.mu.Lock()
+		if srv.closed {
+			srv.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		srv.conns[conn] = struct{}{}
+		srv.wg.Add(1)
+		srv.mu.Unlock()
+
+		go srv.handle(conn)
+	}
+}
+
+// Close stops accepting, drops open connections and waits for their
+// handlers to return. The store itself is left open.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return nil
+	}
+	srv.closed = true
+
+	var err error
+	if srv.listener != nil {
+		err = srv.listener.Close()
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
+	return err
+}
+
+func (srv *Server) handle(conn net.Conn) {
+	defer srv.wg.Done()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, conn)
+		srv.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	rw := respWriter{w: w}
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				rw.error("ERR " + err.Error())
+				w.Flush()
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := srv.dispatch(rw, args)
+
+		// flush once the client has no more pipelined commands buffered
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// dispatch runs one command and reports whether the connection should
+// be closed afterwards.
+func (srv *Server) dispatch(rw respWriter, args []string) bool {
+	s := srv.store
+	cmd := strings.ToUpper(args[0])
+
+	switch cmd {
+	case "PING":
+		if len(args) > 1 {
+			rw.bulk(args[1])
+		} else {
+			rw.simple("PONG")
+		}
+
+	case "ECHO":
+		if !arity(rw, args, 2) {
+			break
+		}
+		rw.bulk(args[1])
+
+	case "QUIT":
+		rw.simple("OK")
+		return true
+
+	case "COMMAND":
+		// redis-cli asks for command docs on startup; no docs is fine
+		rw.array(nil)
+
+	case "GET":
+		if !arity(rw, args, 2) {
+			break
+		}
+		if v, ok := s.Get(args[1]); ok {
+			rw.bulk(v)
+		} else {
+			rw.null()
+		}
+
+	case "SET":
+		srv.set(rw, args)
+
+	case "DEL":
+		if len(args) < 2 {
+			wrongArgs(rw, args[0])
+			break
+		}
+
+		var n int64
+		for _, key := range args[1:] {
+			if !s.Has(key) {
+				continue
+			}
+			if err := s.Delete(key); err != nil {
+				rw.error("ERR " + err.Error())
+				return false
+			}
+			n++
+		}
+		rw.integer(n)
+
+	case "EXISTS":
+		if len(args) < 2 {
+			wrongArgs(rw, args[0])
+			break
+		}
+
+		var n int64
+		for _, key := range args[1:] {
+			if s.Has(key) {
+				n++
+			}
+		}
+		rw.integer(n)
+
+	case "KEYS":
+		if !arity(rw, args, 2) {
+			break
+		}
+		pattern := args[1]
+		if _, err := path.Match(pattern, ""); err != nil {
+			rw.error("ERR invalid pattern")
+			break
+		}
+
+		var keys []string
+		for _, key := range s.Keys() {
+			if ok, _ := path.Match(pattern, key); ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		rw.array(keys)
+
+	case "TTL":
+		if !arity(rw, args, 2) {
+			break
+		}
+		if !s.Has(args[1]) {
+			rw.integer(-2)
+			break
+		}
+		ttl, ok := s.TTL(args[1])
+		if !ok {
+			rw.integer(-1)
+			break
+		}
+		rw.integer(int64((ttl + time.Second - 1) / time.Second))
+
+	case "DBSIZE":
+		rw.integer(int64(s.Len()))
+
+	default:
+		rw.error("ERR unknown command '" + args[0] + "'")
+	}
+
+	return false
+}
+
+// set handles SET key value [EX seconds | PX milliseconds].
+func (srv *Server) set(rw respWriter, args []string) {
+	if len(args) != 3 && len(args) != 5 {
+		wrongArgs(rw, args[0])
+		return
+	}
+
+	var ttl time.Duration
+	if len(args) == 5 {
+		n, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil || n <= 0 {
+			rw.error("ERR invalid expire time in 'set' command")
+			return
+		}
+
+		switch strings.ToUpper(args[3]) {
+		case "EX":
+			ttl = time.Duration(n) * time.Second
+		case "PX":
+			ttl = time.Duration(n) * time.Millisecond
+		default:
+			rw.error("ERR syntax error")
+			return
+		}
+	}
+
+	if err := srv.store.SetWithTTL(args[1], args[2], ttl); err != nil {
+		rw.error("ERR " + err.Error())
+		return
+	}
+	rw.simple("OK")
+}
+
+func arity(rw respWriter, args []string, n int) bool {
+	if len(args) != n {
+		wrongArgs(rw, args[0])
+		return false
+	}
+	return true
+}
+
+func wrongArgs(rw respWriter, cmd string) {
+	rw.error("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+}
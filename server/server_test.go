@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+	"github.com/jerkeyray/walrus/wal"
+)
+
+func newTestServer(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	w, err := wal.Open(t.TempDir(), 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.New(w)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := New(s)
+	go srv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Close()
+		s.Close()
+	})
+
+	return conn, bufio.NewReader(conn)
+}
+
+// do sends args as a RESP array and returns the reply rendered as text:
+// simple strings and errors as-is, bulk strings by value, nil bulk as
+// "(nil)", integers as "(integer) N" and arrays joined with commas.
+func do(t *testing.T, conn net.Conn, r *bufio.Reader, args ...string) string {
+	t.Helper()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	return readReply(t, r)
+}
+
+func readReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	switch line[0] {
+	case '+', '-':
+		return line
+	case ':':
+		return "(integer) " + line[1:]
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]string, n)
+		for i := range items {
+			items[i] = readReply(t, r)
+		}
+		return strings.Join(items, ",")
+	}
+
+	t.Fatalf("unexpected reply %q", line)
+	return ""
+}
+
+func TestBasicCommands(t *testing.T) {
+	conn, r := newTestServer(t)
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"SET", "name", "jerk"}, "+OK"},
+		{[]string{"get", "name"}, "jerk"},
+		{[]string{"GET", "missing"}, "(nil)"},
+		{[]string{"SET", "other", "x"}, "+OK"},
+		{[]string{"EXISTS", "name", "other", "missing"}, "(integer) 2"},
+		{[]string{"KEYS", "*"}, "name,other"},
+		{[]string{"KEYS", "n*"}, "name"},
+		{[]string{"DEL", "name", "missing"}, "(integer) 1"},
+		{[]string{"DBSIZE"}, "(integer) 1"},
+		{[]string{"SET", "s", "v", "EX", "100"}, "+OK"},
+		{[]string{"TTL", "s"}, "(integer) 100"},
+		{[]string{"TTL", "other"}, "(integer) -1"},
+		{[]string{"TTL", "missing"}, "(integer) -2"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"NOPE"}, "-ERR unknown command 'NOPE'"},
+	}
+
+	for _, c := range cases {
+		if got := do(t, conn, r, c.args...); got != c.want {
+			t.Fatalf("%v: expected %q, got %q", c.args, c.want, got)
+		}
+	}
+}
+
+func TestInlineAndPipelinedCommands(t *testing.T) {
+	conn, r := newTestServer(t)
+
+	// inline commands, pipelined in one write
+	if _, err := conn.Write([]byte("SET a 1\r\nSET b 2\r\nGET b\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"+OK", "+OK", "2"} {
+		if got := readReply(t, r); got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+
+	if got := do(t, conn, r, "QUIT"); got != "+OK" {
+		t.Fatalf("expected +OK on QUIT, got %q", got)
+	}
+}
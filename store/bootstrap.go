@@ -0,0 +1,103 @@
+package store
+
+import (
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// Bootstrap records carry up to bootstrapBatch keys, and about
+// bootstrapBytes of them, each, well under wal.DefaultMaxRecordSize.
+const (
+	bootstrapBatch = 1000
+	bootstrapBytes = 4 << 20
+)
+
+// Bootstrap calls fn with records that rebuild the store as it is now,
+// for a new replica to start from instead of the whole log, and returns
+// the LSN the state is as of. They are OpBatch records of the live keys,
+// with their expiry, and the idempotency keys still in their windows: the
+// first starts with an OpReset, and all but the last have no LSN, which
+// carries the returned one. Applied in order with ApplyReplicated they
+// leave a store as this one is, to replicate on from the LSN after; one
+// cut short leaves LastLSN at 0, so starting over is safe. The keys'
+// versions and write times aren't carried. A store that has logged
+// nothing calls fn with nothing.
+//
+// The state is copied under the lock, buckets moved out brought back as
+// for CreateSnapshot, and fn runs without it, the values shared with the
+// store rather than copied.
+func (s *Store) Bootstrap(fn func(*wal.Record) error) (uint64, error) {
+	records, lsn, err := s.bootstrapState()
+	if err != nil || lsn == 0 {
+		return 0, err
+	}
+
+	batch, size := []*wal.Record{{Op: wal.OpReset}}, 0
+	send := func(last bool) error {
+		value, err := wal.EncodeBatch(batch)
+		if err != nil {
+			return err
+		}
+		rec := &wal.Record{Op: wal.OpBatch, Value: value}
+		if last {
+			rec.LSN = lsn
+		}
+		batch, size = batch[:0], 0
+		return fn(rec)
+	}
+
+	for _, r := range records {
+		n := len(r.Key) + len(r.Value)
+		if len(batch) == bootstrapBatch || len(batch) > 0 && size+n > bootstrapBytes {
+			if err := send(false); err != nil {
+				return 0, err
+			}
+		}
+		batch = append(batch, r)
+		size += n
+	}
+	if err := send(true); err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
+
+// bootstrapState returns a record per live key and idempotency key, and
+// the LSN they are as of.
+func (s *Store) bootstrapState() ([]*wal.Record, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.caughtUpLocked(); err != nil {
+		return nil, 0, err
+	}
+	if err := s.loadAllBucketsLocked(); err != nil {
+		return nil, 0, err
+	}
+
+	// writers log and apply under mu, so the state is exactly LastLSN's
+	lsn := s.wal.LastLSN()
+	now := time.Now().UnixNano()
+	records := make([]*wal.Record, 0, len(s.data)+len(s.idempotency))
+	for n := s.index.seek(""); n != nil; n = n.next[0] {
+		if s.expired(n.key, now) {
+			continue
+		}
+		val, ok := s.valueLocked(n.key)
+		if !ok {
+			continue
+		}
+		if exp, ok := s.expires[n.key]; ok {
+			records = append(records, &wal.Record{Op: wal.OpSetTTL, Key: bytesOf(n.key), Value: encodeTTLValue(exp, val)})
+		} else {
+			records = append(records, setRecord(n.key, val))
+		}
+	}
+	for key, exp := range s.idempotency {
+		if exp > now {
+			records = append(records, &wal.Record{Op: wal.OpIdempotent, Key: bytesOf(key), Value: encodeTTLValue(exp, "")})
+		}
+	}
+	return records, lsn, nil
+}
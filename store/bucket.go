@@ -0,0 +1,266 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBucketName is returned by Bucket for an empty name or one with a
+// NUL byte in it.
+var ErrBucketName = errors.New("bucket name must be non-empty and free of NUL bytes")
+
+// Keys in a bucket are stored, and logged, as NUL, the bucket name, NUL
+// and the key. They all sort before any key that doesn't start with a
+// NUL, which the store's own listings skip; such keys are reserved.
+const (
+	bucketMark = "\x00"
+	bucketsEnd = "\x01" // the first key after every bucketed one
+)
+
+func isBucketKey(key string) bool {
+	return strings.HasPrefix(key, bucketMark)
+}
+
+// Bucket is a namespace within a store: its keys don't collide with the
+// same keys in the store or in other buckets, and Keys, Scan and Len see
+// only its own. Buckets are created by writing to them and share the
+// store's log, so a write to a bucket is as durable as any other.
+type Bucket struct {
+	s      *Store
+	name   string
+	prefix string
+}
+
+var _ KV = (*Bucket)(nil)
+
+// Bucket returns the bucket called name.
+func (s *Store) Bucket(name string) (*Bucket, error) {
+	if name == "" || strings.Contains(name, "\x00") {
+		return nil, ErrBucketName
+	}
+	return &Bucket{s: s, name: name, prefix: bucketMark + name + bucketMark}, nil
+}
+
+// Buckets returns the names of the buckets holding live keys, sorted,
+// including those moved out of memory by SetBucketIdleTTL.
+func (s *Store) Buckets() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	var names []string
+	for n := s.index.seek(bucketMark); n != nil && isBucketKey(n.key); {
+		name, _, _ := strings.Cut(n.key[1:], bucketMark)
+		prefix := bucketMark + name + bucketMark
+		for ; n != nil && strings.HasPrefix(n.key, prefix); n = n.next[0] {
+			if !s.expired(n.key, now) {
+				names = append(names, name)
+				break
+			}
+		}
+		// on to the next bucket without walking the rest of this one
+		n = s.index.seek(bucketMark + name + bucketsEnd)
+	}
+
+	// moved-out buckets have no keys in memory, so none is listed twice
+	names = append(names, s.IdleBuckets()...)
+	sort.Strings(names)
+	return names
+}
+
+// skipBuckets moves n past the bucketed keys if it is on one. Caller
+// holds s.mu.
+func (s *Store) skipBuckets(n *indexNode) *indexNode {
+	if n != nil && isBucketKey(n.key) {
+		return s.index.seek(bucketsEnd)
+	}
+	return n
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// Every method first records a use of the bucket, see SetBucketIdleTTL.
+// A bucket that can't be read back reads as empty, and writes to it fail.
+
+func (b *Bucket) Set(key, value string) error {
+	if err := b.s.useBucket(b.name); err != nil {
+		return err
+	}
+	return b.s.Set(b.prefix+key, value)
+}
+
+func (b *Bucket) SetWithTTL(key, value string, ttl time.Duration) error {
+	if err := b.s.useBucket(b.name); err != nil {
+		return err
+	}
+	return b.s.SetWithTTL(b.prefix+key, value, ttl)
+}
+
+func (b *Bucket) Get(key string) (string, bool) {
+	b.s.useBucket(b.name)
+	return b.s.Get(b.prefix + key)
+}
+
+func (b *Bucket) GetWithMeta(key string) (Meta, bool) {
+	b.s.useBucket(b.name)
+	return b.s.GetWithMeta(b.prefix + key)
+}
+
+// Prefetch reads the bucket back into memory if it was moved out, as the
+// first of keys' reads would. See Store.Prefetch.
+func (b *Bucket) Prefetch(keys []string) error {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = b.prefix + key
+	}
+	return b.s.Prefetch(prefixed)
+}
+
+func (b *Bucket) History(key string, limit int) ([]Revision, error) {
+	return b.s.History(b.prefix+key, limit)
+}
+
+func (b *Bucket) TTL(key string) (time.Duration, bool) {
+	b.s.useBucket(b.name)
+	return b.s.TTL(b.prefix + key)
+}
+
+func (b *Bucket) Incr(key string, delta int64) (int64, error) {
+	if err := b.s.useBucket(b.name); err != nil {
+		return 0, err
+	}
+	return b.s.Incr(b.prefix+key, delta)
+}
+
+func (b *Bucket) Delete(key string) error {
+	if err := b.s.useBucket(b.name); err != nil {
+		return err
+	}
+	return b.s.Delete(b.prefix + key)
+}
+
+func (b *Bucket) DeleteMany(keys []string) error {
+	if err := b.s.useBucket(b.name); err != nil {
+		return err
+	}
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = b.prefix + key
+	}
+	return b.s.DeleteMany(prefixed)
+}
+
+func (b *Bucket) Has(key string) bool {
+	b.s.useBucket(b.name)
+	return b.s.Has(b.prefix + key)
+}
+
+// Keys returns the bucket's live keys in sorted order.
+func (b *Bucket) Keys() []string {
+	entries := b.Scan("")
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys
+}
+
+func (b *Bucket) Len() int {
+	return len(b.Scan(""))
+}
+
+// EstimateCount is Store.EstimateCount within the bucket.
+func (b *Bucket) EstimateCount(prefix string) (n int, exact bool) {
+	b.s.useBucket(b.name)
+	return b.s.EstimateCount(b.prefix + prefix)
+}
+
+// Scan is Store.Scan within the bucket. The keys returned don't carry
+// the bucket's prefix.
+func (b *Bucket) Scan(prefix string) []Entry {
+	b.s.useBucket(b.name)
+	entries := b.s.Scan(b.prefix + prefix)
+	for i := range entries {
+		entries[i].Key = entries[i].Key[len(b.prefix):]
+	}
+	return entries
+}
+
+// Iterate is Store.Iterate over the bucket's keys.
+func (b *Bucket) Iterate(fn func(key, value string) bool) {
+	b.s.useBucket(b.name)
+	b.s.iterate(b.prefix, func(key, value string) bool {
+		return fn(key[len(b.prefix):], value)
+	})
+}
+
+// SetJSON is Store.SetJSON in the bucket.
+func (b *Bucket) SetJSON(key string, v any) error {
+	if err := b.s.useBucket(b.name); err != nil {
+		return err
+	}
+	return b.s.SetJSON(b.prefix+key, v)
+}
+
+// GetJSON is Store.GetJSON in the bucket.
+func (b *Bucket) GetJSON(key string, dst any) (bool, error) {
+	b.s.useBucket(b.name)
+	return b.s.GetJSON(b.prefix+key, dst)
+}
+
+// JSONGet is Store.JSONGet in the bucket.
+func (b *Bucket) JSONGet(key, path string) (json.RawMessage, bool, error) {
+	b.s.useBucket(b.name)
+	return b.s.JSONGet(b.prefix+key, path)
+}
+
+// JSONSet is Store.JSONSet in the bucket.
+func (b *Bucket) JSONSet(key, path string, v any) error {
+	if err := b.s.useBucket(b.name); err != nil {
+		return err
+	}
+	return b.s.JSONSet(b.prefix+key, path, v)
+}
+
+// Batch is Store.Batch with fn writing to the bucket.
+func (b *Bucket) Batch(fn func(kv KV) error) error {
+	if err := fn(b); err != nil {
+		return err
+	}
+
+	b.s.flushLogs()
+	return nil
+}
+
+// Watch is Store.Watch within the bucket, with the events' keys relative
+// to it.
+func (b *Bucket) Watch(prefix string) (<-chan Event, CancelFunc) {
+	events, cancelInner := b.s.Watch(b.prefix + prefix)
+	out := make(chan Event, watchBuffer)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(out)
+		for ev := range events {
+			ev.Key = strings.TrimPrefix(ev.Key, b.prefix)
+			select {
+			case out <- ev:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		cancelInner()
+		once.Do(func() { close(done) })
+	}
+	return out, cancel
+}
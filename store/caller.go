@@ -0,0 +1,48 @@
+package store
+
+import (
+	"context"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// Caller says who a write was made for. A server attaches one to each
+// request's context with WithCaller, and the Ctx writes log it with their
+// records, hand it to watchers on their Events and report it in History,
+// so a change can be traced back to the user and request behind it. It
+// is taken on trust: the store only records what it is given.
+type Caller struct {
+	User    string
+	Request string
+}
+
+type callerKey struct{}
+
+// WithCaller returns a copy of ctx carrying c.
+func WithCaller(ctx context.Context, c Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// CallerFrom returns the Caller attached to ctx by WithCaller, if any.
+func CallerFrom(ctx context.Context) (Caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(Caller)
+	return c, ok
+}
+
+// callerOf returns the Caller logged with rec.
+func callerOf(rec *wal.Record) Caller {
+	return Caller{User: rec.User, Request: rec.Request}
+}
+
+// callerFrom is CallerFrom without the ok, the zero Caller meaning none.
+func callerFrom(ctx context.Context) Caller {
+	c, _ := CallerFrom(ctx)
+	return c
+}
+
+// attribute stamps rec with ctx's Caller and returns it.
+func attribute(ctx context.Context, rec *wal.Record) *wal.Record {
+	c := callerFrom(ctx)
+	rec.User, rec.Request = c.User, c.Request
+	return rec
+}
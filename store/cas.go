@@ -0,0 +1,80 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+var errConditionFailed = errors.New("condition failed")
+
+// CompareAndSet sets key to newValue only if it currently holds
+// expectedOld, and reports whether it did. A missing or expired key
+// never matches; use SetIfAbsent to create one. Like Set, it clears any
+// TTL. The check and the write happen under one lock, so of several
+// writers racing from the same old value exactly one wins.
+func (s *Store) CompareAndSet(key, expectedOld, newValue string) (bool, error) {
+	rec := &wal.Record{
+		Op:    wal.OpCompareAndSet,
+		Key:   []byte(key),
+		Value: encodeCASValue(expectedOld, newValue),
+	}
+	return s.setIf(rec, func() bool {
+		v, ok := s.valueLocked(key)
+		return ok && v == expectedOld && !s.expiredNow(key)
+	})
+}
+
+// SetIfAbsent sets key to value only if it is missing or expired, and
+// reports whether it did.
+func (s *Store) SetIfAbsent(key, value string) (bool, error) {
+	rec := &wal.Record{
+		Op:    wal.OpSetIfAbsent,
+		Key:   []byte(key),
+		Value: []byte(value),
+	}
+	return s.setIf(rec, func() bool {
+		_, ok := s.data[key]
+		return !ok || s.expiredNow(key)
+	})
+}
+
+// setIf logs and applies rec if cond, run under s.mu, holds. The record
+// is only logged when it does, so replay applies it without checking
+// again: a key's TTL may have run out since, which must not undo a write
+// that succeeded.
+func (s *Store) setIf(rec *wal.Record, cond func() bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.writeIfLocked(rec, func() error {
+		if !cond() {
+			return errConditionFailed
+		}
+		return nil
+	})
+	if errors.Is(err, errConditionFailed) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func encodeCASValue(old, value string) []byte {
+	buf := make([]byte, 4+len(old)+len(value))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(old)))
+	copy(buf[4:], old)
+	copy(buf[4+len(old):], value)
+	return buf
+}
+
+func decodeCASValue(data []byte) (old, value []byte, ok bool) {
+	if len(data) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(data[0:4])
+	if uint64(len(data)-4) < uint64(n) {
+		return nil, nil, false
+	}
+	return data[4 : 4+n], data[4+n:], true
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// catchUpChunk is how many records background recovery applies between
+// letting reads in.
+const catchUpChunk = 1024
+
+var errClosedDuringRecovery = errors.New("store closed during recovery")
+
+// RecoverInBackground starts RecoverWithOptions on its own goroutine and
+// returns at once, so a store with a long log can serve reads while it
+// replays. Until the returned channel delivers recovery's result,
+// CatchingUp reports true and reads see the records replayed so far,
+// every few thousand at a time; writes wait for replay to finish, and
+// watchers aren't told about replayed records. If recovery fails, the
+// store is left empty and every write fails with its error. Close stops
+// a replay still running.
+func (s *Store) RecoverInBackground(opts RecoverOptions) <-chan error {
+	done := make(chan error, 1)
+
+	s.mu.Lock()
+	s.catchUp = make(chan struct{})
+	s.mu.Unlock()
+
+	go func() {
+		s.mu.Lock()
+		n := 0
+		err := s.recoverLocked(opts, func() error {
+			if n++; n%catchUpChunk != 0 {
+				return nil
+			}
+			s.mu.Unlock()
+			s.mu.Lock()
+			select {
+			case <-s.sweepStop:
+				return errClosedDuringRecovery
+			default:
+				return nil
+			}
+		})
+		s.catchUpErr = err
+		close(s.catchUp)
+		s.catchUp = nil
+		s.mu.Unlock()
+
+		if err == nil {
+			err = s.checkAfterCrash(opts)
+		}
+		done <- err
+	}()
+	return done
+}
+
+// CatchingUp reports whether RecoverInBackground is still replaying.
+func (s *Store) CatchingUp() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.catchUp != nil
+}
+
+// writableLocked returns nil if the store takes writes, after
+// caughtUpLocked. Caller holds s.mu.
+func (s *Store) writableLocked() error {
+	if err := s.caughtUpLocked(); err != nil {
+		return err
+	}
+	if s.closed {
+		return ErrClosed
+	}
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// caughtUpLocked waits out a background recovery, returning its error if
+// it failed. Caller holds s.mu, which is given up while it waits, so it
+// must come before a write looks at any state.
+func (s *Store) caughtUpLocked() error {
+	for s.catchUp != nil {
+		ch := s.catchUp
+		s.mu.Unlock()
+		<-ch
+		s.mu.Lock()
+	}
+	if s.catchUpErr != nil {
+		return fmt.Errorf("background recovery failed: %w", s.catchUpErr)
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+package store
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+const (
+	// coldCheckInterval bounds how often the sweeper looks for keys to
+	// move out, as finding them visits every key.
+	coldCheckInterval = time.Minute
+
+	// coldMinValue is the smallest value moved out. A smaller one saves
+	// less memory than its bookkeeping takes, and Incr's counters, which
+	// the log holds only as deltas, are all smaller.
+	coldMinValue = 64
+)
+
+// ColdTier holds the values SetColdTTL moves out of memory. DirTier keeps
+// them in files; one backed by an object store such as S3 only has to
+// implement these three. Put is called without the store's lock, and Get
+// too when Get or Prefetch bring a value back, from several goroutines
+// at once; Get from the other reads and Delete are called with it held,
+// so they should not be slow. With the WAL encrypted, values reach the
+// tier sealed with its key.
+type ColdTier interface {
+	Put(key string, value []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// coldKeys tracks the reads of keys for SetColdTTL. Like idleBuckets it
+// has its own lock, taken after s.mu when both are held.
+type coldKeys struct {
+	on    atomic.Bool // ttl != 0, checked by Get without any lock
+	mu    sync.Mutex
+	ttl   time.Duration
+	tier  ColdTier
+	since int64            // when ttl was set, for keys not read since
+	read  map[string]int64 // key -> unix nanos of its last read or write
+	last  int64            // unix nanos of the last look for keys to move
+	sets  uint64           // SetColdTTL calls, to tell tier was replaced
+
+	// keys whose value is in tier, held in data as "", counting moves.
+	// Guarded by s.mu, not mu.
+	offloaded map[string]coldValue
+	moves     uint64
+}
+
+// coldValue is a value moved out of memory: the move that put it in the
+// tier, so Get and Prefetch can tell a value moved out again from the one
+// they fetched, and the LSN of the record that wrote it, to read it back
+// from the log by if the tier loses it.
+type coldValue struct {
+	move uint64
+	lsn  uint64
+}
+
+// coldMove is a value offloadCold puts in the tier, with the LSN and last
+// read it had, to check nothing changed meanwhile.
+type coldMove struct {
+	key, value string
+	lsn        uint64
+	read       int64
+}
+
+// SetColdTTL moves the values of keys nobody has read or written for ttl
+// out of memory and into tier, keeping only the key and its metadata,
+// and Get brings a value back the next time it is read. Other reads,
+// such as Scan, Export and snapshots, read moved values from tier without
+// bringing them back, and don't count as reads. Keys in buckets are left
+// to SetBucketIdleTTL. As with it, nothing is logged: the WAL still holds
+// every value, so recovery brings them all back, and a value tier loses
+// is read back from the log, from the record that wrote it. Values under
+// 64 bytes, and those of keys written without an LSN, such as by a
+// bootstrap, stay in memory. A ttl of 0 turns it off and brings every
+// value back into memory.
+func (s *Store) SetColdTTL(ttl time.Duration, tier ColdTier) error {
+	if ttl < 0 {
+		return errors.New("cold ttl must not be negative")
+	}
+	if ttl > 0 && tier == nil {
+		return errors.New("cold ttl needs a tier")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.cold.offloaded {
+		if err := s.rehydrateLocked(key); err != nil {
+			return err
+		}
+	}
+
+	s.cold.mu.Lock()
+	defer s.cold.mu.Unlock()
+
+	if tier != nil && s.wal.Encrypted() {
+		tier = sealedTier{tier, s.wal}
+	}
+	s.cold.ttl, s.cold.tier = ttl, tier
+	s.cold.sets++
+	s.cold.since = time.Now().UnixNano()
+	s.cold.read = make(map[string]int64)
+	if s.cold.offloaded == nil {
+		s.cold.offloaded = make(map[string]coldValue)
+	}
+	s.cold.on.Store(ttl > 0)
+
+	if ttl > 0 {
+		s.sweepOnce.Do(func() { go s.sweepLoop() })
+	}
+	return nil
+}
+
+// ColdKeys returns how many keys have their values moved out of memory
+// by SetColdTTL.
+func (s *Store) ColdKeys() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.cold.offloaded)
+}
+
+// touch records a read or write of key, if SetColdTTL is on.
+func (s *Store) touch(key string) {
+	if !s.cold.on.Load() {
+		return
+	}
+
+	s.cold.mu.Lock()
+	if s.cold.ttl > 0 {
+		s.cold.read[key] = time.Now().UnixNano()
+	}
+	s.cold.mu.Unlock()
+}
+
+// getCold is Get while SetColdTTL is on, bringing key's value back into
+// memory if it was moved out. The tier is read without the lock, as
+// Prefetch does.
+func (s *Store) getCold(key string) (string, bool) {
+	s.touch(key)
+
+	s.mu.RLock()
+	cv, moved := s.cold.offloaded[key]
+	if !moved {
+		defer s.mu.RUnlock()
+		if s.expiredNow(key) {
+			return "", false
+		}
+		val, ok := s.data[key]
+		return val, ok
+	}
+	s.mu.RUnlock()
+
+	p := prefetched{key: key, move: cv.move}
+	s.cold.mu.Lock()
+	tier := s.cold.tier
+	s.cold.mu.Unlock()
+	if tier != nil {
+		p.value, p.err = tier.Get(key)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiredNow(key) {
+		return "", false
+	}
+	if err := s.restorePrefetchedLocked(p); err != nil {
+		return "", false
+	}
+	val, ok := s.data[key]
+	return val, ok
+}
+
+// valueLocked is s.data[key], reading a moved-out value from its tier
+// without bringing it back. A value neither the tier nor the log can
+// give back reads as missing. Caller holds s.mu.
+func (s *Store) valueLocked(key string) (string, bool) {
+	val, ok := s.data[key]
+	if !ok {
+		return "", false
+	}
+	if cv, moved := s.cold.offloaded[key]; moved {
+		v, err := s.coldValueLocked(key, cv)
+		if err != nil {
+			return "", false
+		}
+		val = v
+	}
+	return val, true
+}
+
+// coldValueLocked reads a moved-out value from its tier, or from the log
+// if the tier can't give it back. Caller holds s.mu.
+func (s *Store) coldValueLocked(key string, cv coldValue) (string, error) {
+	s.cold.mu.Lock()
+	tier := s.cold.tier
+	s.cold.mu.Unlock()
+
+	if tier != nil {
+		if v, err := tier.Get(key); err == nil {
+			return string(v), nil
+		}
+	}
+	return s.valueFromLog(key, cv.lsn)
+}
+
+// errNotInLog is valueFromLog's error for a value the log no longer has.
+var errNotInLog = errors.New("moved-out value not in the log")
+
+// valueFromLog reads key's value from the record logged under lsn, which
+// wrote it, reading only from the segment that holds it on. Caller holds
+// s.mu.
+func (s *Store) valueFromLog(key string, lsn uint64) (string, error) {
+	// Readers only see what is written out; nothing is buffered read-only
+	if err := s.wal.Sync(); err != nil && !errors.Is(err, wal.ErrReadOnly) {
+		return "", err
+	}
+	r, err := s.wal.ReadFrom(lsn)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return "", errNotInLog
+		}
+		if err != nil {
+			return "", err
+		}
+		if rec.LSN < lsn {
+			continue
+		}
+		if rec.LSN > lsn {
+			return "", errNotInLog
+		}
+		if val, ok := valueIn(rec, key); ok {
+			return val, nil
+		}
+		return "", errNotInLog
+	}
+}
+
+// valueIn returns the value rec sets key to, if it carries it. A batch's
+// last write to key is the one that counts.
+func valueIn(rec *wal.Record, key string) (string, bool) {
+	switch rec.Op {
+	case wal.OpBatch:
+		records, err := wal.DecodeBatch(rec.Value)
+		if err != nil {
+			return "", false
+		}
+		val, found := "", false
+		for _, r := range records {
+			if r.Op == wal.OpReset || string(r.Key) == key {
+				val, found = valueIn(r, key)
+			}
+		}
+		return val, found
+	case wal.OpSet, wal.OpSetIfAbsent:
+		return string(rec.Value), string(rec.Key) == key
+	case wal.OpSetTTL:
+		_, val, ok := decodeTTLValue(rec.Value)
+		return val, ok && string(rec.Key) == key
+	case wal.OpCompareAndSet:
+		_, val, ok := decodeCASValue(rec.Value)
+		return string(val), ok && string(rec.Key) == key
+	}
+	return "", false
+}
+
+// rehydrateLocked brings key's value back into memory, if it was moved
+// out. Caller holds s.mu.
+func (s *Store) rehydrateLocked(key string) error {
+	cv, moved := s.cold.offloaded[key]
+	if !moved {
+		return nil
+	}
+
+	val, err := s.coldValueLocked(key, cv)
+	if err != nil {
+		return err
+	}
+	s.restoreColdLocked(key, val)
+	return nil
+}
+
+// restoreColdLocked puts a moved-out value back in memory. Caller holds
+// s.mu.
+func (s *Store) restoreColdLocked(key, val string) {
+	s.memory += int64(len(val))
+	s.data[key] = val
+	s.forgetColdLocked(key)
+}
+
+// forgetColdLocked drops key's moved-out value, once memory holds its
+// value again or no longer holds the key. Caller holds s.mu.
+func (s *Store) forgetColdLocked(key string) {
+	if _, moved := s.cold.offloaded[key]; !moved {
+		return
+	}
+	delete(s.cold.offloaded, key)
+
+	s.cold.mu.Lock()
+	if s.cold.tier != nil {
+		s.cold.tier.Delete(key)
+	}
+	s.cold.mu.Unlock()
+}
+
+// offloadCold moves out the values of the keys not read or written for
+// the cold ttl, at most once per coldCheckInterval or ttl, whichever is
+// shorter. The keys are picked under s.mu and the values put in the tier
+// without it; a key written or read meanwhile, or a value the tier won't
+// take, stays in memory.
+func (s *Store) offloadCold(now int64) {
+	s.mu.Lock()
+	tier, sets, moves := s.coldMovesLocked(now)
+	s.mu.Unlock()
+	if len(moves) == 0 {
+		return
+	}
+
+	put := moves[:0]
+	for _, m := range moves {
+		if tier.Put(m.key, []byte(m.value)) == nil {
+			put = append(put, m)
+		}
+	}
+
+	s.mu.Lock()
+	stale := s.moveColdLocked(sets, put)
+	s.mu.Unlock()
+	for _, key := range stale {
+		tier.Delete(key)
+	}
+}
+
+// coldMovesLocked returns the tier, as of which SetColdTTL call, and the
+// values offloadCold is to move out, if it is time to look. Caller holds
+// s.mu.
+func (s *Store) coldMovesLocked(now int64) (ColdTier, uint64, []coldMove) {
+	s.cold.mu.Lock()
+	defer s.cold.mu.Unlock()
+
+	ttl := int64(s.cold.ttl)
+	if ttl == 0 || now-s.cold.last < min(ttl, int64(coldCheckInterval)) {
+		return nil, 0, nil
+	}
+	s.cold.last = now
+
+	var moves []coldMove
+	for n := s.skipBuckets(s.index.seek("")); n != nil; n = s.skipBuckets(n.next[0]) {
+		key := n.key
+		if _, moved := s.cold.offloaded[key]; moved || s.expired(key, now) {
+			continue
+		}
+		read, ok := s.cold.read[key]
+		if !ok {
+			read = s.cold.since
+		}
+		val, lsn := s.data[key], s.meta[key].lsn
+		if now-read < ttl || len(val) < coldMinValue || lsn == 0 {
+			continue
+		}
+		moves = append(moves, coldMove{key: key, value: val, lsn: lsn, read: s.cold.read[key]})
+	}
+
+	for key := range s.cold.read {
+		if _, ok := s.data[key]; !ok {
+			delete(s.cold.read, key)
+		}
+	}
+	return s.cold.tier, s.cold.sets, moves
+}
+
+// moveColdLocked drops from memory the values put in the tier of the
+// sets'th SetColdTTL call that are still as they were, and returns the
+// keys of the others, whose copies in it are stale. Caller holds s.mu.
+func (s *Store) moveColdLocked(sets uint64, put []coldMove) []string {
+	s.cold.mu.Lock()
+	defer s.cold.mu.Unlock()
+
+	var stale []string
+	for _, m := range put {
+		_, moved := s.cold.offloaded[m.key]
+		_, there := s.data[m.key]
+		if s.cold.sets != sets || moved || !there || s.meta[m.key].lsn != m.lsn || s.cold.read[m.key] != m.read {
+			if !moved {
+				stale = append(stale, m.key)
+			}
+			continue
+		}
+		s.memory -= int64(len(m.value))
+		s.data[m.key] = ""
+		s.cold.moves++
+		s.cold.offloaded[m.key] = coldValue{move: s.cold.moves, lsn: m.lsn}
+		delete(s.cold.read, m.key)
+	}
+	return stale
+}
+
+// dropColdLocked forgets every moved-out value, for reset. Caller holds
+// s.mu.
+func (s *Store) dropColdLocked() {
+	for key := range s.cold.offloaded {
+		s.forgetColdLocked(key)
+	}
+}
+
+// dirTier is the ColdTier DirTier returns.
+type dirTier struct {
+	dir   string
+	clean sync.Once
+}
+
+// DirTier returns a ColdTier keeping each value in a file of its own in
+// dir, created if missing. Files left there by an earlier run are
+// removed on first use, as recovery has brought their values back.
+func DirTier(dir string) ColdTier {
+	return &dirTier{dir: dir}
+}
+
+func (t *dirTier) path(key string) string {
+	return filepath.Join(t.dir, hex.EncodeToString([]byte(key))+".value")
+}
+
+// Put writes the value whole under a temporary name first, so a failed
+// write leaves no partial file behind. Only the walrus user can read it.
+func (t *dirTier) Put(key string, value []byte) error {
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return err
+	}
+	t.clean.Do(func() {
+		stale, _ := filepath.Glob(filepath.Join(t.dir, "*.value"))
+		for _, path := range stale {
+			os.Remove(path)
+		}
+	})
+	path := t.path(key)
+	if err := os.WriteFile(path+".tmp", value, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (t *dirTier) Get(key string) ([]byte, error) {
+	return os.ReadFile(t.path(key))
+}
+
+func (t *dirTier) Delete(key string) error {
+	err := os.Remove(t.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// sealedTier is a ColdTier whose values are sealed with w's encryption
+// key, for a store whose log is encrypted.
+type sealedTier struct {
+	ColdTier
+	w *wal.WAL
+}
+
+func (t sealedTier) Put(key string, value []byte) error {
+	return t.ColdTier.Put(key, t.w.Seal(value))
+}
+
+func (t sealedTier) Get(key string) ([]byte, error) {
+	sealed, err := t.ColdTier.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return t.w.Unseal(sealed)
+}
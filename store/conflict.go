@@ -0,0 +1,37 @@
+package store
+
+import (
+	"hash/maphash"
+	"strings"
+)
+
+// Optimistic transactions detect conflicts through version counters
+// kept per scope: a key, and each prefix of it that ends in ':' (so
+// user:42:name is in scopes user:, user:42: and user:42:name), plus the
+// empty prefix covering every key. A write bumps all of its scopes;
+// a read remembers the version of the scope it read. Counters live in a
+// fixed table indexed by hash, so memory doesn't grow with the keyspace
+// and an unrelated write can at worst cause a spurious conflict.
+const conflictSlots = 4096
+
+var conflictSeed = maphash.MakeSeed()
+
+func conflictSlot(scope string) uint32 {
+	return uint32(maphash.String(conflictSeed, scope) % conflictSlots)
+}
+
+// bumpScopes marks every scope of key as changed. Caller holds s.mu.
+func (s *Store) bumpScopes(key string) {
+	s.versions[conflictSlot("")]++
+	for i := 0; i < len(key); i++ {
+		if key[i] == ':' {
+			s.versions[conflictSlot(key[:i+1])]++
+		}
+	}
+	s.versions[conflictSlot(key)]++
+}
+
+// prefixScope returns the narrowest scope covering every key with prefix.
+func prefixScope(prefix string) string {
+	return prefix[:strings.LastIndexByte(prefix, ':')+1]
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// SetCtx is Set that first checks ctx. Like every Ctx variant it returns
+// ctx's error, and does nothing, if ctx is already done. Only the durable
+// writes can block for long, on fsync; they stop waiting when ctx ends,
+// but by then the write has been applied and logged, so ctx.Err() from
+// them means "not known to be durable", not "not written".
+//
+// The Ctx writes also log the Caller attached to ctx by WithCaller, if
+// any, with their records.
+func (s *Store) SetCtx(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.write(attribute(ctx, setRecord(key, value)))
+}
+
+func (s *Store) SetWithTTLCtx(ctx context.Context, key, value string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.setWithTTL(ctx, key, value, ttl)
+}
+
+// SetDurableCtx is SetDurable that stops waiting for fsync when ctx is
+// done.
+func (s *Store) SetDurableCtx(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.writeDurable(ctx, attribute(ctx, setRecord(key, value)))
+}
+
+func (s *Store) GetCtx(ctx context.Context, key string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	v, ok := s.Get(key)
+	return v, ok, nil
+}
+
+func (s *Store) DeleteCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.delete(ctx, key)
+}
+
+// DeleteDurableCtx deletes key and waits, until ctx is done, for the
+// delete to reach disk.
+func (s *Store) DeleteDurableCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := s.writeDurable(ctx, attribute(ctx, deleteRecord(bytesOf(key)))); err != nil {
+		return err
+	}
+
+	s.sweepOnce.Do(func() { go s.sweepLoop() })
+	return nil
+}
+
+// BarrierCtx is Barrier that stops waiting for fsync when ctx is done.
+func (s *Store) BarrierCtx(ctx context.Context, durable bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// writers log and apply under mu, so once we hold it none is midway
+	s.mu.RLock()
+	logs := s.logsLocked()
+	pos := make([]int64, len(logs))
+	for i, w := range logs {
+		pos[i] = w.Position()
+	}
+	s.mu.RUnlock()
+
+	if !durable {
+		return nil
+	}
+	for i, w := range logs {
+		if err := w.WaitDurableCtx(ctx, pos[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) WriteCtx(ctx context.Context, b *WriteBatch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.writeIf(b, callerFrom(ctx), nil)
+}
+
+// WriteIdempotentCtx is WriteIdempotent that first checks ctx.
+func (s *Store) WriteIdempotentCtx(ctx context.Context, idemKey string, window time.Duration, b *WriteBatch) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.writeIdempotent(idemKey, window, b, callerFrom(ctx))
+}
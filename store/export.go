@@ -0,0 +1,488 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// Format is a file format for Export and Import.
+type Format int
+
+const (
+	// FormatJSON is one JSON array of entries:
+	//
+	//	[
+	//	  {"key":"a","value":"1"},
+	//	  {"key":"blob","value_base64":"AAE=","expires_at":"2026-01-02T15:04:05Z"},
+	//	  {"bucket":"users","key":"42","value":"ann"}
+	//	]
+	//
+	// Keys and values that aren't valid UTF-8 are written base64-encoded
+	// under key_base64 and value_base64 instead, so binary data survives.
+	FormatJSON Format = iota
+
+	// FormatNDJSON is the same entries one per line, for jq and other
+	// line-oriented tools.
+	FormatNDJSON
+
+	// FormatCSV has a header row and the columns key, value, bucket,
+	// expires_at and encoding. An encoding of base64 means the row's key
+	// and value are base64-encoded, which Export does when either isn't
+	// valid UTF-8. On import the columns can come in any order, and only
+	// key and value are required.
+	FormatCSV
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatJSON:
+		return "json"
+	case FormatNDJSON:
+		return "ndjson"
+	case FormatCSV:
+		return "csv"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat returns the Format called name: json, ndjson or csv.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "json":
+		return FormatJSON, nil
+	case "ndjson", "jsonl":
+		return FormatNDJSON, nil
+	case "csv":
+		return FormatCSV, nil
+	}
+	return 0, fmt.Errorf("unknown format %q (json, ndjson or csv)", name)
+}
+
+// ImportMode is what Import does with keys that aren't in the file.
+type ImportMode int
+
+const (
+	ImportMerge   ImportMode = iota // keep them; keys in the file overwrite
+	ImportReplace                   // delete them, leaving only the file's keys
+)
+
+type ImportOptions struct {
+	Format Format
+	Mode   ImportMode
+}
+
+// importBatch is how many writes Import logs per batch record.
+const importBatch = 1000
+
+var csvHeader = []string{"key", "value", "bucket", "expires_at", "encoding"}
+
+// exportEntry is one key in a JSON or NDJSON file.
+type exportEntry struct {
+	Bucket      string     `json:"bucket,omitempty"`
+	Key         *string    `json:"key,omitempty"`
+	KeyBase64   string     `json:"key_base64,omitempty"`
+	Value       *string    `json:"value,omitempty"`
+	ValueBase64 string     `json:"value_base64,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// importEntry is one key read back from a file in any format.
+type importEntry struct {
+	bucket     string
+	key, value []byte
+	expiresAt  int64 // unix nanos, 0 for none
+}
+
+// exported is one key as Export copies it out of the store.
+type exported struct {
+	stored, value string // stored is the key with its bucket prefix
+	expiresAt     int64
+}
+
+// Export writes every live key, those in buckets included, with its
+// value and expiry. The keys are copied under the lock and written
+// out after it is released, so writers only wait for the copy.
+func (s *Store) Export(out io.Writer, format Format) error {
+	// the write lock, to bring back buckets moved out of memory first
+	s.mu.Lock()
+	if err := s.loadAllBucketsLocked(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	now := time.Now().UnixNano()
+	keys := make([]exported, 0, len(s.data))
+	for n := s.index.seek(""); n != nil; n = n.next[0] {
+		if s.expired(n.key, now) {
+			continue
+		}
+		value, _ := s.valueLocked(n.key)
+		keys = append(keys, exported{n.key, value, s.expires[n.key]})
+	}
+	s.mu.Unlock()
+
+	bw := bufio.NewWriter(out)
+	var err error
+	switch format {
+	case FormatJSON, FormatNDJSON:
+		err = writeJSON(bw, keys, format == FormatNDJSON)
+	case FormatCSV:
+		err = writeCSV(bw, keys)
+	default:
+		err = fmt.Errorf("cannot export as %v", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// writeJSON writes keys as a JSON array with one entry per line, or with
+// lines set, as the bare entries one per line.
+func writeJSON(bw *bufio.Writer, keys []exported, lines bool) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	if !lines {
+		bw.WriteString("[")
+	}
+	for i, k := range keys {
+		buf.Reset()
+		if err := enc.Encode(newExportEntry(k)); err != nil {
+			return err
+		}
+		if lines {
+			bw.Write(buf.Bytes())
+			continue
+		}
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		bw.WriteString("\n  ")
+		bw.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	}
+	if lines {
+		return nil
+	}
+	if len(keys) > 0 {
+		bw.WriteString("\n")
+	}
+	_, err := bw.WriteString("]\n")
+	return err
+}
+
+func writeCSV(bw *bufio.Writer, keys []exported) error {
+	cw := csv.NewWriter(bw)
+	cw.Write(csvHeader)
+
+	for _, k := range keys {
+		bucket, key := splitBucket(k.stored)
+		value, encoding := k.value, ""
+		if !utf8.ValidString(key) || !utf8.ValidString(value) {
+			key = base64.StdEncoding.EncodeToString([]byte(key))
+			value = base64.StdEncoding.EncodeToString([]byte(value))
+			encoding = "base64"
+		}
+		expiresAt := ""
+		if k.expiresAt != 0 {
+			expiresAt = time.Unix(0, k.expiresAt).UTC().Format(time.RFC3339Nano)
+		}
+		if err := cw.Write([]string{key, value, bucket, expiresAt, encoding}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// splitBucket splits a stored key into its bucket, if any, and the key
+// within it.
+func splitBucket(stored string) (bucket, key string) {
+	if !isBucketKey(stored) {
+		return "", stored
+	}
+	bucket, key, _ = strings.Cut(stored[len(bucketMark):], bucketMark)
+	return bucket, key
+}
+
+func newExportEntry(k exported) exportEntry {
+	var e exportEntry
+
+	var key string
+	e.Bucket, key = splitBucket(k.stored)
+
+	if utf8.ValidString(key) {
+		e.Key = &key
+	} else {
+		e.KeyBase64 = base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	if utf8.ValidString(k.value) {
+		e.Value = &k.value
+	} else {
+		e.ValueBase64 = base64.StdEncoding.EncodeToString([]byte(k.value))
+	}
+	if k.expiresAt != 0 {
+		t := time.Unix(0, k.expiresAt).UTC()
+		e.ExpiresAt = &t
+	}
+	return e
+}
+
+// Import reads a file written by Export and merges it into the store;
+// see ImportWithOptions.
+func (s *Store) Import(in io.Reader, format Format) error {
+	return s.ImportWithOptions(in, ImportOptions{Format: format})
+}
+
+// ImportWithOptions reads a file written by Export and sets every key in
+// it. Writes are logged importBatch at a time, each batch all-or-nothing,
+// and entries whose expiry has already passed are skipped.
+//
+// A merge streams the file, so an error, which names the entry that
+// caused it, leaves the batches before it imported. A replace reads the
+// whole file before writing anything, so a bad file changes nothing;
+// it then deletes the keys that aren't in the file as well.
+func (s *Store) ImportWithOptions(in io.Reader, opts ImportOptions) error {
+	if opts.Mode == ImportReplace {
+		return s.importReplace(in, opts.Format)
+	}
+
+	b := &WriteBatch{}
+	err := readEntries(in, opts.Format, func(rec *wal.Record) error {
+		b.records = append(b.records, rec)
+		if b.Len() < importBatch {
+			return nil
+		}
+		if err := s.Write(b); err != nil {
+			return err
+		}
+		b = &WriteBatch{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if b.Len() == 0 {
+		return nil
+	}
+	return s.Write(b)
+}
+
+func (s *Store) importReplace(in io.Reader, format Format) error {
+	var sets []*wal.Record
+	keep := make(map[string]struct{})
+	err := readEntries(in, format, func(rec *wal.Record) error {
+		sets = append(sets, rec)
+		keep[string(rec.Key)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var records []*wal.Record
+	s.mu.RLock()
+	for key := range s.data {
+		if _, ok := keep[key]; !ok {
+			records = append(records, deleteRecord([]byte(key)))
+		}
+	}
+	s.mu.RUnlock()
+	records = append(records, sets...)
+
+	for len(records) > 0 {
+		n := min(len(records), importBatch)
+		if err := s.Write(&WriteBatch{records: records[:n]}); err != nil {
+			return err
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// readEntries decodes in and calls fn with the write for each entry that
+// hasn't expired.
+func readEntries(in io.Reader, format Format, fn func(*wal.Record) error) error {
+	now := time.Now().UnixNano()
+	n := 0
+	each := func(e importEntry) error {
+		n++
+		if e.expiresAt != 0 && e.expiresAt <= now {
+			return nil
+		}
+		rec, err := e.record()
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", n, err)
+		}
+		return fn(rec)
+	}
+
+	switch format {
+	case FormatJSON, FormatNDJSON:
+		return readJSON(bufio.NewReader(in), format == FormatJSON, each)
+	case FormatCSV:
+		return readCSV(bufio.NewReader(in), each)
+	}
+	return fmt.Errorf("cannot import %v", format)
+}
+
+// readJSON reads a JSON array of entries, or with !array, a stream of
+// them such as NDJSON.
+func readJSON(in io.Reader, array bool, fn func(importEntry) error) error {
+	dec := json.NewDecoder(in)
+	if array {
+		if tok, err := dec.Token(); err != nil {
+			return err
+		} else if tok != json.Delim('[') {
+			return fmt.Errorf("expected a JSON array of entries, got %v", tok)
+		}
+	}
+
+	for n := 1; !array || dec.More(); n++ {
+		var e exportEntry
+		err := dec.Decode(&e)
+		if err == io.EOF && !array {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", n, err)
+		}
+		ie, err := e.decode()
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", n, err)
+		}
+		if err := fn(ie); err != nil {
+			return err
+		}
+	}
+
+	_, err := dec.Token()
+	return err
+}
+
+func (e exportEntry) decode() (importEntry, error) {
+	var ie importEntry
+	switch {
+	case e.Key != nil:
+		ie.key = []byte(*e.Key)
+	case e.KeyBase64 != "":
+		k, err := base64.StdEncoding.DecodeString(e.KeyBase64)
+		if err != nil {
+			return ie, fmt.Errorf("key_base64: %w", err)
+		}
+		ie.key = k
+	default:
+		return ie, errors.New("no key")
+	}
+	switch {
+	case e.Value != nil:
+		ie.value = []byte(*e.Value)
+	case e.ValueBase64 != "":
+		v, err := base64.StdEncoding.DecodeString(e.ValueBase64)
+		if err != nil {
+			return ie, fmt.Errorf("value_base64: %w", err)
+		}
+		ie.value = v
+	default:
+		return ie, fmt.Errorf("no value for key %q", ie.key)
+	}
+
+	ie.bucket = e.Bucket
+	if e.ExpiresAt != nil {
+		ie.expiresAt = e.ExpiresAt.UnixNano()
+	}
+	return ie, nil
+}
+
+func readCSV(in io.Reader, fn func(importEntry) error) error {
+	cr := csv.NewReader(in)
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("reading CSV header: %w", err)
+	}
+
+	col := make(map[string]int)
+	for i, name := range header {
+		col[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"key", "value"} {
+		if _, ok := col[required]; !ok {
+			return fmt.Errorf("CSV header has no %s column", required)
+		}
+	}
+	field := func(row []string, name string) string {
+		if i, ok := col[name]; ok {
+			return row[i]
+		}
+		return ""
+	}
+
+	for n := 1; ; n++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		e := importEntry{
+			bucket: field(row, "bucket"),
+			key:    []byte(field(row, "key")),
+			value:  []byte(field(row, "value")),
+		}
+		switch enc := field(row, "encoding"); enc {
+		case "":
+		case "base64":
+			if e.key, err = base64.StdEncoding.DecodeString(string(e.key)); err != nil {
+				return fmt.Errorf("entry %d: key: %w", n, err)
+			}
+			if e.value, err = base64.StdEncoding.DecodeString(string(e.value)); err != nil {
+				return fmt.Errorf("entry %d: value: %w", n, err)
+			}
+		default:
+			return fmt.Errorf("entry %d: unknown encoding %q", n, enc)
+		}
+		if at := field(row, "expires_at"); at != "" {
+			t, err := time.Parse(time.RFC3339Nano, at)
+			if err != nil {
+				return fmt.Errorf("entry %d: expires_at: %w", n, err)
+			}
+			e.expiresAt = t.UnixNano()
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// record is the write that restores e.
+func (e importEntry) record() (*wal.Record, error) {
+	key := e.key
+	if e.bucket != "" {
+		if strings.Contains(e.bucket, bucketMark) {
+			return nil, ErrBucketName
+		}
+		key = append([]byte(bucketMark+e.bucket+bucketMark), key...)
+	}
+
+	if e.expiresAt != 0 {
+		return &wal.Record{Op: wal.OpSetTTL, Key: key, Value: encodeTTLValue(e.expiresAt, string(e.value))}, nil
+	}
+	return &wal.Record{Op: wal.OpSet, Key: key, Value: e.value}, nil
+}
@@ -0,0 +1,596 @@
+package store
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// ErrFamilySpan is returned, with SetBucketFamilies on, by a batch that
+// writes to more than one bucket, or to a bucket and keys outside any,
+// as it can't be logged in one family whole.
+var ErrFamilySpan = errors.New("batch spans bucket families")
+
+// ErrBucketInStoreLog is returned by a Bucket's Backup and Purge for a
+// bucket with records in the store's WAL, logged before SetBucketFamilies
+// was turned on or by a replicated batch spanning families, which the
+// family alone would leave behind.
+var ErrBucketInStoreLog = errors.New("bucket has records in the store's WAL")
+
+// errNoFamilies is returned by the bucket family calls on a store
+// without SetBucketFamilies.
+var errNoFamilies = errors.New("bucket families are off")
+
+// bucketFamilies are the WALs SetBucketFamilies logs buckets in, one per
+// bucket, each in a directory under opts.Dir. Guarded by s.mu.
+type bucketFamilies struct {
+	opts    wal.Options         // template for every family's WAL
+	logs    map[string]*wal.WAL // bucket name -> its family, once written
+	inStore map[string]bool     // buckets with records in the store's WAL
+}
+
+// purgedSuffix marks a family's directory being removed, so a crash part
+// way never leaves a family with only some of its segments.
+const purgedSuffix = ".purged"
+
+// SetBucketFamilies logs each bucket's records in a WAL of its own, a
+// segment family in a directory under opts.Dir named after the bucket,
+// instead of in the store's WAL, so a Bucket's Backup, Restore and Purge
+// can act on it without touching the others. opts is the template for
+// the families, whose Dir and LSNs are filled in: they share the store's
+// LSNs, so LSNs stay unique and in order across every family. Call it
+// before Recover, which replays the families after the store's WAL.
+//
+// The store's WAL keeps everything else, including what buckets logged
+// before families were turned on; a Bucket's Backup and Purge fail with
+// ErrBucketInStoreLog while it has any. Store.Backup archives the
+// families with the store's WAL. Replication streams a single log, so
+// SetBucketFamilies fails with wal.ErrLSNsShared on a store whose WAL is
+// replicated, and a replication.Primary refuses to serve one with
+// families open. A batch has to stay within one bucket, or outside all
+// of them, and fails with ErrFamilySpan otherwise; only a replicated one,
+// which can't be turned away, goes to the store's WAL whole.
+func (s *Store) SetBucketFamilies(opts wal.Options) error {
+	if opts.Dir == "" {
+		return errors.New("bucket families need a directory")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.families != nil {
+		return errors.New("bucket families are already set")
+	}
+	if s.wal.LSNs().Streamed() {
+		return fmt.Errorf("bucket families on a replicated store: %w", wal.ErrLSNsShared)
+	}
+	if s.recovery.Duration > 0 || len(s.data) > 0 {
+		return errors.New("set bucket families before Recover")
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	f := &bucketFamilies{opts: opts, logs: make(map[string]*wal.WAL), inStore: make(map[string]bool)}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		// left by a Purge or Reset a crash cut short
+		if strings.HasSuffix(e.Name(), purgedSuffix) {
+			if err := os.RemoveAll(filepath.Join(opts.Dir, e.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		name, err := hex.DecodeString(e.Name())
+		if err != nil {
+			continue
+		}
+		w, err := s.openFamily(f, string(name))
+		if err != nil {
+			closeFamilies(f)
+			return err
+		}
+		f.logs[string(name)] = w
+	}
+
+	s.families = f
+	return nil
+}
+
+func (f *bucketFamilies) path(name string) string {
+	return filepath.Join(f.opts.Dir, hex.EncodeToString([]byte(name)))
+}
+
+func (s *Store) openFamily(f *bucketFamilies, name string) (*wal.WAL, error) {
+	opts := f.opts
+	opts.Dir = f.path(name)
+	opts.LSNs = s.wal.LSNs()
+
+	w, err := wal.OpenWithOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("bucket %q: %w", name, err)
+	}
+	return w, nil
+}
+
+func closeFamilies(f *bucketFamilies) error {
+	var firstErr error
+	for _, w := range f.logs {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// familyOf returns the bucket whose family rec is logged in, "" for the
+// store's WAL, and whether it spans more than one. A batch's idempotency
+// marks go where the rest of it does, and resets in the store's WAL.
+func familyOf(rec *wal.Record) (name string, spans bool) {
+	records := []*wal.Record{rec}
+	if rec.Op == wal.OpBatch {
+		records, _ = wal.DecodeBatch(rec.Value)
+	}
+
+	first := true
+	for _, r := range records {
+		if r.Op == wal.OpIdempotent && len(records) > 1 {
+			continue
+		}
+		in := ""
+		if key := string(r.Key); r.Op != wal.OpReset && isBucketKey(key) {
+			in = bucketOf(key)
+		}
+		if !first && in != name {
+			return "", true
+		}
+		name, first = in, false
+	}
+	return name, false
+}
+
+// hasReset reports whether rec clears the store, alone or in a batch.
+func hasReset(rec *wal.Record) bool {
+	if rec.Op != wal.OpBatch {
+		return rec.Op == wal.OpReset
+	}
+	records, _ := wal.DecodeBatch(rec.Value)
+	for _, r := range records {
+		if r.Op == wal.OpReset {
+			return true
+		}
+	}
+	return false
+}
+
+// note records the buckets rec, logged in the store's WAL, writes to. A
+// reset forgets the ones before it.
+func (f *bucketFamilies) note(rec *wal.Record) {
+	records := []*wal.Record{rec}
+	if rec.Op == wal.OpBatch {
+		records, _ = wal.DecodeBatch(rec.Value)
+	}
+	for _, r := range records {
+		switch key := string(r.Key); {
+		case r.Op == wal.OpReset:
+			clear(f.inStore)
+		case isBucketKey(key):
+			f.inStore[bucketOf(key)] = true
+		}
+	}
+}
+
+// loggedLocked notes rec, just logged in w, for the families. Caller
+// holds s.mu.
+func (s *Store) loggedLocked(w *wal.WAL, rec *wal.Record) {
+	if s.families != nil && w == s.wal {
+		s.families.note(rec)
+	}
+}
+
+// logOfLocked returns the WAL rec is logged in, opening its bucket's
+// family on its first write. replicated sends a batch spanning families
+// to the store's WAL rather than failing it. Caller holds s.mu.
+func (s *Store) logOfLocked(rec *wal.Record, replicated bool) (*wal.WAL, error) {
+	if s.families == nil {
+		return s.wal, nil
+	}
+
+	name, spans := familyOf(rec)
+	switch {
+	case spans && !replicated:
+		return nil, ErrFamilySpan
+	case spans || name == "":
+		return s.wal, nil
+	}
+
+	if w, ok := s.families.logs[name]; ok {
+		return w, nil
+	}
+	w, err := s.openFamily(s.families, name)
+	if err != nil {
+		return nil, err
+	}
+	s.families.logs[name] = w
+	return w, nil
+}
+
+// logsLocked returns the store's WAL followed by every family. Caller
+// holds s.mu.
+func (s *Store) logsLocked() []*wal.WAL {
+	logs := []*wal.WAL{s.wal}
+	if s.families != nil {
+		for _, w := range s.families.logs {
+			logs = append(logs, w)
+		}
+	}
+	return logs
+}
+
+// flushLogs flushes the store's WAL and every family.
+func (s *Store) flushLogs() {
+	s.mu.RLock()
+	logs := s.logsLocked()
+	s.mu.RUnlock()
+
+	for _, w := range logs {
+		w.Flush()
+	}
+}
+
+// replayer is a WAL or a snapshot of one.
+type replayer interface {
+	Replay(fn func(*wal.Record) error) (wal.ReadStats, error)
+}
+
+// replayLogs replays logs into fn one after another, the store's WAL
+// first, summing their stats. The families hold keys of their own, so
+// only a reset orders records across logs: a family's records from
+// before the last reset in the store's WAL are left out, as a crash
+// between logging a reset and removing the families would keep them.
+func replayLogs(logs []replayer, fn func(*wal.Record) error) (wal.ReadStats, error) {
+	var total wal.ReadStats
+	var reset uint64
+	for i, log := range logs {
+		stats, err := log.Replay(func(rec *wal.Record) error {
+			if i == 0 && len(logs) > 1 && hasReset(rec) {
+				reset = rec.LSN
+			}
+			if i > 0 && rec.LSN < reset {
+				return nil
+			}
+			return fn(rec)
+		})
+		total.Segments += stats.Segments
+		total.Records += stats.Records
+		total.Bytes += stats.Bytes
+		total.CorruptBytes += stats.CorruptBytes
+		total.Resyncs += stats.Resyncs
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// replayFunc is a replayer made of a function.
+type replayFunc func(fn func(*wal.Record) error) (wal.ReadStats, error)
+
+func (f replayFunc) Replay(fn func(*wal.Record) error) (wal.ReadStats, error) {
+	return f(fn)
+}
+
+// replayersLocked returns the store's WAL and its families to replay.
+// Caller holds s.mu.
+func (s *Store) replayersLocked() []replayer {
+	var logs []replayer
+	for _, w := range s.logsLocked() {
+		logs = append(logs, w)
+	}
+	return logs
+}
+
+// recoverersLocked is replayersLocked for Recover, which also notes the
+// buckets with records in the store's WAL. Caller holds s.mu.
+func (s *Store) recoverersLocked() []replayer {
+	logs := s.replayersLocked()
+	if f := s.families; f != nil {
+		clear(f.inStore)
+		log := logs[0]
+		logs[0] = replayFunc(func(fn func(*wal.Record) error) (wal.ReadStats, error) {
+			return log.Replay(func(rec *wal.Record) error {
+				f.note(rec)
+				return fn(rec)
+			})
+		})
+	}
+	return logs
+}
+
+// backupFamilies is Store.Backup with families on: the store's WAL and
+// every family are captured together under s.mu, so the archive is one
+// point in time across them, and copied without it. The families go in
+// directories of the archive named as under SetBucketFamilies' Dir.
+func (s *Store) backupFamilies(out io.Writer) error {
+	s.mu.Lock()
+	names := []string{""}
+	logs := []*wal.WAL{s.wal}
+	for name, w := range s.families.logs {
+		names = append(names, filepath.Base(s.families.path(name)))
+		logs = append(logs, w)
+	}
+	var snaps []*wal.Snapshot
+	for _, w := range logs {
+		snap, err := w.Snapshot()
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		defer snap.Close()
+		snaps = append(snaps, snap)
+	}
+	s.mu.Unlock()
+
+	tw := tar.NewWriter(out)
+	for i, snap := range snaps {
+		if err := snap.Archive(tw, names[i]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// RestoreInto unpacks an archive written by Store.Backup: the store's
+// WAL into dir, as wal.RestoreInto does, and its bucket families, if it
+// has any, into familiesDir, the Dir to pass SetBucketFamilies. Neither
+// may hold the logs already.
+func RestoreInto(dir, familiesDir string, in io.Reader) error {
+	if err := wal.RestoreInto(dir, in); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := hex.DecodeString(e.Name()); err != nil || !e.IsDir() || filepath.Clean(familiesDir) == filepath.Clean(dir) {
+			continue
+		}
+		if err := os.MkdirAll(familiesDir, 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(dir, e.Name()), filepath.Join(familiesDir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotLogsLocked snapshots the store's WAL and the families of
+// buckets, or every family if buckets is nil, for replaying them while
+// writes go on. Close them with closeSnapshots. Caller holds s.mu.
+func (s *Store) snapshotLogsLocked(buckets []string) ([]replayer, error) {
+	logs := []*wal.WAL{s.wal}
+	if s.families != nil {
+		if buckets == nil {
+			logs = s.logsLocked()
+		}
+		for _, name := range buckets {
+			if w, ok := s.families.logs[name]; ok {
+				logs = append(logs, w)
+			}
+		}
+	}
+
+	var snaps []replayer
+	for _, w := range logs {
+		snap, err := w.Snapshot()
+		if err != nil {
+			closeSnapshots(snaps)
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+func closeSnapshots(snaps []replayer) {
+	for _, snap := range snaps {
+		snap.(*wal.Snapshot).Close()
+	}
+}
+
+// dropFamiliesLocked removes every family, for a reset, once it is
+// logged. Caller holds s.mu.
+func (s *Store) dropFamiliesLocked() error {
+	if s.families == nil {
+		return nil
+	}
+
+	var firstErr error
+	for name := range s.families.logs {
+		if err := s.removeFamilyLocked(name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// removeFamilyLocked closes a bucket's family, if it has one, and
+// deletes its directory. Caller holds s.mu.
+func (s *Store) removeFamilyLocked(name string) error {
+	w, ok := s.families.logs[name]
+	if !ok {
+		return nil
+	}
+	delete(s.families.logs, name)
+
+	if err := w.Close(); err != nil && !errors.Is(err, wal.ErrClosed) {
+		return err
+	}
+	dir := s.families.path(name)
+	if err := os.Rename(dir, dir+purgedSuffix); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir + purgedSuffix)
+}
+
+// Backup writes a point-in-time tar archive of the bucket's family to
+// out, the same as wal.Backup for the store's WAL. A bucket not written
+// since SetBucketFamilies has no family to back up, and one with records
+// in the store's WAL fails with ErrBucketInStoreLog.
+func (b *Bucket) Backup(out io.Writer) error {
+	s := b.s
+	s.mu.RLock()
+	if s.families == nil {
+		s.mu.RUnlock()
+		return errNoFamilies
+	}
+	w, ok := s.families.logs[b.name]
+	inStore := s.families.inStore[b.name]
+	s.mu.RUnlock()
+
+	if inStore {
+		return fmt.Errorf("%w: %q", ErrBucketInStoreLog, b.name)
+	}
+	if !ok {
+		return fmt.Errorf("bucket %q has no family", b.name)
+	}
+	return w.Backup(out)
+}
+
+// Restore writes an archive taken by Backup back into a bucket with no
+// keys and no family, such as one just purged. Each record is logged in
+// the bucket's new family as it is applied, keeping its time and origin
+// but taking a new LSN, so the bucket can be restored into a store other
+// than the one it was backed up from. Records for keys outside the
+// bucket fail it, and a restore that fails part way keeps the records
+// before the failure; Purge clears them for another try.
+func (b *Bucket) Restore(in io.Reader) error {
+	s := b.s
+	s.mu.RLock()
+	f := s.families
+	s.mu.RUnlock()
+	if f == nil {
+		return errNoFamilies
+	}
+
+	// into a scratch directory beside the families, to read it back
+	tmp, err := os.MkdirTemp(f.opts.Dir, ".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := wal.RestoreInto(tmp, in); err != nil {
+		return err
+	}
+	src, err := wal.OpenReadOnly(wal.Options{
+		Dir:            tmp,
+		EncryptionKeys: f.opts.EncryptionKeys,
+		MaxRecordSize:  f.opts.MaxRecordSize,
+	})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writableLocked(); err != nil {
+		return err
+	}
+	if err := s.useBucketLocked(b.name); err != nil {
+		return err
+	}
+	if _, ok := s.families.logs[b.name]; ok || s.hasPrefixLocked(b.prefix) {
+		return fmt.Errorf("bucket %q is not empty", b.name)
+	}
+
+	now := time.Now().UnixNano()
+	_, err = src.Replay(func(rec *wal.Record) error {
+		if name, spans := familyOf(rec); spans || name != b.name {
+			return fmt.Errorf("archive holds writes outside bucket %q", b.name)
+		}
+		w, err := s.logOfLocked(rec, false)
+		if err != nil {
+			return err
+		}
+
+		relogged := *rec
+		lsn, err := w.Append(&relogged)
+		if !wal.Logged(err) {
+			return err
+		}
+		relogged.LSN = lsn
+		if err := s.apply(&relogged, now); err != nil {
+			return err
+		}
+		s.ops.wrote(&relogged)
+		return nil
+	})
+	return err
+}
+
+// Purge deletes every key in the bucket and, with SetBucketFamilies on,
+// its family, without logging anything or touching the other buckets.
+// Watchers see each key deleted. A bucket with records in the store's
+// WAL, which would come back on the next Recover, fails with
+// ErrBucketInStoreLog and is left as it is; Delete its keys instead.
+func (b *Bucket) Purge() error {
+	s := b.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writableLocked(); err != nil {
+		return err
+	}
+	if s.families == nil {
+		return errNoFamilies
+	}
+	if s.families.inStore[b.name] {
+		return fmt.Errorf("%w: %q", ErrBucketInStoreLog, b.name)
+	}
+
+	s.idle.mu.Lock()
+	if _, ok := s.idle.evicted[b.name]; ok {
+		os.Remove(s.idle.path(b.name))
+		delete(s.idle.evicted, b.name)
+	}
+	delete(s.idle.used, b.name)
+	s.idle.mu.Unlock()
+
+	var keys []string
+	for n := s.index.seek(b.prefix); n != nil && strings.HasPrefix(n.key, b.prefix); n = n.next[0] {
+		keys = append(keys, n.key)
+	}
+	for _, key := range keys {
+		s.remove(key)
+		delete(s.tombstones, key)
+		s.notify(EventDelete, key, "", Caller{})
+	}
+	return s.removeFamilyLocked(b.name)
+}
+
+// hasPrefixLocked reports whether any key, live or expired, starts with
+// prefix. Caller holds s.mu.
+func (s *Store) hasPrefixLocked(prefix string) bool {
+	n := s.index.seek(prefix)
+	return n != nil && strings.HasPrefix(n.key, prefix)
+}
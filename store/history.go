@@ -0,0 +1,103 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// Revision is one write to a key as History reports it: the value it
+// left, or Deleted if it removed the key, stamped like GetWithMeta.
+type Revision struct {
+	Meta
+	Deleted bool   // by a delete or a reset
+	Caller  Caller // who it was made for, if it was logged with one
+}
+
+// History returns the writes to key still in the log, newest first, up
+// to limit of them, or all with a limit of 0. It reads the whole log, so
+// it is meant for audits and debugging rather than the request path, and
+// it only goes back as far as the oldest segment kept, which is never
+// past the last Reset. Expiry isn't a
+// write and doesn't show: a value set with a TTL is reported with when it
+// was to expire.
+func (s *Store) History(key string, limit int) ([]Revision, error) {
+	family := []string{}
+	if isBucketKey(key) {
+		family = append(family, bucketOf(key))
+	}
+	s.mu.RLock()
+	snaps, err := s.snapshotLogsLocked(family)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer closeSnapshots(snaps)
+
+	// only the key's own records go in, which is all its value depends on
+	scratch := New(s.wal)
+	var revs []Revision
+	record := func(rec, stamp *wal.Record) error {
+		_, existed := scratch.data[key]
+		if err := scratch.apply(rec, stamp.Timestamp); err != nil {
+			return err
+		}
+		value, exists := scratch.data[key]
+		if !exists && !existed && rec.Op == wal.OpReset {
+			return nil
+		}
+
+		rev := Revision{Meta: Meta{Value: value, Version: stamp.LSN}, Deleted: !exists, Caller: callerOf(stamp)}
+		if stamp.Timestamp != 0 {
+			rev.Modified = time.Unix(0, stamp.Timestamp)
+		}
+		if exp, ok := scratch.expires[key]; ok {
+			rev.Expires = time.Unix(0, exp)
+		}
+		revs = append(revs, rev)
+		if limit > 0 && len(revs) > limit {
+			revs = revs[1:]
+		}
+		return nil
+	}
+
+	_, err = replayLogs(snaps, func(rec *wal.Record) error {
+		var err error
+		switch rec.Op {
+		case wal.OpReset:
+			err = record(rec, rec)
+		case wal.OpBatch:
+			records, derr := wal.DecodeBatch(rec.Value)
+			if derr != nil {
+				return nil // set aside, as Recover does
+			}
+			for _, r := range records {
+				if !canApply(r.Op) {
+					return nil
+				}
+			}
+			for _, r := range records {
+				if string(r.Key) == key && err == nil {
+					err = record(r, rec)
+				}
+			}
+		default:
+			if string(rec.Key) == key {
+				err = record(rec, rec)
+			}
+		}
+		if errors.Is(err, ErrUnappliable) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(revs)-1; i < j; i, j = i+1, j-1 {
+		revs[i], revs[j] = revs[j], revs[i]
+	}
+	return revs, nil
+}
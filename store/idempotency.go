@@ -0,0 +1,61 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// DefaultIdempotencyWindow is how long WriteIdempotent remembers a key
+// when given no window.
+const DefaultIdempotencyWindow = 10 * time.Minute
+
+var errAlreadyApplied = errors.New("already applied")
+
+// WriteIdempotent is Write for requests that may be retried, such as
+// network writes whose response was lost. The first call with a given
+// idemKey applies b and logs the key with it, atomically; calls with the
+// same key within window after that apply nothing and report false, even
+// across restarts. A window of 0 means DefaultIdempotencyWindow.
+func (s *Store) WriteIdempotent(idemKey string, window time.Duration, b *WriteBatch) (bool, error) {
+	return s.writeIdempotent(idemKey, window, b, Caller{})
+}
+
+func (s *Store) writeIdempotent(idemKey string, window time.Duration, b *WriteBatch, by Caller) (bool, error) {
+	if window <= 0 {
+		window = DefaultIdempotencyWindow
+	}
+
+	marked := &WriteBatch{records: append([]*wal.Record{{
+		Op:    wal.OpIdempotent,
+		Key:   []byte(idemKey),
+		Value: encodeTTLValue(time.Now().Add(window).UnixNano(), ""),
+	}}, b.records...)}
+
+	err := s.writeIf(marked, by, func() error {
+		if exp, ok := s.idempotency[idemKey]; ok && exp > time.Now().UnixNano() {
+			return errAlreadyApplied
+		}
+		return nil
+	})
+	if errors.Is(err, errAlreadyApplied) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	s.sweepOnce.Do(func() { go s.sweepLoop() })
+	return true, nil
+}
+
+// Applied reports whether a write with idemKey was applied within its
+// window.
+func (s *Store) Applied(idemKey string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	exp, ok := s.idempotency[idemKey]
+	return ok && exp > time.Now().UnixNano()
+}
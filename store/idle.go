@@ -0,0 +1,358 @@
+package store
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// idleBuckets tracks the use of buckets for SetBucketIdleTTL. It has its
+// own lock so reads in a bucket can record their use without s.mu's write
+// lock; when both are held, s.mu is taken first.
+type idleBuckets struct {
+	mu      sync.Mutex
+	ttl     time.Duration // 0 is off
+	dir     string
+	since   int64             // when ttl was set, for buckets not used since
+	used    map[string]int64  // bucket name -> unix nanos of its last use
+	evicted map[string]uint64 // buckets whose keys are in dir, not memory
+	moves   uint64            // evictions so far, the one of each in evicted
+}
+
+// SetBucketIdleTTL moves the keys of buckets nobody has read or written
+// for ttl out of memory and into a file in dir, and reads them back the
+// next time the bucket is used, so memory follows the buckets in use
+// rather than every bucket ever written. Nothing is logged: the WAL still
+// holds every key, so recovery brings them all back and the files only
+// matter while the store is open. Only the walrus user can read them,
+// and with the WAL encrypted they are sealed with its key. A ttl of 0
+// turns it off and brings every bucket back into memory.
+func (s *Store) SetBucketIdleTTL(ttl time.Duration, dir string) error {
+	if ttl < 0 {
+		return errors.New("bucket idle ttl must not be negative")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.loadAllBucketsLocked(); err != nil {
+		return err
+	}
+	if ttl == 0 {
+		s.idle.mu.Lock()
+		s.idle.ttl = 0
+		s.idle.mu.Unlock()
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// left by an earlier run; recovery has loaded what they held
+	stale, _ := filepath.Glob(filepath.Join(dir, "*.bucket"))
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	s.idle.mu.Lock()
+	s.idle.ttl, s.idle.dir = ttl, dir
+	s.idle.since = time.Now().UnixNano()
+	if s.idle.used == nil {
+		s.idle.used = make(map[string]int64)
+		s.idle.evicted = make(map[string]uint64)
+	}
+	s.idle.mu.Unlock()
+
+	s.sweepOnce.Do(func() { go s.sweepLoop() })
+	return nil
+}
+
+// IdleBuckets returns the names of the buckets moved out of memory by
+// SetBucketIdleTTL, sorted.
+func (s *Store) IdleBuckets() []string {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	names := make([]string, 0, len(s.idle.evicted))
+	for name := range s.idle.evicted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// useBucket records a use of the bucket, first reading its keys back into
+// memory if they were moved out. It takes s.mu's write lock only then.
+func (s *Store) useBucket(name string) error {
+	if !s.idle.use(name) {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadBucketLocked(name)
+}
+
+// useBucketLocked is useBucket for the write path. Caller holds s.mu.
+func (s *Store) useBucketLocked(name string) error {
+	if !s.idle.use(name) {
+		return nil
+	}
+	return s.loadBucketLocked(name)
+}
+
+// useBucketsOfLocked loads every bucket rec writes to, or the records of
+// the batch it is, so writes fail before they are logged rather than
+// after, partway through a batch, when a bucket can't be read back.
+// Caller holds s.mu.
+func (s *Store) useBucketsOfLocked(rec *wal.Record) error {
+	s.idle.mu.Lock()
+	on := s.idle.ttl > 0
+	s.idle.mu.Unlock()
+	if !on {
+		return nil
+	}
+
+	var records []*wal.Record
+	if rec.Op == wal.OpBatch {
+		records, _ = wal.DecodeBatch(rec.Value)
+	}
+	for _, r := range append(records, rec) {
+		if key := string(r.Key); isBucketKey(key) {
+			if err := s.useBucketLocked(bucketOf(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// use records a use of the bucket and reports whether it was moved out.
+func (idle *idleBuckets) use(name string) bool {
+	idle.mu.Lock()
+	defer idle.mu.Unlock()
+
+	if idle.ttl == 0 {
+		return false
+	}
+	idle.used[name] = time.Now().UnixNano()
+	_, evicted := idle.evicted[name]
+	return evicted
+}
+
+// bucketOf returns the name of the bucket a stored key is in.
+func bucketOf(key string) string {
+	name, _, _ := strings.Cut(key[len(bucketMark):], bucketMark)
+	return name
+}
+
+func (idle *idleBuckets) path(name string) string {
+	return filepath.Join(idle.dir, hex.EncodeToString([]byte(name))+".bucket")
+}
+
+// evictIdleLocked moves out the buckets unused for the idle ttl. A bucket
+// whose file can't be written stays in memory. Caller holds s.mu.
+func (s *Store) evictIdleLocked(now int64) {
+	s.evictBucketsLocked(now, 0)
+}
+
+// evictBucketsLocked is evictIdleLocked for the buckets unused for
+// idleFor, or the idle ttl if idleFor is 0. It does nothing while the
+// idle ttl is off, as there is no dir to move buckets to. Caller holds
+// s.mu.
+func (s *Store) evictBucketsLocked(now int64, idleFor time.Duration) {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	if s.idle.ttl == 0 {
+		return
+	}
+	if idleFor == 0 {
+		idleFor = s.idle.ttl
+	}
+
+	for n := s.index.seek(bucketMark); n != nil && isBucketKey(n.key); {
+		name := bucketOf(n.key)
+		prefix := bucketMark + name + bucketMark
+
+		last, ok := s.idle.used[name]
+		if !ok {
+			last = s.idle.since
+		}
+		if now-last < int64(idleFor) {
+			n = s.index.seek(bucketMark + name + bucketsEnd)
+			continue
+		}
+
+		records, keys := s.bucketRecordsLocked(prefix, now)
+		n = s.index.seek(bucketMark + name + bucketsEnd)
+		if err := s.idle.write(name, records, s.wal); err != nil {
+			continue
+		}
+
+		for _, key := range keys {
+			s.remove(key)
+		}
+		s.idle.moves++
+		s.idle.evicted[name] = s.idle.moves
+		delete(s.idle.used, name)
+	}
+}
+
+// write saves a bucket's records, sealed with w's key, replacing the file
+// whole so a failed write leaves no partial one behind. Caller holds
+// idle.mu.
+func (idle *idleBuckets) write(name string, records []*wal.Record, w *wal.WAL) error {
+	data, err := wal.EncodeBatch(records)
+	if err != nil {
+		return err
+	}
+
+	path := idle.path(name)
+	if err := os.WriteFile(path+".tmp", w.Seal(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadBucketLocked reads a moved-out bucket back into memory, if it was
+// moved out. A file that can't be read is rebuilt from the log. Caller
+// holds s.mu.
+func (s *Store) loadBucketLocked(name string) error {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	if _, ok := s.idle.evicted[name]; !ok {
+		return nil
+	}
+	records, err := readBucketFile(s.idle.path(name), s.wal)
+	return s.restoreBucketLocked(name, records, err)
+}
+
+// restoreBucketLocked puts the records read from a moved-out bucket's
+// file back in memory, or, if readErr says they couldn't be read, its
+// records from the log. Caller holds s.mu and idle.mu.
+func (s *Store) restoreBucketLocked(name string, records []*wal.Record, readErr error) error {
+	if readErr != nil {
+		var err error
+		if records, err = s.bucketFromLog(name); err != nil {
+			return fmt.Errorf("loading bucket %q: %w", name, err)
+		}
+	}
+
+	now := time.Now().UnixNano()
+	for _, rec := range records {
+		key := string(rec.Key)
+		if rec.Op == wal.OpSetTTL {
+			expiresAt, value, _ := decodeTTLValue(rec.Value)
+			if expiresAt <= now {
+				continue
+			}
+			s.put(key, value)
+			s.expires[key] = expiresAt
+		} else {
+			s.put(key, string(rec.Value))
+		}
+		s.stamp(key, rec)
+	}
+
+	delete(s.idle.evicted, name)
+	os.Remove(s.idle.path(name))
+	return nil
+}
+
+func readBucketFile(path string, w *wal.WAL) ([]*wal.Record, error) {
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := w.Unseal(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return wal.DecodeBatch(data)
+}
+
+// bucketFromLog rebuilds a bucket's keys by replaying the log, the way
+// SelfCheck does. No write reaches a moved-out bucket without loading it
+// first, so the log agrees with the lost file. Caller holds s.mu.
+func (s *Store) bucketFromLog(name string) ([]*wal.Record, error) {
+	snaps, err := s.snapshotLogsLocked([]string{name})
+	if err != nil {
+		return nil, err
+	}
+	defer closeSnapshots(snaps)
+
+	now := time.Now().UnixNano()
+	scratch := New(s.wal)
+	_, err = replayLogs(snaps, func(rec *wal.Record) error {
+		if err := scratch.apply(rec, now); !errors.Is(err, ErrUnappliable) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records, _ := scratch.bucketRecordsLocked(bucketMark+name+bucketMark, now)
+	return records, nil
+}
+
+// bucketRecordsLocked returns the keys under a bucket's prefix, and the
+// live ones as the records that set them again, stamped as their last
+// writes were. Caller holds s.mu.
+func (s *Store) bucketRecordsLocked(prefix string, now int64) ([]*wal.Record, []string) {
+	var records []*wal.Record
+	var keys []string
+	for n := s.index.seek(prefix); n != nil && strings.HasPrefix(n.key, prefix); n = n.next[0] {
+		keys = append(keys, n.key)
+		if s.expired(n.key, now) {
+			continue
+		}
+
+		value, _ := s.valueLocked(n.key)
+		rec := &wal.Record{Op: wal.OpSet, Key: []byte(n.key), Value: []byte(value)}
+		if exp, ok := s.expires[n.key]; ok {
+			rec.Op, rec.Value = wal.OpSetTTL, encodeTTLValue(exp, value)
+		}
+		if m, ok := s.meta[n.key]; ok {
+			rec.Timestamp, rec.LSN = m.modified, m.lsn
+		}
+		records = append(records, rec)
+	}
+	return records, keys
+}
+
+// loadAllBucketsLocked reads every moved-out bucket back, for the
+// operations that need the whole store in memory. Caller holds s.mu.
+func (s *Store) loadAllBucketsLocked() error {
+	for _, name := range s.IdleBuckets() {
+		if err := s.loadBucketLocked(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropIdleBucketsLocked forgets the moved-out buckets, for reset. Caller
+// holds s.mu.
+func (s *Store) dropIdleBucketsLocked() {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	for name := range s.idle.evicted {
+		os.Remove(s.idle.path(name))
+		delete(s.idle.evicted, name)
+	}
+}
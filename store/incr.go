@@ -0,0 +1,116 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+var (
+	ErrNotInteger = errors.New("value is not an integer")
+	ErrOverflow   = errors.New("increment would overflow")
+)
+
+// Incr adds delta to the integer stored at key and returns the result. A
+// missing key counts as 0, and a key with a TTL keeps it. The increment
+// is logged as an OpIncr rather than the resulting value, and the read,
+// add and write happen under one lock, so concurrent increments are
+// never lost.
+func (s *Store) Incr(key string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writableLocked(); err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UnixNano()
+	n, expiresAt, err := s.counter(key, now)
+	if err != nil {
+		return 0, err
+	}
+	if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+		return 0, ErrOverflow
+	}
+
+	rec := &wal.Record{
+		Op:    wal.OpIncr,
+		Key:   []byte(key),
+		Value: encodeIncrValue(expiresAt, delta),
+	}
+	logged := s.logLocked(rec, now)
+	if !wal.Logged(logged) {
+		return 0, logged
+	}
+	if err := s.apply(rec, now); err != nil {
+		return 0, err
+	}
+	s.ops.wrote(rec)
+	return n + delta, logged
+}
+
+// Decr is Incr with -delta.
+func (s *Store) Decr(key string, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, ErrOverflow
+	}
+	return s.Incr(key, -delta)
+}
+
+// counter returns the integer at key and its expiry, 0 and 0 if the key
+// is missing or expired. Caller holds s.mu.
+func (s *Store) counter(key string, now int64) (int64, int64, error) {
+	v, ok := s.valueLocked(key)
+	if !ok || s.expired(key, now) {
+		return 0, 0, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %q", ErrNotInteger, key)
+	}
+	return n, s.expires[key], nil
+}
+
+// applyIncr applies an OpIncr. The record carries the key's expiry at
+// the time, so a counter whose TTL has passed by replay is dropped like
+// the value it was added to. Caller holds s.mu.
+func (s *Store) applyIncr(key string, value []byte, by Caller, now int64) error {
+	if len(value) != 16 {
+		return fmt.Errorf("%w: incr value is %d bytes", ErrUnappliable, len(value))
+	}
+	expiresAt := int64(binary.BigEndian.Uint64(value[0:8]))
+	delta := int64(binary.BigEndian.Uint64(value[8:16]))
+
+	if expiresAt != 0 && expiresAt <= now {
+		s.remove(key)
+		return nil
+	}
+
+	n, _, err := s.counter(key, now)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnappliable, err)
+	}
+
+	result := strconv.FormatInt(n+delta, 10)
+	s.put(key, result)
+	if expiresAt != 0 {
+		s.expires[key] = expiresAt
+	} else {
+		delete(s.expires, key)
+	}
+	s.notify(EventSet, key, result, by)
+	return nil
+}
+
+func encodeIncrValue(expiresAt, delta int64) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(expiresAt))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(delta))
+	return buf
+}
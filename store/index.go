@@ -0,0 +1,130 @@
+package store
+
+import (
+	"math/rand/v2"
+	"strings"
+)
+
+const (
+	indexMaxLevel = 32
+	indexP        = 0.25 // chance a node is promoted one more level
+
+	// estimateSample is how many nodes estimate wants on a level before
+	// it goes by that level's count, which is then off by around
+	// 1/sqrt(estimateSample), some 6%.
+	estimateSample = 256
+)
+
+// index keeps the store's keys in sorted order for Scan and Range. It is
+// a skiplist, so inserts and deletes stay O(log n) on large stores where
+// a sorted slice would shift megabytes per write. Caller holds s.mu.
+type index struct {
+	head  *indexNode
+	level int
+	len   int
+}
+
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+func newIndex() *index {
+	return &index{
+		head:  &indexNode{next: make([]*indexNode, indexMaxLevel)},
+		level: 1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < indexMaxLevel && rand.Float64() < indexP {
+		level++
+	}
+	return level
+}
+
+// path fills update with the rightmost node before key on every level.
+func (ix *index) path(key string, update []*indexNode) *indexNode {
+	n := ix.head
+	for l := ix.level - 1; l >= 0; l-- {
+		for n.next[l] != nil && n.next[l].key < key {
+			n = n.next[l]
+		}
+		if update != nil {
+			update[l] = n
+		}
+	}
+	return n.next[0]
+}
+
+// insert adds key if it is not already present.
+func (ix *index) insert(key string) {
+	var update [indexMaxLevel]*indexNode
+	if n := ix.path(key, update[:]); n != nil && n.key == key {
+		return
+	}
+
+	level := randomLevel()
+	for l := ix.level; l < level; l++ {
+		update[l] = ix.head
+	}
+	if level > ix.level {
+		ix.level = level
+	}
+
+	node := &indexNode{key: key, next: make([]*indexNode, level)}
+	for l := 0; l < level; l++ {
+		node.next[l] = update[l].next[l]
+		update[l].next[l] = node
+	}
+	ix.len++
+}
+
+func (ix *index) remove(key string) {
+	var update [indexMaxLevel]*indexNode
+	n := ix.path(key, update[:])
+	if n == nil || n.key != key {
+		return
+	}
+
+	for l := 0; l < len(n.next); l++ {
+		update[l].next[l] = n.next[l]
+	}
+	for ix.level > 1 && ix.head.next[ix.level-1] == nil {
+		ix.level--
+	}
+	ix.len--
+}
+
+// seek returns the first node with a key >= key.
+func (ix *index) seek(key string) *indexNode {
+	return ix.path(key, nil)
+}
+
+// estimate returns about how many keys start with prefix. It counts them
+// on the highest level that has estimateSample of them and scales up by
+// how rarely nodes reach that level, so it walks a few thousand nodes
+// however many keys match. It reports whether it got down to level 0,
+// where the count is exact.
+func (ix *index) estimate(prefix string) (int, bool) {
+	n := ix.head
+	scale := 1.0
+	for l := 1; l < ix.level; l++ {
+		scale /= indexP
+	}
+
+	for l := ix.level - 1; ; l-- {
+		for n.next[l] != nil && n.next[l].key < prefix {
+			n = n.next[l]
+		}
+		count := 0
+		for m := n.next[l]; m != nil && strings.HasPrefix(m.key, prefix); m = m.next[l] {
+			count++
+		}
+		if count >= estimateSample || l == 0 {
+			return int(float64(count) * scale), l == 0
+		}
+		scale *= indexP
+	}
+}
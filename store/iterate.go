@@ -0,0 +1,166 @@
+package store
+
+import (
+	"strings"
+	"time"
+)
+
+// iteratePage is how many entries Iterate reads per hold of the lock.
+const iteratePage = 256
+
+// iteration is an Iterate in progress. Writes to its keys save what the
+// keys held when it started, the first time each is written, so it goes
+// on seeing that while it walks the index a page at a time.
+type iteration struct {
+	prefix  string
+	buckets bool  // whether keys in buckets are in it, as they are under a prefix
+	start   int64 // unix nanos, the time keys' expiry is judged at
+	prior   map[string]priorValue
+	written *index // prior's keys, sorted, for the ones since deleted
+}
+
+// priorValue is what a key written since an iteration started held then.
+type priorValue struct {
+	value string
+	live  bool
+}
+
+// Iterate calls fn with every live key, leaving out the keys in buckets,
+// and its value, in sorted order, until fn returns false. It sees the
+// store as it was when it started, like a snapshot, without holding the
+// lock while fn runs: writes go on meanwhile, and only the first write to
+// each key after it started costs more, to save the key's value. As fn
+// runs without the lock it may write to the store. Iterate is an
+// iter.Seq2, so it can be ranged over:
+//
+//	for key, value := range s.Iterate {
+//		...
+//	}
+func (s *Store) Iterate(fn func(key, value string) bool) {
+	s.iterate("", fn)
+}
+
+// iterate is Iterate over the keys starting with prefix, those in buckets
+// included if prefix is not empty, as with Scan.
+func (s *Store) iterate(prefix string, fn func(key, value string) bool) {
+	s.ops.scans.Add(1)
+
+	it := &iteration{
+		prefix:  prefix,
+		buckets: prefix != "",
+		start:   time.Now().UnixNano(),
+		prior:   make(map[string]priorValue),
+		written: newIndex(),
+	}
+	s.mu.Lock()
+	if s.iterations == nil {
+		s.iterations = make(map[*iteration]struct{})
+	}
+	s.iterations[it] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.iterations, it)
+		s.mu.Unlock()
+	}()
+
+	after, first := prefix, true
+	for {
+		s.mu.RLock()
+		page, more := s.iteratePageLocked(it, after, first)
+		s.mu.RUnlock()
+
+		for _, e := range page {
+			if !fn(e.Key, e.Value) {
+				return
+			}
+		}
+		if !more {
+			return
+		}
+		after, first = page[len(page)-1].Key, false
+	}
+}
+
+// iteratePageLocked returns up to iteratePage of it's entries from after
+// on, after itself included only for the first page, and whether there
+// may be more. It merges the keys in the index, as they are now or as
+// they were if written since, with the keys deleted since. Caller holds
+// s.mu.
+func (s *Store) iteratePageLocked(it *iteration, after string, first bool) ([]Entry, bool) {
+	// written has no keys in buckets unless it.buckets is set
+	skip := func(n *indexNode) *indexNode {
+		if !it.buckets {
+			n = s.skipBuckets(n)
+		}
+		if n != nil && !strings.HasPrefix(n.key, it.prefix) {
+			return nil
+		}
+		return n
+	}
+	from := func(ix *index) *indexNode {
+		n := skip(ix.seek(after))
+		if n != nil && !first && n.key == after {
+			n = skip(n.next[0])
+		}
+		return n
+	}
+	now, was := from(s.index), from(it.written)
+
+	var page []Entry
+	for len(page) < iteratePage {
+		var key string
+		switch {
+		case now == nil && was == nil:
+			return page, false
+		case was == nil || now != nil && now.key < was.key:
+			key, now = now.key, skip(now.next[0])
+		default:
+			if now != nil && now.key == was.key {
+				now = skip(now.next[0])
+			}
+			key, was = was.key, skip(was.next[0])
+		}
+		if v, ok := it.valueLocked(s, key); ok {
+			page = append(page, Entry{Key: key, Value: v})
+		}
+	}
+	return page, true
+}
+
+// valueLocked returns what key held when it started. Caller holds s.mu.
+func (it *iteration) valueLocked(s *Store, key string) (string, bool) {
+	if p, ok := it.prior[key]; ok {
+		return p.value, p.live
+	}
+	if s.expired(key, it.start) {
+		return "", false
+	}
+	return s.valueLocked(key)
+}
+
+// keepPriorLocked saves what key holds for the iterations in progress
+// that haven't seen it written yet, ahead of a write to it. Caller holds
+// s.mu.
+func (s *Store) keepPriorLocked(key string) {
+	for it := range s.iterations {
+		if _, ok := it.prior[key]; ok || !strings.HasPrefix(key, it.prefix) || !it.buckets && isBucketKey(key) {
+			continue
+		}
+		v, ok := it.valueLocked(s, key)
+		it.prior[key] = priorValue{v, ok}
+		it.written.insert(key)
+	}
+}
+
+// keepAllPriorLocked is keepPriorLocked for every key, ahead of a reset.
+// Caller holds s.mu.
+func (s *Store) keepAllPriorLocked() {
+	if len(s.iterations) == 0 {
+		return
+	}
+	for n := s.index.seek(""); n != nil; n = n.next[0] {
+		s.keepPriorLocked(n.key)
+	}
+}
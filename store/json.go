@@ -0,0 +1,229 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// ErrNotJSON is returned by the JSON methods for a value that isn't JSON.
+var ErrNotJSON = errors.New("value is not JSON")
+
+// ErrJSONPath is returned by JSONSet for a path that runs into something
+// other than an object or an array.
+var ErrJSONPath = errors.New("JSON path doesn't fit the document")
+
+// SetJSON stores v encoded as JSON under key, as Set does.
+func (s *Store) SetJSON(key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Set(key, string(data))
+}
+
+// GetJSON decodes key's JSON value into dst, as json.Unmarshal does, and
+// reports whether the key was there.
+func (s *Store) GetJSON(key string, dst any) (bool, error) {
+	val, ok := s.Get(key)
+	if !ok {
+		return false, nil
+	}
+	if !json.Valid([]byte(val)) {
+		return true, ErrNotJSON
+	}
+	return true, json.Unmarshal([]byte(val), dst)
+}
+
+// JSONGet returns the part of key's JSON document at path, such as
+// "user.name" or "items[0].id" (or "items.0.id"), as the JSON it is in
+// the document. Each step splits one object or array into its members'
+// raw JSON, so the values off the path are scanned but never decoded
+// into Go values. ok is false if the key or the path isn't there; an
+// empty path is the whole document.
+func (s *Store) JSONGet(key, path string) (json.RawMessage, bool, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	val, ok := s.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	if !json.Valid([]byte(val)) {
+		return nil, false, ErrNotJSON
+	}
+
+	doc := json.RawMessage(val)
+	for _, step := range steps {
+		switch jsonKind(doc) {
+		case '{':
+			var obj map[string]json.RawMessage
+			json.Unmarshal(doc, &obj)
+			if doc, ok = obj[step.name]; !ok {
+				return nil, false, nil
+			}
+		case '[':
+			var arr []json.RawMessage
+			json.Unmarshal(doc, &arr)
+			i, err := strconv.Atoi(step.name)
+			if err != nil || i < 0 || i >= len(arr) {
+				return nil, false, nil
+			}
+			doc = arr[i]
+		default:
+			return nil, false, nil
+		}
+	}
+	return doc, true, nil
+}
+
+// JSONSet sets the part of key's JSON document at path to v encoded as
+// JSON, reading and writing the document under one lock, so concurrent
+// JSONSets of different paths all land. Objects missing along the path
+// are made, arrays for an [i] step, an index one past an array's end
+// appends to it, and a key that isn't there starts as an object. The
+// key keeps its TTL. The whole document is logged, the objects and
+// arrays along the path re-encoded compactly with their keys sorted, a
+// duplicate key keeping only its last value; <, > and & are left as
+// they are rather than escaped as json.Marshal does. A path running
+// into anything else, such as a string, fails with ErrJSONPath.
+func (s *Store) JSONSet(key, path string, v any) error {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return err
+	}
+	data, err := marshalJSON(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writableLocked(); err != nil {
+		return err
+	}
+	var doc json.RawMessage
+	if val, ok := s.valueLocked(key); ok && !s.expiredNow(key) {
+		if !json.Valid([]byte(val)) {
+			return ErrNotJSON
+		}
+		doc = json.RawMessage(val)
+	}
+	updated, err := jsonWith(doc, steps, data)
+	if err != nil {
+		return fmt.Errorf("%w: %s in %q", err, path, key)
+	}
+
+	rec := setRecord(key, string(updated))
+	if exp, ok := s.expires[key]; ok && doc != nil {
+		rec = &wal.Record{Op: wal.OpSetTTL, Key: rec.Key, Value: encodeTTLValue(exp, string(updated))}
+	}
+	return s.writeIfLocked(rec, nil)
+}
+
+// jsonWith returns doc with value at steps, doc being nil if it isn't
+// there yet.
+func jsonWith(doc json.RawMessage, steps []jsonStep, value json.RawMessage) (json.RawMessage, error) {
+	if len(steps) == 0 {
+		return value, nil
+	}
+	step, rest := steps[0], steps[1:]
+
+	kind := jsonKind(doc)
+	if kind == 0 && step.index {
+		kind = '['
+	}
+	switch kind {
+	case 0, '{':
+		obj := make(map[string]json.RawMessage)
+		if doc != nil {
+			json.Unmarshal(doc, &obj)
+		}
+		next, err := jsonWith(obj[step.name], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		obj[step.name] = next
+		return marshalJSON(obj)
+
+	case '[':
+		var arr []json.RawMessage
+		if doc != nil {
+			json.Unmarshal(doc, &arr)
+		}
+		i, err := strconv.Atoi(step.name)
+		if err != nil || i < 0 || i > len(arr) {
+			return nil, ErrJSONPath
+		}
+		if i == len(arr) {
+			arr = append(arr, nil)
+		}
+		next, err := jsonWith(arr[i], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = next
+		return marshalJSON(arr)
+	}
+	return nil, ErrJSONPath
+}
+
+// marshalJSON is json.Marshal without its HTML escaping, which would
+// rewrite the strings of the document that JSONSet didn't touch.
+func marshalJSON(v any) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// jsonKind returns the first byte of valid JSON doc, '{' for an object
+// and '[' for an array, or 0 if doc is empty.
+func jsonKind(doc json.RawMessage) byte {
+	doc = bytes.TrimLeft(doc, " \t\r\n")
+	if len(doc) == 0 {
+		return 0
+	}
+	return doc[0]
+}
+
+// jsonStep is a step along a JSON path: an object's field, or an array
+// index, which may be written as a field too.
+type jsonStep struct {
+	name  string
+	index bool // written as [i]
+}
+
+// parseJSONPath splits user.name, .items[2].id or items.2.id into its
+// steps.
+func parseJSONPath(path string) ([]jsonStep, error) {
+	var steps []jsonStep
+	for _, part := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		if part == "" {
+			continue
+		}
+		name, rest, _ := strings.Cut(part, "[")
+		if name != "" {
+			steps = append(steps, jsonStep{name: name})
+		}
+		for rest != "" {
+			idx, after, ok := strings.Cut(rest, "]")
+			if !ok {
+				return nil, fmt.Errorf("unterminated [ in JSON path %q", path)
+			}
+			steps = append(steps, jsonStep{name: idx, index: true})
+			rest = strings.TrimPrefix(after, "[")
+		}
+	}
+	return steps, nil
+}
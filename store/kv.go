@@ -0,0 +1,21 @@
+package store
+
+// KV is the key-value surface of a Store. Code that only needs to read
+// and write keys can depend on KV, so tests can substitute a fake and
+// the engine behind it can change.
+type KV interface {
+	Set(key, value string) error
+	Get(key string) (string, bool)
+	Delete(key string) error
+	Has(key string) bool
+	Keys() []string
+	Len() int
+
+	// Batch runs fn against the KV and flushes afterwards.
+	Batch(fn func(kv KV) error) error
+
+	// Watch streams changes to keys starting with prefix until cancelled.
+	Watch(prefix string) (<-chan Event, CancelFunc)
+}
+
+var _ KV = (*Store)(nil)
@@ -0,0 +1,55 @@
+package store
+
+import "github.com/jerkeyray/walrus/wal"
+
+// GetMany looks up every key under one read lock and returns the live
+// ones; missing and expired keys are left out of the map.
+func (s *Store) GetMany(keys []string) map[string]string {
+	s.ops.gets.Add(uint64(len(keys)))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if s.expiredNow(key) {
+			continue
+		}
+		if v, ok := s.valueLocked(key); ok {
+			found[key] = v
+			s.touch(key)
+		}
+	}
+	return found
+}
+
+// SetMany sets every entry of kv as one batch: a single WAL record,
+// applied under one lock and all-or-nothing like Write. Like Set, it
+// logs keys and values without copying them first.
+func (s *Store) SetMany(kv map[string]string) error {
+	records := make([]wal.Record, 0, len(kv))
+	for key, value := range kv {
+		records = append(records, wal.Record{Op: wal.OpSet, Key: bytesOf(key), Value: bytesOf(value)})
+	}
+
+	b := &WriteBatch{records: make([]*wal.Record, len(records))}
+	for i := range records {
+		b.records[i] = &records[i]
+	}
+	return s.Write(b)
+}
+
+// DeleteMany deletes every key in keys as one batch, all-or-nothing like
+// SetMany. Keys that aren't there are passed over.
+func (s *Store) DeleteMany(keys []string) error {
+	var b WriteBatch
+	for _, key := range keys {
+		b.Delete(key)
+	}
+	if err := s.Write(&b); err != nil {
+		return err
+	}
+
+	s.sweepOnce.Do(func() { go s.sweepLoop() })
+	return nil
+}
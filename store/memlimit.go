@@ -0,0 +1,88 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime/debug"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// ErrMemoryLimit is returned by writes that would take the store past the
+// limit set with SetMemoryLimit.
+var ErrMemoryLimit = errors.New("store memory limit reached")
+
+// memoryPressure is the share of the memory limit, in tenths, from which
+// writes start making room.
+const memoryPressure = 9
+
+// SetMemoryLimit caps the store's estimated memory, Stats().Memory, at
+// limit bytes, so a store outgrowing the memory it was given turns away
+// writes instead of taking the process down. From 90% of the limit up,
+// writes first make room, at most once a second: they sweep out expired
+// keys early and, if SetBucketIdleTTL is on, move every bucket not used
+// in the last second out of memory. A write that would still take the
+// store past the limit fails with ErrMemoryLimit. Deletes, resets and
+// writes that don't grow the store always go through. A limit of 0
+// removes it.
+func (s *Store) SetMemoryLimit(limit int64) error {
+	if limit < 0 {
+		return errors.New("memory limit must not be negative")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.memLimit = limit
+	return nil
+}
+
+// GoMemoryLimit returns the Go runtime's soft memory limit, as set by
+// GOMEMLIMIT or debug.SetMemoryLimit, or 0 if there is none, for
+// deriving the store's limit from the process's.
+func GoMemoryLimit() int64 {
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		return 0
+	}
+	return limit
+}
+
+// makeRoomLocked fails with ErrMemoryLimit if rec would take the store
+// past its memory limit, after trying to free enough. Caller holds s.mu.
+func (s *Store) makeRoomLocked(rec *wal.Record, now int64) error {
+	if s.memLimit == 0 || rec.Op == wal.OpDelete || rec.Op == wal.OpReset {
+		return nil
+	}
+
+	growth := s.growth(rec)
+	if growth <= 0 || s.memory+growth < s.memLimit/10*memoryPressure {
+		return nil
+	}
+
+	if now-s.lastRelief >= int64(time.Second) {
+		s.lastRelief = now
+		s.sweepLocked(now)
+		s.evictBucketsLocked(now, time.Second)
+	}
+
+	if s.memory+growth > s.memLimit {
+		s.memRejected++
+		return fmt.Errorf("%w: %d of %d bytes in use", ErrMemoryLimit, s.memory, s.memLimit)
+	}
+	return nil
+}
+
+// growth estimates how much rec would add to s.memory, taking an
+// overwrite as only the difference in value size. Caller holds s.mu.
+func (s *Store) growth(rec *wal.Record) int64 {
+	if rec.Op == wal.OpBatch {
+		return int64(len(rec.Value)) // an upper bound, as every entry encodes its key and value
+	}
+	if old, ok := s.data[string(rec.Key)]; ok {
+		return int64(len(rec.Value) - len(old))
+	}
+	return int64(len(rec.Key)+len(rec.Value)) + entryOverhead
+}
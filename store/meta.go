@@ -0,0 +1,68 @@
+package store
+
+import (
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// Meta is a key's value with when and under which record it was last
+// written, for tracking down where a stale value came from.
+type Meta struct {
+	Value string
+
+	// Modified is when the last write to the key was logged. It is zero
+	// for keys last written before records carried a timestamp.
+	Modified time.Time
+
+	// Version is the LSN of the record that last wrote the key, which
+	// grows with every write to the store. A key written in a batch takes
+	// the batch's LSN. It is 0 for keys last written before LSNs existed.
+	Version uint64
+
+	// Expires is when the key's TTL runs out, zero if it has none.
+	Expires time.Time
+}
+
+// keyMeta is what GetWithMeta reports beyond the value.
+type keyMeta struct {
+	modified int64 // unix nanos
+	lsn      uint64
+}
+
+// GetWithMeta is Get that also returns when the key was last written and
+// its version.
+func (s *Store) GetWithMeta(key string) (Meta, bool) {
+	s.ops.gets.Add(1)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.expiredNow(key) {
+		return Meta{}, false
+	}
+	val, ok := s.valueLocked(key)
+	if !ok {
+		return Meta{}, false
+	}
+	s.touch(key)
+
+	m := Meta{Value: val, Version: s.meta[key].lsn}
+	if ts := s.meta[key].modified; ts != 0 {
+		m.Modified = time.Unix(0, ts)
+	}
+	if exp, ok := s.expires[key]; ok {
+		m.Expires = time.Unix(0, exp)
+	}
+	return m, true
+}
+
+// stamp records rec as the last write to key, if the key is still there
+// after it. Caller holds s.mu.
+func (s *Store) stamp(key string, rec *wal.Record) {
+	if _, ok := s.data[key]; !ok || rec.Timestamp == 0 && rec.LSN == 0 {
+		delete(s.meta, key)
+		return
+	}
+	s.meta[key] = keyMeta{modified: rec.Timestamp, lsn: rec.LSN}
+}
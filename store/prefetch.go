@@ -0,0 +1,162 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// prefetchWorkers bounds how many values Prefetch reads at once.
+const prefetchWorkers = 16
+
+// prefetched is one value, or bucket, Prefetch reads back.
+type prefetched struct {
+	key    string // or bucket name
+	bucket bool
+	move   uint64 // that put it out, from coldKeys.offloaded or idleBuckets.evicted
+	path   string // of the bucket's file
+
+	value   []byte
+	records []*wal.Record
+	err     error
+}
+
+// Prefetch brings back into memory the values of keys SetColdTTL moved
+// out, and the buckets SetBucketIdleTTL moved out that keys are in, ahead
+// of a batch of reads that would otherwise load them one Get at a time.
+// It reads up to prefetchWorkers of them at once and without the store's
+// lock, so other reads and writes carry on meanwhile, and counts as a
+// read of every key. Keys that weren't moved out, or aren't there, are
+// passed over. Like Get, it reads a value the tier can't give back from
+// the log; the error is the first of those it couldn't.
+func (s *Store) Prefetch(keys []string) error {
+	todo := append(s.idleBucketsIn(keys), s.coldKeysIn(keys)...)
+	if len(todo) == 0 {
+		return nil
+	}
+
+	s.cold.mu.Lock()
+	tier := s.cold.tier
+	s.cold.mu.Unlock()
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, prefetchWorkers)
+	for i := range todo {
+		p := &todo[i]
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			if p.bucket {
+				p.records, p.err = readBucketFile(p.path, s.wal)
+			} else if tier != nil {
+				p.value, p.err = tier.Get(p.key)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var first error
+	for _, p := range todo {
+		var err error
+		if p.bucket {
+			err = s.restorePrefetchedBucketLocked(p)
+		} else {
+			err = s.restorePrefetchedLocked(p)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// idleBucketsIn records a use of the buckets keys are in and returns
+// those moved out, to be read back.
+func (s *Store) idleBucketsIn(keys []string) []prefetched {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	if s.idle.ttl == 0 {
+		return nil
+	}
+	var todo []prefetched
+	now := time.Now().UnixNano()
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if !isBucketKey(key) {
+			continue
+		}
+		name := bucketOf(key)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		s.idle.used[name] = now
+		if move, ok := s.idle.evicted[name]; ok {
+			todo = append(todo, prefetched{key: name, bucket: true, move: move, path: s.idle.path(name)})
+		}
+	}
+	return todo
+}
+
+// coldKeysIn records a read of keys and returns those whose values are
+// moved out, to be read back.
+func (s *Store) coldKeysIn(keys []string) []prefetched {
+	if !s.cold.on.Load() {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var todo []prefetched
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		s.touch(key)
+		if cv, ok := s.cold.offloaded[key]; ok && !s.expiredNow(key) {
+			todo = append(todo, prefetched{key: key, move: cv.move})
+		}
+	}
+	return todo
+}
+
+// restorePrefetchedLocked puts back a value Prefetch read, unless it was
+// brought back meanwhile. One moved out again since, perhaps to another
+// tier, or that the tier couldn't give back, is read again the way Get
+// would. Caller holds s.mu.
+func (s *Store) restorePrefetchedLocked(p prefetched) error {
+	cv, ok := s.cold.offloaded[p.key]
+	if !ok {
+		return nil
+	}
+	if cv.move != p.move || p.err != nil {
+		return s.rehydrateLocked(p.key)
+	}
+	s.restoreColdLocked(p.key, string(p.value))
+	return nil
+}
+
+// restorePrefetchedBucketLocked is restorePrefetchedLocked for a bucket.
+// Caller holds s.mu.
+func (s *Store) restorePrefetchedBucketLocked(p prefetched) error {
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+
+	move, ok := s.idle.evicted[p.key]
+	if !ok {
+		return nil
+	}
+	if move != p.move {
+		p.records, p.err = readBucketFile(s.idle.path(p.key), s.wal)
+	}
+	return s.restoreBucketLocked(p.key, p.records, p.err)
+}
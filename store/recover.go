@@ -0,0 +1,357 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// RecoveryStats summarises the last call to Recover.
+type RecoveryStats struct {
+	Segments     int   // WAL segments read
+	Records      int   // records replayed
+	Keys         int   // live keys once replay finished
+	Bytes        int64 // bytes of valid records replayed
+	CorruptBytes int64 // bytes that failed validation and were skipped
+	Resyncs      int   // corrupt stretches replay read on past, see wal.RecoverySalvage
+	TailDropped  int64 // bytes of a torn write cut off the log on open, see wal.RepairTail
+	PeakMemory   int64 // highest estimated memory use while replaying
+	DeadLetters  int   // unappliable records set aside, see RecoverOptions
+	Crashed      bool  // the log wasn't closed cleanly, see wal.Crashed
+	Duration     time.Duration
+}
+
+// RecoverOptions tune RecoverWithOptions.
+type RecoverOptions struct {
+	// MaxMemory caps the estimated memory recovery may use. Replay stops
+	// with ErrRecoveryBudget once the rebuilt state outgrows it. Zero
+	// means no limit.
+	MaxMemory int64
+
+	// Handler is given records the store can't apply itself, such as ops
+	// it doesn't know. Returning nil counts the record as applied.
+	Handler func(rec *wal.Record) error
+
+	// DeadLetterPath, if set, is where records that can't be applied (and
+	// that Handler rejected) are written before replay moves on. Without
+	// it such a record fails recovery. The file is written the way
+	// WAL.WriteRecord does, encrypted if the log is, and read back with
+	// the WAL's ReadRecords.
+	DeadLetterPath string
+
+	// CheckAfterCrash runs SelfCheck once a log that wasn't closed
+	// cleanly has been replayed, failing recovery if memory doesn't match
+	// it, at the cost of replaying the log a second time. Clean restarts
+	// skip it.
+	CheckAfterCrash bool
+}
+
+var (
+	ErrRecoveryBudget = errors.New("recovery memory budget exceeded")
+	ErrUnappliable    = errors.New("record cannot be applied")
+)
+
+// entryOverhead approximates what a key costs beyond its key and value
+// bytes: the map entry, string headers and its index node.
+const entryOverhead = 128
+
+// Recover rebuilds memory from the WAL with no memory limit.
+func (s *Store) Recover() error {
+	return s.RecoverWithOptions(RecoverOptions{})
+}
+
+// RecoverWithOptions replays the WAL one record at a time, so memory
+// grows with the live keys rather than the log size. If the estimated
+// footprint passes opts.MaxMemory it gives up with ErrRecoveryBudget and
+// leaves the store empty; so does a record that can't be applied, unless
+// opts say where to put it.
+func (s *Store) RecoverWithOptions(opts RecoverOptions) error {
+	s.mu.Lock()
+	err := s.recoverLocked(opts, nil)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.checkAfterCrash(opts)
+}
+
+// checkAfterCrash is RecoverOptions.CheckAfterCrash.
+func (s *Store) checkAfterCrash(opts RecoverOptions) error {
+	if !opts.CheckAfterCrash || !s.wal.Crashed() {
+		return nil
+	}
+	r, err := s.SelfCheck()
+	if err != nil {
+		return fmt.Errorf("check after crash: %w", err)
+	}
+	if !r.OK() {
+		return fmt.Errorf("check after crash: %d key(s) differ from the log", r.Divergent)
+	}
+	return nil
+}
+
+// recoverLocked is RecoverWithOptions with s.mu held. pause, if set, is
+// called between records and may give up s.mu for a while; an error from
+// it ends replay.
+func (s *Store) recoverLocked(opts RecoverOptions, pause func() error) error {
+	start := time.Now()
+	now := time.Now().UnixNano()
+	peak := s.memory
+
+	var dead *deadLetters
+	if opts.DeadLetterPath != "" {
+		dead = &deadLetters{path: opts.DeadLetterPath, wal: s.wal}
+		defer dead.close()
+	}
+
+	stats, err := replayLogs(s.recoverersLocked(), func(rec *wal.Record) error {
+		if pause != nil {
+			if err := pause(); err != nil {
+				return err
+			}
+		}
+		err := s.apply(rec, now)
+		if errors.Is(err, ErrUnappliable) && opts.Handler != nil {
+			err = opts.Handler(rec)
+		}
+		if err != nil {
+			if dead == nil {
+				return fmt.Errorf("replay: %w", err)
+			}
+			if err := dead.add(rec); err != nil {
+				return fmt.Errorf("dead letter: %w", err)
+			}
+		}
+
+		// the record being applied is held alongside the state
+		used := s.memory + int64(len(rec.Key)+len(rec.Value))
+		peak = max(peak, used)
+
+		if opts.MaxMemory > 0 && used > opts.MaxMemory {
+			return fmt.Errorf("%w: %d bytes needed, limit is %d", ErrRecoveryBudget, used, opts.MaxMemory)
+		}
+		return nil
+	})
+	if err != nil {
+		s.reset()
+		return err
+	}
+
+	if len(s.expires) > 0 || len(s.tombstones) > 0 {
+		s.sweepOnce.Do(func() { go s.sweepLoop() })
+	}
+
+	s.recovery = RecoveryStats{
+		Segments:     stats.Segments,
+		Records:      stats.Records,
+		Keys:         len(s.data),
+		Bytes:        stats.Bytes,
+		CorruptBytes: stats.CorruptBytes,
+		Resyncs:      stats.Resyncs,
+		TailDropped:  s.wal.TailRepaired().Dropped,
+		PeakMemory:   peak,
+		DeadLetters:  dead.count(),
+		Crashed:      s.wal.Crashed(),
+		Duration:     time.Since(start),
+	}
+	return dead.close()
+}
+
+// LastRecovery returns the summary of the most recent Recover call.
+func (s *Store) LastRecovery() RecoveryStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.recovery
+}
+
+// deadLetters appends unappliable records to a file, creating it only
+// once there is something to write. They are framed by the WAL, so
+// sealed with its key when it has one.
+type deadLetters struct {
+	path string
+	wal  *wal.WAL
+	file *os.File
+	n    int
+}
+
+func (d *deadLetters) add(rec *wal.Record) error {
+	if d.file == nil {
+		f, err := os.OpenFile(d.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		d.file = f
+	}
+
+	if err := d.wal.WriteRecord(d.file, rec); err != nil {
+		return err
+	}
+	d.n++
+	return nil
+}
+
+func (d *deadLetters) count() int {
+	if d == nil {
+		return 0
+	}
+	return d.n
+}
+
+func (d *deadLetters) close() error {
+	if d == nil || d.file == nil {
+		return nil
+	}
+
+	err := d.file.Sync()
+	if cerr := d.file.Close(); err == nil {
+		err = cerr
+	}
+	d.file = nil
+	return err
+}
+
+// DryRunReport is what replaying the log would produce, without applying
+// it to the store.
+type DryRunReport struct {
+	RecoveryStats
+
+	Unappliable int           // records Recover would fail on or dead-letter
+	TopPrefixes []PrefixCount // largest key prefixes, most keys first
+}
+
+// PrefixCount is a key prefix, up to and including its first ':', and
+// how many live keys share it. Keys without a ':' count under "".
+type PrefixCount struct {
+	Prefix string
+	Keys   int
+}
+
+const dryRunTopPrefixes = 10
+
+// RecoverDryRun replays the WAL into a scratch copy and reports what
+// Recover would end up with. Neither the store nor the log is changed,
+// so it is safe to point at a data directory before trusting it.
+func (s *Store) RecoverDryRun() (DryRunReport, error) {
+	start := time.Now()
+	now := start.UnixNano()
+
+	scratch := New(s.wal)
+	peak := int64(0)
+	unappliable := 0
+
+	s.mu.RLock()
+	logs := s.replayersLocked()
+	s.mu.RUnlock()
+	stats, err := replayLogs(logs, func(rec *wal.Record) error {
+		if err := scratch.apply(rec, now); err != nil {
+			if !errors.Is(err, ErrUnappliable) {
+				return err
+			}
+			unappliable++
+		}
+
+		peak = max(peak, scratch.memory+int64(len(rec.Key)+len(rec.Value)))
+		return nil
+	})
+	if err != nil {
+		return DryRunReport{}, err
+	}
+
+	return DryRunReport{
+		RecoveryStats: RecoveryStats{
+			Segments:     stats.Segments,
+			Records:      stats.Records,
+			Keys:         len(scratch.data),
+			Bytes:        stats.Bytes,
+			CorruptBytes: stats.CorruptBytes,
+			Resyncs:      stats.Resyncs,
+			PeakMemory:   peak,
+			Duration:     time.Since(start),
+		},
+		Unappliable: unappliable,
+		TopPrefixes: topPrefixes(scratch.data, dryRunTopPrefixes),
+	}, nil
+}
+
+// RecoveryEstimate is what EstimateRecovery measured and projected.
+type RecoveryEstimate struct {
+	LogBytes      int64 // size of the log's segment files
+	SampleBytes   int64 // bytes of records replayed to time
+	SampleRecords int
+	SampleTime    time.Duration
+	Estimate      time.Duration // for Recover over the whole log
+}
+
+// EstimateRecovery replays up to sample bytes from the start of the log
+// into a scratch copy, timing it, and projects how long Recover would
+// take over the whole log at that rate, so a restart can be planned.
+// Like RecoverDryRun it changes neither the store nor the log. The
+// projection is linear, and replay slows somewhat as the key count
+// grows, so it leans low for a log much larger than the sample.
+func (s *Store) EstimateRecovery(sample int64) (RecoveryEstimate, error) {
+	ws, err := s.wal.Stats()
+	if err != nil {
+		return RecoveryEstimate{}, err
+	}
+	r, err := s.wal.Reader()
+	if err != nil {
+		return RecoveryEstimate{}, err
+	}
+	defer r.Close()
+
+	est := RecoveryEstimate{LogBytes: ws.SegmentBytes}
+	scratch := New(s.wal)
+	start := time.Now()
+	now := start.UnixNano()
+	for r.Bytes() < sample {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return RecoveryEstimate{}, err
+		}
+		if err := scratch.apply(rec, now); err != nil && !errors.Is(err, ErrUnappliable) {
+			return RecoveryEstimate{}, err
+		}
+		est.SampleRecords++
+	}
+	est.SampleTime = time.Since(start)
+	est.SampleBytes = r.Bytes()
+
+	if est.SampleBytes > 0 {
+		est.Estimate = time.Duration(float64(est.SampleTime) * float64(est.LogBytes) / float64(est.SampleBytes))
+	}
+	return est, nil
+}
+
+func topPrefixes(data map[string]string, n int) []PrefixCount {
+	counts := make(map[string]int)
+	for key := range data {
+		prefix := ""
+		if i := strings.IndexByte(key, ':'); i >= 0 {
+			prefix = key[:i+1]
+		}
+		counts[prefix]++
+	}
+
+	top := make([]PrefixCount, 0, len(counts))
+	for prefix, keys := range counts {
+		top = append(top, PrefixCount{Prefix: prefix, Keys: keys})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Keys != top[j].Keys {
+			return top[i].Keys > top[j].Keys
+		}
+		return top[i].Prefix < top[j].Prefix
+	})
+
+	return top[:min(n, len(top))]
+}
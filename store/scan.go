@@ -0,0 +1,83 @@
+package store
+
+import (
+	"strings"
+	"time"
+)
+
+// Entry is one key/value pair returned by Scan and Range.
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Scan returns every live entry whose key starts with prefix, sorted by
+// key. An empty prefix returns the whole store but for its buckets.
+func (s *Store) Scan(prefix string) []Entry {
+	s.ops.scans.Add(1)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.scanLocked(prefix)
+}
+
+func (s *Store) scanLocked(prefix string) []Entry {
+	now := time.Now().UnixNano()
+	// only an empty prefix reaches into the buckets from outside them
+	next := s.skipBuckets
+	if prefix != "" {
+		next = func(n *indexNode) *indexNode { return n }
+	}
+
+	var entries []Entry
+	for n := next(s.index.seek(prefix)); n != nil && strings.HasPrefix(n.key, prefix); n = next(n.next[0]) {
+		if s.expired(n.key, now) {
+			continue
+		}
+		value, _ := s.valueLocked(n.key)
+		entries = append(entries, Entry{Key: n.key, Value: value})
+	}
+
+	return entries
+}
+
+// EstimateCount returns about how many keys start with prefix, without
+// visiting each of them: on a large keyspace it reads the count off the
+// sorted index's upper levels, usually within 10% of the truth, in
+// time that doesn't grow with the number of matches. It reports whether
+// the count is exact, as it is for small counts and for an empty prefix,
+// which counts the whole store but for its buckets. Unlike Len, keys past
+// their TTL that haven't been swept out yet are counted. Use it for
+// dashboards and query planning, and Len or Scan where the number must be
+// right.
+func (s *Store) EstimateCount(prefix string) (n int, exact bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if prefix == "" {
+		return len(s.data) - s.bucketed, true
+	}
+	return s.index.estimate(prefix)
+}
+
+// Range returns the live entries with start <= key < end, sorted by key,
+// leaving out the keys in buckets. An empty end means no upper bound.
+func (s *Store) Range(start, end string) []Entry {
+	s.ops.scans.Add(1)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	var entries []Entry
+	for n := s.skipBuckets(s.index.seek(start)); n != nil && (end == "" || n.key < end); n = s.skipBuckets(n.next[0]) {
+		if s.expired(n.key, now) {
+			continue
+		}
+		value, _ := s.valueLocked(n.key)
+		entries = append(entries, Entry{Key: n.key, Value: value})
+	}
+
+	return entries
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSnapshotName   = errors.New("snapshot name must not be empty")
+	ErrSnapshotExists = errors.New("snapshot already exists")
+	ErrNoSnapshot     = errors.New("no such snapshot")
+)
+
+// Snapshot is a named, frozen view of a store, for reporting jobs that
+// need one stable state while writes carry on against the store. It sees
+// the keys that were live when it was taken, with the values they had,
+// and none of the writes since; it doesn't expire keys either. It lives in
+// memory until dropped and isn't kept across restarts. Values are shared
+// with the store, not copied, so a snapshot costs about a map entry per
+// key.
+type Snapshot struct {
+	name    string
+	created time.Time
+	data    map[string]string
+	keys    []string // sorted, leaving out the keys in buckets
+}
+
+// CreateSnapshot takes a snapshot of the store called name.
+func (s *Store) CreateSnapshot(name string) (*Snapshot, error) {
+	if name == "" {
+		return nil, ErrSnapshotName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.snapshots[name]; ok {
+		return nil, ErrSnapshotExists
+	}
+	if err := s.loadAllBucketsLocked(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	sn := &Snapshot{
+		name:    name,
+		created: now,
+		data:    make(map[string]string, len(s.data)),
+		keys:    make([]string, 0, len(s.data)-s.bucketed),
+	}
+	for n := s.index.seek(""); n != nil; n = n.next[0] {
+		if s.expired(n.key, now.UnixNano()) {
+			continue
+		}
+		sn.data[n.key], _ = s.valueLocked(n.key)
+		if !isBucketKey(n.key) {
+			sn.keys = append(sn.keys, n.key)
+		}
+	}
+
+	if s.snapshots == nil {
+		s.snapshots = make(map[string]*Snapshot)
+	}
+	s.snapshots[name] = sn
+	return sn, nil
+}
+
+// Snapshot returns the snapshot called name.
+func (s *Store) Snapshot(name string) (*Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sn, ok := s.snapshots[name]
+	if !ok {
+		return nil, ErrNoSnapshot
+	}
+	return sn, nil
+}
+
+// Snapshots returns every snapshot, oldest first.
+func (s *Store) Snapshots() []*Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Snapshot, 0, len(s.snapshots))
+	for _, sn := range s.snapshots {
+		list = append(list, sn)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].created.Before(list[j].created) })
+	return list
+}
+
+// DropSnapshot forgets the snapshot called name, freeing what only it
+// held. Readers still holding it can carry on.
+func (s *Store) DropSnapshot(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.snapshots[name]; !ok {
+		return ErrNoSnapshot
+	}
+	delete(s.snapshots, name)
+	return nil
+}
+
+func (sn *Snapshot) Name() string {
+	return sn.name
+}
+
+// Created returns when the snapshot was taken.
+func (sn *Snapshot) Created() time.Time {
+	return sn.created
+}
+
+func (sn *Snapshot) Get(key string) (string, bool) {
+	v, ok := sn.data[key]
+	return v, ok
+}
+
+func (sn *Snapshot) Has(key string) bool {
+	_, ok := sn.data[key]
+	return ok
+}
+
+// Keys returns the snapshot's keys in sorted order, leaving out the keys
+// in buckets as Store.Keys does. The caller must not modify the slice.
+func (sn *Snapshot) Keys() []string {
+	return sn.keys
+}
+
+func (sn *Snapshot) Len() int {
+	return len(sn.keys)
+}
+
+// Scan returns the keys starting with prefix and their values, sorted.
+func (sn *Snapshot) Scan(prefix string) []Entry {
+	var entries []Entry
+	for i := sort.SearchStrings(sn.keys, prefix); i < len(sn.keys) && strings.HasPrefix(sn.keys[i], prefix); i++ {
+		entries = append(entries, Entry{Key: sn.keys[i], Value: sn.data[sn.keys[i]]})
+	}
+	return entries
+}
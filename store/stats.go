@@ -0,0 +1,90 @@
+package store
+
+import (
+	"sync/atomic"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// OpCounts counts the operations a store has served since it was
+// created. Batches count once, however many writes they hold.
+type OpCounts struct {
+	Gets    uint64 // Get, GetBytes and Has
+	Scans   uint64 // Scan, Range and Keys
+	Sets    uint64 // every flavour of Set, including Incr and CompareAndSet
+	Deletes uint64
+	Batches uint64 // Write, transaction commits, WriteIdempotent
+	Resets  uint64
+}
+
+type opCounters struct {
+	gets, scans, sets, deletes, batches, resets atomic.Uint64
+}
+
+// wrote counts a successful write of rec.
+func (c *opCounters) wrote(rec *wal.Record) {
+	switch rec.Op {
+	case wal.OpSet, wal.OpSetTTL, wal.OpIncr, wal.OpCompareAndSet, wal.OpSetIfAbsent:
+		c.sets.Add(1)
+	case wal.OpDelete:
+		c.deletes.Add(1)
+	case wal.OpBatch:
+		c.batches.Add(1)
+	case wal.OpReset:
+		c.resets.Add(1)
+	}
+}
+
+// Stats is a snapshot of a store and its WAL, for metrics and debugging.
+type Stats struct {
+	Keys     int
+	Memory   int64 // estimated bytes held by keys and values
+	Watchers int   // open Watch and WatchBatches subscriptions
+
+	// MemoryLimit is the limit on Memory set by SetMemoryLimit, 0 for
+	// none, and MemoryRejected the writes that failed on it.
+	MemoryLimit    int64
+	MemoryRejected uint64
+
+	// IdleBuckets are out of memory, see SetBucketIdleTTL, and so left
+	// out of Memory.
+	IdleBuckets int
+
+	// ColdKeys have their values moved out of memory by SetColdTTL, and
+	// only their keys counted in Memory.
+	ColdKeys int
+	Ops      OpCounts
+	Recovery RecoveryStats // the last Recover, including its Duration
+	WAL      wal.Stats
+}
+
+func (s *Store) Stats() (Stats, error) {
+	ws, err := s.wal.Stats()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	st := Stats{
+		Keys: s.Len(),
+		Ops: OpCounts{
+			Gets:    s.ops.gets.Load(),
+			Scans:   s.ops.scans.Load(),
+			Sets:    s.ops.sets.Load(),
+			Deletes: s.ops.deletes.Load(),
+			Batches: s.ops.batches.Load(),
+			Resets:  s.ops.resets.Load(),
+		},
+		WAL: ws,
+	}
+
+	s.mu.RLock()
+	st.Memory = s.memory
+	st.MemoryLimit, st.MemoryRejected = s.memLimit, s.memRejected
+	st.Watchers = len(s.watchers) + len(s.batchWatchers)
+	st.IdleBuckets = len(s.IdleBuckets())
+	st.ColdKeys = len(s.cold.offloaded)
+	st.Recovery = s.recovery
+	s.mu.RUnlock()
+
+	return st, nil
+}
@@ -1,134 +1,731 @@
 package store
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
+	"time"
+	"unsafe"
 
 	"github.com/jerkeyray/walrus/wal"
 )
 
 type Store struct {
-	mu   sync.Mutex
-	data map[string]string
-	wal  *wal.WAL
+	mu      sync.RWMutex // read-locked by Get, Scan and the other reads
+	data    map[string]string
+	expires map[string]int64   // unix nanos, only for keys set with a TTL
+	meta    map[string]keyMeta // see GetWithMeta
+	index   *index             // keys of data in sorted order
+	memory  int64              // estimated bytes held by data, see entryOverhead
+	wal     *wal.WAL
+
+	bucketed int // keys of data that are in a bucket, see Bucket
+	idle     idleBuckets
+	cold     coldKeys
+	families *bucketFamilies // nil unless SetBucketFamilies
+
+	sweepOnce sync.Once
+	sweepStop chan struct{}
+	sweepDone chan struct{}
+
+	recovery RecoveryStats
+	ops      opCounters // see Stats
+	watchers map[*watcher]struct{}
+
+	batchWatchers map[*batchWatcher]struct{}
+
+	readOnly bool // writes come only through ApplyReplicated, see SetReadOnly
+	closed   bool // by Close, failing every write since
+
+	closeOnce sync.Once
+	closeErr  error
+
+	catchUp    chan struct{} // open while RecoverInBackground replays
+	catchUpErr error         // why it failed, failing every write since
+
+	idempotency map[string]int64 // request key -> expiry, see WriteIdempotent
+
+	tombstones   map[string]int64 // deleted key -> unix nanos, see Tombstones
+	tombstoneTTL time.Duration
+
+	snapshots  map[string]*Snapshot    // see CreateSnapshot
+	iterations map[*iteration]struct{} // see Iterate
+
+	memLimit    int64  // bytes, 0 for none; see SetMemoryLimit
+	memRejected uint64 // writes failed with ErrMemoryLimit
+	lastRelief  int64  // unix nanos of the last try to make room under it
+
+	// for optimistic transactions, see conflict.go
+	versions   [conflictSlots]uint64
+	generation uint64 // bumped by reset, which changes every key at once
 }
 
+// ErrReadOnly is returned by writes to a store that follows another.
+var ErrReadOnly = errors.New("store is read-only")
+
+// ErrClosed is returned by writes to a store after Close.
+var ErrClosed = errors.New("store is closed")
+
 func New(w *wal.WAL) *Store {
 	return &Store{
-		data: make(map[string]string),
-		wal:  w,
+		data:    make(map[string]string),
+		expires: make(map[string]int64),
+		meta:    make(map[string]keyMeta),
+		index:   newIndex(),
+		wal:     w,
+
+		sweepStop: make(chan struct{}),
+		sweepDone: make(chan struct{}),
+
+		idempotency: make(map[string]int64),
+
+		tombstones:   make(map[string]int64),
+		tombstoneTTL: DefaultTombstoneTTL,
+	}
+}
+
+// OpenReadOnly loads the store logged in dir without changing anything
+// there, to inspect the data of a process that has it open; see
+// wal.OpenReadOnly. Writes fail with ErrReadOnly. It holds what was
+// logged when it was opened and doesn't follow later writes.
+func OpenReadOnly(dir string) (*Store, error) {
+	w, err := wal.OpenReadOnly(wal.Options{Dir: dir})
+	if err != nil {
+		return nil, err
+	}
+
+	s := New(w)
+	s.readOnly = true
+	if err := s.Recover(); err != nil {
+		s.Close()
+		return nil, err
 	}
+	return s, nil
 }
 
 func (s *Store) Set(key, value string) error {
+	return s.SetBytes(key, bytesOf(value))
+}
+
+// SetBytes stores an arbitrary binary value. The WAL copies value into
+// its buffer without an intermediate encoding pass, and the store keeps
+// its own copy, so the caller may reuse value once SetBytes returns.
+func (s *Store) SetBytes(key string, value []byte) error {
 	rec := &wal.Record{
 		Op:    wal.OpSet,
-		Key:   []byte(key),
-		Value: []byte(value),
+		Key:   bytesOf(key),
+		Value: value,
 	}
 
-	// write to WAL first
-	if err := s.wal.Append(rec); err != nil {
+	return s.write(rec)
+}
+
+// SetDurable is Set that returns only once the write is fsynced,
+// whatever the sync policy. Concurrent durable writes share fsyncs (group
+// commit), so many writers cost far less than one fsync each. Readers can
+// see the value before SetDurable returns.
+func (s *Store) SetDurable(key, value string) error {
+	return s.writeDurable(context.Background(), setRecord(key, value))
+}
+
+func setRecord(key, value string) *wal.Record {
+	return &wal.Record{
+		Op:    wal.OpSet,
+		Key:   bytesOf(key),
+		Value: bytesOf(value),
+	}
+}
+
+// bytesOf views str as bytes without copying. Records built from it are
+// only read, by the WAL encoder and apply, never written to.
+func bytesOf(str string) []byte {
+	return unsafe.Slice(unsafe.StringData(str), len(str))
+}
+
+// SetWithTTL stores a key that expires after ttl. The expiry is logged
+// with the value, so it survives recovery.
+func (s *Store) SetWithTTL(key, value string, ttl time.Duration) error {
+	return s.setWithTTL(context.Background(), key, value, ttl)
+}
+
+func (s *Store) setWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return s.write(attribute(ctx, setRecord(key, value)))
+	}
+
+	rec := &wal.Record{
+		Op:    wal.OpSetTTL,
+		Key:   bytesOf(key),
+		Value: encodeTTLValue(time.Now().Add(ttl).UnixNano(), value),
+	}
+
+	if err := s.write(attribute(ctx, rec)); err != nil {
 		return err
 	}
 
+	s.sweepOnce.Do(func() { go s.sweepLoop() })
+	return nil
+}
+
+// write logs rec and applies it under one lock, so memory and the log
+// agree on the order of concurrent writes.
+func (s *Store) write(rec *wal.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writableLocked(); err != nil {
+		return err
+	}
+
+	// write to WAL first
+	now := time.Now().UnixNano()
+	logged := s.logLocked(rec, now)
+	if !wal.Logged(logged) {
+		return logged
+	}
+
 	// mutate memory
+	if err := s.apply(rec, now); err != nil {
+		return err
+	}
+	s.ops.wrote(rec)
+	return logged
+}
+
+// logLocked appends rec to the WAL stamped with now, then sets its LSN to
+// the one it was logged under, so apply records both as the key's
+// metadata. The buckets rec writes to are loaded first, and a record
+// that would take the store past its memory limit fails with
+// ErrMemoryLimit and isn't logged. One the WAL logged but
+// couldn't sync comes back with wal.ErrDurabilityUnknown, and callers
+// apply it all the same, as replay would. Caller holds s.mu.
+func (s *Store) logLocked(rec *wal.Record, now int64) error {
+	if err := s.useBucketsOfLocked(rec); err != nil {
+		return err
+	}
+	w, err := s.logOfLocked(rec, false)
+	if err != nil {
+		return err
+	}
+	if err := s.makeRoomLocked(rec, now); err != nil {
+		return err
+	}
+
+	rec.Timestamp = now
+	lsn, err := w.Append(rec)
+	if !wal.Logged(err) {
+		return err
+	}
+	rec.LSN = lsn
+	s.loggedLocked(w, rec)
+	return err
+}
+
+// LastLSN returns the LSN of the last record logged by the store, in
+// its WAL or a bucket's family.
+func (s *Store) LastLSN() uint64 {
+	return s.wal.LSNs().Last()
+}
+
+// SetReadOnly makes every write fail with ErrReadOnly, for a store that
+// follows another and takes its writes only through ApplyReplicated.
+// Reads are unaffected.
+func (s *Store) SetReadOnly(readOnly bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.data[key] = value
+	s.readOnly = readOnly
+}
+
+// ApplyReplicated logs and applies a record shipped from another store's
+// WAL, read-only or not. The record keeps its origin and LSN, so LastLSN
+// is where replication resumes after a restart.
+func (s *Store) ApplyReplicated(rec *wal.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.caughtUpLocked(); err != nil {
+		return err
+	}
+	if s.closed {
+		return ErrClosed
+	}
+	if err := s.useBucketsOfLocked(rec); err != nil {
+		return err
+	}
+	w, err := s.logOfLocked(rec, true)
+	if err != nil {
+		return err
+	}
+	logged := w.AppendReplicated(rec)
+	if !wal.Logged(logged) {
+		return logged
+	}
+	s.loggedLocked(w, rec)
+	if hasReset(rec) {
+		if err := s.dropFamiliesLocked(); err != nil {
+			return err
+		}
+	}
+	if err := s.apply(rec, time.Now().UnixNano()); err != nil {
+		return err
+	}
+
+	if len(s.expires) > 0 || len(s.idempotency) > 0 || len(s.tombstones) > 0 {
+		s.sweepOnce.Do(func() { go s.sweepLoop() })
+	}
+	return logged
+}
+
+// writeDurable is write followed by waiting for rec to reach disk. The
+// wait happens outside s.mu so other writers can join the same fsync,
+// and ends early if ctx does.
+func (s *Store) writeDurable(ctx context.Context, rec *wal.Record) error {
+	s.mu.Lock()
+	if err := s.writableLocked(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	now := time.Now().UnixNano()
+	if err := s.logLocked(rec, now); !wal.Logged(err) {
+		s.mu.Unlock()
+		return err
+	}
+	w, _ := s.logOfLocked(rec, false)
+	pos := w.Position()
+	err := s.apply(rec, now)
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	s.ops.wrote(rec)
+	return w.WaitDurableCtx(ctx, pos)
+}
+
+// apply mutates memory for one record. Caller holds s.mu. Records it
+// cannot apply, such as ops from a newer version, return an error and
+// change nothing.
+func (s *Store) apply(rec *wal.Record, now int64) error {
+	return s.applyBy(rec, callerOf(rec), now)
+}
+
+// applyBy is apply reporting the change to watchers as made for by, which
+// for the records of a batch is the batch's Caller. Caller holds s.mu.
+func (s *Store) applyBy(rec *wal.Record, by Caller, now int64) error {
+	key := string(rec.Key)
+	if isBucketKey(key) {
+		if err := s.useBucketLocked(bucketOf(key)); err != nil {
+			return err
+		}
+	}
+
+	switch rec.Op {
+	case wal.OpSet:
+		s.put(key, string(rec.Value))
+		delete(s.expires, key)
+		s.notify(EventSet, key, string(rec.Value), by)
+
+	case wal.OpSetTTL:
+		expiresAt, value, ok := decodeTTLValue(rec.Value)
+		if !ok || expiresAt <= now {
+			// already expired (typically during replay)
+			s.remove(key)
+			return nil
+		}
+		s.put(key, value)
+		s.expires[key] = expiresAt
+		s.notify(EventSet, key, value, by)
 
+	case wal.OpDelete:
+		if _, ok := s.data[key]; ok {
+			s.entomb(key, rec, now)
+		}
+		s.remove(key)
+		s.notify(EventDelete, key, "", by)
+
+	case wal.OpReset:
+		s.reset()
+		s.notifyReset(by)
+
+	case wal.OpIdempotent:
+		expiresAt, _, ok := decodeTTLValue(rec.Value)
+		if ok && expiresAt > now {
+			s.idempotency[key] = expiresAt
+		}
+
+	case wal.OpCompareAndSet, wal.OpSetIfAbsent:
+		value := rec.Value
+		if rec.Op == wal.OpCompareAndSet {
+			_, v, ok := decodeCASValue(value)
+			if !ok {
+				return fmt.Errorf("%w: malformed compare-and-set", ErrUnappliable)
+			}
+			value = v
+		}
+		s.put(key, string(value))
+		delete(s.expires, key)
+		s.notify(EventSet, key, string(value), by)
+
+	case wal.OpIncr:
+		if err := s.applyIncr(key, rec.Value, by, now); err != nil {
+			return err
+		}
+
+	case wal.OpBatch:
+		records, err := wal.DecodeBatch(rec.Value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUnappliable, err)
+		}
+		return s.applyBatch(rec, records, now)
+
+	default:
+		return fmt.Errorf("%w: unknown op %d", ErrUnappliable, rec.Op)
+	}
+
+	s.stamp(key, rec)
 	return nil
 }
 
+// applyBatch applies the records of the OpBatch rec, checking them all
+// first so the batch still applies all-or-nothing. Its keys take rec's
+// time, LSN and Caller. Caller holds s.mu.
+func (s *Store) applyBatch(rec *wal.Record, records []*wal.Record, now int64) error {
+	for _, r := range records {
+		if !canApply(r.Op) {
+			return fmt.Errorf("%w: unknown op %d in batch", ErrUnappliable, r.Op)
+		}
+	}
+	by := callerOf(rec)
+	for _, r := range records {
+		if err := s.applyBy(r, by, now); err != nil {
+			return err
+		}
+		s.stamp(string(r.Key), rec)
+	}
+	return nil
+}
+
+func canApply(op wal.OpType) bool {
+	switch op {
+	case wal.OpSet, wal.OpSetTTL, wal.OpDelete, wal.OpReset, wal.OpIdempotent, wal.OpIncr,
+		wal.OpCompareAndSet, wal.OpSetIfAbsent:
+		return true
+	}
+	return false
+}
+
+// put and remove keep data and the index in step. Caller holds s.mu.
+func (s *Store) put(key, value string) {
+	if len(s.iterations) > 0 {
+		s.keepPriorLocked(key)
+	}
+	s.bumpScopes(key)
+	delete(s.tombstones, key)
+	s.forgetColdLocked(key)
+	s.touch(key)
+
+	if old, ok := s.data[key]; ok {
+		s.memory += int64(len(value) - len(old))
+	} else {
+		s.index.insert(key)
+		s.memory += int64(len(key)+len(value)) + entryOverhead
+		if isBucketKey(key) {
+			s.bucketed++
+		}
+	}
+	s.data[key] = value
+}
+
+func (s *Store) remove(key string) {
+	if len(s.iterations) > 0 {
+		s.keepPriorLocked(key)
+	}
+	s.bumpScopes(key)
+
+	if old, ok := s.data[key]; ok {
+		s.index.remove(key)
+		s.memory -= int64(len(key)+len(old)) + entryOverhead
+		if isBucketKey(key) {
+			s.bucketed--
+		}
+	}
+	delete(s.data, key)
+	delete(s.expires, key)
+	delete(s.meta, key)
+	s.forgetColdLocked(key)
+}
+
+// expired reports whether key has outlived its TTL. Caller holds s.mu.
+func (s *Store) expired(key string, now int64) bool {
+	exp, ok := s.expires[key]
+	return ok && exp <= now
+}
+
+// expiredNow is expired for one key, reading the clock only if the key
+// has a TTL, which keeps it off the hot path of Get. Caller holds s.mu.
+func (s *Store) expiredNow(key string) bool {
+	exp, ok := s.expires[key]
+	return ok && exp <= time.Now().UnixNano()
+}
+
 // memory only, does not go through WAL
 func (s *Store) Get(key string) (string, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.ops.gets.Add(1)
+	if s.cold.on.Load() {
+		return s.getCold(key)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.expiredNow(key) {
+		return "", false
+	}
 
 	val, ok := s.data[key]
 	return val, ok
 }
 
-func (s *Store) Delete(key string) error {
-	rec := &wal.Record{
-		Op:  wal.OpDelete,
-		Key: []byte(key),
+// GetBytes is Get for binary values. The returned slice is a copy the
+// caller owns.
+func (s *Store) GetBytes(key string) ([]byte, bool) {
+	val, ok := s.Get(key)
+	if !ok {
+		return nil, false
 	}
+	return []byte(val), true
+}
 
-	if err := s.wal.Append(rec); err != nil {
-		return err
+// TTL returns the time left before key expires. ok is false if the key
+// does not exist or has no TTL.
+func (s *Store) TTL(key string) (time.Duration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	exp, ok := s.expires[key]
+	if !ok || exp <= now {
+		return 0, false
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return time.Duration(exp - now), true
+}
 
-	delete(s.data, key)
+func (s *Store) Delete(key string) error {
+	return s.delete(context.Background(), key)
+}
+
+func (s *Store) delete(ctx context.Context, key string) error {
+	if err := s.write(attribute(ctx, deleteRecord(bytesOf(key)))); err != nil {
+		return err
+	}
 
+	s.sweepOnce.Do(func() { go s.sweepLoop() })
 	return nil
 }
 
 func (s *Store) Has(key string) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.ops.gets.Add(1)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.expiredNow(key) {
+		return false
+	}
 
 	_, ok := s.data[key]
 	return ok
 }
 
-func (s *Store) Recover() error {
-	records, err := s.wal.ReadAll()
+// Reset clears every key and truncates the log while the store keeps
+// serving. It logs a reset marker to a fresh segment, makes it durable and
+// deletes the older segments, so a crash part way through still replays
+// to an empty store.
+func (s *Store) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writableLocked(); err != nil {
+		return err
+	}
+
+	active, err := s.wal.Rotate()
 	if err != nil {
 		return err
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	rec := &wal.Record{Op: wal.OpReset}
+	now := time.Now().UnixNano()
+	logged := s.logLocked(rec, now)
+	if !wal.Logged(logged) {
+		return logged
+	}
+	if err := s.apply(rec, now); err != nil {
+		return err
+	}
+	s.ops.wrote(rec)
 
-	for _, rec := range records {
-		switch rec.Op {
-		case wal.OpSet:
-			s.data[string(rec.Key)] = string(rec.Value)
-		case wal.OpDelete:
-			delete(s.data, string(rec.Key))
-		}
+	// the old segments go only once the reset is on disk
+	if logged != nil {
+		return logged
 	}
-	return nil
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	if err := s.wal.RemoveSegmentsBefore(active); err != nil {
+		return err
+	}
+	return s.dropFamiliesLocked()
 }
 
+// reset drops all in-memory state. Caller holds s.mu.
+func (s *Store) reset() {
+	s.keepAllPriorLocked()
+	s.data = make(map[string]string)
+	s.expires = make(map[string]int64)
+	s.meta = make(map[string]keyMeta)
+	s.idempotency = make(map[string]int64)
+	s.tombstones = make(map[string]int64)
+	s.index = newIndex()
+	s.memory = 0
+	s.bucketed = 0
+	s.dropIdleBucketsLocked()
+	s.dropColdLocked()
+	s.generation++
+}
+
+// Keys returns every live key in sorted order, leaving out the keys in
+// buckets.
 func (s *Store) Keys() []string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.ops.scans.Add(1)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	keys := make([]string, 0, len(s.data))
-	for k := range s.data {
-		keys = append(keys, k)
+	now := time.Now().UnixNano()
+	keys := make([]string, 0, len(s.data)-s.bucketed)
+	for n := s.skipBuckets(s.index.seek("")); n != nil; n = s.skipBuckets(n.next[0]) {
+		if s.expired(n.key, now) {
+			continue
+		}
+		keys = append(keys, n.key)
 	}
 
 	return keys
 }
 
 func (s *Store) Len() int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// expired keys the sweeper hasn't reached yet don't count
+	now := time.Now().UnixNano()
+	n := len(s.data) - s.bucketed
+	for key, exp := range s.expires {
+		if exp <= now && !isBucketKey(key) {
+			n--
+		}
+	}
 
-	return len(s.data)
+	return n
 }
 
+// Close stops the store taking writes, then flushes and syncs the log
+// and releases its directory. A write that has returned is in the log;
+// one made from then on, including by a Batch still running, fails with
+// ErrClosed. Reads go on seeing what the store held. Closing again waits
+// for the first Close and returns what it did.
 func (s *Store) Close() error {
-	return s.wal.Close()
+	s.closeOnce.Do(func() { s.closeErr = s.close() })
+	return s.closeErr
+}
+
+func (s *Store) close() error {
+	// writes holding s.mu finish first; any after see closed
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.sweepStop)
+
+	// stop a sweeper that was started; mark it done if it never was
+	s.sweepOnce.Do(func() { close(s.sweepDone) })
+	<-s.sweepDone
+
+	s.mu.Lock()
+	s.caughtUpLocked() // a replay still running stops at its next pause
+	for w := range s.watchers {
+		s.unwatch(w)
+	}
+	for w := range s.batchWatchers {
+		w.stop()
+		delete(s.batchWatchers, w)
+	}
+	s.mu.Unlock()
+
+	err := s.wal.Close()
+	if s.families != nil {
+		if ferr := closeFamilies(s.families); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// Backup writes a point-in-time tar archive of the store's log to out.
+// Writers are only held up while it is captured; see wal.Backup. Restore
+// it with wal.RestoreInto. With SetBucketFamilies on, the bucket
+// families are captured with it and archived in directories of their
+// own; restore that with RestoreInto.
+func (s *Store) Backup(out io.Writer) error {
+	s.mu.RLock()
+	families := s.families != nil
+	s.mu.RUnlock()
+
+	if families {
+		return s.backupFamilies(out)
+	}
+	return s.wal.Backup(out)
 }
 
-func (s *Store) Batch(fn func(s *Store) error) error {
+// Batch runs fn and flushes afterwards. The writes inside fn are
+// logged one by one, so a crash can persist only some of them; use Write
+// or Begin when they must land together. On a closed store it fails with
+// ErrClosed without running fn; if Close comes while fn runs, the writes
+// before it are flushed by Close and those after fail.
+func (s *Store) Batch(fn func(kv KV) error) error {
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
 	// Don't hold the lock here - each operation will lock itself
 	if err := fn(s); err != nil {
 		return err
 	}
 
 	// Flush all buffered writes
-	s.wal.Flush()
+	s.flushLogs()
 	return nil
 }
 
 func (s *Store) Commit() {
-	s.wal.Flush()
+	s.flushLogs()
+}
+
+// Barrier returns once every write accepted before the call has been
+// applied, so that a goroutine handed work after Barrier reads what the
+// writers before it wrote. With durable it also waits for those writes to
+// be fsynced, sharing one fsync with other waiters like SetDurable, and
+// without flushing writes accepted after the call. A write that has
+// returned is applied already; Barrier is for ordering against writers
+// still in flight, without a Commit after each of them.
+func (s *Store) Barrier(durable bool) error {
+	return s.BarrierCtx(context.Background(), durable)
 }
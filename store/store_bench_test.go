@@ -0,0 +1,203 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// Benchmark recovery time against log size
+func BenchmarkRecover1KRecords(b *testing.B)   { benchmarkRecover(b, 1000) }
+func BenchmarkRecover10KRecords(b *testing.B)  { benchmarkRecover(b, 10000) }
+func BenchmarkRecover100KRecords(b *testing.B) { benchmarkRecover(b, 100000) }
+
+func benchmarkRecover(b *testing.B, records int) {
+	dir := b.TempDir()
+	size := writeBenchLog(b, dir, records)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		w, err := wal.Open(dir, 100*time.Millisecond, 100*1024*1024)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		s := New(w)
+		if err := s.Recover(); err != nil {
+			b.Fatal(err)
+		}
+		s.Close()
+	}
+}
+
+// Benchmark compaction throughput: replaying a log full of overwrites
+// and rewriting only the live keys into a fresh log, which is the work
+// compaction has to do.
+func BenchmarkCompact(b *testing.B) {
+	dir := b.TempDir()
+	size := writeBenchLog(b, dir, 100000)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		w, err := wal.Open(dir, 100*time.Millisecond, 100*1024*1024)
+		if err != nil {
+			b.Fatal(err)
+		}
+		src := New(w)
+		if err := src.Recover(); err != nil {
+			b.Fatal(err)
+		}
+
+		out, err := wal.Open(b.TempDir(), 100*time.Millisecond, 100*1024*1024)
+		if err != nil {
+			b.Fatal(err)
+		}
+		dst := New(out)
+
+		for _, key := range src.Keys() {
+			value, _ := src.Get(key)
+			if err := dst.Set(key, value); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		dst.Close()
+		src.Close()
+	}
+}
+
+// writeBenchLog fills dir with records writes over 1000 distinct keys and
+// returns the number of bytes logged.
+func writeBenchLog(b *testing.B, dir string, records int) int64 {
+	b.Helper()
+
+	w, err := wal.Open(dir, 100*time.Millisecond, 100*1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := New(w)
+
+	value := "benchmark-value-with-some-data-to-make-it-realistic"
+	for i := 0; i < records; i++ {
+		if err := s.Set(fmt.Sprintf("key-%d", i%1000), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	s.Close()
+
+	w, err = wal.Open(dir, 100*time.Millisecond, 100*1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	_, stats, err := w.ReadAllWithStats()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return stats.Bytes
+}
+
+// Benchmark concurrent reads, alone and mixed with writes, which a
+// single exclusive lock serializes
+func BenchmarkStoreGetParallel(b *testing.B)   { benchmarkParallel(b, 0) }
+func BenchmarkStoreMixedParallel(b *testing.B) { benchmarkParallel(b, 10) }
+
+// benchmarkParallel runs Get from every goroutine, replacing one read in
+// every writeEvery with a Set (0 means reads only).
+func benchmarkParallel(b *testing.B, writeEvery int) {
+	w, err := wal.Open(b.TempDir(), 100*time.Millisecond, 100*1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		s.Set(keys[i], "value")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if writeEvery > 0 && i%writeEvery == 0 {
+				s.Set(key, "value")
+			} else {
+				s.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+// Benchmark loading and reading 1000 entries at a time, against the same
+// work done one key per call
+func BenchmarkStoreSetMany(b *testing.B) { benchmarkMany(b, true) }
+func BenchmarkStoreSetLoop(b *testing.B) { benchmarkMany(b, false) }
+
+func benchmarkMany(b *testing.B, many bool) {
+	w, err := wal.Open(b.TempDir(), 100*time.Millisecond, 100*1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	kv := make(map[string]string, 1000)
+	for i := 0; i < 1000; i++ {
+		kv[fmt.Sprintf("key-%d", i)] = "value"
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if many {
+			if err := s.SetMany(kv); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for key, value := range kv {
+			if err := s.Set(key, value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkStoreGetMany(b *testing.B) {
+	w, err := wal.Open(b.TempDir(), 100*time.Millisecond, 100*1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		s.Set(keys[i], "value")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s.GetMany(keys)
+	}
+}
@@ -1,8 +1,21 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -177,7 +190,7 @@ func TestBatch(t *testing.T) {
 	defer cleanup()
 
 	// Use Batch to group multiple operations
-	err := s.Batch(func(s *Store) error {
+	err := s.Batch(func(s KV) error {
 		s.Set("key1", "val1")
 		s.Set("key2", "val2")
 		s.Set("key3", "val3")
@@ -442,7 +455,7 @@ func BenchmarkStoreBatch(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		s.Batch(func(s *Store) error {
+		s.Batch(func(s KV) error {
 			s.Set("key1", "val1")
 			s.Set("key2", "val2")
 			s.Set("key3", "val3")
@@ -548,3 +561,3193 @@ func TestStressTest(t *testing.T) {
 		numWriters, numReaders, numDeleters, opsPerWorker)
 	t.Logf("Final store size: %d keys", s.Len())
 }
+
+// Test that Recover reports what it replayed
+func TestRecoveryStats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "walrus-store-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(w)
+	s.Set("a", "1")
+	s.Set("b", "2")
+	s.Delete("a")
+	s.Commit()
+	s.Close()
+
+	w2, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+
+	s2 := New(w2)
+	if err := s2.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := s2.LastRecovery()
+	if stats.Segments != 1 {
+		t.Fatalf("expected 1 segment, got %d", stats.Segments)
+	}
+	if stats.Records != 3 {
+		t.Fatalf("expected 3 records, got %d", stats.Records)
+	}
+	if stats.Keys != 1 {
+		t.Fatalf("expected 1 live key, got %d", stats.Keys)
+	}
+	if stats.CorruptBytes != 0 {
+		t.Fatalf("expected no corrupt bytes, got %d", stats.CorruptBytes)
+	}
+}
+
+// Test that keys set with a TTL disappear once it passes
+func TestSetWithTTL(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if err := s.SetWithTTL("session", "abc", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	s.Set("forever", "x")
+
+	if v, ok := s.Get("session"); !ok || v != "abc" {
+		t.Fatal("expected key with TTL to be readable before expiry")
+	}
+
+	if ttl, ok := s.TTL("session"); !ok || ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Fatalf("unexpected TTL %v (ok=%v)", ttl, ok)
+	}
+
+	if _, ok := s.TTL("forever"); ok {
+		t.Fatal("expected no TTL on a plain key")
+	}
+
+	time.Sleep(80 * time.Millisecond)
+
+	if s.Has("session") {
+		t.Fatal("expected key to be expired")
+	}
+
+	if s.Len() != 1 {
+		t.Fatalf("expected 1 live key, got %d", s.Len())
+	}
+
+	// a plain Set clears the TTL
+	s.SetWithTTL("k", "v", 50*time.Millisecond)
+	s.Set("k", "v2")
+	time.Sleep(80 * time.Millisecond)
+
+	if v, ok := s.Get("k"); !ok || v != "v2" {
+		t.Fatal("expected Set to clear the previous TTL")
+	}
+}
+
+// Test that TTLs are honoured after recovery
+func TestRecoveryWithTTL(t *testing.T) {
+	dir, err := os.MkdirTemp("", "walrus-store-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(w)
+	s.SetWithTTL("short", "1", 50*time.Millisecond)
+	s.SetWithTTL("long", "2", time.Hour)
+	s.Commit()
+	s.Close()
+
+	time.Sleep(80 * time.Millisecond)
+
+	w2, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s2 := New(w2)
+	defer s2.Close()
+
+	if err := s2.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s2.Has("short") {
+		t.Fatal("expected expired key to be dropped on recovery")
+	}
+
+	if ttl, ok := s2.TTL("long"); !ok || ttl < 59*time.Minute {
+		t.Fatalf("expected TTL to survive recovery, got %v", ttl)
+	}
+}
+
+// Test that a WriteBatch is applied as one unit
+func TestWriteBatch(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	s.Set("old", "x")
+
+	var b WriteBatch
+	b.Set("a", "1")
+	b.Set("b", "2")
+	b.Delete("old")
+
+	if err := s.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := s.Get("a"); v != "1" {
+		t.Fatal("batch set 'a' not applied")
+	}
+	if s.Has("old") {
+		t.Fatal("batch delete not applied")
+	}
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 keys, got %d", s.Len())
+	}
+}
+
+// Test that a batch torn by a crash is dropped as a whole on recovery
+func TestWriteBatchTornOnCrash(t *testing.T) {
+	dir, err := os.MkdirTemp("", "walrus-store-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(w)
+	s.Set("before", "ok")
+
+	var b WriteBatch
+	b.Set("tx1", "a")
+	b.Set("tx2", "b")
+	s.Write(&b)
+	s.Commit()
+
+	// chop the last byte off the batch record, and the marker Close
+	// leaves after it, as a crash mid-write would
+	path := filepath.Join(dir, "wal-0001.log")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s2 := New(w2)
+	defer s2.Close()
+
+	if err := s2.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s2.Has("before") {
+		t.Fatal("expected write before the batch to survive")
+	}
+
+	if s2.Has("tx1") || s2.Has("tx2") {
+		t.Fatal("expected torn batch to be dropped entirely")
+	}
+}
+
+// Test transaction commit, rollback and read-your-writes
+func TestTx(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	s.Set("gone", "soon")
+
+	tx := s.Begin()
+	tx.Set("k", "v")
+	tx.Delete("gone")
+
+	if v, ok := tx.Get("k"); !ok || v != "v" {
+		t.Fatal("expected tx to see its own write")
+	}
+	if _, ok := tx.Get("gone"); ok {
+		t.Fatal("expected tx to see its own delete")
+	}
+	if s.Has("k") {
+		t.Fatal("uncommitted write leaked into the store")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Fatalf("expected ErrTxDone on second commit, got %v", err)
+	}
+
+	if !s.Has("k") || s.Has("gone") {
+		t.Fatal("committed tx not applied")
+	}
+
+	tx = s.Begin()
+	tx.Set("never", "1")
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set("x", "y"); err != ErrTxDone {
+		t.Fatalf("expected ErrTxDone after rollback, got %v", err)
+	}
+	if s.Has("never") {
+		t.Fatal("rolled back write was applied")
+	}
+}
+
+// Test that code written against KV works with a real Store
+func TestStoreAsKV(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	fill := func(kv KV) error {
+		return kv.Batch(func(kv KV) error {
+			if err := kv.Set("a", "1"); err != nil {
+				return err
+			}
+			return kv.Set("b", "2")
+		})
+	}
+
+	if err := fill(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 keys, got %d", s.Len())
+	}
+}
+
+func TestScanAndRange(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	for _, k := range []string{"user:3", "order:1", "user:1", "user:2", "zeta"} {
+		s.Set(k, "v-"+k)
+	}
+	s.SetWithTTL("user:0", "gone", time.Millisecond)
+	s.Delete("user:2")
+	time.Sleep(5 * time.Millisecond)
+
+	keysOf := func(entries []Entry) string {
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		return strings.Join(keys, ",")
+	}
+
+	entries := s.Scan("user:")
+	if got := keysOf(entries); got != "user:1,user:3" {
+		t.Fatalf("Scan: unexpected keys %q", got)
+	}
+	if entries[0].Value != "v-user:1" {
+		t.Fatalf("Scan: unexpected value %q", entries[0].Value)
+	}
+
+	if got := keysOf(s.Range("order:", "user:3")); got != "order:1,user:1" {
+		t.Fatalf("Range: unexpected keys %q", got)
+	}
+	if got := keysOf(s.Range("user:3", "")); got != "user:3,zeta" {
+		t.Fatalf("open Range: unexpected keys %q", got)
+	}
+
+	if got := strings.Join(s.Keys(), ","); got != "order:1,user:1,user:3,zeta" {
+		t.Fatalf("expected sorted keys, got %q", got)
+	}
+}
+
+// Test that EstimateCount is exact for small counts and close for large
+// ones
+func TestEstimateCount(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	entries := make(map[string]string)
+	for i := 0; i < 20000; i++ {
+		entries[fmt.Sprintf("big:%05d", i)] = "v"
+	}
+	for i := 0; i < 10; i++ {
+		entries[fmt.Sprintf("small:%d", i)] = "v"
+	}
+	if err := s.SetMany(entries); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := s.Bucket("b")
+	b.Set("small:1", "v")
+
+	if n, exact := s.EstimateCount("small:"); n != 10 || !exact {
+		t.Fatalf("expected exactly 10, got %d, %v", n, exact)
+	}
+	if n, exact := s.EstimateCount(""); n != 20010 || !exact {
+		t.Fatalf("expected exactly 20010 outside buckets, got %d, %v", n, exact)
+	}
+	if n, exact := b.EstimateCount("small:"); n != 1 || !exact {
+		t.Fatalf("expected exactly 1 in the bucket, got %d, %v", n, exact)
+	}
+
+	n, exact := s.EstimateCount("big:")
+	if exact || n < 15000 || n > 25000 {
+		t.Fatalf("expected an estimate near 20000, got %d, %v", n, exact)
+	}
+}
+
+// Test the skiplist against a sorted slice under random inserts and removes
+func TestIndexMatchesSortedKeys(t *testing.T) {
+	ix := newIndex()
+	want := make(map[string]bool)
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("k%03d", rng.IntN(500))
+		if rng.IntN(3) == 0 {
+			ix.remove(key)
+			delete(want, key)
+		} else {
+			ix.insert(key)
+			want[key] = true
+		}
+	}
+
+	var expected []string
+	for k := range want {
+		expected = append(expected, k)
+	}
+	sort.Strings(expected)
+
+	var got []string
+	for n := ix.seek(""); n != nil; n = n.next[0] {
+		got = append(got, n.key)
+	}
+
+	if strings.Join(got, ",") != strings.Join(expected, ",") || ix.len != len(expected) {
+		t.Fatalf("index out of sync: %d keys, expected %d", len(got), len(expected))
+	}
+}
+
+func TestRecoverWithMemoryBudget(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprintf("key-%d", i), value)
+	}
+	s.Close()
+
+	// each reopen closes the store before, which holds the directory's lock
+	reopen := func(opts RecoverOptions) (*Store, error) {
+		s.Close()
+		w, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s = New(w)
+		t.Cleanup(func() { s.Close() })
+		return s, s.RecoverWithOptions(opts)
+	}
+
+	s, err = reopen(RecoverOptions{MaxMemory: 10 * 1024})
+	if !errors.Is(err, ErrRecoveryBudget) {
+		t.Fatalf("expected ErrRecoveryBudget, got %v", err)
+	}
+	if s.Len() != 0 {
+		t.Fatalf("expected failed recovery to leave the store empty, got %d keys", s.Len())
+	}
+
+	s, err = reopen(RecoverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peak := s.LastRecovery().PeakMemory
+	if peak < 100*1024 {
+		t.Fatalf("expected peak memory to cover the values, got %d", peak)
+	}
+
+	// the reported peak is enough to recover under a budget
+	if _, err := reopen(RecoverOptions{MaxMemory: peak}); err != nil {
+		t.Fatalf("expected recovery within %d bytes, got %v", peak, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	events, cancel := s.Watch("user:")
+	defer cancel()
+
+	s.Set("user:1", "alice")
+	s.Set("order:1", "x")
+	s.Delete("user:1")
+
+	b := &WriteBatch{}
+	b.Set("user:2", "bob")
+	b.Set("user:3", "carol")
+	s.Write(b)
+
+	want := []Event{
+		{Op: EventSet, Key: "user:1", Value: "alice"},
+		{Op: EventDelete, Key: "user:1"},
+		{Op: EventSet, Key: "user:2", Value: "bob"},
+		{Op: EventSet, Key: "user:3", Value: "carol"},
+	}
+	for _, w := range want {
+		select {
+		case ev := <-events:
+			if ev != w {
+				t.Fatalf("expected %+v, got %+v", w, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %+v", w)
+		}
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("expected channel to be closed after cancel")
+	}
+	cancel() // cancelling twice is harmless
+}
+
+func TestWatchSlowConsumerIsDropped(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	events, cancel := s.Watch("")
+	defer cancel()
+
+	for i := 0; i < watchBuffer+1; i++ {
+		s.Set(fmt.Sprintf("k%d", i), "v")
+	}
+
+	n := 0
+	for range events {
+		n++
+	}
+	if n != watchBuffer {
+		t.Fatalf("expected %d buffered events before the drop, got %d", watchBuffer, n)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+
+	blob := []byte{0x00, 0xff, 0xfe, '\n', ' ', ' ', 0x00}
+	want := string(blob)
+
+	if err := s.SetBytes("blob", blob); err != nil {
+		t.Fatal(err)
+	}
+	blob[0] = 'x' // the store must have kept its own copy
+
+	got, ok := s.GetBytes("blob")
+	if !ok || string(got) != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	got[1] = 'y' // nor may callers reach into it
+	if v, _ := s.Get("blob"); v != want {
+		t.Fatalf("GetBytes leaked internal storage, value now %q", v)
+	}
+	s.Close()
+
+	w, err = wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(w)
+	defer s.Close()
+
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.GetBytes("blob"); string(got) != want {
+		t.Fatalf("expected %q after recovery, got %q", want, got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+
+	s.Set("a", "1")
+	s.Set("b", "2")
+
+	events, cancel := s.Watch("user:")
+	defer cancel()
+
+	if err := s.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 0 || s.Has("a") {
+		t.Fatal("expected reset to clear every key")
+	}
+	if ev := <-events; ev.Op != EventReset {
+		t.Fatalf("expected a reset event, got %+v", ev)
+	}
+
+	// the store keeps serving
+	s.Set("c", "3")
+	s.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(files) != 1 {
+		t.Fatalf("expected old segments to be removed, found %v", files)
+	}
+
+	w, err = wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(w)
+	defer s.Close()
+
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := s.Keys(); len(keys) != 1 || keys[0] != "c" {
+		t.Fatalf("expected only c after recovery, got %v", keys)
+	}
+}
+
+// Test that a reset marker clears older segments even if a crash kept
+// them from being deleted
+func TestResetMarkerSurvivesCrash(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	s.Set("old", "1")
+
+	// the first half of Reset, without removing segments
+	if _, err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	w.Append(&wal.Record{Op: wal.OpReset})
+	s.Set("new", "2")
+	s.Close()
+
+	w, err = wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(w)
+	defer s.Close()
+
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has("old") || !s.Has("new") {
+		t.Fatalf("expected only writes after the marker, got %v", s.Keys())
+	}
+}
+
+func TestSetDurable(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.OpenWithOptions(wal.Options{
+		Dir:        dir,
+		FlushEvery: time.Hour, // nothing but SetDurable reaches disk
+		SyncPolicy: wal.SyncPolicy{Mode: wal.SyncNever},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.SetDurable(fmt.Sprintf("k%d", i), "v"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// read the log through a second handle while the store is still open
+	other, err := wal.OpenReadOnly(wal.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	records, err := other.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 20 {
+		t.Fatalf("expected 20 durable records on disk, got %d", len(records))
+	}
+}
+
+func TestBarrier(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.OpenWithOptions(wal.Options{
+		Dir:        dir,
+		FlushEvery: time.Hour, // nothing but the barrier reaches disk
+		SyncPolicy: wal.SyncPolicy{Mode: wal.SyncNever},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.Set(fmt.Sprintf("k%d", i), "v")
+		}(i)
+	}
+	wg.Wait()
+
+	if err := s.Barrier(false); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := w.Stats(); st.Syncs != 0 {
+		t.Fatal("expected Barrier(false) not to sync")
+	}
+	if err := s.Barrier(true); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := wal.OpenReadOnly(wal.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	records, err := other.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 10 {
+		t.Fatalf("expected 10 records on disk after the barrier, got %d", len(records))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.BarrierCtx(ctx, true); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRecoverDeadLetters(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(&wal.Record{Op: wal.OpSet, Key: []byte("a"), Value: []byte("1")})
+	w.Append(&wal.Record{Op: 99, Key: []byte("future"), Value: []byte("?")})
+	w.Append(&wal.Record{Op: wal.OpSet, Key: []byte("b"), Value: []byte("2")})
+	w.Close()
+
+	reopen := func() *Store {
+		w, err := wal.Open(dir, time.Hour, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return New(w)
+	}
+
+	// without somewhere to put it, an unknown op fails recovery
+	s := reopen()
+	if err := s.Recover(); !errors.Is(err, ErrUnappliable) {
+		t.Fatalf("expected ErrUnappliable, got %v", err)
+	}
+	if s.Len() != 0 {
+		t.Fatal("failed recovery should leave the store empty")
+	}
+	s.Close()
+
+	// a handler can take it instead
+	s = reopen()
+	var handled []string
+	err = s.RecoverWithOptions(RecoverOptions{Handler: func(rec *wal.Record) error {
+		handled = append(handled, string(rec.Key))
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 1 || handled[0] != "future" || s.Len() != 2 {
+		t.Fatalf("expected handler to take 'future', got %v with %d keys", handled, s.Len())
+	}
+	s.Close()
+
+	// or it goes to the dead-letter file and replay carries on
+	deadPath := filepath.Join(t.TempDir(), "dead.log")
+	s = reopen()
+	err = s.RecoverWithOptions(RecoverOptions{
+		DeadLetterPath: deadPath,
+		Handler:        func(*wal.Record) error { return errors.New("not mine") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if v, _ := s.Get("b"); v != "2" || s.Len() != 2 {
+		t.Fatal("expected records after the dead letter to be applied")
+	}
+	if n := s.LastRecovery().DeadLetters; n != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", n)
+	}
+
+	f, err := os.Open(deadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var dead []*wal.Record
+	if err := wal.ReadRecords(f, func(rec *wal.Record) error {
+		dead = append(dead, rec)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Op != 99 || string(dead[0].Key) != "future" {
+		t.Fatalf("unexpected dead letters %+v", dead)
+	}
+}
+
+// Test that an encrypted store's dead letters are sealed with its key and
+// read back with the WAL
+func TestRecoverDeadLettersEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *wal.WAL {
+		w, err := wal.OpenWithOptions(wal.Options{
+			Dir:            dir,
+			FlushEvery:     time.Hour,
+			EncryptionKeys: []wal.EncryptionKey{{ID: 1, Key: make([]byte, 32)}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	w := open()
+	w.Append(&wal.Record{Op: 99, Key: []byte("future"), Value: []byte("plaintext")})
+	w.Close()
+
+	w = open()
+	s := New(w)
+	defer s.Close()
+	deadPath := filepath.Join(t.TempDir(), "dead.log")
+	if err := s.RecoverWithOptions(RecoverOptions{DeadLetterPath: deadPath}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(deadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("plaintext")) || bytes.Contains(data, []byte("future")) {
+		t.Fatal("expected the dead letter encrypted")
+	}
+	if info, _ := os.Stat(deadPath); info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the dead-letter file 0600, got %v", info.Mode().Perm())
+	}
+	if err := wal.ReadRecords(bytes.NewReader(data), func(*wal.Record) error { return nil }); !errors.Is(err, wal.ErrUnknownKey) {
+		t.Fatalf("expected reading without the key to fail, got %v", err)
+	}
+	var dead []*wal.Record
+	if err := w.ReadRecords(bytes.NewReader(data), func(rec *wal.Record) error {
+		dead = append(dead, rec)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || string(dead[0].Value) != "plaintext" {
+		t.Fatalf("unexpected dead letters %+v", dead)
+	}
+}
+
+func TestBatchWithUnknownOpIsNotApplied(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := wal.EncodeBatch([]*wal.Record{
+		{Op: wal.OpSet, Key: []byte("a"), Value: []byte("1")},
+		{Op: 99, Key: []byte("future")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(&wal.Record{Op: wal.OpBatch, Value: batch})
+	w.Close()
+
+	w, err = wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	if err := s.RecoverWithOptions(RecoverOptions{DeadLetterPath: filepath.Join(t.TempDir(), "dead.log")}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has("a") {
+		t.Fatal("a batch with an unknown op should be set aside whole")
+	}
+	if s.LastRecovery().DeadLetters != 1 {
+		t.Fatal("expected the batch as one dead letter")
+	}
+}
+
+func TestRecoverDryRun(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"user:1", "user:2", "user:3", "order:1", "plain"} {
+		w.Append(&wal.Record{Op: wal.OpSet, Key: []byte(k), Value: []byte("v")})
+	}
+	w.Append(&wal.Record{Op: wal.OpDelete, Key: []byte("user:3")})
+	w.Append(&wal.Record{Op: 99, Key: []byte("future")})
+	w.Close()
+
+	w, err = wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	r, err := s.RecoverDryRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Keys != 4 || r.Records != 7 || r.Unappliable != 1 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	want := []PrefixCount{{"user:", 2}, {"", 1}, {"order:", 1}}
+	if fmt.Sprint(r.TopPrefixes) != fmt.Sprint(want) {
+		t.Fatalf("expected prefixes %v, got %v", want, r.TopPrefixes)
+	}
+
+	if s.Len() != 0 || s.LastRecovery().Records != 0 {
+		t.Fatal("a dry run should not touch the store")
+	}
+}
+
+// Test that EstimateRecovery times a sample of the log and scales it up
+// to the whole of it, leaving the store alone
+func TestEstimateRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 1000 {
+		w.Append(&wal.Record{Op: wal.OpSet, Key: []byte(fmt.Sprintf("key:%d", i)), Value: []byte("value")})
+	}
+	w.Close()
+
+	w, err = wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	est, err := s.EstimateRecovery(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.SampleRecords == 0 || est.SampleRecords == 1000 || est.SampleBytes < 4096 || est.LogBytes <= est.SampleBytes {
+		t.Fatalf("expected a sample of part of the log, got %+v", est)
+	}
+	if est.Estimate < est.SampleTime {
+		t.Fatalf("expected the estimate to scale the sample up, got %+v", est)
+	}
+	if s.Len() != 0 {
+		t.Fatal("an estimate should not touch the store")
+	}
+
+	if est, _ := s.EstimateRecovery(1 << 30); est.SampleRecords != 1000 || est.SampleBytes != est.LogBytes {
+		t.Fatalf("expected a sample larger than the log to read all of it, got %+v", est)
+	}
+}
+
+// Test that a background recovery holds writes until it has replayed
+// the log, and that Close stops one still running
+func TestRecoverInBackground(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5000 {
+		w.Append(&wal.Record{Op: wal.OpSet, Key: []byte(fmt.Sprintf("key:%d", i)), Value: []byte("value")})
+	}
+	w.Close()
+
+	w, err = wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	done := s.RecoverInBackground(RecoverOptions{})
+	wrote := make(chan error, 1)
+	go func() {
+		err := s.Set("key:0", "new")
+		if err == nil && s.CatchingUp() {
+			err = errors.New("write went through while catching up")
+		}
+		wrote <- err
+	}()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-wrote; err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("key:0"); v != "new" || s.Len() != 5000 || s.CatchingUp() {
+		t.Fatalf("expected the write to land on the recovered store, got %q with %d keys", v, s.Len())
+	}
+
+	w, err = wal.Open(t.TempDir(), time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := New(w)
+	done = s2.RecoverInBackground(RecoverOptions{})
+	s2.Close()
+	if err := <-done; err != nil && !errors.Is(err, errClosedDuringRecovery) {
+		t.Fatalf("expected recovery to finish or stop, got %v", err)
+	}
+}
+
+// Test that recovery reports a log left without Close's marker as a
+// crash, and checks the store it recovered from one when asked to
+func TestRecoverAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal-0001.log")
+
+	open := func() *Store {
+		w, err := wal.Open(dir, time.Hour, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := New(w)
+		if err := s.RecoverWithOptions(RecoverOptions{CheckAfterCrash: true}); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := open()
+	s.Set("key", "value")
+	s.Close()
+
+	s = open()
+	if s.LastRecovery().Crashed {
+		t.Fatal("expected a clean shutdown")
+	}
+	s.Set("other", "value")
+	s.Commit()
+	info, _ := os.Stat(path)
+	s.Close()
+
+	os.Truncate(path, info.Size())
+	s = open()
+	defer s.Close()
+	if !s.LastRecovery().Crashed || s.Len() != 2 {
+		t.Fatalf("expected both keys recovered after a crash, got %+v", s.LastRecovery())
+	}
+}
+
+func TestTree(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	for _, k := range []string{"user:1:profile", "user:1:settings", "user:1", "user:2", "order:1"} {
+		s.Set(k, "v")
+	}
+
+	root := s.Tree(":")
+	if root.Keys != 5 || len(root.Children) != 2 {
+		t.Fatalf("expected 5 keys in 2 branches, got %d in %d", root.Keys, len(root.Children))
+	}
+
+	user := root.Children[1]
+	if user.Name != "user" || user.Keys != 4 || user.IsKey {
+		t.Fatalf("unexpected user branch %+v", user)
+	}
+
+	one := user.Children[0]
+	if one.Path != "user:1" || one.Keys != 3 || !one.IsKey || len(one.Children) != 2 {
+		t.Fatalf("expected user:1 to be a key and a branch of 3, got %+v", one)
+	}
+	if one.Children[1].Path != "user:1:settings" {
+		t.Fatalf("expected full paths on leaves, got %q", one.Children[1].Path)
+	}
+}
+
+// collect reads batches until until reports the events so far are
+// enough, failing the test if that takes too long.
+func collect(t *testing.T, ch <-chan []Event, until func([]Event) bool) []Event {
+	t.Helper()
+
+	var got []Event
+	timeout := time.After(5 * time.Second)
+	for !until(got) {
+		select {
+		case batch := <-ch:
+			got = append(got, batch...)
+		case <-timeout:
+			t.Fatalf("timed out, got %+v", got)
+		}
+	}
+	return got
+}
+
+func lastIs(key, value string) func([]Event) bool {
+	return func(evs []Event) bool {
+		return len(evs) > 0 && evs[len(evs)-1].Key == key && evs[len(evs)-1].Value == value
+	}
+}
+
+func TestWatchBatchesCoalesces(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	events, cancel := s.WatchBatches("", WatchOptions{Coalesce: true})
+	defer cancel()
+
+	for i := 1; i <= 100; i++ {
+		s.Set("counter", fmt.Sprint(i))
+	}
+	s.Set("done", "1")
+
+	got := collect(t, events, lastIs("done", "1"))
+	if len(got) > 3 {
+		t.Fatalf("expected updates to counter to coalesce, got %d events", len(got))
+	}
+	if got[len(got)-2].Key != "counter" || got[len(got)-2].Value != "100" {
+		t.Fatalf("expected the latest counter value to survive, got %+v", got)
+	}
+}
+
+func TestWatchBatchesOverflow(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	events, cancel := s.WatchBatches("", WatchOptions{Buffer: 4})
+	defer cancel()
+
+	for i := 0; i < 50; i++ {
+		s.Set(fmt.Sprintf("k%d", i), "v")
+	}
+
+	got := collect(t, events, lastIs("k49", "v"))
+	overflowed := false
+	for _, ev := range got {
+		overflowed = overflowed || ev.Op == EventOverflow
+	}
+	if !overflowed || len(got) >= 50 {
+		t.Fatalf("expected dropped events to be reported, got %d events", len(got))
+	}
+}
+
+func TestWatchBatchesBlock(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	events, cancel := s.WatchBatches("", WatchOptions{Buffer: 2, Block: true})
+
+	go func() {
+		for i := 0; i < 50; i++ {
+			s.Set(fmt.Sprintf("k%d", i), "v")
+		}
+	}()
+
+	got := collect(t, events, lastIs("k49", "v"))
+	if len(got) != 50 {
+		t.Fatalf("expected every event with a blocking watcher, got %d", len(got))
+	}
+
+	// cancelling releases a writer stuck on a consumer that stopped reading
+	done := make(chan struct{})
+	go func() {
+		for _, k := range []string{"a", "b", "c", "d"} {
+			s.Set(k, "1")
+		}
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer still blocked after cancel")
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprintf("k%d", i), "v")
+	}
+
+	// writers carry on during the backup; only what came before counts
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				s.Set(fmt.Sprintf("late%d", i), "v")
+			}
+		}
+	}()
+
+	var buf bytes.Buffer
+	err := s.Backup(&buf)
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := wal.RestoreInto(dir, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.RestoreInto(dir, bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("expected restoring over an existing log to fail")
+	}
+
+	w, err := wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := New(w)
+	defer restored.Close()
+
+	if err := restored.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if !restored.Has(fmt.Sprintf("k%d", i)) {
+			t.Fatalf("k%d missing from the restored store", i)
+		}
+	}
+	if restored.LastRecovery().CorruptBytes != 0 {
+		t.Fatal("expected the backup to end on a record boundary")
+	}
+}
+
+func TestOptimisticTxConflicts(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	s.Set("user:1:name", "ann")
+	s.Set("order:9", "open")
+
+	// a key read conflicts with a write to that key
+	tx := s.BeginOptimistic()
+	tx.Get("user:1:name")
+	tx.Set("user:1:seen", "yes")
+	s.Set("user:1:name", "bob")
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if s.Has("user:1:seen") {
+		t.Fatal("a conflicting tx should write nothing")
+	}
+
+	// a scan conflicts with a new key under its prefix, not elsewhere
+	tx = s.BeginOptimistic()
+	if n := len(tx.Scan("user:1:")); n != 1 {
+		t.Fatalf("expected 1 entry, got %d", n)
+	}
+	s.Set("order:9", "paid")
+	tx.Set("user:1:count", "1")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("expected an unrelated write not to conflict, got %v", err)
+	}
+
+	tx = s.BeginOptimistic()
+	tx.Scan("user:")
+	s.Set("user:2:name", "cy")
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected a write under the scanned prefix to conflict, got %v", err)
+	}
+
+	tx = s.BeginOptimistic()
+	tx.Get("order:9")
+	s.Reset()
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected a reset to conflict, got %v", err)
+	}
+}
+
+func TestOptimisticTxIncrement(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	s.Set("counter", "0")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				tx := s.BeginOptimistic()
+				v, _ := tx.Get("counter")
+				n, _ := strconv.Atoi(v)
+				tx.Set("counter", strconv.Itoa(n+1))
+
+				err := tx.Commit()
+				if err == nil {
+					return
+				}
+				if !errors.Is(err, ErrConflict) {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := s.Get("counter"); v != "20" {
+		t.Fatalf("expected 20 increments, got %s", v)
+	}
+}
+
+func TestTxSavepoints(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	s.Set("a", "0")
+
+	tx := s.Begin()
+	tx.Set("a", "1")
+	sp, _ := tx.Savepoint()
+
+	tx.Set("a", "2")
+	tx.Set("b", "2")
+	inner, _ := tx.Savepoint()
+	tx.Delete("a")
+
+	if err := tx.RollbackTo(sp); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := tx.Get("a"); v != "1" {
+		t.Fatalf("expected a=1 after rolling back, got %q", v)
+	}
+	if _, ok := tx.Get("b"); ok {
+		t.Fatal("expected b to be rolled back")
+	}
+	if err := tx.RollbackTo(inner); !errors.Is(err, ErrInvalidSavepoint) {
+		t.Fatalf("expected a later savepoint to be released, got %v", err)
+	}
+
+	// sp stays usable
+	tx.Set("c", "3")
+	if err := tx.RollbackTo(sp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("a"); v != "1" || s.Has("b") || s.Has("c") {
+		t.Fatalf("expected only the writes before the savepoint to commit, got a=%q", v)
+	}
+}
+
+func TestWriteIdempotent(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+
+	incr := func() *WriteBatch {
+		v, _ := s.Get("counter")
+		n, _ := strconv.Atoi(v)
+		b := &WriteBatch{}
+		b.Set("counter", strconv.Itoa(n+1))
+		return b
+	}
+
+	for i := 0; i < 3; i++ {
+		applied, err := s.WriteIdempotent("req-1", time.Minute, incr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied != (i == 0) {
+			t.Fatalf("attempt %d: applied = %v", i, applied)
+		}
+	}
+	if v, _ := s.Get("counter"); v != "1" {
+		t.Fatalf("expected the retries to be dropped, got counter %q", v)
+	}
+	if !s.Applied("req-1") || s.Applied("req-2") {
+		t.Fatal("Applied disagrees with what was written")
+	}
+
+	// a short window lapses, after which the key applies again
+	if _, err := s.WriteIdempotent("req-short", 20*time.Millisecond, incr()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if applied, err := s.WriteIdempotent("req-short", 20*time.Millisecond, incr()); err != nil || !applied {
+		t.Fatalf("expected an expired key to apply again, got %v %v", applied, err)
+	}
+
+	s.Commit()
+	s.Close()
+
+	// the key is remembered across a restart
+	w2, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := New(w2)
+	defer s2.Close()
+	if err := s2.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &WriteBatch{}
+	b.Set("counter", "100")
+	if applied, err := s2.WriteIdempotent("req-1", time.Minute, b); err != nil || applied {
+		t.Fatalf("expected a retry after restart to be dropped, got %v %v", applied, err)
+	}
+	if v, _ := s2.Get("counter"); v != "3" {
+		t.Fatalf("expected counter 3, got %q", v)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	s.Set("a", "1")
+	s.SetWithTTL("b", "2", time.Minute)
+	s.Delete("a")
+	s.Get("b")
+	s.Has("a")
+	s.Scan("")
+	b := &WriteBatch{}
+	b.Set("c", "3")
+	s.Write(b)
+	_, cancel := s.Watch("")
+	defer cancel()
+
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OpCounts{Gets: 2, Scans: 1, Sets: 2, Deletes: 1, Batches: 1}
+	if st.Ops != want {
+		t.Fatalf("expected ops %+v, got %+v", want, st.Ops)
+	}
+	if st.Keys != 2 || st.Memory <= 0 || st.WAL.Appends != 4 || st.Watchers != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestContextVariants(t *testing.T) {
+	w, err := wal.OpenWithOptions(wal.Options{
+		Dir:        t.TempDir(),
+		FlushEvery: time.Hour,
+		Faults:     wal.Faults{SyncLatency: 300 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.SetCtx(canceled, "a", "1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if s.Has("a") {
+		t.Fatal("a write with a done context was applied")
+	}
+	if _, _, err := s.GetCtx(canceled, "a"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled from GetCtx, got %v", err)
+	}
+
+	// a slow fsync is abandoned at the deadline, but the write stands
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.SetDurableCtx(ctx, "b", "2"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("SetDurableCtx waited %v past its deadline", elapsed)
+	}
+	if v, ok, err := s.GetCtx(context.Background(), "b"); err != nil || !ok || v != "2" {
+		t.Fatalf("expected b=2 after an abandoned fsync, got %q %v %v", v, ok, err)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	s.Set("a", "1")
+	s.Set("b", "2")
+	s.SetWithTTL("c", "3", time.Hour)
+	s.Delete("b")
+	b := &WriteBatch{}
+	b.Set("d", "4")
+	b.Delete("a")
+	s.Write(b)
+
+	r, err := s.SelfCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() || r.Keys != 2 || r.Records != 5 {
+		t.Fatalf("expected a clean check of 2 keys and 5 records, got %+v", r)
+	}
+
+	// change memory behind the log's back
+	s.mu.Lock()
+	s.data["c"] = "tampered"
+	s.put("e", "5")
+	s.remove("d")
+	s.mu.Unlock()
+
+	r, err = s.SelfCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Divergence{
+		{Key: "c", Reason: "value", Memory: "tampered", Log: "3"},
+		{Key: "d", Reason: "missing", Log: "4"},
+		{Key: "e", Reason: "extra", Memory: "5"},
+	}
+	if r.OK() || r.Divergent != 3 || fmt.Sprint(r.Divergences) != fmt.Sprint(want) {
+		t.Fatalf("expected divergences %v, got %+v", want, r)
+	}
+}
+
+func TestReadsShareTheLock(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	s.Set("a", "1")
+
+	// a reader holding the lock must not stop another from reading
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Get("a")
+		s.Has("a")
+		s.Keys()
+		s.Len()
+		s.Scan("")
+		s.Applied("req")
+		s.LastRecovery()
+		s.BeginOptimistic().Get("a")
+		s.Stats()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reads blocked behind another reader")
+	}
+}
+
+func TestIncr(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := s.Incr("hits", 1); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n, err := s.Decr("hits", 10); err != nil || n != 990 {
+		t.Fatalf("expected 990, got %d (%v)", n, err)
+	}
+
+	s.SetWithTTL("visits", "5", time.Hour)
+	if n, _ := s.Incr("visits", 2); n != 7 {
+		t.Fatalf("expected 7, got %d", n)
+	}
+	if _, ok := s.TTL("visits"); !ok {
+		t.Fatal("expected Incr to keep the TTL")
+	}
+
+	s.SetWithTTL("gone", "100", 20*time.Millisecond)
+	s.Incr("gone", 1)
+	time.Sleep(40 * time.Millisecond)
+
+	s.Set("name", "jerk")
+	if _, err := s.Incr("name", 1); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("expected ErrNotInteger, got %v", err)
+	}
+	s.Set("big", strconv.FormatInt(math.MaxInt64, 10))
+	if _, err := s.Incr("big", 1); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected ErrOverflow, got %v", err)
+	}
+	s.Close()
+
+	w, err = wal.Open(dir, 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(w)
+	defer s.Close()
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := s.Get("hits"); v != "990" {
+		t.Fatalf("expected hits to replay to 990, got %q", v)
+	}
+	if v, _ := s.Get("visits"); v != "7" {
+		t.Fatalf("expected visits to replay to 7, got %q", v)
+	}
+	if _, ok := s.TTL("visits"); !ok {
+		t.Fatal("expected the replayed counter to keep its TTL")
+	}
+	if s.Has("gone") {
+		t.Fatal("expected an expired counter to stay expired after replay")
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+
+	// of many writers racing for the same key, exactly one wins
+	var wins atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, err := s.SetIfAbsent("leader", fmt.Sprintf("node-%d", i)); err != nil {
+				t.Error(err)
+			} else if ok {
+				wins.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if wins.Load() != 1 {
+		t.Fatalf("expected one SetIfAbsent to win, %d did", wins.Load())
+	}
+
+	leader, _ := s.Get("leader")
+	if ok, _ := s.CompareAndSet("leader", "someone-else", "me"); ok {
+		t.Fatal("expected CompareAndSet with the wrong old value to fail")
+	}
+	if ok, _ := s.CompareAndSet("leader", leader, "me"); !ok {
+		t.Fatal("expected CompareAndSet with the current value to succeed")
+	}
+	if ok, _ := s.CompareAndSet("missing", "", "x"); ok {
+		t.Fatal("expected CompareAndSet on a missing key to fail")
+	}
+
+	// a swap clears the TTL it replaced, also on replay after it ran out
+	s.SetWithTTL("lease", "a", 20*time.Millisecond)
+	if ok, _ := s.CompareAndSet("lease", "a", "b"); !ok {
+		t.Fatal("expected CompareAndSet on a key with a TTL to succeed")
+	}
+	s.SetWithTTL("old", "x", 20*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	if ok, _ := s.SetIfAbsent("old", "y"); !ok {
+		t.Fatal("expected SetIfAbsent to replace an expired key")
+	}
+	s.Close()
+
+	w, err = wal.Open(dir, 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(w)
+	defer s.Close()
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{"leader": "me", "lease": "b", "old": "y"} {
+		if v, ok := s.Get(key); !ok || v != want {
+			t.Fatalf("expected %s = %q after replay, got %q", key, want, v)
+		}
+	}
+}
+
+func TestGetManySetMany(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if err := s.SetMany(map[string]string{"a": "1", "b": "2", "c": "3"}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetWithTTL("gone", "x", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	got := s.GetMany([]string{"a", "c", "missing", "gone"})
+	want := map[string]string{"a": "1", "c": "3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// the whole map goes into one batch record
+	s.Commit()
+	records, err := s.wal.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].Op != wal.OpBatch {
+		t.Fatalf("expected SetMany to log one batch, first record is op %d", records[0].Op)
+	}
+	if batch, _ := wal.DecodeBatch(records[0].Value); len(batch) != 3 {
+		t.Fatalf("expected 3 writes in the batch, got %d", len(batch))
+	}
+
+	if err := s.DeleteMany([]string{"a", "b", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := s.Keys(); len(keys) != 1 || keys[0] != "c" {
+		t.Fatalf("expected only c left, got %v", keys)
+	}
+	s.Commit()
+	records, _ = s.wal.ReadAll()
+	if last := records[len(records)-1]; last.Op != wal.OpBatch {
+		t.Fatalf("expected DeleteMany to log one batch, last record is op %d", last.Op)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+
+	for _, k := range []string{"a", "b", "c"} {
+		s.Set(k, "v")
+	}
+	s.Delete("a")
+	time.Sleep(time.Millisecond)
+	b := &WriteBatch{}
+	b.Delete("b")
+	s.Write(b)
+	s.Delete("never-set")
+
+	got := s.Tombstones()
+	if len(got) != 2 || got[0].Key != "b" || got[1].Key != "a" {
+		t.Fatalf("expected tombstones for b then a, got %v", got)
+	}
+	if time.Since(got[1].DeletedAt) > time.Minute {
+		t.Fatalf("unexpected deletion time %v", got[1].DeletedAt)
+	}
+
+	// setting a key again buries its tombstone
+	s.Set("b", "back")
+	if got := s.Tombstones(); len(got) != 1 || got[0].Key != "a" {
+		t.Fatalf("expected only a's tombstone, got %v", got)
+	}
+	s.Close()
+
+	w, err = wal.Open(dir, 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(w)
+	defer s.Close()
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Tombstones(); len(got) != 1 || got[0].Key != "a" {
+		t.Fatalf("expected a's tombstone to survive a restart, got %v", got)
+	}
+
+	s.SetTombstoneTTL(time.Nanosecond)
+	if got := s.Tombstones(); len(got) != 0 {
+		t.Fatalf("expected tombstones past their TTL to be hidden, got %v", got)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+
+	if _, err := s.Bucket(""); !errors.Is(err, ErrBucketName) {
+		t.Fatalf("expected ErrBucketName for an empty name, got %v", err)
+	}
+
+	users, _ := s.Bucket("users")
+	orders, _ := s.Bucket("orders")
+	events, cancel := users.Watch("")
+	defer cancel()
+
+	s.Set("42", "root")
+	users.Set("42", "alice")
+	users.Set("43", "bob")
+	orders.Set("42", "order")
+	users.Delete("43")
+
+	if v, _ := users.Get("42"); v != "alice" {
+		t.Fatalf("expected users/42 = alice, got %q", v)
+	}
+	if v, _ := s.Get("42"); v != "root" {
+		t.Fatalf("expected root 42 = root, got %q", v)
+	}
+	if keys := s.Keys(); !slices.Equal(keys, []string{"42"}) {
+		t.Fatalf("expected the store's keys to leave out buckets, got %v", keys)
+	}
+	if n := s.Len(); n != 1 {
+		t.Fatalf("expected the store to count 1 key, got %d", n)
+	}
+	if entries := s.Scan(""); len(entries) != 1 {
+		t.Fatalf("expected Scan to leave out buckets, got %v", entries)
+	}
+	if keys := users.Keys(); !slices.Equal(keys, []string{"42"}) {
+		t.Fatalf("expected users to hold only 42, got %v", keys)
+	}
+	if got := s.Buckets(); !slices.Equal(got, []string{"orders", "users"}) {
+		t.Fatalf("expected buckets orders and users, got %v", got)
+	}
+
+	for _, want := range []Event{{Op: EventSet, Key: "42", Value: "alice"}, {Op: EventSet, Key: "43", Value: "bob"}, {Op: EventDelete, Key: "43"}} {
+		if ev := <-events; ev != want {
+			t.Fatalf("expected %v, got %v", want, ev)
+		}
+	}
+	s.Close()
+
+	w, err = wal.Open(dir, 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(w)
+	defer s.Close()
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	orders, _ = s.Bucket("orders")
+	if v, _ := orders.Get("42"); v != "order" {
+		t.Fatalf("expected orders/42 to survive a restart, got %q", v)
+	}
+	if n := s.Len(); n != 1 {
+		t.Fatalf("expected the store to count 1 key after replay, got %d", n)
+	}
+}
+
+func TestBucketIdleTTL(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if err := s.SetBucketIdleTTL(50*time.Millisecond, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	idle, _ := s.Bucket("idle")
+	busy, _ := s.Bucket("busy")
+	idle.Set("a", "1")
+	idle.SetWithTTL("b", "2", time.Hour)
+	busy.Set("a", "1")
+	s.Set("top", "level")
+
+	time.Sleep(60 * time.Millisecond)
+	busy.Get("a")
+	before, _ := s.Stats()
+	s.sweep()
+
+	if got := s.IdleBuckets(); !slices.Equal(got, []string{"idle"}) {
+		t.Fatalf("expected only the idle bucket moved out, got %v", got)
+	}
+	after, _ := s.Stats()
+	if after.Memory >= before.Memory || after.IdleBuckets != 1 {
+		t.Fatalf("expected memory to drop with 1 idle bucket, got %+v then %+v", before, after)
+	}
+	if got := s.Buckets(); !slices.Equal(got, []string{"busy", "idle"}) {
+		t.Fatalf("expected Buckets to list the idle bucket too, got %v", got)
+	}
+
+	// a read brings it back, expiry included
+	if v, ok := idle.Get("a"); !ok || v != "1" {
+		t.Fatalf("expected idle/a to load back as 1, got %q, %v", v, ok)
+	}
+	if ttl, ok := idle.TTL("b"); !ok || ttl <= 0 {
+		t.Fatalf("expected idle/b to keep its TTL, got %v, %v", ttl, ok)
+	}
+	if len(s.IdleBuckets()) != 0 {
+		t.Fatal("expected the bucket back in memory")
+	}
+
+	// a file lost while moved out is rebuilt from the log
+	time.Sleep(60 * time.Millisecond)
+	s.sweep()
+	os.Remove(s.idle.path("busy"))
+	if err := busy.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := busy.Keys(); !slices.Equal(keys, []string{"a", "b"}) {
+		t.Fatalf("expected busy to hold a and b, got %v", keys)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	s.sweep()
+	if r, err := s.SelfCheck(); err != nil || !r.OK() {
+		t.Fatalf("expected moved-out buckets to pass the check, got %+v, %v", r, err)
+	}
+	s.sweep()
+	var out bytes.Buffer
+	if err := s.Export(&out, FormatNDJSON); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 5 {
+		t.Fatalf("expected 5 keys exported, got %d:\n%s", n, out.String())
+	}
+
+	if err := s.SetBucketIdleTTL(0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.IdleBuckets()) != 0 || idle.Len() != 2 {
+		t.Fatal("expected turning it off to load every bucket back")
+	}
+}
+
+// Test that with bucket families each bucket is logged on its own, under
+// LSNs shared with the store's WAL, and can be backed up, purged and
+// restored without touching the others
+func TestBucketFamilies(t *testing.T) {
+	dir, families := t.TempDir(), t.TempDir()
+	open := func() *Store {
+		t.Helper()
+		w, err := wal.Open(dir, 10*time.Millisecond, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := New(w)
+		if err := s.SetBucketFamilies(wal.Options{FlushEvery: 10 * time.Millisecond, Dir: families}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := open()
+	a, _ := s.Bucket("a")
+	b, _ := s.Bucket("b")
+	a.Set("k", "1")
+	b.Set("k", "2")
+	s.Set("top", "3")
+	a.DeleteMany([]string{"gone", "also"})
+	ma, _ := a.GetWithMeta("k")
+	mb, _ := b.GetWithMeta("k")
+	mt, _ := s.GetWithMeta("top")
+	if ma.Version != 1 || mb.Version != 2 || mt.Version != 3 {
+		t.Fatalf("expected LSNs in one sequence, got %d, %d, %d", ma.Version, mb.Version, mt.Version)
+	}
+	s.Commit()
+	if records, _ := s.wal.ReadAll(); len(records) != 1 || string(records[0].Key) != "top" {
+		t.Fatalf("expected only top in the store's WAL, got %d records", len(records))
+	}
+
+	var batch WriteBatch
+	batch.Set(a.prefix+"x", "1")
+	batch.Set("y", "1")
+	if err := s.Write(&batch); !errors.Is(err, ErrFamilySpan) {
+		t.Fatalf("expected ErrFamilySpan, got %v", err)
+	}
+
+	var archive bytes.Buffer
+	if err := a.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Len() != 0 || !b.Has("k") || !s.Has("top") {
+		t.Fatal("expected only bucket a purged")
+	}
+	if dirs, _ := os.ReadDir(families); len(dirs) != 1 {
+		t.Fatalf("expected a's family removed, got %d left", len(dirs))
+	}
+	if err := b.Restore(bytes.NewReader(archive.Bytes())); err == nil {
+		t.Fatal("expected a restore into a bucket with keys to fail")
+	}
+	if err := a.Restore(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := a.GetWithMeta("k"); !ok || m.Value != "1" || m.Version <= 3 {
+		t.Fatalf("expected a/k restored under a new LSN, got %+v, %v", m, ok)
+	}
+
+	// both families and the store's WAL are replayed
+	s.Close()
+	s = open()
+	a, _ = s.Bucket("a")
+	b, _ = s.Bucket("b")
+	if v, _ := a.Get("k"); v != "1" || !b.Has("k") || !s.Has("top") {
+		t.Fatal("expected every key back after a restart")
+	}
+	if r, err := s.SelfCheck(); err != nil || !r.OK() {
+		t.Fatalf("expected the families to pass the check, got %+v, %v", r, err)
+	}
+	if revs, _ := s.History(a.prefix+"k", 0); len(revs) != 1 {
+		t.Fatalf("expected a/k's history from its family, got %v", revs)
+	}
+
+	if err := s.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if dirs, _ := os.ReadDir(families); len(dirs) != 0 {
+		t.Fatalf("expected Reset to remove the families, got %d", len(dirs))
+	}
+	s.Close()
+	s = open()
+	defer s.Close()
+	if s.Len() != 0 || len(s.Buckets()) != 0 {
+		t.Fatal("expected nothing after a reset")
+	}
+}
+
+// Test that Store.Backup archives the bucket families with the store's
+// WAL, that a bucket with records in the store's WAL can't be purged or
+// backed up alone, and that families and replication exclude each other
+func TestBucketFamiliesStoreLog(t *testing.T) {
+	open := func(dir, families string) *Store {
+		t.Helper()
+		w, err := wal.Open(dir, 10*time.Millisecond, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := New(w)
+		if families != "" {
+			if err := s.SetBucketFamilies(wal.Options{FlushEvery: 10 * time.Millisecond, Dir: families}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	dir, families := t.TempDir(), t.TempDir()
+	s := open(dir, "")
+	c, _ := s.Bucket("c")
+	c.Set("old", "1")
+	s.Set("top", "1")
+	s.Close()
+
+	s = open(dir, families)
+	defer s.Close()
+	c, _ = s.Bucket("c")
+	d, _ := s.Bucket("d")
+	c.Set("new", "1")
+	d.Set("k", "1")
+	if err := c.Purge(); !errors.Is(err, ErrBucketInStoreLog) {
+		t.Fatalf("expected Purge to fail with ErrBucketInStoreLog, got %v", err)
+	}
+	if err := c.Backup(io.Discard); !errors.Is(err, ErrBucketInStoreLog) {
+		t.Fatalf("expected Backup to fail with ErrBucketInStoreLog, got %v", err)
+	}
+	if !c.Has("old") || !c.Has("new") {
+		t.Fatal("expected the failed Purge to leave the bucket")
+	}
+	if err := d.Backup(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := s.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	restored, restoredFamilies := filepath.Join(t.TempDir(), "wal"), filepath.Join(t.TempDir(), "families")
+	if err := RestoreInto(restored, restoredFamilies, &archive); err != nil {
+		t.Fatal(err)
+	}
+	r := open(restored, restoredFamilies)
+	defer r.Close()
+	rc, _ := r.Bucket("c")
+	rd, _ := r.Bucket("d")
+	if !r.Has("top") || !rc.Has("old") || !rc.Has("new") || !rd.Has("k") {
+		t.Fatalf("expected every key in the restored store, got %d buckets", len(r.Buckets()))
+	}
+
+	if err := s.wal.LSNs().Stream(); !errors.Is(err, wal.ErrLSNsShared) {
+		t.Fatalf("expected streaming a store with families to fail, got %v", err)
+	}
+	w, err := wal.Open(t.TempDir(), time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed := New(w)
+	defer streamed.Close()
+	w.LSNs().Stream()
+	if err := streamed.SetBucketFamilies(wal.Options{Dir: t.TempDir()}); !errors.Is(err, wal.ErrLSNsShared) {
+		t.Fatalf("expected families on a replicated store to fail, got %v", err)
+	}
+}
+
+// Test that an encrypted store's bucket files hold no plaintext, and that
+// a batch whose bucket can't be loaded back fails before it is logged,
+// leaving its other buckets untouched
+func TestBucketIdleFiles(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.OpenWithOptions(wal.Options{
+		Dir:            dir,
+		FlushEvery:     10 * time.Millisecond,
+		EncryptionKeys: []wal.EncryptionKey{{ID: 1, Key: make([]byte, 32)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	spills := t.TempDir()
+	if err := s.SetBucketIdleTTL(50*time.Millisecond, spills); err != nil {
+		t.Fatal(err)
+	}
+	lost, _ := s.Bucket("lost")
+	kept, _ := s.Bucket("kept")
+	lost.Set("a", "plaintext")
+	kept.Set("a", "plaintext")
+	w.Sync()
+	w.Rotate()
+
+	time.Sleep(60 * time.Millisecond)
+	s.sweep()
+	if len(s.IdleBuckets()) != 2 {
+		t.Fatalf("expected both buckets moved out, got %v", s.IdleBuckets())
+	}
+	data, err := os.ReadFile(s.idle.path("lost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "plaintext") {
+		t.Fatal("expected the bucket file encrypted")
+	}
+	if fi, _ := os.Stat(s.idle.path("lost")); fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v", fi.Mode().Perm())
+	}
+
+	// lose the file and the log's copy of it
+	os.Remove(s.idle.path("lost"))
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	slices.Sort(segments)
+	data, _ = os.ReadFile(segments[0])
+	data[20] ^= 0xff
+	if err := os.WriteFile(segments[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	last := s.LastLSN()
+	var batch WriteBatch
+	batch.Set(kept.prefix+"b", "2")
+	batch.Set(lost.prefix+"b", "2")
+	if err := s.Write(&batch); err == nil {
+		t.Fatal("expected the batch to fail")
+	}
+	if s.LastLSN() != last || kept.Has("b") {
+		t.Fatal("expected nothing logged or applied")
+	}
+}
+
+func TestColdTTL(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	dir := t.TempDir()
+	if err := s.SetColdTTL(50*time.Millisecond, DirTier(dir)); err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("x", 4096)
+	s.Set("cold", big)
+	s.Set("hot", "1")
+	s.Set("gone", big)
+
+	time.Sleep(60 * time.Millisecond)
+	s.Get("hot")
+	before, _ := s.Stats()
+	s.sweep()
+
+	after, _ := s.Stats()
+	if after.ColdKeys != 2 || after.Memory > before.Memory-2*4096 || after.Keys != 3 {
+		t.Fatalf("expected 2 values moved out, got %+v then %+v", before, after)
+	}
+
+	// other reads see the value without bringing it back
+	if e := s.Scan("cold"); len(e) != 1 || e[0].Value != big {
+		t.Fatalf("expected Scan to read the moved value, got %d entries", len(e))
+	}
+	if s.ColdKeys() != 2 {
+		t.Fatal("expected Scan to leave the value out of memory")
+	}
+
+	// Get brings it back
+	if v, ok := s.Get("cold"); !ok || v != big {
+		t.Fatalf("expected cold to load back, got %d bytes, %v", len(v), ok)
+	}
+	if s.ColdKeys() != 1 {
+		t.Fatalf("expected 1 value left out, got %d", s.ColdKeys())
+	}
+
+	// a value the tier lost is read back from the log, and writes and
+	// deletes drop the tier's copy
+	files, _ := filepath.Glob(filepath.Join(dir, "*.value"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file in the tier, got %v", files)
+	}
+	os.Remove(files[0])
+	if m, ok := s.GetWithMeta("gone"); !ok || m.Value != big {
+		t.Fatalf("expected gone to be read from the log, got %+v, %v", m, ok)
+	}
+	s.Delete("gone")
+	if s.ColdKeys() != 0 || s.Has("gone") {
+		t.Fatal("expected the delete to drop the moved-out value")
+	}
+
+	// hot is too small to move out
+	time.Sleep(60 * time.Millisecond)
+	s.sweep()
+	if s.ColdKeys() != 1 {
+		t.Fatalf("expected 1 value moved out again, got %d", s.ColdKeys())
+	}
+	if err := s.SetColdTTL(0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.ColdKeys() != 0 || s.Len() != 2 {
+		t.Fatalf("expected every value back in memory, got %d out", s.ColdKeys())
+	}
+	if v, _ := s.Get("cold"); v != big {
+		t.Fatal("expected cold back after turning tiering off")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.value")); len(files) != 0 {
+		t.Fatalf("expected the tier emptied, got %v", files)
+	}
+}
+
+// writeTier is a ColdTier that runs write during each Put
+type writeTier struct {
+	ColdTier
+	write func(key string)
+}
+
+func (t writeTier) Put(key string, value []byte) error {
+	t.write(key)
+	return t.ColdTier.Put(key, value)
+}
+
+// Test that values go to the tier without the store's lock, that one
+// written meanwhile stays in memory, and that an encrypted store's tier
+// holds no plaintext, only files its user can read
+func TestColdTierWrites(t *testing.T) {
+	key := make([]byte, 32)
+	w, err := wal.OpenWithOptions(wal.Options{
+		Dir:            t.TempDir(),
+		FlushEvery:     10 * time.Millisecond,
+		EncryptionKeys: []wal.EncryptionKey{{ID: 1, Key: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	dir := t.TempDir()
+	fresh := strings.Repeat("y", 100)
+	tier := writeTier{DirTier(dir), func(key string) {
+		if key == "written" {
+			s.Set(key, fresh)
+		}
+	}}
+	if err := s.SetColdTTL(50*time.Millisecond, tier); err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("x", 100)
+	s.Set("cold", big)
+	s.Set("written", big)
+
+	time.Sleep(60 * time.Millisecond)
+	s.sweep()
+	if s.ColdKeys() != 1 {
+		t.Fatalf("expected only cold moved out, got %d", s.ColdKeys())
+	}
+	if v, _ := s.Get("written"); v != fresh {
+		t.Fatalf("expected the value written during the move, got %q", v)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.value"))
+	if len(files) != 1 {
+		t.Fatalf("expected only cold's file in the tier, got %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "xxxx") {
+		t.Fatal("expected the tier's copy encrypted")
+	}
+	if fi, _ := os.Stat(files[0]); fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v", fi.Mode().Perm())
+	}
+	if m, ok := s.GetWithMeta("cold"); !ok || m.Value != big {
+		t.Fatalf("expected cold read back through the tier, got %+v, %v", m, ok)
+	}
+
+	// and read back from its own record if the tier loses it
+	s.Set("other", "after")
+	os.Remove(files[0])
+	if m, ok := s.GetWithMeta("cold"); !ok || m.Value != big {
+		t.Fatalf("expected cold read from the log, got %+v, %v", m, ok)
+	}
+}
+
+// Test that Iterate sees the store as it was when it started, in order,
+// while writes, deletes and a reset go on between its pages
+func TestIterate(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	want := make(map[string]string)
+	for i := range 3 * iteratePage {
+		key := fmt.Sprintf("k%04d", i)
+		s.Set(key, "old")
+		want[key] = "old"
+	}
+	s.SetWithTTL("k0001x", "gone", time.Nanosecond)
+	b, _ := s.Bucket("b")
+	b.Set("in", "bucket")
+	time.Sleep(time.Millisecond)
+
+	check := func(what string, during func()) {
+		t.Helper()
+		var got []string
+		for key, value := range s.Iterate {
+			if len(got) == 0 {
+				during()
+			}
+			if want[key] != value {
+				t.Fatalf("%s: expected %s = %q, got %q", what, key, want[key], value)
+			}
+			got = append(got, key)
+		}
+		if len(got) != len(want) || !slices.IsSorted(got) {
+			t.Fatalf("%s: expected %d keys in order, got %d", what, len(want), len(got))
+		}
+	}
+
+	check("writes", func() {
+		s.Set("k0500", "new")
+		s.Delete("k0700")
+		s.Set("k0600x", "added")
+		s.SetWithTTL("k0000", "new", time.Hour) // already seen
+		s.Delete("k0002")
+		s.Set("k0002", "back")
+	})
+	want["k0500"], want["k0000"], want["k0002"] = "new", "new", "back"
+	delete(want, "k0700")
+	want["k0600x"] = "added"
+
+	check("a reset", func() { s.Reset() })
+	if s.Len() != 0 || len(s.iterations) != 0 {
+		t.Fatalf("expected the reset store empty and no iteration left, got %d keys", s.Len())
+	}
+
+	// stopping early, and a bucket
+	s.Set("a", "1")
+	s.Set("b", "2")
+	n := 0
+	s.Iterate(func(string, string) bool { n++; return false })
+	b.Set("x", "1")
+	var inBucket []string
+	b.Iterate(func(key, value string) bool { inBucket = append(inBucket, key+"="+value); return true })
+	if n != 1 || !slices.Equal(inBucket, []string{"x=1"}) {
+		t.Fatalf("expected to stop after 1 and the bucket's own key, got %d and %v", n, inBucket)
+	}
+}
+
+// Test that Close stops writes, a Batch's included, flushes what came
+// before and releases the directory, and that closing twice is safe
+func TestClose(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	s.Set("before", "1")
+
+	inside, closed := make(chan struct{}), make(chan struct{})
+	batchErr := make(chan error, 1)
+	go func() {
+		batchErr <- s.Batch(func(kv KV) error {
+			kv.Set("batch", "1")
+			close(inside)
+			<-closed
+			return kv.Set("late", "1")
+		})
+	}()
+	<-inside
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(closed)
+
+	if err := <-batchErr; !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected the Batch's late write to fail with ErrClosed, got %v", err)
+	}
+	if err := s.Set("after", "1"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected Set to fail with ErrClosed, got %v", err)
+	}
+	if err := s.Delete("before"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected Delete to fail with ErrClosed, got %v", err)
+	}
+	if err := s.Batch(func(KV) error { t.Fatal("expected fn not to run"); return nil }); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected Batch to fail with ErrClosed, got %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("expected a second Close to be safe, got %v", err)
+	}
+	if v, ok := s.Get("before"); !ok || v != "1" {
+		t.Fatal("expected reads to go on after Close")
+	}
+
+	// flushed without waiting on the hour-long interval, and unlocked
+	w, err = wal.Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(w)
+	defer s.Close()
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Keys(); !slices.Equal(got, []string{"batch", "before"}) {
+		t.Fatalf("expected the writes before Close, got %v", got)
+	}
+}
+
+// Test that Prefetch brings moved-out values and buckets back into memory
+// in one go, minding values moved out again while it read them
+func TestPrefetch(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if err := s.SetColdTTL(50*time.Millisecond, DirTier(t.TempDir())); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetBucketIdleTTL(50*time.Millisecond, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := s.Bucket("reports")
+	b.Set("a", "1")
+	var keys []string
+	for i := range 40 {
+		key := fmt.Sprintf("k%02d", i)
+		s.Set(key, strings.Repeat(key, 100))
+		keys = append(keys, key)
+	}
+	time.Sleep(60 * time.Millisecond)
+	s.sweep()
+	if s.ColdKeys() != 40 || len(s.IdleBuckets()) != 1 {
+		t.Fatalf("expected 40 values and a bucket moved out, got %d and %v", s.ColdKeys(), s.IdleBuckets())
+	}
+
+	if err := s.Prefetch(append(slices.Clone(keys[:20]), "k00", "missing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Prefetch([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.ColdKeys() != 20 || len(s.IdleBuckets()) != 0 {
+		t.Fatalf("expected 20 values left out and the bucket back, got %d and %v", s.ColdKeys(), s.IdleBuckets())
+	}
+	for _, key := range keys {
+		if v, ok := s.Get(key); !ok || v != strings.Repeat(key, 100) {
+			t.Fatalf("expected %s intact, got %q, %v", key, v, ok)
+		}
+	}
+
+	// a value fetched before it was written and moved out again is read
+	// again rather than put back stale
+	time.Sleep(60 * time.Millisecond)
+	s.sweep()
+	p := s.coldKeysIn([]string{"k00"})[0]
+	p.value = []byte("stale")
+	fresh := strings.Repeat("new", 100)
+	s.Set("k00", fresh)
+	s.cold.last = 0
+	s.offloadCold(time.Now().Add(time.Hour).UnixNano())
+	s.mu.Lock()
+	err := s.restorePrefetchedLocked(p)
+	s.mu.Unlock()
+	if v, _ := s.Get("k00"); err != nil || v != fresh {
+		t.Fatalf("expected the new value, got %q, %v", v, err)
+	}
+}
+
+// Test that writes past the memory limit fail once nothing can be freed,
+// while deletes and writes that free memory go through
+func TestMemoryLimit(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if err := s.SetMemoryLimit(2000); err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("x", 100)
+
+	// short-lived keys are swept out early to make room
+	for i := 0; i < 5; i++ {
+		if err := s.SetWithTTL(fmt.Sprintf("tmp%d", i), value, 20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	var n int
+	var err error
+	for ; n < 100; n++ {
+		if err = s.Set(fmt.Sprintf("k%02d", n), value); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrMemoryLimit) || n < 8 {
+		t.Fatalf("expected ErrMemoryLimit after the expired keys made room, got %v after %d sets", err, n)
+	}
+	if st, _ := s.Stats(); st.Memory > 2000 || st.MemoryRejected != 1 || s.Has("tmp0") {
+		t.Fatalf("expected memory under the limit and one rejection, got %+v", st)
+	}
+
+	if err := s.Set("k00", "small"); err != nil {
+		t.Fatalf("expected a shrinking overwrite to go through, got %v", err)
+	}
+	if err := s.Delete("k01"); err != nil {
+		t.Fatalf("expected a delete to go through, got %v", err)
+	}
+	if err := s.Set("k99", value); err != nil {
+		t.Fatalf("expected room after the delete, got %v", err)
+	}
+
+	if err := s.SetMemoryLimit(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("more", strings.Repeat("x", 10000)); err != nil {
+		t.Fatalf("expected no limit after setting 0, got %v", err)
+	}
+}
+
+// Test that GetWithMeta reports each key's last write, batches included,
+// and that recovery and idle buckets keep it
+func TestGetWithMeta(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+
+	before := time.Now()
+	s.Set("a", "1")
+	s.SetWithTTL("b", "2", time.Hour)
+	var b WriteBatch
+	b.Set("c", "3")
+	b.Set("d", "4")
+	s.Write(&b)
+	s.Set("a", "5")
+
+	a, ok := s.GetWithMeta("a")
+	if !ok || a.Value != "5" || a.Version != 4 || a.Modified.Before(before) || !a.Expires.IsZero() {
+		t.Fatalf("unexpected meta for a: %+v, %v", a, ok)
+	}
+	if m, _ := s.GetWithMeta("b"); m.Version != 2 || m.Expires.IsZero() {
+		t.Fatalf("expected b at version 2 with an expiry, got %+v", m)
+	}
+	c, _ := s.GetWithMeta("c")
+	d, _ := s.GetWithMeta("d")
+	if c.Version != 3 || d.Version != 3 || !c.Modified.Equal(d.Modified) {
+		t.Fatalf("expected both batch keys at the batch's version, got %+v and %+v", c, d)
+	}
+	s.Delete("d")
+	if _, ok := s.GetWithMeta("d"); ok {
+		t.Fatal("expected no meta for a deleted key")
+	}
+
+	users, _ := s.Bucket("users")
+	users.Set("42", "ann")
+	want, _ := users.GetWithMeta("42")
+	if err := s.SetBucketIdleTTL(time.Nanosecond, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	s.sweep()
+	if len(s.IdleBuckets()) != 1 {
+		t.Fatal("expected the bucket moved out")
+	}
+	if got, _ := users.GetWithMeta("42"); got != want {
+		t.Fatalf("expected meta to survive the bucket moving out, got %+v, want %+v", got, want)
+	}
+	s.Close()
+
+	w, err = wal.Open(dir, 10*time.Millisecond, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(w)
+	defer s.Close()
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.GetWithMeta("a"); got.Version != a.Version || !got.Modified.Equal(a.Modified) {
+		t.Fatalf("expected meta to survive recovery, got %+v, want %+v", got, a)
+	}
+}
+
+// Test that History lists a key's writes from the log, newest first,
+// batches and increments included, back to the last reset
+func TestHistory(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	s.Set("k", "1")
+	s.Set("other", "x")
+	var b WriteBatch
+	b.Set("k", "2")
+	b.Set("other", "y")
+	s.Write(&b)
+	s.Incr("k", 5)
+	s.Delete("k")
+	s.SetWithTTL("k", "3", time.Hour)
+
+	revs, err := s.History("k", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range revs {
+		v := r.Value
+		if r.Deleted {
+			v = "-"
+		}
+		got = append(got, v)
+	}
+	if want := []string{"3", "-", "7", "2", "1"}; !slices.Equal(got, want) {
+		t.Fatalf("expected history %v, got %v", want, got)
+	}
+	if revs[0].Expires.IsZero() || revs[3].Version != 3 || revs[0].Modified.Before(revs[4].Modified) {
+		t.Fatalf("unexpected revisions: %+v", revs)
+	}
+
+	if revs, _ := s.History("k", 2); len(revs) != 2 || revs[0].Value != "3" || !revs[1].Deleted {
+		t.Fatalf("expected the 2 newest revisions, got %+v", revs)
+	}
+	if revs, _ := s.History("none", 0); len(revs) != 0 {
+		t.Fatalf("expected no history, got %+v", revs)
+	}
+
+	// a reset drops the log before it
+	s.Reset()
+	if revs, _ := s.History("k", 0); len(revs) != 0 {
+		t.Fatalf("expected no history past a reset, got %+v", revs)
+	}
+}
+
+// Test that a read-only store loads another store's log and refuses
+// writes
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := wal.Open(dir, 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+	s.Set("a", "1")
+	s.Commit()
+
+	ro, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	if v, ok := ro.Get("a"); !ok || v != "1" {
+		t.Fatalf("expected a = 1, got %q, %v", v, ok)
+	}
+	if err := ro.Set("b", "2"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	ro.SetReadOnly(false)
+	if err := ro.Set("b", "2"); !errors.Is(err, wal.ErrReadOnly) {
+		t.Fatalf("expected the WAL to refuse writes too, got %v", err)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	s.Set("report:a", "1")
+	s.Set("report:b", "2")
+	s.Set("other", "x")
+	users, _ := s.Bucket("users")
+	users.Set("42", "ann")
+
+	sn, err := s.CreateSnapshot("nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateSnapshot("nightly"); !errors.Is(err, ErrSnapshotExists) {
+		t.Fatalf("expected ErrSnapshotExists, got %v", err)
+	}
+	if _, err := s.CreateSnapshot(""); !errors.Is(err, ErrSnapshotName) {
+		t.Fatalf("expected ErrSnapshotName, got %v", err)
+	}
+
+	s.Set("report:a", "changed")
+	s.Delete("report:b")
+	s.Set("report:c", "3")
+
+	got, err := s.Snapshot("nightly")
+	if err != nil || got != sn {
+		t.Fatalf("expected to look the snapshot up by name, got %v, %v", got, err)
+	}
+	if v, _ := sn.Get("report:a"); v != "1" {
+		t.Fatalf("expected the snapshot to keep report:a = 1, got %q", v)
+	}
+	if !sn.Has("report:b") || sn.Has("report:c") {
+		t.Fatal("expected the snapshot to ignore writes made after it")
+	}
+	if keys := sn.Keys(); !slices.Equal(keys, []string{"other", "report:a", "report:b"}) {
+		t.Fatalf("expected the keys outside buckets, got %v", keys)
+	}
+	if entries := sn.Scan("report:"); len(entries) != 2 || entries[1] != (Entry{Key: "report:b", Value: "2"}) {
+		t.Fatalf("unexpected scan %v", entries)
+	}
+	if v, _ := s.Get("report:a"); v != "changed" {
+		t.Fatalf("expected the store to carry on at head, got %q", v)
+	}
+
+	s.CreateSnapshot("later")
+	if list := s.Snapshots(); len(list) != 2 || list[0].Name() != "nightly" {
+		t.Fatalf("expected 2 snapshots, oldest first, got %v", list)
+	}
+	if err := s.DropSnapshot("nightly"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Snapshot("nightly"); !errors.Is(err, ErrNoSnapshot) {
+		t.Fatalf("expected ErrNoSnapshot after the drop, got %v", err)
+	}
+	if err := s.DropSnapshot("nightly"); !errors.Is(err, ErrNoSnapshot) {
+		t.Fatalf("expected ErrNoSnapshot dropping twice, got %v", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	w, err := wal.Open(t.TempDir(), 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	s.Set("a", `{"html":"<b>"}`)
+	s.Set("empty", "")
+	s.SetBytes("blob", []byte{0xff, 0x00, 0x01})
+	s.SetWithTTL("soon", "v", time.Hour)
+	users, _ := s.Bucket("users")
+	users.Set("42", "ann")
+
+	var buf bytes.Buffer
+	if err := s.Export(&buf, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"value_base64":"/wAB"`) || !strings.Contains(buf.String(), `"bucket":"users"`) {
+		t.Fatalf("unexpected export:\n%s", buf.String())
+	}
+
+	w2, err := wal.Open(t.TempDir(), 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := New(w2)
+	defer s2.Close()
+
+	s2.Set("a", "old")
+	s2.Set("kept", "v")
+	if err := s2.Import(&buf, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "empty", "blob", "soon"} {
+		want, _ := s.Get(key)
+		if got, ok := s2.Get(key); !ok || got != want {
+			t.Fatalf("expected %q = %q after import, got %q", key, want, got)
+		}
+	}
+	if v, _ := s2.Get("kept"); v != "v" {
+		t.Fatal("expected import to leave other keys alone")
+	}
+	if ttl, ok := s2.TTL("soon"); !ok || ttl < 59*time.Minute {
+		t.Fatalf("expected soon to keep its TTL, got %v", ttl)
+	}
+	users, _ = s2.Bucket("users")
+	if v, _ := users.Get("42"); v != "ann" {
+		t.Fatalf("expected users/42 = ann after import, got %q", v)
+	}
+
+	if err := s2.Import(strings.NewReader(`[{"key":"x","value":"1"},{"key":"y"}]`), FormatJSON); err == nil || !strings.Contains(err.Error(), "entry 2") {
+		t.Fatalf("expected an error naming entry 2, got %v", err)
+	}
+}
+
+func TestImportFormatsAndReplace(t *testing.T) {
+	w, err := wal.Open(t.TempDir(), 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(w)
+	defer s.Close()
+
+	s.Set("a", "one, with \"quotes\"\nand a newline")
+	s.SetBytes("blob", []byte{0xff, 0x00})
+	s.SetWithTTL("soon", "v", time.Hour)
+	users, _ := s.Bucket("users")
+	users.Set("42", "ann")
+
+	for _, format := range []Format{FormatNDJSON, FormatCSV} {
+		var buf bytes.Buffer
+		if err := s.Export(&buf, format); err != nil {
+			t.Fatal(err)
+		}
+
+		w2, err := wal.Open(t.TempDir(), 10*time.Millisecond, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s2 := New(w2)
+		s2.Set("stale", "x")
+		stale, _ := s2.Bucket("old")
+		stale.Set("k", "x")
+
+		if err := s2.ImportWithOptions(&buf, ImportOptions{Format: format, Mode: ImportReplace}); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		for _, key := range []string{"a", "blob", "soon"} {
+			want, _ := s.Get(key)
+			if got, _ := s2.Get(key); got != want {
+				t.Fatalf("%v: expected %q = %q, got %q", format, key, want, got)
+			}
+		}
+		if _, ok := s2.TTL("soon"); !ok {
+			t.Fatalf("%v: expected soon to keep its TTL", format)
+		}
+		if s2.Has("stale") || stale.Len() != 0 {
+			t.Fatalf("%v: expected replace to delete keys not in the file", format)
+		}
+		if imported, _ := s2.Bucket("users"); !imported.Has("42") {
+			t.Fatalf("%v: expected users/42 to be imported", format)
+		}
+		s2.Close()
+	}
+
+	// columns in any order, and a replace that fails changes nothing
+	csvIn := "value,key\n1,x\n"
+	if err := s.ImportWithOptions(strings.NewReader(csvIn), ImportOptions{Format: FormatCSV}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("x"); v != "1" {
+		t.Fatalf("expected x = 1 from CSV, got %q", v)
+	}
+	bad := "{\"key\":\"y\",\"value\":\"1\"}\n{\"key\":\"z\"}\n"
+	if err := s.ImportWithOptions(strings.NewReader(bad), ImportOptions{Format: FormatNDJSON, Mode: ImportReplace}); err == nil {
+		t.Fatal("expected an entry without a value to fail")
+	}
+	if !s.Has("x") || s.Has("y") {
+		t.Fatal("expected a failed replace to leave the store alone")
+	}
+}
+
+// Test that a store restored from a backup has the same digest, and
+// that any difference in the data changes it
+func TestDigest(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	s.Set("a", "1")
+	s.SetWithTTL("b", "2", time.Hour)
+	s.Set("c", "3")
+	s.Delete("c")
+
+	var archive bytes.Buffer
+	if err := s.wal.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := wal.RestoreInto(dir, &archive); err != nil {
+		t.Fatal(err)
+	}
+	w, err := wal.Open(dir, 0, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	restored := New(w)
+	if err := restored.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := s.Digest()
+	if got, _ := restored.Digest(); got != want {
+		t.Fatalf("expected the restored store to match, got %x and %x", got, want)
+	}
+
+	// a key and value that only differ in where one ends and the other
+	// starts hash differently
+	restored.Delete("a")
+	restored.Set("a1", "")
+	if got, _ := restored.Digest(); got == want {
+		t.Fatal("expected a different digest for different data")
+	}
+	restored.Delete("a1")
+	restored.Set("a", "1")
+	restored.Set("b", "2")
+	if got, _ := restored.Digest(); got == want {
+		t.Fatal("expected a dropped TTL to change the digest")
+	}
+}
+
+// Test that the Caller attached to a write's context reaches its
+// watchers, its record and History, batches included
+func TestCaller(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	events, cancel := s.Watch("")
+	defer cancel()
+
+	alice := Caller{User: "alice", Request: "req-1"}
+	ctx := WithCaller(context.Background(), alice)
+	if err := s.SetCtx(ctx, "k", "1"); err != nil {
+		t.Fatal(err)
+	}
+	var b WriteBatch
+	b.Set("k", "2")
+	if err := s.WriteCtx(WithCaller(context.Background(), Caller{User: "bob"}), &b); err != nil {
+		t.Fatal(err)
+	}
+	s.Delete("k")
+
+	for _, want := range []Caller{alice, {User: "bob"}, {}} {
+		if ev := <-events; ev.Caller != want {
+			t.Fatalf("expected an event for %+v, got %+v", want, ev)
+		}
+	}
+
+	revs, err := s.History("k", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 3 || revs[0].Caller != (Caller{}) || revs[1].Caller.User != "bob" || revs[2].Caller != alice {
+		t.Fatalf("unexpected revisions: %+v", revs)
+	}
+
+	if c, ok := CallerFrom(context.Background()); ok || c != (Caller{}) {
+		t.Fatalf("expected no caller, got %+v", c)
+	}
+}
+
+// Test that applying Bootstrap's records leaves a store like the one they
+// came from, with the keys' expiry, buckets and idempotency keys, under
+// its LSN and across a restart
+func TestBootstrap(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	for i := 0; i < bootstrapBatch*2+10; i++ {
+		s.Set(fmt.Sprintf("k%d", i), "v")
+	}
+	s.Set("k0", "overwritten")
+	s.Delete("k1")
+	s.SetWithTTL("session", "abc", time.Hour)
+	b, _ := s.Bucket("users")
+	b.Set("ann", "1")
+	paid := &WriteBatch{}
+	paid.Set("paid", "yes")
+	s.WriteIdempotent("req-1", 0, paid)
+
+	dir := t.TempDir()
+	w, err := wal.Open(dir, 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := New(w)
+	to.Set("stale", "1") // the bootstrap's reset clears it
+
+	var records []*wal.Record
+	lsn, err := s.Bootstrap(func(rec *wal.Record) error {
+		records = append(records, rec)
+		return to.ApplyReplicated(rec)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lsn != s.LastLSN() || to.LastLSN() != lsn {
+		t.Fatalf("expected the state as of LSN %d, got %d, applied to %d", s.LastLSN(), lsn, to.LastLSN())
+	}
+	if len(records) != 3 || records[0].LSN != 0 || records[1].LSN != 0 || records[2].LSN != lsn {
+		t.Fatalf("expected 3 records, with an LSN only on the last, got %d", len(records))
+	}
+
+	check := func(to *Store) {
+		t.Helper()
+		if to.Len() != s.Len() || to.Has("stale") || to.Has("k1") {
+			t.Fatalf("expected %d keys, got %d", s.Len(), to.Len())
+		}
+		if v, _ := to.Get("k0"); v != "overwritten" {
+			t.Fatalf("expected k0's latest value, got %q", v)
+		}
+		if ttl, ok := to.TTL("session"); !ok || ttl <= 0 || ttl > time.Hour {
+			t.Fatalf("expected session to keep its expiry, got %v, %v", ttl, ok)
+		}
+		if tb, _ := to.Bucket("users"); !tb.Has("ann") {
+			t.Fatal("expected the bucket's keys")
+		}
+		if !to.Applied("req-1") {
+			t.Fatal("expected the idempotency key")
+		}
+	}
+	check(to)
+	to.Close()
+
+	w, err = wal.Open(dir, 10*time.Millisecond, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to = New(w)
+	defer to.Close()
+	if err := to.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	check(to)
+	if to.LastLSN() != lsn {
+		t.Fatalf("expected to resume after LSN %d, got %d", lsn, to.LastLSN())
+	}
+
+	empty, cleanupEmpty := newTestStore(t)
+	defer cleanupEmpty()
+	if lsn, err := empty.Bootstrap(func(*wal.Record) error { t.Fatal("expected no records"); return nil }); lsn != 0 || err != nil {
+		t.Fatalf("expected nothing to bootstrap from, got %d, %v", lsn, err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	type user struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	if err := s.SetJSON("u", user{Name: "ann", Tags: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	var got user
+	if ok, err := s.GetJSON("u", &got); !ok || err != nil || got.Name != "ann" {
+		t.Fatalf("GetJSON = %+v, %v, %v", got, ok, err)
+	}
+	if ok, err := s.GetJSON("missing", &got); ok || err != nil {
+		t.Fatalf("GetJSON of a missing key = %v, %v", ok, err)
+	}
+
+	for path, want := range map[string]string{
+		"name":     `"ann"`,
+		".tags[0]": `"a"`,
+		"tags.0":   `"a"`,
+		"":         `{"name":"ann","tags":["a"]}`,
+	} {
+		if v, ok, err := s.JSONGet("u", path); !ok || err != nil || string(v) != want {
+			t.Fatalf("JSONGet(%q) = %s, %v, %v; want %s", path, v, ok, err, want)
+		}
+	}
+	for _, path := range []string{"age", "tags[1]", "name.first"} {
+		if _, ok, err := s.JSONGet("u", path); ok || err != nil {
+			t.Fatalf("JSONGet(%q) = %v, %v; want not found", path, ok, err)
+		}
+	}
+
+	if err := s.JSONSet("u", "name", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.JSONSet("u", "tags[1]", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.JSONSet("u", "address.city", "Oslo"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("u"); v != `{"address":{"city":"Oslo"},"name":"bob","tags":["a","b"]}` {
+		t.Fatalf("after JSONSet, u = %s", v)
+	}
+	for path, err := range map[string]error{"name.first": ErrJSONPath, "tags[5]": ErrJSONPath} {
+		if got := s.JSONSet("u", path, 1); !errors.Is(got, err) {
+			t.Fatalf("JSONSet(%q) = %v, want %v", path, got, err)
+		}
+	}
+
+	if err := s.JSONSet("new", "a.b", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.JSONSet("new", "list[0].id", 2); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("new"); v != `{"a":{"b":1},"list":[{"id":2}]}` {
+		t.Fatalf("JSONSet of a new key = %s", v)
+	}
+
+	// the rest of the document isn't HTML-escaped on the way through
+	s.Set("html", `{"body":"<b>&</b>","n":1,"n":2}`)
+	if err := s.JSONSet("html", "title", "a<b"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("html"); v != `{"body":"<b>&</b>","n":2,"title":"a<b"}` {
+		t.Fatalf("JSONSet re-encoded the document as %s", v)
+	}
+
+	s.SetWithTTL("session", `{"n":1}`, time.Hour)
+	if err := s.JSONSet("session", "n", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.TTL("session"); !ok {
+		t.Fatal("JSONSet dropped the key's TTL")
+	}
+
+	s.Set("plain", "not json")
+	if err := s.JSONSet("plain", "a", 1); !errors.Is(err, ErrNotJSON) {
+		t.Fatalf("JSONSet of a non-JSON value = %v", err)
+	}
+	if _, _, err := s.JSONGet("plain", "a"); !errors.Is(err, ErrNotJSON) {
+		t.Fatalf("JSONGet of a non-JSON value = %v", err)
+	}
+
+	b, _ := s.Bucket("docs")
+	if err := b.JSONSet("d", "title", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, _ := b.JSONGet("d", "title"); !ok || string(v) != `"hi"` {
+		t.Fatalf("bucket JSONGet = %s, %v", v, ok)
+	}
+	if s.Has("d") {
+		t.Fatal("bucket JSONSet wrote outside the bucket")
+	}
+}
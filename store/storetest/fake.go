@@ -0,0 +1,243 @@
+// Package storetest provides an in-memory store.KV for tests that don't
+// want tempdirs or real WALs.
+package storetest
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+// same as the store's per-watcher buffer
+const watchBuffer = 256
+
+// Op names a KV method, for injecting failures and latency.
+type Op string
+
+const (
+	OpSet    Op = "Set"
+	OpGet    Op = "Get"
+	OpDelete Op = "Delete"
+	OpHas    Op = "Has"
+	OpKeys   Op = "Keys"
+	OpLen    Op = "Len"
+	OpBatch  Op = "Batch"
+	OpWatch  Op = "Watch"
+)
+
+// Fake is a deterministic in-memory KV. Keys are returned sorted, and
+// failures and latency can be injected per operation. Only methods that
+// return an error can fail; latency applies to every method.
+type Fake struct {
+	mu       sync.Mutex
+	data     map[string]string
+	errs     map[Op]error
+	failNext map[Op][]error
+	latency  map[Op]time.Duration
+	calls    map[Op]int
+	watchers map[*watcher]struct{}
+}
+
+type watcher struct {
+	prefix string
+	ch     chan store.Event
+}
+
+var _ store.KV = (*Fake)(nil)
+
+func New() *Fake {
+	return &Fake{
+		data:     make(map[string]string),
+		errs:     make(map[Op]error),
+		failNext: make(map[Op][]error),
+		latency:  make(map[Op]time.Duration),
+		calls:    make(map[Op]int),
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// FailWith makes every call to op return err until it is cleared with a
+// nil err.
+func (f *Fake) FailWith(op Op, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		delete(f.errs, op)
+		return
+	}
+	f.errs[op] = err
+}
+
+// FailNext makes the next call to op return err. Calls queue up, so
+// FailNext twice fails the next two calls.
+func (f *Fake) FailNext(op Op, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failNext[op] = append(f.failNext[op], err)
+}
+
+// SetLatency delays every call to op by d.
+func (f *Fake) SetLatency(op Op, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.latency[op] = d
+}
+
+// Calls returns how many times op has been called.
+func (f *Fake) Calls(op Op) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[op]
+}
+
+// enter records a call, sleeps for op's latency and returns the error
+// the call should fail with, if any.
+func (f *Fake) enter(op Op) error {
+	f.mu.Lock()
+	f.calls[op]++
+	delay := f.latency[op]
+
+	err := f.errs[op]
+	if queued := f.failNext[op]; len(queued) > 0 {
+		err = queued[0]
+		f.failNext[op] = queued[1:]
+	}
+	f.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return err
+}
+
+func (f *Fake) Set(key, value string) error {
+	if err := f.enter(OpSet); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.data[key] = value
+	f.notify(store.EventSet, key, value)
+	return nil
+}
+
+func (f *Fake) Get(key string) (string, bool) {
+	f.enter(OpGet)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v, ok := f.data[key]
+	return v, ok
+}
+
+func (f *Fake) Delete(key string) error {
+	if err := f.enter(OpDelete); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.data, key)
+	f.notify(store.EventDelete, key, "")
+	return nil
+}
+
+func (f *Fake) Has(key string) bool {
+	f.enter(OpHas)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.data[key]
+	return ok
+}
+
+func (f *Fake) Keys() []string {
+	f.enter(OpKeys)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.data))
+	for k := range f.data {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *Fake) Len() int {
+	f.enter(OpLen)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.data)
+}
+
+// Batch runs fn against the fake. Like Store.Batch it is not atomic: an
+// injected failure inside fn leaves earlier writes in place.
+func (f *Fake) Batch(fn func(kv store.KV) error) error {
+	if err := f.enter(OpBatch); err != nil {
+		return err
+	}
+
+	return fn(f)
+}
+
+// Watch delivers events like Store.Watch, including closing the channel
+// of a watcher that falls more than watchBuffer events behind.
+func (f *Fake) Watch(prefix string) (<-chan store.Event, store.CancelFunc) {
+	f.enter(OpWatch)
+
+	w := &watcher{prefix: prefix, ch: make(chan store.Event, watchBuffer)}
+
+	f.mu.Lock()
+	f.watchers[w] = struct{}{}
+	f.mu.Unlock()
+
+	cancel := func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		f.unwatch(w)
+	}
+
+	return w.ch, cancel
+}
+
+// unwatch drops w and closes its channel, once. Caller holds f.mu.
+func (f *Fake) unwatch(w *watcher) {
+	if _, ok := f.watchers[w]; !ok {
+		return
+	}
+	delete(f.watchers, w)
+	close(w.ch)
+}
+
+// notify sends to matching watchers. Caller holds f.mu.
+func (f *Fake) notify(op store.EventOp, key, value string) {
+	for w := range f.watchers {
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+
+		select {
+		case w.ch <- store.Event{Op: op, Key: key, Value: value}:
+		default:
+			f.unwatch(w)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package storetest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jerkeyray/walrus/store"
+)
+
+func TestFakeBehavesLikeKV(t *testing.T) {
+	var kv store.KV = New()
+
+	kv.Set("b", "2")
+	kv.Set("a", "1")
+
+	if v, ok := kv.Get("a"); !ok || v != "1" {
+		t.Fatal("expected to read back 'a'")
+	}
+
+	keys := kv.Keys()
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("expected sorted keys, got %v", keys)
+	}
+
+	kv.Delete("a")
+	if kv.Has("a") || kv.Len() != 1 {
+		t.Fatal("expected 'a' to be deleted")
+	}
+}
+
+func TestFakeFailures(t *testing.T) {
+	f := New()
+	boom := errors.New("boom")
+
+	f.FailNext(OpSet, boom)
+	if err := f.Set("k", "v"); err != boom {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	if f.Has("k") {
+		t.Fatal("failed Set should not write")
+	}
+	if err := f.Set("k", "v"); err != nil {
+		t.Fatalf("expected FailNext to fail only once, got %v", err)
+	}
+
+	f.FailWith(OpDelete, boom)
+	for i := 0; i < 3; i++ {
+		if err := f.Delete("k"); err != boom {
+			t.Fatalf("call %d: expected persistent failure, got %v", i, err)
+		}
+	}
+	f.FailWith(OpDelete, nil)
+	if err := f.Delete("k"); err != nil {
+		t.Fatalf("expected failure to be cleared, got %v", err)
+	}
+
+	if f.Calls(OpDelete) != 4 {
+		t.Fatalf("expected 4 Delete calls, got %d", f.Calls(OpDelete))
+	}
+}
+
+func TestFakeLatency(t *testing.T) {
+	f := New()
+	f.SetLatency(OpGet, 20*time.Millisecond)
+
+	start := time.Now()
+	f.Get("k")
+
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("expected Get to be delayed")
+	}
+}
+
+func TestFakeWatch(t *testing.T) {
+	f := New()
+
+	events, cancel := f.Watch("user:")
+	f.Set("user:1", "a")
+	f.Set("order:1", "b")
+	f.Delete("user:1")
+	cancel()
+
+	var got []store.Event
+	for ev := range events {
+		got = append(got, ev)
+	}
+
+	if len(got) != 2 || got[0].Op != store.EventSet || got[1].Op != store.EventDelete || got[1].Key != "user:1" {
+		t.Fatalf("unexpected events %+v", got)
+	}
+}
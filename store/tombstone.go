@@ -0,0 +1,79 @@
+package store
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+// DefaultTombstoneTTL is how long a store remembers deleted keys unless
+// told otherwise with SetTombstoneTTL.
+const DefaultTombstoneTTL = 24 * time.Hour
+
+// Tombstone is a key that was deleted, and when.
+type Tombstone struct {
+	Key       string
+	DeletedAt time.Time
+}
+
+// SetTombstoneTTL sets how long deleted keys are listed by Tombstones;
+// 0 stops tracking them. Call it before Recover for replayed deletes to
+// be listed under the same TTL.
+func (s *Store) SetTombstoneTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tombstoneTTL = ttl
+	if ttl <= 0 {
+		s.tombstones = make(map[string]int64)
+	}
+}
+
+// Tombstones returns the keys deleted within the tombstone TTL that
+// haven't been set again since, most recent first. Deletes are logged
+// with their time, so the list survives a restart; deletes logged by
+// older versions carry none and aren't listed.
+func (s *Store) Tombstones() []Tombstone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cutoff := time.Now().Add(-s.tombstoneTTL).UnixNano()
+	list := make([]Tombstone, 0, len(s.tombstones))
+	for key, at := range s.tombstones {
+		if at > cutoff && !isBucketKey(key) {
+			list = append(list, Tombstone{Key: key, DeletedAt: time.Unix(0, at)})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].DeletedAt.Equal(list[j].DeletedAt) {
+			return list[i].DeletedAt.After(list[j].DeletedAt)
+		}
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// deleteRecord is the OpDelete for key, stamped with the time for
+// Tombstones. key is logged as is, not copied.
+func deleteRecord(key []byte) *wal.Record {
+	return &wal.Record{
+		Op:    wal.OpDelete,
+		Key:   key,
+		Value: encodeTTLValue(time.Now().UnixNano(), ""),
+	}
+}
+
+// entomb remembers that key, which existed, was deleted by rec. Caller
+// holds s.mu.
+func (s *Store) entomb(key string, rec *wal.Record, now int64) {
+	if s.tombstoneTTL <= 0 {
+		return
+	}
+	at, _, ok := decodeTTLValue(rec.Value)
+	if !ok || at+int64(s.tombstoneTTL) <= now {
+		return
+	}
+	s.tombstones[key] = at
+}
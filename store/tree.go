@@ -0,0 +1,81 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// TreeNode is one branch of the keyspace as grouped by Tree. Keys counts
+// the live keys at or below it; IsKey reports whether Path itself is a
+// key as well as a branch.
+type TreeNode struct {
+	Name     string // this level's segment, e.g. "42"
+	Path     string // the full prefix, e.g. "user:42"
+	Keys     int
+	IsKey    bool
+	Children []*TreeNode // sorted by Name
+
+	byName map[string]*TreeNode
+}
+
+// Tree groups the live keys hierarchically on sep, so user:42:profile
+// sits under user then 42. The root has an empty Name and Path and
+// counts every key outside the buckets. An empty sep means ":".
+func (s *Store) Tree(sep string) *TreeNode {
+	if sep == "" {
+		sep = ":"
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	root := &TreeNode{}
+	for n := s.skipBuckets(s.index.seek("")); n != nil; n = s.skipBuckets(n.next[0]) {
+		if s.expired(n.key, now) {
+			continue
+		}
+		root.add(n.key, sep)
+	}
+
+	root.finish()
+	return root
+}
+
+func (t *TreeNode) add(key, sep string) {
+	t.Keys++
+
+	node := t
+	for i, name := range strings.Split(key, sep) {
+		child, ok := node.byName[name]
+		if !ok {
+			path := name
+			if i > 0 {
+				path = node.Path + sep + name
+			}
+			child = &TreeNode{Name: name, Path: path}
+			if node.byName == nil {
+				node.byName = make(map[string]*TreeNode)
+			}
+			node.byName[name] = child
+			node.Children = append(node.Children, child)
+		}
+
+		child.Keys++
+		node = child
+	}
+	node.IsKey = true
+}
+
+// finish sorts children and drops the build-time lookup maps.
+func (t *TreeNode) finish() {
+	sort.Slice(t.Children, func(i, j int) bool {
+		return t.Children[i].Name < t.Children[j].Name
+	})
+	t.byName = nil
+
+	for _, c := range t.Children {
+		c.finish()
+	}
+}
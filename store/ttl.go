@@ -0,0 +1,75 @@
+package store
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// how often expired keys are swept out of memory
+const sweepInterval = time.Second
+
+func encodeTTLValue(expiresAt int64, value string) []byte {
+	buf := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(buf[0:8], uint64(expiresAt))
+	copy(buf[8:], value)
+	return buf
+}
+
+func decodeTTLValue(data []byte) (int64, string, bool) {
+	if len(data) < 8 {
+		return 0, "", false
+	}
+
+	return int64(binary.BigEndian.Uint64(data[0:8])), string(data[8:]), true
+}
+
+// sweepLoop drops expired keys from memory. Expiry needs no WAL record:
+// replay skips values whose TTL has already passed.
+func (s *Store) sweepLoop() {
+	defer close(s.sweepDone)
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-s.sweepStop:
+			return
+		}
+	}
+}
+
+func (s *Store) sweep() {
+	now := time.Now().UnixNano()
+
+	s.mu.Lock()
+	s.sweepLocked(now)
+	s.evictIdleLocked(now)
+	s.mu.Unlock()
+
+	// puts values in the tier without the lock
+	s.offloadCold(now)
+}
+
+// sweepLocked drops the keys, idempotency keys and tombstones that have
+// expired by now. Caller holds s.mu.
+func (s *Store) sweepLocked(now int64) {
+	for k, exp := range s.expires {
+		if exp <= now {
+			s.remove(k)
+			s.notify(EventDelete, k, "", Caller{})
+		}
+	}
+	for k, exp := range s.idempotency {
+		if exp <= now {
+			delete(s.idempotency, k)
+		}
+	}
+	for k, at := range s.tombstones {
+		if at+int64(s.tombstoneTTL) <= now {
+			delete(s.tombstones, k)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package store
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jerkeyray/walrus/wal"
+)
+
+var (
+	ErrTxDone   = errors.New("transaction already committed or rolled back")
+	ErrConflict = errors.New("transaction read data that has since changed")
+
+	ErrInvalidSavepoint = errors.New("savepoint is not active in this transaction")
+)
+
+// WriteBatch collects writes that Store.Write logs as a single record and
+// applies all-or-nothing, both live and during recovery.
+type WriteBatch struct {
+	records []*wal.Record
+}
+
+func (b *WriteBatch) Set(key, value string) {
+	b.records = append(b.records, &wal.Record{
+		Op:    wal.OpSet,
+		Key:   []byte(key),
+		Value: []byte(value),
+	})
+}
+
+func (b *WriteBatch) SetWithTTL(key, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		b.Set(key, value)
+		return
+	}
+
+	b.records = append(b.records, &wal.Record{
+		Op:    wal.OpSetTTL,
+		Key:   []byte(key),
+		Value: encodeTTLValue(time.Now().Add(ttl).UnixNano(), value),
+	})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.records = append(b.records, deleteRecord([]byte(key)))
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+// Write logs b as one WAL record and applies it. Readers never see part
+// of a batch, and a crash loses either the whole batch or none of it.
+func (s *Store) Write(b *WriteBatch) error {
+	return s.writeIf(b, Caller{}, nil)
+}
+
+// writeIf is Write for by that first runs check under the same lock, and
+// writes nothing if it fails.
+func (s *Store) writeIf(b *WriteBatch, by Caller, check func() error) error {
+	if b.Len() == 0 && check == nil {
+		return nil
+	}
+
+	var rec *wal.Record
+	if b.Len() > 0 {
+		value, err := wal.EncodeBatch(b.records)
+		if err != nil {
+			return err
+		}
+		rec = &wal.Record{
+			Op:      wal.OpBatch,
+			Value:   value,
+			User:    by.User,
+			Request: by.Request,
+		}
+	}
+
+	s.mu.Lock()
+	err := s.writeBatchLocked(rec, b.records, check)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range b.records {
+		if r.Op == wal.OpSetTTL || r.Op == wal.OpDelete {
+			s.sweepOnce.Do(func() { go s.sweepLoop() })
+			break
+		}
+	}
+	return nil
+}
+
+func (s *Store) writeIfLocked(rec *wal.Record, check func() error) error {
+	return s.writeBatchLocked(rec, nil, check)
+}
+
+// writeBatchLocked is writeIfLocked for an OpBatch built from records,
+// which are applied as they are rather than decoded back out of rec.
+// Caller holds s.mu.
+func (s *Store) writeBatchLocked(rec *wal.Record, records []*wal.Record, check func() error) error {
+	if err := s.writableLocked(); err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	if rec == nil {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	logged := s.logLocked(rec, now)
+	if !wal.Logged(logged) {
+		return logged
+	}
+
+	var err error
+	if records != nil {
+		err = s.applyBatch(rec, records, now)
+	} else {
+		err = s.apply(rec, now)
+	}
+	if err != nil {
+		return err
+	}
+	s.ops.wrote(rec)
+	return logged
+}
+
+// Tx buffers writes until Commit, which applies them atomically through
+// Store.Write. Reads inside the transaction see its own pending writes.
+// A Tx is not safe for concurrent use.
+type Tx struct {
+	store   *Store
+	batch   WriteBatch
+	pending map[string]*string // nil value means deleted in this tx
+	done    bool
+
+	undo       []undoEntry // how to reverse each write, for RollbackTo
+	savepoints []Savepoint // active savepoints, oldest first
+	nextID     int
+
+	// set for BeginOptimistic: the scope versions read and the store's
+	// generation when the tx began
+	reads      map[uint32]uint64
+	generation uint64
+}
+
+func (s *Store) Begin() *Tx {
+	return &Tx{
+		store:   s,
+		pending: make(map[string]*string),
+	}
+}
+
+func (tx *Tx) Set(key, value string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	tx.record(key)
+	tx.batch.Set(key, value)
+	tx.pending[key] = &value
+	return nil
+}
+
+func (tx *Tx) SetWithTTL(key, value string, ttl time.Duration) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	tx.record(key)
+	tx.batch.SetWithTTL(key, value, ttl)
+	tx.pending[key] = &value
+	return nil
+}
+
+func (tx *Tx) Delete(key string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	tx.record(key)
+	tx.batch.Delete(key)
+	tx.pending[key] = nil
+	return nil
+}
+
+// undoEntry is what a key's pending write was before the write it undoes.
+type undoEntry struct {
+	key  string
+	prev *string
+	had  bool
+}
+
+// record notes key's pending state ahead of a write to it.
+func (tx *Tx) record(key string) {
+	prev, had := tx.pending[key]
+	tx.undo = append(tx.undo, undoEntry{key: key, prev: prev, had: had})
+}
+
+// Savepoint marks the transaction's writes so far. RollbackTo undoes
+// everything written after it while keeping the transaction open.
+type Savepoint struct {
+	id     int
+	writes int
+}
+
+func (tx *Tx) Savepoint() (Savepoint, error) {
+	if tx.done {
+		return Savepoint{}, ErrTxDone
+	}
+
+	tx.nextID++
+	sp := Savepoint{id: tx.nextID, writes: len(tx.undo)}
+	tx.savepoints = append(tx.savepoints, sp)
+	return sp, nil
+}
+
+// RollbackTo discards the writes made since sp. sp stays active, so it
+// can be rolled back to again; savepoints taken after it are released.
+// Reads an optimistic transaction made stay part of its read set.
+func (tx *Tx) RollbackTo(sp Savepoint) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	i := slices.IndexFunc(tx.savepoints, func(s Savepoint) bool { return s.id == sp.id })
+	if i < 0 || sp.id == 0 {
+		return ErrInvalidSavepoint
+	}
+	tx.savepoints = tx.savepoints[:i+1]
+
+	for j := len(tx.undo) - 1; j >= sp.writes; j-- {
+		u := tx.undo[j]
+		if u.had {
+			tx.pending[u.key] = u.prev
+		} else {
+			delete(tx.pending, u.key)
+		}
+	}
+	tx.undo = tx.undo[:sp.writes]
+	tx.batch.records = tx.batch.records[:sp.writes]
+	return nil
+}
+
+// Release forgets sp and every savepoint taken after it, without
+// undoing anything.
+func (tx *Tx) Release(sp Savepoint) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	i := slices.IndexFunc(tx.savepoints, func(s Savepoint) bool { return s.id == sp.id })
+	if i < 0 || sp.id == 0 {
+		return ErrInvalidSavepoint
+	}
+	tx.savepoints = tx.savepoints[:i]
+	return nil
+}
+
+// BeginOptimistic starts a transaction that remembers what it reads and
+// fails to commit with ErrConflict if any of it was written by someone
+// else in the meantime, making the transaction serializable without
+// holding locks while it runs. Key reads conflict with writes to that
+// key, and Scan with writes to any key under the prefix; see conflict.go
+// for the granularity. Callers typically retry on ErrConflict.
+func (s *Store) BeginOptimistic() *Tx {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return &Tx{
+		store:      s,
+		pending:    make(map[string]*string),
+		reads:      make(map[uint32]uint64),
+		generation: s.generation,
+	}
+}
+
+// observe records the version of scope as read by tx, keeping the first
+// one seen. Caller holds the store's mu.
+func (tx *Tx) observe(scope string) {
+	if tx.reads == nil {
+		return
+	}
+
+	slot := conflictSlot(scope)
+	if _, ok := tx.reads[slot]; !ok {
+		tx.reads[slot] = tx.store.versions[slot]
+	}
+}
+
+// Get reads through the transaction's pending writes to the store.
+func (tx *Tx) Get(key string) (string, bool) {
+	if v, ok := tx.pending[key]; ok {
+		if v == nil {
+			return "", false
+		}
+		return *v, true
+	}
+
+	s := tx.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx.observe(key)
+	if s.expired(key, time.Now().UnixNano()) {
+		return "", false
+	}
+	return s.valueLocked(key)
+}
+
+// Scan is Store.Scan seen through the transaction's pending writes.
+func (tx *Tx) Scan(prefix string) []Entry {
+	s := tx.store
+	s.mu.RLock()
+	tx.observe(prefixScope(prefix))
+	entries := s.scanLocked(prefix)
+	s.mu.RUnlock()
+
+	if len(tx.pending) == 0 {
+		return entries
+	}
+
+	merged := make(map[string]string, len(entries))
+	for _, e := range entries {
+		merged[e.Key] = e.Value
+	}
+	for k, v := range tx.pending {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = *v
+		}
+	}
+
+	entries = entries[:0]
+	for k, v := range merged {
+		entries = append(entries, Entry{Key: k, Value: v})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	if tx.reads == nil {
+		return tx.store.Write(&tx.batch)
+	}
+	return tx.store.writeIf(&tx.batch, Caller{}, tx.validate)
+}
+
+// validate fails if anything tx read has changed. Caller holds the
+// store's mu.
+func (tx *Tx) validate() error {
+	s := tx.store
+	if s.generation != tx.generation {
+		return ErrConflict
+	}
+	for slot, version := range tx.reads {
+		if s.versions[slot] != version {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// Rollback discards the pending writes. Nothing has reached the WAL yet,
+// so there is nothing to undo.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	tx.batch = WriteBatch{}
+	tx.pending = nil
+	tx.undo, tx.savepoints = nil, nil
+	return nil
+}
@@ -0,0 +1,129 @@
+package store
+
+import "strings"
+
+// events buffered per watcher before it counts as fallen behind
+const watchBuffer = 256
+
+type EventOp int
+
+const (
+	EventSet EventOp = iota + 1
+	EventDelete
+	EventReset    // every key was cleared; Key and Value are empty
+	EventOverflow // events were dropped for a slow WatchBatches consumer
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventReset:
+		return "reset"
+	case EventOverflow:
+		return "overflow"
+	}
+	return "unknown"
+}
+
+// Event describes one applied change. Value is empty for deletes.
+// Caller is who the write was made for, as logged with it; it is empty
+// for writes made without one and for expiries.
+type Event struct {
+	Op     EventOp
+	Key    string
+	Value  string
+	Caller Caller
+}
+
+// CancelFunc stops a watch and closes its channel.
+type CancelFunc func()
+
+type watcher struct {
+	prefix string
+	ch     chan Event
+}
+
+// Watch returns a channel of the Set and Delete events applied to keys
+// starting with prefix, in the order they were logged. Every watcher also
+// gets an EventReset when the store is reset. Expired keys are
+// reported as deletes when the sweeper removes them.
+//
+// Writers never wait for watchers: one that falls more than watchBuffer
+// events behind has its channel closed and must Watch again, re-reading
+// whatever state it caches.
+func (s *Store) Watch(prefix string) (<-chan Event, CancelFunc) {
+	w := &watcher{prefix: prefix, ch: make(chan Event, watchBuffer)}
+
+	s.mu.Lock()
+	if s.watchers == nil {
+		s.watchers = make(map[*watcher]struct{})
+	}
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+
+	cancel := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.unwatch(w)
+	}
+
+	return w.ch, cancel
+}
+
+// unwatch drops w and closes its channel, once. Caller holds s.mu.
+func (s *Store) unwatch(w *watcher) {
+	if _, ok := s.watchers[w]; !ok {
+		return
+	}
+	delete(s.watchers, w)
+	close(w.ch)
+}
+
+// notify hands the event to every matching watcher. Caller holds s.mu.
+func (s *Store) notify(op EventOp, key, value string, by Caller) {
+	if s.catchUp != nil {
+		return // replayed, not new
+	}
+	for w := range s.watchers {
+		if watching(w.prefix, key) {
+			s.send(w, Event{Op: op, Key: key, Value: value, Caller: by})
+		}
+	}
+	for w := range s.batchWatchers {
+		if watching(w.prefix, key) {
+			w.push(Event{Op: op, Key: key, Value: value, Caller: by})
+		}
+	}
+}
+
+// watching reports whether a watcher of prefix sees key. Watching the
+// whole store doesn't take in its buckets.
+func watching(prefix, key string) bool {
+	return strings.HasPrefix(key, prefix) && (prefix != "" || !isBucketKey(key))
+}
+
+// notifyReset tells every watcher, whatever its prefix. Caller holds s.mu.
+func (s *Store) notifyReset(by Caller) {
+	if s.catchUp != nil {
+		return
+	}
+	for w := range s.watchers {
+		s.send(w, Event{Op: EventReset, Caller: by})
+	}
+	for w := range s.batchWatchers {
+		w.push(Event{Op: EventReset, Caller: by})
+	}
+}
+
+// send delivers ev without blocking, dropping w if it has fallen behind.
+func (s *Store) send(w *watcher, ev Event) {
+	select {
+	case w.ch <- ev:
+	default:
+		s.unwatch(w)
+	}
+}
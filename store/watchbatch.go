@@ -0,0 +1,156 @@
+package store
+
+import "sync"
+
+// WatchOptions tune WatchBatches.
+type WatchOptions struct {
+	// Buffer is how many events may wait for the consumer before it
+	// counts as fallen behind. Zero means watchBuffer.
+	Buffer int
+
+	// Coalesce keeps only the latest event for each key among those
+	// waiting, so a key updated many times between reads costs one event.
+	// The surviving event keeps the position of the key's first one.
+	Coalesce bool
+
+	// Block makes writers wait for a full buffer to drain instead of
+	// dropping events. A consumer that stops reading then stalls every
+	// write to the store until it is cancelled.
+	Block bool
+}
+
+type batchWatcher struct {
+	prefix string
+	opts   WatchOptions
+	ch     chan []Event
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signalled when pending grows, drains or closed is set
+	pending []Event
+	index   map[string]int // key -> position in pending, when coalescing
+	closed  bool
+	done    chan struct{}
+	once    sync.Once
+}
+
+// WatchBatches is Watch for consumers that want events in batches: each
+// receive returns every event that arrived since the last one, up to
+// opts.Buffer of them. Unlike Watch, a consumer that falls behind keeps
+// its channel; without opts.Block the waiting events are discarded and
+// the next batch starts with an EventOverflow, after which the consumer
+// should re-read whatever state it caches.
+func (s *Store) WatchBatches(prefix string, opts WatchOptions) (<-chan []Event, CancelFunc) {
+	if opts.Buffer <= 0 {
+		opts.Buffer = watchBuffer
+	}
+
+	w := &batchWatcher{
+		prefix: prefix,
+		opts:   opts,
+		ch:     make(chan []Event),
+		done:   make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	go w.deliver()
+
+	s.mu.Lock()
+	if s.batchWatchers == nil {
+		s.batchWatchers = make(map[*batchWatcher]struct{})
+	}
+	s.batchWatchers[w] = struct{}{}
+	s.mu.Unlock()
+
+	cancel := func() {
+		// stop first: a writer blocked on w holds s.mu
+		w.stop()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.batchWatchers, w)
+	}
+
+	return w.ch, cancel
+}
+
+// push queues ev for delivery. Caller holds s.mu.
+func (w *batchWatcher) push(ev Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	if w.opts.Coalesce {
+		// a reset supersedes everything still waiting
+		if ev.Op == EventReset {
+			w.pending, w.index = w.pending[:0], nil
+		} else if i, ok := w.index[ev.Key]; ok {
+			w.pending[i] = ev
+			return
+		}
+	}
+
+	for w.opts.Block && len(w.pending) >= w.opts.Buffer && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return
+	}
+
+	if len(w.pending) >= w.opts.Buffer {
+		w.pending = append(w.pending[:0], Event{Op: EventOverflow})
+		w.index = nil
+	}
+
+	w.pending = append(w.pending, ev)
+	if w.opts.Coalesce && ev.Op != EventReset {
+		if w.index == nil {
+			w.index = make(map[string]int)
+		}
+		w.index[ev.Key] = len(w.pending) - 1
+	}
+	w.cond.Broadcast()
+}
+
+// deliver hands pending events to the consumer as batches until the
+// watcher stops, then closes its channel.
+func (w *batchWatcher) deliver() {
+	defer close(w.ch)
+
+	for {
+		w.mu.Lock()
+		for len(w.pending) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+
+		batch := w.pending
+		w.pending, w.index = nil, nil
+		w.cond.Broadcast() // room for blocked writers
+		w.mu.Unlock()
+
+		select {
+		case w.ch <- batch:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// stop ends delivery and releases any writer blocked on w. It does not
+// need s.mu.
+func (w *batchWatcher) stop() {
+	w.once.Do(func() {
+		w.mu.Lock()
+		w.closed = true
+		w.cond.Broadcast()
+		w.mu.Unlock()
+
+		close(w.done)
+	})
+}
@@ -0,0 +1,237 @@
+package wal
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Backup writes a tar archive of the log as it stands when Backup is
+// called. Only the capture happens under the WAL's lock: the buffer is
+// written out and every segment opened and measured up to the end of its
+// records, and since segments are only ever appended to, copying each up
+// to that size afterwards gives a consistent point-in-time copy while
+// writers carry on. Segments deleted during the copy are still read
+// through the open files, and none is reused while it runs.
+func (w *WAL) Backup(out io.Writer) error {
+	segments, err := w.captureSegments()
+	if err != nil {
+		return err
+	}
+	defer w.release(segments)
+
+	tw := tar.NewWriter(out)
+	if err := writeSegments(tw, "", segments); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeSegments copies segments into tw, named as in dir if it isn't
+// empty.
+func writeSegments(tw *tar.Writer, dir string, segments []capturedSegment) error {
+	now := time.Now()
+	for _, seg := range segments {
+		hdr := &tar.Header{
+			Name:    path.Join(dir, seg.name),
+			Mode:    0644,
+			Size:    seg.size,
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, io.NewSectionReader(seg.file, 0, seg.size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type capturedSegment struct {
+	name string
+	file *os.File
+	size int64
+}
+
+func (w *WAL) captureSegments() ([]capturedSegment, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil, ErrClosed
+	}
+	if err := w.writeBufferLocked(); err != nil {
+		return nil, err
+	}
+
+	files, err := w.segmentFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []capturedSegment
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			closeSegments(segments)
+			return nil, err
+		}
+		size, err := w.segmentSizeLocked(path)
+		if err != nil {
+			f.Close()
+			closeSegments(segments)
+			return nil, err
+		}
+
+		segments = append(segments, capturedSegment{name: filepath.Base(path), file: f, size: size})
+	}
+	w.readers++
+	return segments, nil
+}
+
+func closeSegments(segments []capturedSegment) {
+	for _, seg := range segments {
+		seg.file.Close()
+	}
+}
+
+// release closes segments captured by captureSegments, letting retired
+// segments be reused once no reader is left.
+func (w *WAL) release(segments []capturedSegment) {
+	closeSegments(segments)
+	w.mu.Lock()
+	w.readers--
+	w.mu.Unlock()
+}
+
+// Snapshot is a read-only view of the log as it stood when Snapshot was
+// called, captured the same way as Backup. Writes made afterwards are
+// not in it.
+type Snapshot struct {
+	wal       *WAL
+	keys      *keyring
+	recovery  RecoveryMode
+	maxRecord int64
+	segments  []capturedSegment
+}
+
+// Snapshot captures the log for reading while writers carry on. Close it
+// when done.
+func (w *WAL) Snapshot() (*Snapshot, error) {
+	segments, err := w.captureSegments()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{wal: w, keys: w.keys, recovery: w.recovery, maxRecord: w.maxRecord, segments: segments}, nil
+}
+
+// Replay is WAL.Replay over the captured log.
+func (sn *Snapshot) Replay(fn func(*Record) error) (ReadStats, error) {
+	var stats ReadStats
+
+	var joined chunks
+	for _, seg := range sn.segments {
+		n, ss, err := replayPrefix(seg.file, seg.size, sn.maxRecord, sn.keys, sn.recovery, &joined, fn)
+		stats.Records += n
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Segments++
+		stats.Bytes += ss.validBytes
+		stats.CorruptBytes += ss.corruptBytes
+		stats.Resyncs += ss.resyncs
+	}
+
+	return stats, nil
+}
+
+// Archive writes the captured segments to tw as Backup does, in the
+// directory dir of the archive unless it is empty, for one archive of
+// several logs captured together. RestoreInto unpacks each directory
+// into the same one under its own.
+func (sn *Snapshot) Archive(tw *tar.Writer, dir string) error {
+	if sn.wal == nil {
+		return ErrClosed
+	}
+	return writeSegments(tw, dir, sn.segments)
+}
+
+func (sn *Snapshot) Close() error {
+	if sn.wal != nil {
+		sn.wal.release(sn.segments)
+		sn.wal = nil
+	}
+	sn.segments = nil
+	return nil
+}
+
+// RestoreInto unpacks an archive written by Backup into dir, which must
+// not hold a log already. Segments in a directory of the archive, as
+// Snapshot.Archive writes them, go into that directory of dir. Other
+// entries, or deeper ones, are rejected rather than written anywhere,
+// and each file is fsynced before RestoreInto returns.
+func RestoreInto(dir string, in io.Reader) error {
+	if last, err := lastSegmentID(dir); err != nil {
+		return err
+	} else if last != 0 {
+		return fmt.Errorf("%s already holds a log", dir)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		sub, name := path.Split(hdr.Name)
+		sub = strings.TrimSuffix(sub, "/")
+		if _, ok := segmentID(name); !ok || strings.ContainsAny(sub, "/\\") || sub == "." || sub == ".." || hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unexpected entry %q in backup", hdr.Name)
+		}
+
+		into := filepath.Join(dir, sub)
+		if err := os.MkdirAll(into, 0755); err != nil {
+			return err
+		}
+		if err := restoreFile(filepath.Join(into, name), tr); err != nil {
+			return err
+		}
+	}
+}
+
+func restoreFile(path string, in io.Reader) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, in); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
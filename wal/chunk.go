@@ -0,0 +1,123 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A record whose frame is too big for one chunk is logged as a run of
+// chunk frames instead, with recordMagicChunk, each carrying a piece of
+// the frame it replaces after a header saying where the piece goes:
+//
+//	[Magic 4B][Total 4B][Checksum 4B][Offset 4B][piece]
+//
+// Magic, Total and Checksum are the whole frame's, so the pieces rebuild
+// it exactly, and Offset is where the piece starts in its data. Chunks
+// are written in order and may run on into the next segment, which is
+// how a record bigger than a segment fits the log.
+const (
+	chunkHeader = 16
+	maxChunk    = 1 << 20 // bytes of record in one chunk at most
+	minChunk    = 64      // and at least, however small the segments
+)
+
+// chunkSize returns how much of a frame's data one chunk carries in a
+// log of segments of maxSize bytes: at most half a segment, so every
+// segment takes whole chunks and is at least half full.
+func chunkSize(maxSize int64) int {
+	n := (maxSize-headerSize)/2 - 12 - chunkHeader
+	return int(min(max(n, minChunk), maxChunk))
+}
+
+// appendChunks frames the frame in buf[mark:] as chunks of at most size
+// bytes of its data each, in its place. frame must not alias buf.
+func appendChunks(buf, frame []byte, mark, size int) []byte {
+	buf = buf[:mark]
+	magic := binary.BigEndian.Uint32(frame[0:4])
+	sum := binary.BigEndian.Uint32(frame[8:12])
+	data := frame[12:]
+
+	for off := 0; off < len(data); off += size {
+		piece := data[off:min(off+size, len(data))]
+		start := len(buf)
+		buf = append(buf, make([]byte, 12)...)
+		buf = binary.BigEndian.AppendUint32(buf, magic)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+		buf = binary.BigEndian.AppendUint32(buf, sum)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(off))
+		buf = append(buf, piece...)
+		putHeader(buf[start:], recordMagicChunk)
+	}
+	return buf
+}
+
+// chunks joins the chunks read from the log back into records. Replays
+// keep one across segments, as a record's chunks can span them.
+type chunks struct {
+	magic, total, sum uint32
+	data              []byte
+}
+
+// next passes rec through, or, for an OpChunk frame, adds it to the
+// record being joined and returns that record once its last piece is
+// in, nil before then. Pieces that don't follow on from the ones before,
+// such as those of a record's start lost to a crash or a corrupt frame,
+// are dropped with whatever they would have joined, as is a joined frame
+// that doesn't check out. A whole frame that can't be decrypted is an
+// error, as from readRecordAt, and so is a record over limit bytes, as
+// its chunk is intact.
+func (c *chunks) next(rec *Record, limit int64, kr *keyring) (*Record, error) {
+	if rec.Op != OpChunk {
+		c.reset()
+		return rec, nil
+	}
+
+	p := rec.Value
+	magic, total := binary.BigEndian.Uint32(p[0:4]), binary.BigEndian.Uint32(p[4:8])
+	sum, off := binary.BigEndian.Uint32(p[8:12]), binary.BigEndian.Uint32(p[12:16])
+	piece := p[chunkHeader:]
+
+	if off == 0 {
+		c.reset()
+		if !validMagic(magic) {
+			return nil, nil
+		}
+		if limit > 0 && int64(total) > limit {
+			return nil, fmt.Errorf("%w: an intact %d byte record is over MaxRecordSize (%d); raise it to read the log", ErrRecordTooLarge, total, limit)
+		}
+		c.magic, c.total, c.sum = magic, total, sum
+	} else if c.data == nil || magic != c.magic || total != c.total || sum != c.sum || int(off) != len(c.data) {
+		c.reset()
+		return nil, nil
+	}
+	if int64(len(c.data))+int64(len(piece)) > int64(total) {
+		c.reset()
+		return nil, nil
+	}
+	if c.data == nil {
+		c.data = make([]byte, 0, total)
+	}
+	c.data = append(c.data, piece...)
+	if len(c.data) < int(total) {
+		return nil, nil
+	}
+
+	data := c.data
+	c.reset()
+	if frameChecksum(magic, total, data) != sum {
+		return nil, nil
+	}
+	whole, err := decodeFrame(magic, data, kr)
+	if errors.Is(err, ErrUnknownKey) || errors.Is(err, ErrDecrypt) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, nil
+	}
+	return whole, nil
+}
+
+func (c *chunks) reset() {
+	*c = chunks{}
+}
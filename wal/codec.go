@@ -0,0 +1,101 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// appendFrame encodes r with its [Magic][Length][Checksum] header onto
+// buf. The record is encoded in place after a header-sized gap and the
+// header filled in afterwards, so the key and value are copied exactly
+// once, into buf.
+func appendFrame(buf []byte, r *Record) []byte {
+	start := len(buf)
+	buf = slices.Grow(buf, 12+encodedSize(r))
+	buf = buf[:start+12]
+	buf = appendRecord(buf, r)
+
+	putHeader(buf[start:], recordMagic)
+	return buf
+}
+
+// WriteRecord frames r the way the log does and writes it to out, for
+// files kept beside the log (dead letters, exports) that ReadRecords
+// reads back.
+func WriteRecord(out io.Writer, r *Record) error {
+	_, err := out.Write(appendFrame(nil, r))
+	return err
+}
+
+// WriteRecord is WriteRecord for a file kept beside w: with encryption
+// on, r is framed encrypted under the active key, so the file doesn't
+// hold in the clear the keys and values the log seals. w.ReadRecords
+// reads it back.
+func (w *WAL) WriteRecord(out io.Writer, r *Record) error {
+	if w.keys == nil {
+		return WriteRecord(out, r)
+	}
+	buf, _ := appendFrameEncrypted(nil, r, CompressionNone, w.keys, nil)
+	_, err := out.Write(buf)
+	return err
+}
+
+// ReadRecords calls fn for each record written by WriteRecord until in
+// is exhausted. It has no keys, so encrypted frames fail with
+// ErrUnknownKey; w.ReadRecords has w's. Unlike segment replay it is
+// strict: a torn or corrupt frame is an error, not the end of the data.
+func ReadRecords(in io.Reader, fn func(*Record) error) error {
+	return readRecords(in, nil, fn)
+}
+
+// ReadRecords is ReadRecords with w's keys, for frames w.WriteRecord
+// encrypted.
+func (w *WAL) ReadRecords(in io.Reader, fn func(*Record) error) error {
+	return readRecords(in, w.keys, fn)
+}
+
+func readRecords(in io.Reader, kr *keyring, fn func(*Record) error) error {
+	var header [12]byte
+
+	for n := 0; ; n++ {
+		if _, err := io.ReadFull(in, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+
+		magic := binary.BigEndian.Uint32(header[0:4])
+		if !validMagic(magic) {
+			return fmt.Errorf("record %d: bad magic", n)
+		}
+
+		// grow with the data actually read rather than trusting a length
+		// that might be corrupt
+		length := binary.BigEndian.Uint32(header[4:8])
+		var body bytes.Buffer
+		if _, err := io.CopyN(&body, in, int64(length)); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		data := body.Bytes()
+
+		if frameChecksum(magic, length, data) != binary.BigEndian.Uint32(header[8:12]) {
+			return fmt.Errorf("record %d: checksum mismatch", n)
+		}
+
+		rec, err := decodeFrame(magic, data, kr)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
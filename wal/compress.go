@@ -0,0 +1,170 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression picks how Append compresses records. Records are
+// compressed one at a time and only when that makes them smaller, so a
+// log can mix compressed and plain records, from any setting, and
+// replays the same either way.
+type Compression byte
+
+const (
+	CompressionNone   Compression = 0
+	CompressionSnappy Compression = 1 // fast, modest ratio
+	CompressionZstd   Compression = 2 // slower, much better on text such as JSON
+)
+
+// records smaller than this are not worth compressing
+const compressMinSize = 128
+
+// decompressing never produces more than this, so a corrupt length
+// can't make replay allocate without bound
+const maxDecodedSize = 256 << 20
+
+// Frames with recordMagicFlagged carry a flags byte before the record,
+// covered by the checksum. Its low bits name the compression.
+const flagCompressionMask byte = 0x03
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+// ParseCompression parses "none", "snappy" or "zstd".
+func ParseCompression(s string) (Compression, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none":
+		return CompressionNone, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	case "zstd":
+		return CompressionZstd, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q", s)
+}
+
+func (c Compression) validate() error {
+	if c > CompressionZstd {
+		return fmt.Errorf("wal: invalid compression %d", byte(c))
+	}
+	return nil
+}
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecodedSize))
+		return dec
+	})
+)
+
+// appendFrameCompressed is appendFrame for a WAL with compression on.
+// scratch is reused between calls to hold the uncompressed record and
+// is returned for the next one.
+func appendFrameCompressed(buf []byte, r *Record, c Compression, scratch []byte) ([]byte, []byte) {
+	raw := appendRecord(scratch[:0], r)
+	start := len(buf)
+
+	if len(raw) >= compressMinSize {
+		buf = append(buf, make([]byte, 12)...)
+		buf = append(buf, byte(c))
+
+		switch c {
+		case CompressionSnappy:
+			buf = append(buf, snappy.Encode(nil, raw)...)
+		case CompressionZstd:
+			buf = zstdEncoder().EncodeAll(raw, buf)
+		}
+
+		if len(buf)-start-13 < len(raw) {
+			putHeader(buf[start:], recordMagicFlagged)
+			return buf, raw
+		}
+		buf = buf[:start] // didn't shrink, store it plain
+	}
+
+	buf = append(buf, make([]byte, 12)...)
+	buf = append(buf, raw...)
+	putHeader(buf[start:], recordMagic)
+	return buf, raw
+}
+
+// putHeader fills in the header of the frame at the start of frame.
+func putHeader(frame []byte, magic uint32) {
+	data := frame[12:]
+	binary.BigEndian.PutUint32(frame[0:4], magic)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[8:12], frameChecksum(magic, uint32(len(data)), data))
+}
+
+// decodeFrame decodes the checksummed data of a frame with the given
+// magic, decrypting and decompressing it first if its flags say so. kr
+// may be nil when the WAL has no keys.
+func decodeFrame(magic uint32, data []byte, kr *keyring) (*Record, error) {
+	if magic&1 == 0 {
+		return decodeRecord(data)
+	}
+
+	if len(data) < 1 {
+		return nil, errors.New("flagged record without flags")
+	}
+	flags, body := data[0], data[1:]
+	if flags&^(flagCompressionMask|flagEncrypted) != 0 {
+		return nil, fmt.Errorf("unknown record flags %#x", flags)
+	}
+
+	if flags&flagEncrypted != 0 {
+		plain, err := kr.open(data)
+		if err != nil {
+			return nil, err
+		}
+		body = plain
+	}
+
+	switch Compression(flags & flagCompressionMask) {
+	case CompressionNone:
+		return decodeRecord(body)
+
+	case CompressionSnappy:
+		n, err := snappy.DecodedLen(body)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxDecodedSize {
+			return nil, fmt.Errorf("record decompresses to %d bytes", n)
+		}
+		raw, err := snappy.Decode(nil, body)
+		if err != nil {
+			return nil, err
+		}
+		return decodeRecord(raw)
+
+	case CompressionZstd:
+		raw, err := zstdDecoder().DecodeAll(body, nil)
+		if err != nil {
+			return nil, err
+		}
+		return decodeRecord(raw)
+	}
+
+	return nil, fmt.Errorf("unknown compression in flags %#x", flags)
+}
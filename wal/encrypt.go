@@ -0,0 +1,213 @@
+package wal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// EncryptionKeysEnv names the environment variable EncryptionKeysFromEnv
+// reads: comma-separated id:hexkey pairs, the first of which encrypts.
+const EncryptionKeysEnv = "WALRUS_ENCRYPTION_KEYS"
+
+var (
+	// ErrUnknownKey is returned when replaying a record encrypted under a
+	// key ID the WAL was not given.
+	ErrUnknownKey = errors.New("wal: record encrypted with an unknown key")
+
+	// ErrDecrypt is returned when a record fails authentication under the
+	// key its ID names, which means the wrong key was supplied for it.
+	ErrDecrypt = errors.New("wal: record failed to decrypt")
+)
+
+// Frames with this flag carry [KeyID: 1B][Nonce: 12B] and the record,
+// compressed or not, sealed with AES-GCM. The flags and key ID are
+// authenticated along with it.
+const flagEncrypted byte = 0x04
+
+// EncryptionKey is an AES key and the ID logged beside every record it
+// encrypts. Records name their key, so a key can be rotated by putting a
+// new one first and keeping the old ones for as long as records
+// encrypted with them remain in the log.
+type EncryptionKey struct {
+	ID  byte
+	Key []byte // 16, 24 or 32 bytes for AES-128, -192 or -256
+}
+
+// keyring holds the ciphers for every known key. The first one given
+// encrypts new records.
+type keyring struct {
+	active byte
+	byID   map[byte]cipher.AEAD
+}
+
+func newKeyring(keys []EncryptionKey) (*keyring, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	kr := &keyring{
+		active: keys[0].ID,
+		byID:   make(map[byte]cipher.AEAD, len(keys)),
+	}
+	for _, k := range keys {
+		if _, dup := kr.byID[k.ID]; dup {
+			return nil, fmt.Errorf("wal: encryption key %d given twice", k.ID)
+		}
+
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("wal: encryption key %d: %w", k.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.byID[k.ID] = aead
+	}
+	return kr, nil
+}
+
+// ParseEncryptionKeys parses comma-separated id:hexkey pairs such as
+// "2:<64 hex digits>,1:<64 hex digits>".
+func ParseEncryptionKeys(s string) ([]EncryptionKey, error) {
+	var keys []EncryptionKey
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		id, hexKey, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("encryption key %q is not id:hexkey", pair)
+		}
+		n, err := strconv.ParseUint(id, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key id %q must be 0-255", id)
+		}
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d: %w", n, err)
+		}
+
+		keys = append(keys, EncryptionKey{ID: byte(n), Key: key})
+	}
+
+	return keys, nil
+}
+
+// EncryptionKeysFromEnv returns the keys in EncryptionKeysEnv, or none
+// if it is unset.
+func EncryptionKeysFromEnv() ([]EncryptionKey, error) {
+	return ParseEncryptionKeys(os.Getenv(EncryptionKeysEnv))
+}
+
+// appendFrameEncrypted is appendFrame for a WAL with encryption on,
+// compressing first when c asks for it and that helps. scratch is
+// reused between calls as in appendFrameCompressed.
+func appendFrameEncrypted(buf []byte, r *Record, c Compression, kr *keyring, scratch []byte) ([]byte, []byte) {
+	raw := appendRecord(scratch[:0], r)
+
+	body, flags := raw, flagEncrypted
+	if c != CompressionNone && len(raw) >= compressMinSize {
+		var packed []byte
+		switch c {
+		case CompressionSnappy:
+			packed = snappy.Encode(nil, raw)
+		case CompressionZstd:
+			packed = zstdEncoder().EncodeAll(raw, nil)
+		}
+		if len(packed) < len(raw) {
+			body, flags = packed, flags|byte(c)
+		}
+	}
+
+	var nonce [12]byte
+	rand.Read(nonce[:])
+
+	aad := [2]byte{flags, kr.active} // Seal's output may not overlap it
+
+	start := len(buf)
+	buf = append(buf, make([]byte, 12)...)
+	buf = append(buf, aad[:]...)
+	buf = append(buf, nonce[:]...)
+	buf = kr.byID[kr.active].Seal(buf, nonce[:], body, aad[:])
+
+	putHeader(buf[start:], recordMagicFlagged)
+	return buf, raw
+}
+
+// open authenticates and decrypts the body of an encrypted frame, which
+// follows the flags byte in data.
+func (kr *keyring) open(data []byte) ([]byte, error) {
+	if len(data) < 1+1+12 {
+		return nil, errors.New("encrypted record too short")
+	}
+
+	id := data[1]
+	var aead cipher.AEAD
+	if kr != nil {
+		aead = kr.byID[id]
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w (id %d)", ErrUnknownKey, id)
+	}
+
+	plain, err := aead.Open(nil, data[2:14], data[14:], data[:2])
+	if err != nil {
+		return nil, fmt.Errorf("%w with key %d", ErrDecrypt, id)
+	}
+	return plain, nil
+}
+
+// sealedFlags leads a value sealed by Seal, in place of a frame's flags,
+// so one can't pass for the other.
+const sealedFlags byte = 0x80
+
+// Encrypted reports whether the WAL encrypts its records, and so whether
+// Seal does anything.
+func (w *WAL) Encrypted() bool {
+	return w.keys != nil
+}
+
+// Seal encrypts data with the WAL's active key, for a caller keeping
+// something the log holds outside it, such as a moved-out value. Data
+// is returned as it is when the WAL is not encrypted.
+func (w *WAL) Seal(data []byte) []byte {
+	kr := w.keys
+	if kr == nil {
+		return data
+	}
+
+	var nonce [12]byte
+	rand.Read(nonce[:])
+
+	aad := [2]byte{sealedFlags, kr.active} // Seal's output may not overlap it
+
+	out := make([]byte, 0, 2+12+len(data)+kr.byID[kr.active].Overhead())
+	out = append(out, aad[:]...)
+	out = append(out, nonce[:]...)
+	return kr.byID[kr.active].Seal(out, nonce[:], data, aad[:])
+}
+
+// Unseal decrypts what Seal returned, with whichever of the WAL's keys
+// sealed it.
+func (w *WAL) Unseal(data []byte) ([]byte, error) {
+	if w.keys == nil {
+		return data, nil
+	}
+	if len(data) == 0 || data[0] != sealedFlags {
+		return nil, fmt.Errorf("%w: not sealed", ErrDecrypt)
+	}
+	return w.keys.open(data)
+}
@@ -0,0 +1,75 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrInjected is the error of a flush Faults made fail.
+var ErrInjected = errors.New("wal: injected fault")
+
+// Faults makes a WAL misbehave on purpose, for chaos and soak tests of
+// the application embedding it. The zero value injects nothing.
+type Faults struct {
+	// WriteLatency and SyncLatency are added to every write of the buffer
+	// to the segment file and every fsync, as if the disk were slow.
+	WriteLatency time.Duration
+	SyncLatency  time.Duration
+
+	// Jitter adds a random extra delay of up to Jitter to each injected
+	// latency.
+	Jitter time.Duration
+
+	// FlushErrors is the chance, from 0 to 1, that a flush a caller
+	// waits on fails with ErrInjected, as on a failing disk: the
+	// write-through of an Append with no flush interval, which logs
+	// nothing, and Sync and WaitDurable, which leave what they would have
+	// flushed for the next flush. Background flushes are spared, as they
+	// have no caller to fail.
+	FlushErrors float64
+}
+
+func (f Faults) validate() error {
+	if f.WriteLatency < 0 || f.SyncLatency < 0 || f.Jitter < 0 {
+		return fmt.Errorf("wal: fault latencies must not be negative")
+	}
+	if f.FlushErrors < 0 || f.FlushErrors > 1 {
+		return fmt.Errorf("wal: flush error rate %v is not between 0 and 1", f.FlushErrors)
+	}
+	return nil
+}
+
+// fail returns ErrInjected for FlushErrors of the flushes it is asked
+// about.
+func (f Faults) fail() error {
+	if f.FlushErrors > 0 && rand.Float64() < f.FlushErrors {
+		return ErrInjected
+	}
+	return nil
+}
+
+func (f Faults) delay(base time.Duration) {
+	if base <= 0 {
+		return
+	}
+	if f.Jitter > 0 {
+		base += rand.N(f.Jitter)
+	}
+	time.Sleep(base)
+}
+
+// SetFaults replaces the faults injected into w, so a test can make the
+// disk slow mid-run and recover it again with the zero Faults.
+func (w *WAL) SetFaults(f Faults) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.faults = f
+	return nil
+}
@@ -0,0 +1,102 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A segment file starts with a header saying what wrote it:
+//
+//	[Magic 4B][Version 4B][Created 8B][FirstLSN 8B][CRC32 4B]
+//
+// Files from before headers are bare record streams, which start with a
+// record's magic or nothing, and are read as they always were.
+const (
+	segmentMagic  uint32 = 0x57414C53 // "WALS"
+	segmentFormat uint32 = 1          // the newest format this build writes and reads
+	headerSize           = 28
+)
+
+// SegmentHeader is what a segment file's header says of it.
+type SegmentHeader struct {
+	Version  uint32 // format version, 0 for a file from before headers
+	Created  time.Time
+	FirstLSN uint64 // no record in the segment has a lower LSN
+}
+
+var (
+	// ErrSegmentFormat is returned for a segment written in a format
+	// newer than this build reads, rather than taking it for corruption.
+	ErrSegmentFormat = errors.New("wal: segment format is newer than this build reads")
+
+	// ErrCorruptHeader is returned for a segment whose header fails its
+	// checksum. RecoverySalvage reads its records anyway.
+	ErrCorruptHeader = errors.New("wal: corrupt segment header")
+)
+
+func appendSegmentHeader(buf []byte, hdr SegmentHeader) []byte {
+	start := len(buf)
+	buf = binary.BigEndian.AppendUint32(buf, segmentMagic)
+	buf = binary.BigEndian.AppendUint32(buf, hdr.Version)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(hdr.Created.UnixNano()))
+	buf = binary.BigEndian.AppendUint64(buf, hdr.FirstLSN)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:]))
+}
+
+// readSegmentHeader reads the header of a segment of size bytes and
+// returns it with the offset its records start at, which is 0 for a
+// file from before headers. The offset is past the header with
+// ErrCorruptHeader too.
+func readSegmentHeader(f *os.File, size int64) (SegmentHeader, int64, error) {
+	var buf [headerSize]byte
+	n, _ := f.ReadAt(buf[:min(size, headerSize)], 0)
+	if n < 4 || binary.BigEndian.Uint32(buf[:4]) != segmentMagic {
+		return SegmentHeader{}, 0, nil
+	}
+
+	name := filepath.Base(f.Name())
+	if n < headerSize || crc32.ChecksumIEEE(buf[:24]) != binary.BigEndian.Uint32(buf[24:]) {
+		return SegmentHeader{}, headerSize, fmt.Errorf("%s: %w", name, ErrCorruptHeader)
+	}
+	hdr := SegmentHeader{
+		Version:  binary.BigEndian.Uint32(buf[4:8]),
+		Created:  time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:16]))),
+		FirstLSN: binary.BigEndian.Uint64(buf[16:24]),
+	}
+	if hdr.Version > segmentFormat {
+		return hdr, headerSize, fmt.Errorf("%s: %w (version %d)", name, ErrSegmentFormat, hdr.Version)
+	}
+	return hdr, headerSize, nil
+}
+
+// recordsStart is readSegmentHeader for readers: it returns where the
+// records of f start, skipping a corrupt header under RecoverySalvage.
+func recordsStart(f *os.File, size int64, mode RecoveryMode) (int64, error) {
+	_, start, err := readSegmentHeader(f, size)
+	if errors.Is(err, ErrCorruptHeader) && mode == RecoverySalvage {
+		err = nil
+	}
+	return start, err
+}
+
+// ReadSegmentHeader returns the header of the segment file at path, with
+// a Version of 0 for a file from before headers.
+func ReadSegmentHeader(path string) (SegmentHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return SegmentHeader{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return SegmentHeader{}, err
+	}
+	hdr, _, err := readSegmentHeader(f, info.Size())
+	return hdr, err
+}
@@ -0,0 +1,65 @@
+package wal
+
+import (
+	"errors"
+	"os"
+)
+
+// Frame is one framed record of a segment file, as InspectSegment finds
+// it.
+type Frame struct {
+	Offset int64   // of the frame's header in the file
+	Size   int64   // bytes the frame takes, header included
+	Record *Record // nil if Err is set
+	Err    error   // why the frame can't be read, nil if it can
+}
+
+// InspectSegment calls fn for each frame in the segment file at path,
+// for tools that look into a log by hand. The header isn't a frame; see
+// ReadSegmentHeader. Unlike replay it never changes
+// the file. A frame that fails validation ends the scan, as nothing
+// after it can be framed: it is passed to fn with Err saying why and a
+// Size covering the rest of the file. A frame that is intact but can't
+// be decrypted with keys is passed with Err set and the scan carries on.
+// The zeros a preallocated segment ends in aren't a frame, and end the
+// scan without one.
+func InspectSegment(path string, keys []EncryptionKey, fn func(Frame) error) error {
+	kr, err := newKeyring(keys)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	_, start, err := readSegmentHeader(f, size)
+	if err != nil {
+		return err
+	}
+	for offset := start; offset < size; {
+		rec, n, err := readRecordAt(f, offset, size, 0, kr)
+		if errors.Is(err, errUnused) {
+			if clean, zerr := zeroed(f, offset, size); zerr != nil || clean {
+				return zerr
+			}
+		}
+		if errors.Is(err, errBadFrame) {
+			return fn(Frame{Offset: offset, Size: size - offset, Err: err})
+		}
+
+		if err := fn(Frame{Offset: offset, Size: n, Record: rec, Err: err}); err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
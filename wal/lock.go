@@ -0,0 +1,48 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned by Open when another WAL has the directory open,
+// which would interleave its appends with ours and corrupt both.
+var ErrLocked = errors.New("wal: data directory is locked")
+
+// lockName is the file in the WAL directory that holds the lock and the
+// pid of the process holding it.
+const lockName = "LOCK"
+
+// lockDir takes an exclusive advisory lock on dir for as long as the
+// returned file stays open. The lock goes with the process, so one that
+// dies without closing the WAL doesn't leave the directory locked.
+func lockDir(dir string) (*os.File, error) {
+	path := filepath.Join(dir, lockName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := tryLock(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %w", path, err)
+	}
+	if !ok {
+		holder, _ := os.ReadFile(path)
+		f.Close()
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(holder))); err == nil {
+			return nil, fmt.Errorf("%w by pid %d: %s", ErrLocked, pid, dir)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f, nil
+}
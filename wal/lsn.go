@@ -0,0 +1,64 @@
+package wal
+
+import (
+	"errors"
+	"os"
+)
+
+// errStopReplay ends a replayFile walk early without it being an error.
+var errStopReplay = errors.New("stop replay")
+
+// findLastLSN returns the highest LSN on disk, so Append carries on from
+// it after a restart. Only the newest segment holding LSNs is read.
+func (w *WAL) findLastLSN() (uint64, error) {
+	files, err := w.segmentFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(files) - 1; i >= 0; i-- {
+		var last uint64
+		err := w.readSegment(files[i], func(r *Record) error {
+			last = max(last, r.LSN)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if last != 0 {
+			return last, nil
+		}
+
+		// a segment with no records yet still knows where LSNs had got to
+		if hdr, err := ReadSegmentHeader(files[i]); err == nil && hdr.FirstLSN > 0 {
+			return hdr.FirstLSN - 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// firstLSN returns the LSN of the first record in a segment, or 0 if it
+// is empty or predates LSNs.
+func (w *WAL) firstLSN(path string) (uint64, error) {
+	var first uint64
+	err := w.readSegment(path, func(r *Record) error {
+		first = r.LSN
+		return errStopReplay
+	})
+	return first, err
+}
+
+// readSegment walks the valid records of one segment file.
+func (w *WAL) readSegment(path string, fn func(*Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, _, err = replayFile(f, w.maxRecord, w.keys, w.recovery, nil, fn)
+	if errors.Is(err, errStopReplay) {
+		return nil
+	}
+	return err
+}
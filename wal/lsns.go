@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrLSNsShared is returned by Stream for a counter more than one open
+// WAL takes its LSNs from, and by opening a WAL with a streamed one: a
+// stream of one of the logs would silently miss the others' records.
+var ErrLSNsShared = errors.New("wal: LSNs are shared with other logs")
+
+// LSNs hands out the LSNs of the WALs opened with it, see Options.LSNs.
+// The zero value is ready to use.
+type LSNs struct {
+	last atomic.Uint64
+
+	mu       sync.Mutex
+	open     int  // WALs open with it
+	streamed bool // see Stream
+}
+
+// Stream marks the counter as that of a log streamed elsewhere, such as
+// to replication followers, failing with ErrLSNsShared if another WAL
+// has it; no other can be opened with it from then on.
+func (c *LSNs) Stream() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.open > 1 {
+		return ErrLSNsShared
+	}
+	c.streamed = true
+	return nil
+}
+
+// Streamed reports whether Stream has been called.
+func (c *LSNs) Streamed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.streamed
+}
+
+// join counts a WAL opening with the counter, and leave one closing.
+func (c *LSNs) join() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.streamed && c.open > 0 {
+		return ErrLSNsShared
+	}
+	c.open++
+	return nil
+}
+
+func (c *LSNs) leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.open--
+}
+
+// Last returns the highest LSN handed out or found in the logs opened
+// with it.
+func (c *LSNs) Last() uint64 {
+	return c.last.Load()
+}
+
+func (c *LSNs) next() uint64 {
+	return c.last.Add(1)
+}
+
+// observe raises the counter to lsn, for a log opened or a record
+// appended under an LSN it already had.
+func (c *LSNs) observe(lsn uint64) {
+	for {
+		last := c.last.Load()
+		if lsn <= last || c.last.CompareAndSwap(last, lsn) {
+			return
+		}
+	}
+}
+
+// giveBack returns lsn, which next handed out for an append that logged
+// nothing, unless another WAL has taken a later one since; then it is
+// left as a gap.
+func (c *LSNs) giveBack(lsn uint64) {
+	c.last.CompareAndSwap(lsn, lsn-1)
+}
+
+// LSNs returns the counter the WAL takes its LSNs from, to open other
+// WALs numbering their records alongside it.
+func (w *WAL) LSNs() *LSNs {
+	return w.lsns
+}
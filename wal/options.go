@@ -0,0 +1,213 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMaxSegmentSize = 10 * 1024 * 1024
+	DefaultBufferSize     = 4096
+	DefaultMaxRecordSize  = 64 * 1024 * 1024
+)
+
+// Options configures a WAL opened with OpenWithOptions. Zero values pick
+// the defaults, except Dir which must be set and FlushEvery, where 0
+// means no background flushing: every Append is written, and synced as
+// SyncPolicy says, before it returns.
+type Options struct {
+	Dir            string
+	FlushEvery     time.Duration
+	MaxSegmentSize int64         // rotate once a segment would exceed this
+	MaxSegmentAge  time.Duration // and once it has been written to this long
+	BufferSize     int           // initial capacity of the append buffer
+	SyncPolicy     SyncPolicy    // zero value fsyncs on every flush
+
+	// MaxRecordSize bounds a framed record, after compression and
+	// encryption. Append refuses a bigger one with ErrRecordTooLarge, and
+	// replay takes a frame claiming more for a corrupt length, so a bad
+	// length field can't make it allocate gigabytes. Lowering it below a
+	// record already logged makes replay stop at that record, so only
+	// ever raise it.
+	MaxRecordSize int64
+
+	// Preallocate creates each segment at MaxSegmentSize up front, with
+	// fallocate where there is one, and keeps a segment that retention
+	// deletes to be emptied and reused as the next, so rotating and
+	// fsyncing don't keep growing, creating and deleting files. While a
+	// Reader, Snapshot or Backup is open, retired segments are deleted
+	// instead, as one may still be reading them. The active segment's
+	// unwritten end is zeros, which readers take as its end, and
+	// rotation cuts a segment back to its records. A log written this
+	// way can be reopened without it, and the other way round, but not
+	// by walruses from before it existed, which would append after the
+	// zeros.
+	Preallocate bool
+
+	// MaxBufferedBytes bounds the buffer between flushes, so a disk that
+	// can't keep up slows writers down or turns them away instead of
+	// growing the buffer without bound. An Append that finds it full
+	// starts a flush and then does as BufferPolicy says: BufferBlock,
+	// the default, waits for the flush to make room, and BufferFail
+	// fails at once with ErrBufferFull. 0 is no limit; with no FlushEvery
+	// nothing is ever buffered.
+	//
+	// StallTimeout, if set, is how long BufferBlock waits before failing
+	// with ErrWriteStall. Without it a write waits as long as it takes,
+	// holding its caller's locks meanwhile, and on a disk that has
+	// failed that is for good.
+	MaxBufferedBytes int
+	BufferPolicy     BufferPolicy
+	StallTimeout     time.Duration
+
+	// Scheduler, if set, flushes this WAL instead of the shared scheduler
+	// for FlushEvery. FlushEvery is then taken from the scheduler.
+	Scheduler *Scheduler
+
+	// LSNs, if set, hands out this WAL's LSNs, shared with the other WALs
+	// opened with it so LSNs stay unique and in order across all of them,
+	// as for the segment families of a store's buckets. Each WAL's own
+	// LSNs then have gaps. Nil gives the WAL a counter of its own. Opening
+	// one with a counter another open WAL streams fails with
+	// ErrLSNsShared, see LSNs.Stream.
+	LSNs *LSNs
+
+	// Faults injects artificial disk latency; see Faults.
+	Faults Faults
+
+	// Origin identifies this writer on every record it appends, so logs
+	// merged from several writers can tell whose write is whose.
+	Origin string
+
+	// Compression compresses records as they are appended; see
+	// Compression. Logs replay whatever it is set to.
+	Compression Compression
+
+	// EncryptionKeys turns on AES-GCM encryption of every appended record
+	// with the first key; the rest only decrypt, for rotation. See
+	// EncryptionKey and EncryptionKeysFromEnv.
+	EncryptionKeys []EncryptionKey
+
+	// Retention keeps some segments around after Truncate has made them
+	// obsolete; see Retention.
+	Retention Retention
+
+	// Recovery is what replay does at a corrupt record; see RecoveryMode.
+	Recovery RecoveryMode
+}
+
+// RecoveryMode says how replay treats a record that fails validation.
+type RecoveryMode byte
+
+const (
+	// RecoveryStrict takes a corrupt record as the end of its segment and
+	// drops the rest, which is right for the torn write a crash leaves.
+	RecoveryStrict RecoveryMode = 0
+
+	// RecoverySalvage reads on past a corrupt stretch from the next record
+	// whose magic, length and checksum hold up, as Repair does, so a bad
+	// byte in the middle of a segment costs only the records it hit. The
+	// skipped bytes count in ReadStats.CorruptBytes, and the stretch is
+	// left on disk and skipped again on every replay.
+	RecoverySalvage RecoveryMode = 1
+)
+
+// ParseRecoveryMode parses "strict" or "salvage"; empty is strict.
+func ParseRecoveryMode(s string) (RecoveryMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "strict":
+		return RecoveryStrict, nil
+	case "salvage":
+		return RecoverySalvage, nil
+	}
+	return 0, fmt.Errorf("unknown recovery mode %q", s)
+}
+
+func (m RecoveryMode) String() string {
+	if m == RecoverySalvage {
+		return "salvage"
+	}
+	return "strict"
+}
+
+// Retention limits what Truncate deletes. Only segments wholly before
+// the truncation point are ever deleted; of those, the newest are kept
+// until KeepSegments segments and KeepBytes bytes of log (counting the
+// active segment) remain, e.g. for readers still catching up. Zero
+// values keep nothing extra.
+type Retention struct {
+	KeepSegments int
+	KeepBytes    int64
+}
+
+func (r Retention) validate() error {
+	if r.KeepSegments < 0 {
+		return fmt.Errorf("wal: invalid retention of %d segments", r.KeepSegments)
+	}
+	if r.KeepBytes < 0 {
+		return fmt.Errorf("wal: invalid retention of %d bytes", r.KeepBytes)
+	}
+	return nil
+}
+
+func (o *Options) setDefaults() {
+	if o.Scheduler != nil {
+		o.FlushEvery = o.Scheduler.every
+	}
+	if o.MaxSegmentSize == 0 {
+		o.MaxSegmentSize = DefaultMaxSegmentSize
+	}
+	if o.BufferSize == 0 {
+		o.BufferSize = DefaultBufferSize
+	}
+	if o.MaxRecordSize == 0 {
+		o.MaxRecordSize = DefaultMaxRecordSize
+	}
+}
+
+func (o Options) validate() error {
+	if o.Dir == "" {
+		return errors.New("wal: no directory given")
+	}
+	if o.BufferSize < 0 {
+		return fmt.Errorf("wal: invalid buffer size %d", o.BufferSize)
+	}
+	if o.MaxRecordSize < 0 || o.MaxRecordSize > math.MaxUint32 {
+		return fmt.Errorf("wal: invalid max record size %d", o.MaxRecordSize)
+	}
+	if o.MaxBufferedBytes < 0 {
+		return fmt.Errorf("wal: invalid buffer limit %d", o.MaxBufferedBytes)
+	}
+	if o.StallTimeout < 0 {
+		return fmt.Errorf("wal: invalid stall timeout %v", o.StallTimeout)
+	}
+	if o.BufferPolicy > BufferFail {
+		return fmt.Errorf("wal: unknown buffer policy %d", o.BufferPolicy)
+	}
+	if err := o.Faults.validate(); err != nil {
+		return err
+	}
+	if err := o.Retention.validate(); err != nil {
+		return err
+	}
+	if err := o.Compression.validate(); err != nil {
+		return err
+	}
+	if o.Recovery > RecoverySalvage {
+		return fmt.Errorf("wal: unknown recovery mode %d", o.Recovery)
+	}
+
+	return o.tunables().validate()
+}
+
+func (o Options) tunables() Tunables {
+	return Tunables{
+		FlushEvery:     o.FlushEvery,
+		MaxSegmentSize: o.MaxSegmentSize,
+		MaxSegmentAge:  o.MaxSegmentAge,
+		SyncPolicy:     o.SyncPolicy,
+	}
+}
@@ -0,0 +1,94 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// spareName is the file a segment retention deleted waits in to become
+// the next one, see Options.Preallocate. It isn't named like a segment,
+// so nothing reads it as part of the log.
+const spareName = "wal.spare"
+
+// openSpare opens the spare file for createSegment, or a new file next
+// to path if there is none to reuse. It returns the file's path.
+func (w *WAL) openSpare(path string) (*os.File, string, error) {
+	if w.preallocate {
+		spare := filepath.Join(w.dir, spareName)
+		f, err := os.OpenFile(spare, os.O_RDWR, 0)
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			return f, spare, err
+		}
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR, 0644)
+	return f, tmp, err
+}
+
+// retireSegment deletes the segment file at path or, with Preallocate
+// and no spare yet, keeps it as the spare for createSegment. While a
+// Reader, Snapshot or Backup is open it is deleted regardless, as one
+// may have it open, and reusing it would empty and rewrite it under
+// them; so is one a tailing Reader has open. Caller holds w.mu.
+func (w *WAL) retireSegment(path string) error {
+	if w.preallocate && w.readers == 0 && w.tailing[path] == 0 {
+		spare := filepath.Join(w.dir, spareName)
+		if _, err := os.Stat(spare); errors.Is(err, os.ErrNotExist) {
+			return os.Rename(path, spare)
+		}
+	}
+	return os.Remove(path)
+}
+
+// segmentSizeLocked returns how much of the segment at path holds the
+// log: up to where the next write goes for the active one, which with
+// Preallocate is followed by zeros, and the whole file for the others,
+// which rotation cuts back to their end. Caller holds w.mu.
+func (w *WAL) segmentSizeLocked(path string) (int64, error) {
+	if id, _ := segmentID(path); w.file != nil && id == w.segmentID {
+		return w.offset, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// extend grows f to size bytes, zero-filled, where the space can't be
+// allocated up front. The file is sparse, so the blocks are still
+// allocated as they are written.
+func extend(f *os.File, size int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	return f.Truncate(size)
+}
+
+// zeroed reports whether the bytes of f from offset up to size are all
+// zero, as preallocation left them.
+func zeroed(f *os.File, offset, size int64) (bool, error) {
+	buf := make([]byte, 64*1024)
+	for offset < size {
+		n, err := f.ReadAt(buf[:min(int64(len(buf)), size-offset)], offset)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
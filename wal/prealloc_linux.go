@@ -0,0 +1,21 @@
+//go:build linux
+
+package wal
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// preallocate allocates f's blocks for size bytes, zero-filled, so
+// writes within them neither allocate nor change the file's size, and an
+// fdatasync has no metadata to write. Filesystems without fallocate get
+// a sparse file instead.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return extend(f, size)
+	}
+	return err
+}
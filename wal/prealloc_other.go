@@ -0,0 +1,11 @@
+//go:build !linux
+
+package wal
+
+import "os"
+
+// preallocate makes f size bytes long, zero-filled. Without fallocate
+// the file is sparse, so only its size is set up front.
+func preallocate(f *os.File, size int64) error {
+	return extend(f, size)
+}
@@ -0,0 +1,270 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Reader streams records from the log one at a time, so a consumer
+// holds one record in memory rather than the whole log. It sees what
+// had been written to the segments, not what is still buffered, and
+// like Replay it skips a segment's corrupt tail and moves on to the
+// next segment, or past a corrupt stretch with RecoverySalvage. A Reader
+// is not safe for concurrent use.
+type Reader struct {
+	wal       *WAL // until Close, see retireSegment
+	keys      *keyring
+	recovery  RecoveryMode
+	maxRecord int64
+	files     []string
+	from      uint64 // skip records with a lower LSN
+	file      *os.File
+	path      string // of file
+	size      int64
+	offset    int64
+	read      int64  // bytes of valid records read
+	joined    chunks // of a big record, which may span segments
+
+	tail   bool // see Tail
+	seg    int  // id of the last segment opened
+	sealed bool // file has a later segment, so its end is final
+}
+
+// ErrTruncated is returned by Tail for an LSN the log no longer has the
+// records from, its segments having been deleted.
+var ErrTruncated = errors.New("wal: LSN no longer in the log")
+
+// Reader returns a Reader positioned at the start of the log.
+func (w *WAL) Reader() (*Reader, error) {
+	return w.ReadFrom(0)
+}
+
+// ReadFrom returns a Reader that starts at the first record with an LSN
+// of at least lsn. Segments wholly before lsn are skipped without being
+// read. Records without an LSN (written before LSNs existed) are only
+// returned when lsn is 0.
+func (w *WAL) ReadFrom(lsn uint64) (*Reader, error) {
+	// counted before listing, so none of the files is reused under it
+	w.mu.Lock()
+	w.readers++
+	w.mu.Unlock()
+	r := &Reader{wal: w, keys: w.keys, recovery: w.recovery, maxRecord: w.maxRecord, from: lsn}
+
+	files, err := w.segmentFiles()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	// a segment is wholly before lsn when the next one starts at or below it
+	if lsn > 0 {
+		skip := 0
+		for i := 1; i < len(files); i++ {
+			first, err := w.firstLSN(files[i])
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+			if first == 0 || first > lsn {
+				continue
+			}
+			skip = i
+		}
+		files = files[skip:]
+	}
+
+	r.files = files
+	return r, nil
+}
+
+// Tail returns a Reader like ReadFrom's that follows the log as it grows.
+// At the end of the log its Next returns io.EOF, and called again picks
+// up the records written since, moving on to new segments as the log
+// rotates, so a consumer keeps one Reader rather than reading the active
+// segment over from its start. It fails with ErrTruncated when the
+// oldest segment starts after lsn, or after 1 for an lsn of 0, since
+// the records before it are gone.
+//
+// Unlike other Readers, an open one doesn't keep Preallocate from reusing
+// the segments it has finished, only the one it is reading.
+func (w *WAL) Tail(lsn uint64) (*Reader, error) {
+	files, err := w.segmentFiles()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		if hdr, err := ReadSegmentHeader(files[0]); err == nil && hdr.FirstLSN > max(lsn, 1) {
+			return nil, fmt.Errorf("%w: %d, the oldest segment starts at %d", ErrTruncated, lsn, hdr.FirstLSN)
+		}
+	}
+
+	r, err := w.ReadFrom(lsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// counted by the segment in use instead, see retireSegment
+	w.mu.Lock()
+	w.readers--
+	w.mu.Unlock()
+	r.tail = true
+	return r, nil
+}
+
+// Next returns the next record, or io.EOF once the log is exhausted.
+func (r *Reader) Next() (*Record, error) {
+	for {
+		if r.file == nil {
+			if len(r.files) == 0 && r.tail && r.wal != nil {
+				if err := r.later(); err != nil {
+					return nil, err
+				}
+			}
+			if len(r.files) == 0 {
+				return nil, io.EOF
+			}
+			if err := r.open(r.files[0]); err != nil {
+				return nil, err
+			}
+			r.files = r.files[1:]
+		}
+
+		rec, n, err := readRecordAt(r.file, r.offset, r.size, r.maxRecord, r.keys)
+		if err != nil && !errors.Is(err, errBadFrame) {
+			return nil, err
+		}
+		if err != nil {
+			// the segment may still be written to, so its end isn't known
+			// to be one until a later segment exists; the read to that end
+			// is done again then
+			if r.tail && !r.sealed && len(r.files) == 0 {
+				if err := r.later(); err != nil {
+					return nil, err
+				}
+				r.sealed = len(r.files) > 0
+				if info, err := r.file.Stat(); err == nil {
+					r.size = info.Size()
+				}
+				if r.sealed {
+					continue
+				}
+				return nil, io.EOF
+			}
+			if r.recovery == RecoverySalvage && r.offset < r.size {
+				if next := resync(r.file, r.offset+1, r.size); next < r.size {
+					r.offset = next
+					continue
+				}
+			}
+			r.closeFile()
+			continue
+		}
+		r.offset += n
+		r.read += n
+
+		if rec, err = r.joined.next(rec, r.maxRecord, r.keys); err != nil {
+			return nil, err
+		}
+		if rec == nil || rec.LSN < r.from || rec.Op == OpShutdown {
+			continue
+		}
+		return rec, nil
+	}
+}
+
+// Bytes returns how many bytes of valid records and segment headers the
+// Reader has read, records it skipped for their LSN included.
+func (r *Reader) Bytes() int64 {
+	return r.read
+}
+
+// later lists the segments after the last one opened, for a tailing
+// Reader at the end of what it had.
+func (r *Reader) later() error {
+	files, err := r.wal.segmentFiles()
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		if id, ok := segmentID(path); ok && id > r.seg {
+			r.files = append(r.files, path)
+		}
+	}
+	return nil
+}
+
+func (r *Reader) open(path string) error {
+	// a tailing Reader's segment is marked before it is opened, so it
+	// can't become the spare in between, see retireSegment
+	r.hold(path, 1)
+	f, err := os.Open(path)
+	if err != nil {
+		r.hold(path, -1)
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		r.hold(path, -1)
+		return err
+	}
+
+	start, err := recordsStart(f, info.Size(), r.recovery)
+	if err != nil {
+		f.Close()
+		r.hold(path, -1)
+		return err
+	}
+
+	r.file, r.path, r.size, r.offset = f, path, info.Size(), start
+	r.seg, _ = segmentID(path)
+	r.sealed = false
+	r.read += start
+	return nil
+}
+
+func (r *Reader) closeFile() error {
+	err := r.file.Close()
+	r.hold(r.path, -1)
+	r.file, r.path = nil, ""
+	return err
+}
+
+// hold counts a tailing Reader's segment among the WAL's tailing or,
+// with a delta of -1, no longer.
+func (r *Reader) hold(path string, delta int) {
+	if !r.tail {
+		return
+	}
+	r.wal.mu.Lock()
+	defer r.wal.mu.Unlock()
+
+	if r.wal.tailing == nil {
+		r.wal.tailing = make(map[string]int)
+	}
+	r.wal.tailing[path] += delta
+	if r.wal.tailing[path] == 0 {
+		delete(r.wal.tailing, path)
+	}
+}
+
+// Close releases the segment the Reader has open.
+func (r *Reader) Close() error {
+	r.files = nil
+	var err error
+	if r.file != nil {
+		err = r.closeFile()
+	}
+	if r.wal != nil {
+		if !r.tail {
+			r.wal.mu.Lock()
+			r.wal.readers--
+			r.wal.mu.Unlock()
+		}
+		r.wal = nil
+	}
+	return err
+}
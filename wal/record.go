@@ -3,6 +3,7 @@ package wal
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 )
 
 type OpType byte // operation type
@@ -10,42 +11,236 @@ type OpType byte // operation type
 const (
 	OpSet    OpType = 1
 	OpDelete OpType = 2
+	OpSetTTL OpType = 3 // Value is [ExpiresAt: 8B unix nanos][value]
+	OpBatch  OpType = 4 // Value is EncodeBatch output, applied all-or-nothing
+	OpReset  OpType = 5 // clears every key logged before it
+
+	// OpIdempotent records that the request with idempotency key Key was
+	// applied; Value is its [ExpiresAt: 8B unix nanos]
+	OpIdempotent OpType = 6
+
+	// OpIncr adds a delta to the integer stored at Key, or to 0 if there
+	// is none; Value is [ExpiresAt: 8B unix nanos, 0 for none][Delta: 8B]
+	OpIncr OpType = 7
+
+	// OpCompareAndSet and OpSetIfAbsent set Key to a value, like OpSet,
+	// on the condition their names give, which held when they were
+	// logged. OpCompareAndSet's Value is [OldLen: 4B][old][new];
+	// OpSetIfAbsent's is the value.
+	OpCompareAndSet OpType = 8
+	OpSetIfAbsent   OpType = 9
+
+	// OpShutdown marks the end of a log closed by Close. It is never
+	// replayed, and Open removes it; see WAL.Crashed.
+	OpShutdown OpType = 10
+
+	// OpChunk is a piece of a record too big for one frame, which the
+	// log splits into chunks; see chunk.go. Readers of the log join the
+	// pieces and return the record, never a chunk: only InspectSegment
+	// reports them, as a Record with this Op and the chunk as its Value.
+	OpChunk OpType = 11
 )
 
-const recordMagic uint32 = 0xCAFEBABE
+var opNames = map[OpType]string{
+	OpSet:           "set",
+	OpDelete:        "delete",
+	OpSetTTL:        "set-ttl",
+	OpBatch:         "batch",
+	OpReset:         "reset",
+	OpIdempotent:    "idempotent",
+	OpIncr:          "incr",
+	OpCompareAndSet: "compare-and-set",
+	OpSetIfAbsent:   "set-if-absent",
+	OpShutdown:      "shutdown",
+	OpChunk:         "chunk",
+}
+
+func (op OpType) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("op(%d)", byte(op))
+}
+
+// Frame magics. The checksum of a frame covers its magic and length as
+// well as its data, so a corrupt length fails it like corrupt data does;
+// frames from before that have the legacy magics and a checksum of the
+// data alone. All of them share their first three bytes, and flagged
+// ones are odd.
+const (
+	recordMagic        uint32 = 0xCAFEBAC0
+	recordMagicFlagged uint32 = 0xCAFEBAC1 // data starts with a flags byte
+	recordMagicChunk   uint32 = 0xCAFEBAC2 // a piece of a bigger frame, see chunk.go
+
+	legacyMagic        uint32 = 0xCAFEBABE
+	legacyMagicFlagged uint32 = 0xCAFEBABF
+)
+
+// validMagic reports whether magic starts a frame of a whole record.
+func validMagic(magic uint32) bool {
+	switch magic {
+	case recordMagic, recordMagicFlagged, legacyMagic, legacyMagicFlagged:
+		return true
+	}
+	return false
+}
+
+// frameChecksum returns the checksum a frame with the given header and
+// data should carry.
+func frameChecksum(magic, length uint32, data []byte) uint32 {
+	if magic == legacyMagic || magic == legacyMagicFlagged {
+		return crc32.ChecksumIEEE(data)
+	}
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], magic)
+	binary.BigEndian.PutUint32(hdr[4:8], length)
+	return crc32.Update(crc32.ChecksumIEEE(hdr[:]), crc32.IEEETable, data)
+}
 
 // log entry struct
 type Record struct {
 	Op    OpType
 	Key   []byte
 	Value []byte
+
+	// Origin names the writer that produced the record. Append fills it
+	// in from Options.Origin unless it is already set, so records merged
+	// in from another writer keep their own.
+	Origin string
+
+	// LSN is the record's sequence number in this WAL, assigned by Append
+	// and increasing by one per record across segments and restarts.
+	// Records logged before LSNs existed read back as 0.
+	LSN uint64
+
+	// Timestamp is when the record was logged, in unix nanos. Append sets
+	// it unless it is already set, so replicated records keep the
+	// primary's. Records logged before timestamps existed read back as 0.
+	Timestamp int64
+
+	// User and Request attribute the write to whoever it was made for,
+	// such as the authenticated user and request ID of a server call.
+	// Both are optional and logged only when set.
+	User    string
+	Request string
 }
 
-func encodeRecord(r *Record) ([]byte, error) {
-	keyLen := uint32(len(r.Key))
-	valLen := uint32(len(r.Value))
+// ExcludeOrigins wraps a Replay callback so records written by any of
+// origins are skipped. A sync or replication consumer passes its own
+// origin, so writes it shipped out are not applied again when a merged
+// log brings them back.
+func ExcludeOrigins(fn func(*Record) error, origins ...string) func(*Record) error {
+	return func(r *Record) error {
+		for _, o := range origins {
+			if r.Origin == o {
+				return nil
+			}
+		}
+		return fn(r)
+	}
+}
 
-	totalSize := 1 + 4 + 4 + int(keyLen) + int(valLen)
+// Optional fields follow the key and value as [Tag: 1B][Len: uvarint]
+// [bytes]. Records without them decode as before, and readers skip tags
+// they don't know.
+const (
+	extOrigin    byte = 1
+	extLSN       byte = 2 // uvarint
+	extTimestamp byte = 3 // uvarint unix nanos
+	extUser      byte = 4
+	extRequest   byte = 5
+)
 
-	buf := make([]byte, totalSize)
+func encodeRecord(r *Record) ([]byte, error) {
+	return appendRecord(make([]byte, 0, encodedSize(r)), r), nil
+}
 
-	offset := 0
-	buf[offset] = byte(r.Op)
-	offset += 1
+func encodedSize(r *Record) int {
+	size := 1 + 4 + 4 + len(r.Key) + len(r.Value)
+	if r.Origin != "" {
+		size += 1 + binary.MaxVarintLen64 + len(r.Origin)
+	}
+	if r.LSN != 0 {
+		size += 1 + 1 + binary.MaxVarintLen64
+	}
+	if r.Timestamp != 0 {
+		size += 1 + 1 + binary.MaxVarintLen64
+	}
+	if r.User != "" {
+		size += 1 + binary.MaxVarintLen64 + len(r.User)
+	}
+	if r.Request != "" {
+		size += 1 + binary.MaxVarintLen64 + len(r.Request)
+	}
+	return size
+}
 
-	binary.BigEndian.PutUint32(buf[offset:offset+4], keyLen)
-	offset += 4
+// appendRecord encodes r onto the end of buf, so Append can write
+// straight into the WAL buffer without an intermediate copy.
+func appendRecord(buf []byte, r *Record) []byte {
+	buf = append(buf, byte(r.Op))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(r.Key)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(r.Value)))
+	buf = append(buf, r.Key...)
+	buf = append(buf, r.Value...)
 
-	binary.BigEndian.PutUint32(buf[offset:offset+4], valLen)
-	offset += 4
+	if r.Origin != "" {
+		buf = appendExt(buf, extOrigin, []byte(r.Origin))
+	}
+	if r.LSN != 0 {
+		buf = appendExt(buf, extLSN, binary.AppendUvarint(nil, r.LSN))
+	}
+	if r.Timestamp != 0 {
+		buf = appendExt(buf, extTimestamp, binary.AppendUvarint(nil, uint64(r.Timestamp)))
+	}
+	if r.User != "" {
+		buf = appendExt(buf, extUser, []byte(r.User))
+	}
+	if r.Request != "" {
+		buf = appendExt(buf, extRequest, []byte(r.Request))
+	}
+	return buf
+}
 
-	copy(buf[offset:offset+int(keyLen)], r.Key)
-	offset += int(keyLen)
+func appendExt(buf []byte, tag byte, data []byte) []byte {
+	buf = append(buf, tag)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
 
-	copy(buf[offset:offset+int(valLen)], r.Value)
-	offset += int(valLen)
+// decodeExts fills r's optional fields from the bytes after its value.
+func decodeExts(r *Record, data []byte) error {
+	for len(data) > 0 {
+		tag := data[0]
+		n, size := binary.Uvarint(data[1:])
+		if size <= 0 || uint64(len(data)-1-size) < n {
+			return fmt.Errorf("invalid record extension")
+		}
+		body := data[1+size : 1+size+int(n)]
+		data = data[1+size+int(n):]
 
-	return buf, nil
+		switch tag {
+		case extOrigin:
+			r.Origin = string(body)
+		case extLSN:
+			lsn, n := binary.Uvarint(body)
+			if n <= 0 {
+				return fmt.Errorf("invalid record lsn")
+			}
+			r.LSN = lsn
+		case extTimestamp:
+			ts, n := binary.Uvarint(body)
+			if n <= 0 {
+				return fmt.Errorf("invalid record timestamp")
+			}
+			r.Timestamp = int64(ts)
+		case extUser:
+			r.User = string(body)
+		case extRequest:
+			r.Request = string(body)
+		}
+	}
+	return nil
 }
 
 func decodeRecord(data []byte) (*Record, error) {
@@ -63,17 +258,17 @@ func decodeRecord(data []byte) (*Record, error) {
 	valLen := binary.BigEndian.Uint32(data[offset : offset+4])
 	offset += 4
 
-	expected := int(keyLen + valLen)
-	if len(data[offset:]) != expected {
+	expected := int(keyLen) + int(valLen)
+	if len(data[offset:]) < expected {
 		return nil, fmt.Errorf("invalid record length")
 	}
 
-	key := make([]byte, keyLen)
-	copy(key, data[offset:offset+int(keyLen)])
+	// Key and Value alias data rather than copying it; callers hand over a
+	// buffer they no longer use
+	key := data[offset : offset+int(keyLen) : offset+int(keyLen)]
 	offset += int(keyLen)
 
-	value := make([]byte, valLen)
-	copy(value, data[offset:offset+int(valLen)])
+	value := data[offset : offset+int(valLen) : offset+int(valLen)]
 	offset += int(valLen)
 
 	rec := &Record{
@@ -82,5 +277,80 @@ func decodeRecord(data []byte) (*Record, error) {
 		Value: value,
 	}
 
+	if err := decodeExts(rec, data[offset:]); err != nil {
+		return nil, err
+	}
+
 	return rec, nil
 }
+
+// EncodeBatch packs records into the value of a single OpBatch record:
+// [Count: 4B] followed by [Len: 4B][encoded record] per record. The batch
+// shares one checksum, so replay sees either all of it or none of it.
+func EncodeBatch(records []*Record) ([]byte, error) {
+	size := 4
+	encoded := make([][]byte, len(records))
+	for i, r := range records {
+		if r.Op == OpBatch {
+			return nil, fmt.Errorf("nested batch records are not supported")
+		}
+
+		data, err := encodeRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = data
+		size += 4 + len(data)
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(records)))
+
+	offset := 4
+	for _, data := range encoded {
+		binary.BigEndian.PutUint32(buf[offset:offset+4], uint32(len(data)))
+		offset += 4
+
+		copy(buf[offset:], data)
+		offset += len(data)
+	}
+
+	return buf, nil
+}
+
+// DecodeBatch is the inverse of EncodeBatch.
+func DecodeBatch(data []byte) ([]*Record, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("batch is too short")
+	}
+
+	count := binary.BigEndian.Uint32(data[0:4])
+	offset := 4
+
+	records := make([]*Record, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(data[offset:]) < 4 {
+			return nil, fmt.Errorf("batch truncated at record %d", i)
+		}
+		n := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		offset += 4
+
+		if len(data[offset:]) < n {
+			return nil, fmt.Errorf("batch truncated at record %d", i)
+		}
+
+		rec, err := decodeRecord(data[offset : offset+n])
+		if err != nil {
+			return nil, err
+		}
+		offset += n
+
+		records = append(records, rec)
+	}
+
+	if offset != len(data) {
+		return nil, fmt.Errorf("trailing bytes after batch")
+	}
+
+	return records, nil
+}
@@ -0,0 +1,170 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SegmentRepair is what Repair made of one segment.
+type SegmentRepair struct {
+	Name    string
+	Records int   // frames copied to the repaired log
+	Regions int   // corrupt stretches skipped
+	Skipped int64 // bytes in them
+}
+
+// Repair copies every record in the segments of src that is still intact
+// into a fresh log in dst, which must not hold one already. Replay stops
+// at the first corrupt frame of a segment and drops the rest; Repair
+// instead searches on from it for the next frame whose magic, length and
+// checksum hold up, so one bad byte costs only the record it is in.
+// Frames are copied as they are, LSNs, compression and encryption
+// included, so no keys are needed. Records lost in the skipped stretches
+// are gone, and the repaired log holds what is left, not necessarily
+// what the store held.
+//
+// Both directories are locked while Repair runs, so src must not be open
+// by a running WAL. Segments with nothing left are left out.
+func Repair(src, dst string) ([]SegmentRepair, error) {
+	files, err := segmentFilesIn(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no WAL segments in %s", src)
+	}
+	if last, err := lastSegmentID(dst); err != nil {
+		return nil, err
+	} else if last != 0 {
+		return nil, fmt.Errorf("%s already holds a log", dst)
+	}
+
+	srcLock, err := lockDir(src)
+	if err != nil {
+		return nil, err
+	}
+	defer srcLock.Close()
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return nil, err
+	}
+	dstLock, err := lockDir(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer dstLock.Close()
+
+	var report []SegmentRepair
+	for _, path := range files {
+		rep, err := repairSegment(path, filepath.Join(dst, filepath.Base(path)))
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		report = append(report, rep)
+	}
+	return report, nil
+}
+
+func repairSegment(path, out string) (SegmentRepair, error) {
+	rep := SegmentRepair{Name: filepath.Base(path)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rep, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return rep, err
+	}
+	defer f.Close()
+	size := int64(len(data))
+
+	// a header is kept as it is, as it still holds for the records left
+	_, start, err := readSegmentHeader(f, size)
+	if errors.Is(err, ErrCorruptHeader) {
+		rep.Regions++
+		rep.Skipped += start
+	} else if err != nil {
+		return rep, err
+	}
+	var clean bytes.Buffer
+	if err == nil {
+		clean.Write(data[:start])
+	}
+	for offset := start; offset < size; {
+		rec, n, ok := salvageable(f, offset, size)
+		if ok && rec != nil && rec.Op == OpShutdown {
+			offset += n // a repaired log wasn't closed cleanly
+			continue
+		}
+		if ok {
+			clean.Write(data[offset : offset+n])
+			rep.Records++
+			offset += n
+			continue
+		}
+
+		next := resync(f, offset+1, size)
+		if next == size && bytes.Count(data[offset:], []byte{0}) == len(data[offset:]) {
+			break // preallocated, never written
+		}
+		rep.Regions++
+		rep.Skipped += next - offset
+		offset = next
+	}
+
+	if rep.Records == 0 {
+		return rep, nil
+	}
+	return rep, restoreFile(out, &clean)
+}
+
+// salvageable reports whether a frame that can be copied as it is starts
+// at offset, and its length and record. One that only fails to decrypt
+// counts, as its checksum held, with a nil record.
+func salvageable(f *os.File, offset, size int64) (*Record, int64, bool) {
+	rec, n, err := readRecordAt(f, offset, size, 0, nil)
+	if err != nil && !errors.Is(err, ErrUnknownKey) && !errors.Is(err, ErrDecrypt) {
+		return nil, 0, false
+	}
+	return rec, n, true
+}
+
+// resync returns the offset of the first salvageable frame at or after
+// from in a segment of size bytes, or size if there is none. It reads
+// the segment a chunk at a time, looking for the magic.
+func resync(f *os.File, from, size int64) int64 {
+	// every frame magic starts with the same three bytes
+	magic := binary.BigEndian.AppendUint32(nil, recordMagic)[:3]
+	buf := make([]byte, 64*1024)
+
+	for size-from >= int64(len(magic)) {
+		n, err := f.ReadAt(buf[:min(int64(len(buf)), size-from)], from)
+		if n < len(magic) {
+			break
+		}
+		chunk := buf[:n]
+
+		for i := 0; ; {
+			j := bytes.Index(chunk[i:], magic)
+			if j < 0 {
+				break
+			}
+			at := from + int64(i+j)
+			if _, _, ok := salvageable(f, at, size); ok {
+				return at
+			}
+			i += j + 1
+		}
+		if err != nil {
+			break
+		}
+		// the next chunk starts where a magic cut off by this one would
+		from += int64(n - len(magic) + 1)
+	}
+	return size
+}
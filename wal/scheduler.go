@@ -0,0 +1,156 @@
+package wal
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Scheduler flushes many WALs from a single goroutine. Each tick writes
+// every WAL's buffer first and fsyncs afterwards, so the syncs of WALs on
+// the same disk line up instead of interleaving with writes.
+//
+// WALs opened without Options.Scheduler use a shared scheduler for their
+// flush interval; pass one explicitly to group WALs on your own terms.
+type Scheduler struct {
+	mu    sync.Mutex // held for a whole flush pass
+	wals  map[*WAL]struct{}
+	every time.Duration
+
+	stopCh    chan struct{}
+	stoppedCh chan struct{}
+	stopped   bool
+}
+
+func NewScheduler(every time.Duration) (*Scheduler, error) {
+	if every <= 0 {
+		return nil, errors.New("scheduler: flush interval must be positive")
+	}
+
+	s := &Scheduler{
+		wals:      make(map[*WAL]struct{}),
+		every:     every,
+		stopCh:    make(chan struct{}),
+		stoppedCh: make(chan struct{}),
+	}
+
+	go s.loop()
+	return s, nil
+}
+
+func (s *Scheduler) add(w *WAL) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return errors.New("scheduler is stopped")
+	}
+
+	s.wals[w] = struct{}{}
+	return nil
+}
+
+// remove returns once no flush pass is touching w anymore.
+func (s *Scheduler) remove(w *WAL) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.wals, w)
+}
+
+// Len returns the number of WALs currently driven by the scheduler.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.wals)
+}
+
+func (s *Scheduler) loop() {
+	ticker := time.NewTicker(s.every)
+	defer ticker.Stop()
+	defer close(s.stoppedCh)
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flushAll()
+
+		case <-s.stopCh:
+			s.flushAll()
+			return
+		}
+	}
+}
+
+func (s *Scheduler) flushAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for w := range s.wals {
+		w.writeBuffer()
+	}
+	for w := range s.wals {
+		w.syncIfDue()
+	}
+}
+
+// Stop flushes every registered WAL one last time and stops the
+// scheduler. WALs still registered must be closed by their owners.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	s.mu.Unlock()
+
+	close(s.stopCh)
+	<-s.stoppedCh
+}
+
+// shared holds one scheduler per flush interval for WALs that didn't ask
+// for a specific one. Schedulers stop once their last WAL is closed.
+var shared = struct {
+	sync.Mutex
+	byInterval map[time.Duration]*Scheduler
+	refs       map[*Scheduler]int
+}{
+	byInterval: make(map[time.Duration]*Scheduler),
+	refs:       make(map[*Scheduler]int),
+}
+
+func acquireShared(every time.Duration) (*Scheduler, error) {
+	shared.Lock()
+	defer shared.Unlock()
+
+	if s, ok := shared.byInterval[every]; ok {
+		shared.refs[s]++
+		return s, nil
+	}
+
+	s, err := NewScheduler(every)
+	if err != nil {
+		return nil, err
+	}
+
+	shared.byInterval[every] = s
+	shared.refs[s] = 1
+	return s, nil
+}
+
+func releaseShared(s *Scheduler) {
+	shared.Lock()
+	shared.refs[s]--
+	last := shared.refs[s] == 0
+	if last {
+		delete(shared.refs, s)
+		delete(shared.byInterval, s.every)
+	}
+	shared.Unlock()
+
+	if last {
+		s.Stop()
+	}
+}
@@ -0,0 +1,259 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// segmentID parses the id out of a segment file name, reporting false
+// for anything that isn't one.
+func segmentID(path string) (int, bool) {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, "wal-") || !strings.HasSuffix(name, ".log") {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "wal-"), ".log"))
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// lastSegmentID returns the highest segment id in dir, or 0 if there are
+// none yet.
+func lastSegmentID(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	last := 0
+	for _, e := range entries {
+		if id, ok := segmentID(e.Name()); ok && !e.IsDir() {
+			last = max(last, id)
+		}
+	}
+	return last, nil
+}
+
+// segmentExpired reports whether the active segment was first written to
+// maxAge or more ago. An empty segment never expires, so an idle WAL
+// doesn't pile up empty ones. Caller holds w.mu.
+func (w *WAL) segmentExpired() bool {
+	return w.maxAge > 0 && !w.segmentStart.IsZero() && time.Since(w.segmentStart) >= w.maxAge
+}
+
+// Rotate writes out the buffer, fsyncs and closes the active segment and
+// starts a new one. It returns the id of the new active segment.
+func (w *WAL) Rotate() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if w.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if err := w.writeBufferLocked(); err != nil {
+		return 0, err
+	}
+	if err := w.rotateLocked(); err != nil {
+		return 0, err
+	}
+
+	return w.segmentID, nil
+}
+
+// rotateLocked syncs and closes the active segment and opens the next
+// one. Caller holds w.mu.
+func (w *WAL) rotateLocked() error {
+	// a sealed segment's size is its end, for Backup and Stats
+	if w.preallocate {
+		if err := w.file.Truncate(w.offset); err != nil {
+			return err
+		}
+	}
+	if err := w.syncLocked(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	w.segmentID++
+	w.segmentStart = time.Time{}
+	if err := w.openSegment(); err != nil {
+		return err
+	}
+
+	// retention counts segments, so a new one may free an old one
+	return w.removeObsoleteLocked()
+}
+
+// createSegment creates the segment file at path, starting with its
+// header and, with Preallocate, MaxSegmentSize long. The file is set up
+// under another name and renamed into place, so a crash part way never
+// leaves a segment without its header, or one holding a reused file's
+// old records.
+func (w *WAL) createSegment(path string) (*os.File, error) {
+	f, from, err := w.openSpare(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := SegmentHeader{Version: segmentFormat, Created: time.Now(), FirstLSN: w.lsn + 1}
+	err = f.Truncate(0)
+	if err == nil && w.preallocate {
+		err = preallocate(f, w.maxSize)
+	}
+	if err == nil {
+		_, err = f.WriteAt(appendSegmentHeader(nil, hdr), 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(from, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
+
+// Truncate marks every segment holding only records before lsn as no
+// longer needed, typically once a checkpoint covers them, and deletes
+// those the retention policy doesn't keep. Segments kept for now are
+// deleted by later rotations as they fall out of the retention window.
+// The active segment is never removed.
+func (w *WAL) Truncate(beforeLSN uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
+	before, err := w.segmentBeforeLocked(beforeLSN)
+	if err != nil {
+		return err
+	}
+
+	w.obsolete = max(w.obsolete, before)
+	return w.removeObsoleteLocked()
+}
+
+// segmentBeforeLocked returns the id of the newest segment such that
+// every segment before it holds only records before lsn. A segment's
+// records all come before the first LSN of any later segment. Caller
+// holds w.mu.
+func (w *WAL) segmentBeforeLocked(lsn uint64) (int, error) {
+	if lsn > w.lsn {
+		return w.segmentID, nil
+	}
+
+	files, err := w.segmentFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	before := 0
+	for _, path := range files {
+		id, _ := segmentID(path)
+
+		first, err := w.firstLSN(path)
+		if err != nil {
+			return 0, err
+		}
+		if first == 0 || first > lsn {
+			continue
+		}
+		before = id
+	}
+	return before, nil
+}
+
+// removeObsoleteLocked deletes obsolete segments outside the retention
+// window. Caller holds w.mu.
+func (w *WAL) removeObsoleteLocked() error {
+	if w.obsolete == 0 {
+		return nil
+	}
+
+	files, err := w.segmentFiles()
+	if err != nil {
+		return err
+	}
+
+	// walk back from the newest to find where the window starts
+	var kept int
+	var keptBytes int64
+	cut := 0
+	for i := len(files) - 1; i >= 0; i-- {
+		id, _ := segmentID(files[i])
+
+		retained := kept < w.retention.KeepSegments || keptBytes < w.retention.KeepBytes
+		if id < w.obsolete && !retained {
+			cut = i + 1
+			break
+		}
+
+		size, err := w.segmentSizeLocked(files[i])
+		if err != nil {
+			return err
+		}
+		kept++
+		keptBytes += size
+	}
+
+	// oldest first, so a failure part way never leaves a gap
+	for _, path := range files[:cut] {
+		if err := w.retireSegment(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveSegmentsBefore deletes every segment older than id. The active
+// segment is never removed.
+func (w *WAL) RemoveSegmentsBefore(id int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	id = min(id, w.segmentID)
+
+	files, err := w.segmentFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		if sid, ok := segmentID(path); ok && sid < id {
+			if err := w.retireSegment(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
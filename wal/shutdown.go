@@ -0,0 +1,30 @@
+package wal
+
+// Crashed reports whether the log was last left by something other than
+// Close: a crash, a kill or a power cut. Close ends the log with an
+// OpShutdown marker, which Open looks for and removes, so it is false
+// for a log closed cleanly, a new one and a read-only WAL, which doesn't
+// look. The records themselves are recovered the same either way; a
+// crash only means the tail was written without an orderly stop, so that
+// callers can log it or check the recovered state more closely.
+func (w *WAL) Crashed() bool {
+	return w.crashed
+}
+
+// checkShutdownLocked repairs the active segment's tail and removes the
+// shutdown marker Close left at its end, noting in w.crashed if there
+// was none. A new log has nothing to have crashed. Caller holds w.mu.
+func (w *WAL) checkShutdownLocked(isNew bool) error {
+	rep, seg, err := w.repairTailLocked()
+	w.tailRepair = rep
+	if err != nil {
+		return err
+	}
+
+	// a marker followed by a torn write means something wrote after Close
+	if seg.marker < 0 || rep.Dropped > 0 {
+		w.crashed = !isNew
+		return nil
+	}
+	return w.truncateLocked(seg.marker)
+}
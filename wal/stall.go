@@ -0,0 +1,117 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrWriteStall is returned by Append when the buffer has held
+// Options.MaxBufferedBytes for longer than Options.StallTimeout, which
+// means flushing isn't keeping up with writes, typically because the
+// disk is slow. The record was not logged.
+var ErrWriteStall = errors.New("wal: write stalled, flushing is not keeping up")
+
+// ErrBufferFull is returned by Append under BufferFail when the buffer
+// holds Options.MaxBufferedBytes. The record was not logged.
+var ErrBufferFull = errors.New("wal: buffer full")
+
+// BufferPolicy is what an Append finding the buffer full does, see
+// Options.MaxBufferedBytes. Either way it starts a flush first.
+type BufferPolicy uint8
+
+const (
+	// BufferBlock waits until a flush makes room, or fails with
+	// ErrWriteStall once Options.StallTimeout has passed, if it is set.
+	BufferBlock BufferPolicy = iota
+
+	// BufferFail fails at once with ErrBufferFull.
+	BufferFail
+)
+
+func (p BufferPolicy) String() string {
+	switch p {
+	case BufferBlock:
+		return "block"
+	case BufferFail:
+		return "fail"
+	}
+	return fmt.Sprintf("BufferPolicy(%d)", p)
+}
+
+// ParseBufferPolicy parses the String form of a policy: "block" or
+// "fail".
+func ParseBufferPolicy(s string) (BufferPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "block":
+		return BufferBlock, nil
+	case "fail":
+		return BufferFail, nil
+	}
+	return 0, fmt.Errorf("unknown buffer policy %q (want block or fail)", s)
+}
+
+// stallPoll is how often a stalled Append checks for room.
+const stallPoll = time.Millisecond
+
+// stallCounters are kept outside w.mu: a stalled Append counts itself
+// while a flush holds the lock.
+type stallCounters struct {
+	count    atomic.Uint64
+	timeouts atomic.Uint64
+	nanos    atomic.Int64
+}
+
+// lockForAppend takes w.mu for an Append. With a buffer limit set and
+// the buffer full, it starts a flush rather than wait for the next tick
+// and, under BufferFail, gives up at once with ErrBufferFull. Otherwise
+// it waits for room, up to stallTimeout if that is set, then gives up
+// with ErrWriteStall. The wait doesn't queue on w.mu, which a flush to a
+// slow disk holds throughout, so the timeout holds however slow the disk
+// is.
+func (w *WAL) lockForAppend() error {
+	if w.maxBuffered == 0 || w.buffered.Load() < int64(w.maxBuffered) {
+		w.mu.Lock()
+		return nil
+	}
+
+	start := time.Now()
+	w.stalls.count.Add(1)
+	defer func() { w.stalls.nanos.Add(int64(time.Since(start))) }()
+
+	if w.kicking.CompareAndSwap(false, true) {
+		go w.kickFlush()
+	}
+	if w.bufferPolicy == BufferFail {
+		w.stalls.timeouts.Add(1)
+		return ErrBufferFull
+	}
+	for {
+		if w.buffered.Load() < int64(w.maxBuffered) && w.mu.TryLock() {
+			if len(w.buffer) < w.maxBuffered {
+				return nil
+			}
+			w.mu.Unlock()
+		}
+		if w.stallTimeout > 0 && time.Since(start) >= w.stallTimeout {
+			w.stalls.timeouts.Add(1)
+			return ErrWriteStall
+		}
+		time.Sleep(stallPoll)
+	}
+}
+
+// kickFlush writes the buffer out ahead of the flush interval. An error
+// is left for the scheduled flush to report.
+func (w *WAL) kickFlush() {
+	defer w.kicking.Store(false)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.closed && w.file != nil {
+		w.writeBufferLocked()
+	}
+}
@@ -0,0 +1,157 @@
+package wal
+
+import (
+	"slices"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the latency histogram buckets,
+// from a page-cache write to a stalled disk.
+var latencyBounds = []time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Histogram counts durations into buckets. Counts[i] is the number of
+// observations at or below Bounds[i] and above the bound before it; the
+// last count is for everything above the last bound.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+func newLatencyHistogram() Histogram {
+	return Histogram{
+		Bounds: latencyBounds,
+		Counts: make([]uint64, len(latencyBounds)+1),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(h.Bounds, d)
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+func (h Histogram) clone() Histogram {
+	h.Counts = slices.Clone(h.Counts)
+	return h
+}
+
+// SlowOpThreshold is how long a buffer write or fsync has to take to be
+// listed in Stats.SlowOps.
+const SlowOpThreshold = 50 * time.Millisecond
+
+// maxSlowOps is how many of the most recent slow operations are kept.
+const maxSlowOps = 32
+
+// SlowOp is one buffer write or fsync that took SlowOpThreshold or more.
+type SlowOp struct {
+	Op       string // "flush" or "sync"
+	At       time.Time
+	Duration time.Duration
+	Bytes    int64 // bytes written, or made durable by the sync
+}
+
+// Stats is a snapshot of what a WAL has done since it was opened.
+type Stats struct {
+	Appends       uint64 // records appended, replicated ones included
+	BytesWritten  int64  // bytes handed to the OS
+	BufferedBytes int    // appended but not yet written
+	Flushes       uint64 // buffer writes
+	Syncs         uint64 // fsyncs
+	LastFlush     time.Time
+	Segments      int
+	SegmentBytes  int64 // size of the segment files on disk
+
+	FlushLatency Histogram // time to write the buffer to the OS
+	SyncLatency  Histogram // time to fsync
+	SlowOps      []SlowOp  // the most recent slow ones, oldest first
+
+	// Appends held up by a full buffer, see Options.MaxBufferedBytes,
+	// how long they waited in all, and how many gave up with
+	// ErrWriteStall or, under BufferFail, ErrBufferFull.
+	Stalls        uint64
+	StallTime     time.Duration
+	StallTimeouts uint64
+}
+
+// counters are the parts of Stats kept up as the WAL runs. Guarded by
+// the WAL's mu.
+type counters struct {
+	appends      uint64
+	flushes      uint64
+	syncs        uint64
+	lastFlush    time.Time
+	flushLatency Histogram
+	syncLatency  Histogram
+	slowOps      []SlowOp
+}
+
+func newCounters() counters {
+	return counters{
+		flushLatency: newLatencyHistogram(),
+		syncLatency:  newLatencyHistogram(),
+	}
+}
+
+// slow keeps op if it took SlowOpThreshold or more.
+func (c *counters) slow(op string, start time.Time, d time.Duration, bytes int64) {
+	if d < SlowOpThreshold {
+		return
+	}
+	if len(c.slowOps) == maxSlowOps {
+		c.slowOps = append(c.slowOps[:0], c.slowOps[1:]...)
+	}
+	c.slowOps = append(c.slowOps, SlowOp{Op: op, At: start, Duration: d, Bytes: bytes})
+}
+
+func (w *WAL) Stats() (Stats, error) {
+	files, err := w.segmentFiles()
+	if err != nil {
+		return Stats{}, err
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	// what the segments hold, not the space preallocated for them
+	var size int64
+	for _, path := range files {
+		if n, err := w.segmentSizeLocked(path); err == nil {
+			size += n
+		}
+	}
+
+	c := w.counters
+	return Stats{
+		Appends:       c.appends,
+		BytesWritten:  w.written,
+		BufferedBytes: len(w.buffer),
+		Flushes:       c.flushes,
+		Syncs:         c.syncs,
+		LastFlush:     c.lastFlush,
+		Segments:      len(files),
+		SegmentBytes:  size,
+		FlushLatency:  c.flushLatency.clone(),
+		SyncLatency:   c.syncLatency.clone(),
+		SlowOps:       slices.Clone(c.slowOps),
+		Stalls:        w.stalls.count.Load(),
+		StallTime:     time.Duration(w.stalls.nanos.Load()),
+		StallTimeouts: w.stalls.timeouts.Load(),
+	}, nil
+}
@@ -0,0 +1,260 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs after every flush. A write is on disk once the flush
+	// that carried it returns. This is the default.
+	SyncAlways SyncMode = iota
+
+	// SyncEveryBytes fsyncs once Bytes have been written since the last
+	// fsync. A crash can lose up to Bytes of flushed writes.
+	SyncEveryBytes
+
+	// SyncInterval fsyncs at most once per Interval. A crash can lose up to
+	// Interval (plus one flush interval) of writes.
+	SyncInterval
+
+	// SyncNever leaves syncing to the operating system. Writes survive a
+	// process crash but not a power loss or kernel panic.
+	SyncNever
+)
+
+// SyncPolicy controls when flushed data is fsynced. The zero value is
+// SyncAlways.
+type SyncPolicy struct {
+	Mode     SyncMode
+	Bytes    int64         // for SyncEveryBytes
+	Interval time.Duration // for SyncInterval
+}
+
+func (p SyncPolicy) validate() error {
+	switch p.Mode {
+	case SyncAlways, SyncNever:
+	case SyncEveryBytes:
+		if p.Bytes <= 0 {
+			return fmt.Errorf("sync policy: byte threshold must be positive")
+		}
+	case SyncInterval:
+		if p.Interval <= 0 {
+			return fmt.Errorf("sync policy: interval must be positive")
+		}
+	default:
+		return fmt.Errorf("sync policy: unknown mode %d", p.Mode)
+	}
+
+	return nil
+}
+
+func (p SyncPolicy) String() string {
+	switch p.Mode {
+	case SyncAlways:
+		return "always"
+	case SyncEveryBytes:
+		return fmt.Sprintf("bytes:%d", p.Bytes)
+	case SyncInterval:
+		return fmt.Sprintf("interval:%v", p.Interval)
+	case SyncNever:
+		return "never"
+	}
+
+	return fmt.Sprintf("SyncMode(%d)", p.Mode)
+}
+
+// ParseSyncPolicy parses the String form of a policy: "always", "never",
+// "bytes:<n>" or "interval:<duration>".
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	mode, arg, _ := strings.Cut(strings.ToLower(strings.TrimSpace(s)), ":")
+
+	var p SyncPolicy
+	switch mode {
+	case "always":
+		p.Mode = SyncAlways
+	case "never":
+		p.Mode = SyncNever
+	case "bytes":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("sync policy %q: %v", s, err)
+		}
+		p = SyncPolicy{Mode: SyncEveryBytes, Bytes: n}
+	case "interval":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return p, fmt.Errorf("sync policy %q: %v", s, err)
+		}
+		p = SyncPolicy{Mode: SyncInterval, Interval: d}
+	default:
+		return p, fmt.Errorf("unknown sync policy %q", s)
+	}
+
+	return p, p.validate()
+}
+
+// shouldSync reports whether unsynced data must be fsynced now.
+// Caller holds w.mu.
+func (w *WAL) shouldSync() bool {
+	if w.unsynced == 0 {
+		return false
+	}
+
+	switch w.syncPolicy.Mode {
+	case SyncEveryBytes:
+		return w.unsynced >= w.syncPolicy.Bytes
+	case SyncInterval:
+		return time.Since(w.lastSync) >= w.syncPolicy.Interval
+	case SyncNever:
+		return false
+	}
+
+	return true
+}
+
+// syncLocked fsyncs the active segment. Caller holds w.mu.
+func (w *WAL) syncLocked() error {
+	start := time.Now()
+	w.faults.delay(w.faults.SyncLatency)
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	took := time.Since(start)
+	w.counters.syncs++
+	w.counters.syncLatency.observe(took)
+	w.counters.slow("sync", start, took, w.written-w.durable)
+
+	w.unsynced = 0
+	w.lastSync = time.Now()
+	w.durable = w.written
+	return nil
+}
+
+// Sync writes out the buffer and fsyncs it whatever the sync policy, so
+// everything appended so far is durable when it returns.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if err := w.faults.fail(); err != nil {
+		return err
+	}
+
+	if err := w.writeBufferLocked(); err != nil {
+		return err
+	}
+	return w.syncUnlocked()
+}
+
+// syncUnlocked fsyncs what has been written so far without holding w.mu
+// through it, so Appends fill the buffer while the disk works on what
+// was written before: the buffer and the written data waiting on the
+// fsync are the two halves of a double buffer. Caller holds w.mu, which
+// is given up for the fsync and held again when it returns, so the WAL
+// may have moved on meanwhile. Concurrent calls queue on syncMu; each
+// writes out what was appended while it waited, so one fsync covers
+// them all and the rest find nothing left to do.
+func (w *WAL) syncUnlocked() error {
+	w.mu.Unlock()
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+
+	if w.file == nil {
+		return nil // closed meanwhile, which synced
+	}
+	if err := w.writeBufferLocked(); err != nil {
+		return err
+	}
+	target, file, faults := w.written, w.file, w.faults
+	if w.durable >= target {
+		return nil
+	}
+
+	w.mu.Unlock()
+	start := time.Now()
+	faults.delay(faults.SyncLatency)
+	err := file.Sync()
+	w.mu.Lock()
+
+	if errors.Is(err, os.ErrClosed) {
+		return nil // rotated or closed meanwhile, after an fsync under w.mu
+	}
+	if err != nil {
+		return err
+	}
+	took := time.Since(start)
+	w.counters.syncs++
+	w.counters.syncLatency.observe(took)
+	w.counters.slow("sync", start, took, target-w.durable)
+	w.lastSync = time.Now()
+	w.durable = max(w.durable, target)
+	w.unsynced = w.written - w.durable
+	return nil
+}
+
+// WaitDurableCtx is WaitDurable that gives up when ctx is done. An fsync
+// already under way carries on, so the records before pos may still
+// become durable; the caller just can't count on it.
+func (w *WAL) WaitDurableCtx(ctx context.Context, pos int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- w.WaitDurable(pos) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Position returns the logical offset just past the last appended record.
+// Pass it to WaitDurable to wait for that record and everything before it.
+func (w *WAL) Position() int64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.written + int64(len(w.buffer))
+}
+
+// WaitDurable returns once everything before pos is fsynced, syncing now
+// if nothing else has. This is group commit: one fsync covers every
+// record appended before it, so concurrent callers whose records went
+// into the same fsync all return without issuing their own.
+func (w *WAL) WaitDurable(pos int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.durable >= pos {
+		return nil
+	}
+	if w.closed {
+		return ErrClosed
+	}
+	if err := w.faults.fail(); err != nil {
+		return err
+	}
+
+	if err := w.writeBufferLocked(); err != nil {
+		return err
+	}
+	return w.syncUnlocked()
+}
@@ -0,0 +1,95 @@
+package wal
+
+import (
+	"path/filepath"
+)
+
+// TailRepair is what RepairTail cut off the end of the log.
+type TailRepair struct {
+	Segment string // name of the active segment
+	Offset  int64  // where its valid records end, and it was cut
+	Dropped int64  // bytes cut off, 0 if the tail was intact
+}
+
+// RepairTail cuts the active segment back to the end of its last valid
+// record, dropping what a write torn by a crash left after it, so that
+// new records don't land behind bytes replay stops at. With
+// RecoverySalvage the cut is after the last record replay can reach, so
+// only a tail with nothing intact in it goes. OpenWithOptions runs it,
+// and TailRepaired reports what it cut; reading the log never changes
+// it.
+func (w *WAL) RepairTail() (TailRepair, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.readOnly {
+		return TailRepair{}, ErrReadOnly
+	}
+	if w.closed {
+		return TailRepair{}, ErrClosed
+	}
+	if err := w.writeBufferLocked(); err != nil {
+		return TailRepair{}, err
+	}
+	rep, _, err := w.repairTailLocked()
+	return rep, err
+}
+
+// TailRepaired returns what OpenWithOptions cut off the active segment.
+func (w *WAL) TailRepaired() TailRepair {
+	return w.tailRepair
+}
+
+// repairTailLocked is RepairTail with nothing buffered, also returning
+// what the scan of the segment found. Caller holds w.mu.
+func (w *WAL) repairTailLocked() (TailRepair, segmentStats, error) {
+	rep := TailRepair{Segment: filepath.Base(w.file.Name())}
+
+	info, err := w.file.Stat()
+	if err != nil {
+		return rep, segmentStats{}, err
+	}
+	_, seg, err := replayPrefix(w.file, info.Size(), w.maxRecord, w.keys, w.recovery, nil, func(*Record) error { return nil })
+	if err != nil {
+		return rep, seg, err
+	}
+
+	rep.Offset = seg.end
+	w.offset = seg.end
+
+	// preallocated space is left for the records to come, unless what
+	// follows the zeros shows they are a torn write's
+	garbage := info.Size() - seg.end
+	if seg.unused > 0 {
+		clean, err := zeroed(w.file, info.Size()-seg.unused, info.Size())
+		if err != nil {
+			return rep, seg, err
+		}
+		if clean {
+			garbage -= seg.unused
+		}
+	}
+	if garbage == 0 {
+		return rep, seg, nil
+	}
+	if err := w.truncateLocked(seg.end); err != nil {
+		return rep, seg, err
+	}
+	rep.Dropped = garbage
+	return rep, seg, nil
+}
+
+// truncateLocked cuts the active segment down to size, durably, giving
+// a preallocated one its space back.
+func (w *WAL) truncateLocked(size int64) error {
+	if err := w.file.Truncate(size); err != nil {
+		return err
+	}
+	if w.preallocate {
+		if err := preallocate(w.file, w.maxSize); err != nil {
+			return err
+		}
+	}
+	w.offset = size
+	return w.file.Sync()
+}
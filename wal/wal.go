@@ -1,82 +1,539 @@
 package wal
 
 import (
+	"cmp"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type WAL struct {
-	mu     sync.Mutex
+	mu     sync.RWMutex // read-locked by LastLSN, Position and Stats
 	dir    string
 	file   *os.File // log file
 	buffer []byte   // for batching
 
-	segmentID int
-	maxSize   int64
+	// flow control, see lockForAppend
+	maxBuffered  int           // Append waits while the buffer holds this much, 0 for no limit
+	bufferPolicy BufferPolicy  // or fails at once, see Options.BufferPolicy
+	stallTimeout time.Duration // and fails with ErrWriteStall after this long, if set
+	buffered     atomic.Int64  // len(buffer), readable without mu
+	kicking      atomic.Bool   // a kickFlush is under way
+	stalls       stallCounters
+
+	segmentID    int
+	offset       int64 // where the next write goes in the active segment
+	maxSize      int64
+	maxRecord    int64         // bytes of frame data, see Options.MaxRecordSize
+	maxAge       time.Duration // rotate segments older than this, 0 for no limit
+	segmentStart time.Time     // first write to the active segment, zero while empty
+
+	preallocate bool // see Options.Preallocate
+
+	syncPolicy SyncPolicy
+	unsynced   int64 // bytes written since the last fsync
+	lastSync   time.Time
+
+	syncMu sync.Mutex // queues fsyncs made outside mu, see syncUnlocked
+
+	// Logical byte positions since open: everything before written has
+	// been handed to the OS, everything before durable has been fsynced.
+	written int64
+	durable int64
 
 	flushEvery time.Duration
-	stopCh     chan struct{}
-	stoppedCh  chan struct{}
+	scheduler  *Scheduler // flushes this WAL on every tick; nil if flushEvery is 0
+	shared     bool       // scheduler came from the shared pool
+	reloadMu   sync.Mutex // serialises Reload's scheduler moves
+
+	faults Faults
+	origin string // stamped on records that don't name one
+
+	compression Compression
+	keys        *keyring // nil unless records are encrypted
+	scratch     []byte   // uncompressed record, reused between appends
+
+	recovery RecoveryMode // what replay does at a corrupt record
+
+	lsn  uint64 // last LSN in this log
+	lsns *LSNs  // hands out Append's LSNs, see Options.LSNs
 
-	closed bool
+	tailRepair TailRepair // what Open cut off the active segment
+	crashed    bool       // Open found no shutdown marker, see Crashed
+
+	retention Retention
+	obsolete  int            // segments before this id may be deleted, see Truncate
+	readers   int            // open Readers, Snapshots and Backups, see retireSegment
+	tailing   map[string]int // segments tailing Readers have open, see Tail
+
+	counters counters // see Stats
+
+	lock     *os.File // holds the directory's lock, see lockDir; nil if read-only
+	readOnly bool     // see OpenReadOnly
+	closed   bool
+}
+
+// ErrReadOnly is returned by the writes of a WAL opened with OpenReadOnly.
+var ErrReadOnly = errors.New("wal: opened read-only")
+
+// ErrClosed is returned by the writes of a WAL after Close.
+var ErrClosed = errors.New("wal: closed")
+
+// ErrRecordTooLarge is returned by Append for a record whose frame is
+// over Options.MaxRecordSize, and nothing is logged. Open and the
+// readers of the log return it for an intact record over the limit,
+// written while it was higher, rather than cut the log at it.
+var ErrRecordTooLarge = errors.New("wal: record too large")
+
+// ErrDurabilityUnknown is returned by Append and AppendReplicated when
+// the record was written to the segment but the fsync after it failed.
+// The record is logged under its LSN, and replay will read it back if
+// the OS kept it, so it can't be taken as not written; whether it would
+// survive a crash is unknown.
+var ErrDurabilityUnknown = errors.New("wal: record written, but the sync after it failed; its durability is unknown")
+
+// Logged reports whether an Append or AppendReplicated that returned err
+// logged its record: err is nil or ErrDurabilityUnknown.
+func Logged(err error) bool {
+	return err == nil || errors.Is(err, ErrDurabilityUnknown)
 }
 
+// Open opens the WAL in dir with default options otherwise. It is a thin
+// wrapper around OpenWithOptions.
 func Open(dir string, flushEvery time.Duration, maxSize int64) (*WAL, error) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	return OpenWithOptions(Options{
+		Dir:            dir,
+		FlushEvery:     flushEvery,
+		MaxSegmentSize: maxSize,
+	})
+}
+
+// OpenWithOptions opens the WAL in opts.Dir, creating the directory if
+// needed. It locks the directory until Close, and fails with ErrLocked if
+// another WAL has it open, in this process or another.
+func OpenWithOptions(opts Options) (_ *WAL, err error) {
+	opts.setDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			lock.Close()
+		}
+	}()
+
+	keys, err := newKeyring(opts.EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	lsns := cmp.Or(opts.LSNs, new(LSNs))
+	if err := lsns.join(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			lsns.leave()
+		}
+	}()
+
+	last, err := lastSegmentID(opts.Dir)
+	if err != nil {
 		return nil, err
 	}
 
 	w := &WAL{
-		dir:        dir,
-		buffer:     make([]byte, 0, 4096),
-		segmentID:  1,
-		maxSize:    maxSize,
-		flushEvery: flushEvery,
-		stopCh:     make(chan struct{}),
-		stoppedCh:  make(chan struct{}),
+		dir:         opts.Dir,
+		buffer:      make([]byte, 0, opts.BufferSize),
+		segmentID:   max(last, 1), // keep appending to the newest segment
+		maxSize:     opts.MaxSegmentSize,
+		maxRecord:   opts.MaxRecordSize,
+		maxAge:      opts.MaxSegmentAge,
+		preallocate: opts.Preallocate,
+		syncPolicy:  opts.SyncPolicy,
+		lastSync:    time.Now(),
+		flushEvery:  opts.FlushEvery,
+		scheduler:   opts.Scheduler,
+		faults:      opts.Faults,
+		origin:      opts.Origin,
+		retention:   opts.Retention,
+		compression: opts.Compression,
+		keys:        keys,
+		recovery:    opts.Recovery,
+		lsns:        lsns,
+		counters:    newCounters(),
+		lock:        lock,
+
+		maxBuffered:  opts.MaxBufferedBytes,
+		bufferPolicy: opts.BufferPolicy,
+		stallTimeout: opts.StallTimeout,
 	}
 
 	if err := w.openSegment(); err != nil {
 		return nil, err
 	}
+	if err := w.checkShutdownLocked(last == 0); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	// a reopened segment that has records ages from now
+	if _, start, _ := readSegmentHeader(w.file, w.offset); w.offset > start {
+		w.segmentStart = time.Now()
+	}
+
+	if w.lsn, err = w.findLastLSN(); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	w.lsns.observe(w.lsn)
+
+	// WALs with the same interval share one flush goroutine; with no
+	// interval, Append writes through and there is none
+	if w.scheduler == nil && w.flushEvery > 0 {
+		sched, err := acquireShared(w.flushEvery)
+		if err != nil {
+			w.file.Close()
+			return nil, err
+		}
+		w.scheduler = sched
+		w.shared = true
+	}
+
+	if w.scheduler != nil {
+		if err := w.scheduler.add(w); err != nil {
+			w.file.Close()
+			if w.shared {
+				releaseShared(w.scheduler)
+			}
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// OpenReadOnly opens the WAL in opts.Dir to read the log as it is on
+// disk, such as that of a process still writing it, without risk to it:
+// it creates no files, keeps none open but while reading, and starts no
+// flush goroutine. Append and the other writes fail with ErrReadOnly.
+// Only Dir, EncryptionKeys, Recovery and MaxRecordSize of opts are used. A record the owner is
+// part way through writing reads as the end of the log.
+func OpenReadOnly(opts Options) (*WAL, error) {
+	info, err := os.Stat(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", opts.Dir)
+	}
+
+	keys, err := newKeyring(opts.EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	last, err := lastSegmentID(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
 
-	go w.flushLoop()
+	w := &WAL{
+		dir:       opts.Dir,
+		segmentID: max(last, 1),
+		maxRecord: cmp.Or(opts.MaxRecordSize, DefaultMaxRecordSize),
+		keys:      keys,
+		recovery:  opts.Recovery,
+		lsns:      new(LSNs),
+		counters:  newCounters(),
+		readOnly:  true,
+	}
+	if w.lsn, err = w.findLastLSN(); err != nil {
+		return nil, err
+	}
+	w.lsns.observe(w.lsn)
 	return w, nil
 }
 
-func (w *WAL) Append(r *Record) error {
+// Tunables are the WAL settings that can be changed on a live WAL
+// without reopening it or replaying the log.
+type Tunables struct {
+	FlushEvery     time.Duration
+	MaxSegmentSize int64
+	MaxSegmentAge  time.Duration // 0 rotates on size alone
+	SyncPolicy     SyncPolicy
+}
+
+// Tunables returns the settings currently in effect.
+func (w *WAL) Tunables() Tunables {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return Tunables{
+		FlushEvery:     w.flushEvery,
+		MaxSegmentSize: w.maxSize,
+		MaxSegmentAge:  w.maxAge,
+		SyncPolicy:     w.syncPolicy,
+	}
+}
+
+// Origin returns the origin stamped on records this WAL appends.
+func (w *WAL) Origin() string {
+	return w.origin
+}
+
+func (t Tunables) validate() error {
+	if t.FlushEvery < 0 {
+		return fmt.Errorf("invalid flush interval %v", t.FlushEvery)
+	}
+	if t.MaxSegmentSize <= 0 {
+		return fmt.Errorf("invalid max segment size %d", t.MaxSegmentSize)
+	}
+	if t.MaxSegmentAge < 0 {
+		return fmt.Errorf("invalid max segment age %v", t.MaxSegmentAge)
+	}
+
+	return t.SyncPolicy.validate()
+}
+
+// Reload applies new tunables. A changed flush interval moves the WAL to
+// the shared scheduler for that interval, or off schedulers altogether
+// for an interval of 0, and a changed segment size or age applies on the
+// next flush. The interval of a WAL opened with an explicit Options.Scheduler
+// belongs to that scheduler and is left alone.
+func (w *WAL) Reload(t Tunables) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	w.reloadMu.Lock()
+	defer w.reloadMu.Unlock()
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	if w.readOnly {
+		w.mu.Unlock()
+		return ErrReadOnly
+	}
+
+	w.maxSize = t.MaxSegmentSize
+	w.maxAge = t.MaxSegmentAge
+	w.syncPolicy = t.SyncPolicy
+
+	move := (w.shared || w.scheduler == nil) && t.FlushEvery != w.flushEvery
+	w.mu.Unlock()
+
+	if !move {
+		return nil
+	}
+
+	// a flush pass takes the scheduler lock and then w.mu, so the move
+	// happens without holding w.mu
+	var next *Scheduler
+	if t.FlushEvery > 0 {
+		sched, err := acquireShared(t.FlushEvery)
+		if err != nil {
+			return err
+		}
+		if err := sched.add(w); err != nil {
+			releaseShared(sched)
+			return err
+		}
+		next = sched
+	}
+
+	if prev := w.scheduler; prev != nil {
+		prev.remove(w)
+		releaseShared(prev)
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	w.scheduler = next
+	w.shared = next != nil
+	w.flushEvery = t.FlushEvery
+
+	// appends write through from now on, so write out whatever the old
+	// scheduler left in the buffer
+	if next == nil {
+		return w.flushLocked()
+	}
+	return nil
+}
+
+// Append buffers r and returns the LSN it was logged under. The caller's
+// record is left as it is. With a flush interval of 0 the record is
+// written, and synced if the sync policy says so, before Append returns;
+// if the sync fails the LSN comes back with ErrDurabilityUnknown.
+func (w *WAL) Append(r *Record) (uint64, error) {
+	if err := w.lockForAppend(); err != nil {
+		return 0, err
+	}
+	defer w.mu.Unlock()
+
 	if w.closed {
-		return errors.New("wal is closed")
+		return 0, ErrClosed
+	}
+	if w.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	tagged := *r
+	if tagged.Origin == "" {
+		tagged.Origin = w.origin
+	}
+	if tagged.Timestamp == 0 {
+		tagged.Timestamp = time.Now().UnixNano()
+	}
+	prev := w.lsn
+	w.lsn = w.lsns.next()
+	tagged.LSN = w.lsn
+
+	mark := len(w.buffer)
+	err := w.appendLocked(&tagged)
+	if err == nil {
+		err = w.writeThroughLocked(mark)
+	}
+	w.buffered.Store(int64(len(w.buffer)))
+	if errors.Is(err, ErrDurabilityUnknown) {
+		return w.lsn, err
 	}
-	data, err := encodeRecord(r)
 	if err != nil {
+		w.lsns.giveBack(w.lsn)
+		w.lsn = prev
+		return 0, err
+	}
+	return w.lsn, nil
+}
+
+// writeThroughLocked writes out the record appended at buffer offset
+// mark when there is no flush interval. If the write fails the record is
+// dropped from the buffer, and what of it reached the segment is a torn
+// frame, or chunks short of a record, that replay drops, so the error
+// means it was not logged and its LSN can be handed out again. Once it
+// is all written it is logged, and a failed sync after that returns
+// ErrDurabilityUnknown. Caller holds w.mu.
+func (w *WAL) writeThroughLocked(mark int) error {
+	if w.flushEvery > 0 {
+		return nil
+	}
+	if err := w.faults.fail(); err != nil {
+		w.buffer = w.buffer[:mark]
 		return err
 	}
+	buffered := len(w.buffer)
+	if err := w.writeBufferLocked(); err != nil {
+		// a big record may be split across segments and partly written,
+		// which replay drops; what was written is gone from the buffer
+		w.buffer = w.buffer[:max(mark-(buffered-len(w.buffer)), 0)]
+		return err
+	}
+	if err := w.flushLocked(); err != nil {
+		return fmt.Errorf("%w: %v", ErrDurabilityUnknown, err)
+	}
+	return nil
+}
 
-	length := uint32(len(data))
-	checksum := crc32.ChecksumIEEE(data)
+// flushLocked is flushOnce for callers that hold w.mu and want the error
+// back.
+func (w *WAL) flushLocked() error {
+	if err := w.writeBufferLocked(); err != nil {
+		return err
+	}
+	if w.shouldSync() {
+		return w.syncLocked()
+	}
+	return nil
+}
 
-	var header [12]byte
+// appendLocked frames r onto the buffer, or leaves the buffer as it was
+// with ErrRecordTooLarge if replay wouldn't read the frame back. Caller
+// holds w.mu.
+func (w *WAL) appendLocked(r *Record) error {
+	mark := len(w.buffer)
+	switch {
+	case w.keys != nil:
+		w.buffer, w.scratch = appendFrameEncrypted(w.buffer, r, w.compression, w.keys, w.scratch)
+	case w.compression == CompressionNone:
+		w.buffer = appendFrame(w.buffer, r)
+	default:
+		w.buffer, w.scratch = appendFrameCompressed(w.buffer, r, w.compression, w.scratch)
+	}
 
-	binary.BigEndian.PutUint32(header[0:4], recordMagic)
-	binary.BigEndian.PutUint32(header[4:8], length)
-	binary.BigEndian.PutUint32(header[8:12], checksum)
+	n := int64(len(w.buffer) - mark - 12)
+	if n > w.maxRecord {
+		w.buffer = w.buffer[:mark]
+		return fmt.Errorf("%w: %d bytes framed, limit %d", ErrRecordTooLarge, n, w.maxRecord)
+	}
+	if size := chunkSize(w.maxSize); n > int64(size) {
+		frame := slices.Clone(w.buffer[mark:])
+		w.buffer = appendChunks(w.buffer, frame, mark, size)
+	}
+	w.counters.appends++
+	return nil
+}
 
-	w.buffer = append(w.buffer, header[:]...)
-	w.buffer = append(w.buffer, data...)
+// AppendReplicated buffers a record copied from another WAL under the
+// LSN it already has, so a follower's log numbers records the same way
+// as its primary's and can resume from LastLSN after a restart. The LSN
+// must be above LastLSN, or 0 for state from before the log's first LSN,
+// such as a bootstrap snapshot's, logged without one and leaving LastLSN
+// as it is.
+func (w *WAL) AppendReplicated(r *Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	return nil
+	if w.closed {
+		return ErrClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if r.LSN != 0 && r.LSN <= w.lsn {
+		return fmt.Errorf("replicated LSN %d is not after %d", r.LSN, w.lsn)
+	}
+
+	prev, mark := w.lsn, len(w.buffer)
+	w.lsn = max(w.lsn, r.LSN)
+	err := w.appendLocked(r)
+	if err == nil {
+		err = w.writeThroughLocked(mark)
+	}
+	w.buffered.Store(int64(len(w.buffer)))
+	if err != nil && !errors.Is(err, ErrDurabilityUnknown) {
+		w.lsn = prev
+		return err
+	}
+	w.lsns.observe(w.lsn)
+	return err
+}
+
+// LastLSN returns the LSN of the most recently appended record, or 0 if
+// nothing has been logged yet.
+func (w *WAL) LastLSN() uint64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.lsn
 }
 
 func writeUint32(f *os.File, v uint32) error {
@@ -88,99 +545,279 @@ func writeUint32(f *os.File, v uint32) error {
 }
 
 func (w *WAL) ReadAll() ([]*Record, error) {
-	files, err := w.segmentFiles()
+	records, _, err := w.ReadAllWithStats()
+	return records, err
+}
+
+// ReadStats describes what a full read of the log found.
+type ReadStats struct {
+	Segments     int   // segment files read
+	Records      int   // valid records returned
+	Bytes        int64 // bytes of valid records
+	CorruptBytes int64 // bytes that failed validation and were skipped
+	Resyncs      int   // corrupt stretches RecoverySalvage read on past
+}
+
+// ReadAllWithStats is ReadAll plus a summary of the segments it read.
+func (w *WAL) ReadAllWithStats() ([]*Record, ReadStats, error) {
+	var records []*Record
+
+	stats, err := w.Replay(func(rec *Record) error {
+		records = append(records, rec)
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return nil, stats, err
 	}
 
-	var records []*Record
+	return records, stats, nil
+}
+
+// Replay calls fn for every valid record in log order without holding
+// the whole log in memory, so memory use is bounded by the largest
+// record rather than the log size. An error from fn stops the replay
+// and is returned as is.
+func (w *WAL) Replay(fn func(*Record) error) (ReadStats, error) {
+	var stats ReadStats
 
+	files, err := w.segmentFiles()
+	if err != nil {
+		return stats, err
+	}
+
+	var joined chunks
 	for _, path := range files {
 		f, err := os.Open(path)
 		if err != nil {
-			return nil, err
+			return stats, err
 		}
 
-		recs, err := readAllFromFile(f)
+		n, seg, err := replayFile(f, w.maxRecord, w.keys, w.recovery, &joined, fn)
 		f.Close()
 
+		stats.Records += n
 		if err != nil {
-			return nil, err
+			return stats, err
 		}
 
-		records = append(records, recs...)
+		stats.Segments++
+		stats.Bytes += seg.validBytes
+		stats.CorruptBytes += seg.corruptBytes
+		stats.Resyncs += seg.resyncs
 	}
 
-	return records, nil
+	return stats, nil
 }
 
-func readAllFromFile(f *os.File) ([]*Record, error) {
-	var records []*Record
-	var offset int64 = 0
+type segmentStats struct {
+	validBytes   int64
+	corruptBytes int64
+	resyncs      int
+	end          int64 // just past the last valid record
+	marker       int64 // where the record last read starts if it is an OpShutdown, or -1
+	unused       int64 // preallocated bytes after the last record, see errUnused
+}
+
+// replayFile calls fn for each valid record in f and returns how many
+// it passed on. It only reads f. A record that is intact but can't be decrypted with kr
+// is an error rather than a corrupt tail, so a missing key never costs
+// data. The chunks of big records are joined in joined, which a replay
+// of several segments carries from one to the next; nil joins only a
+// record's chunks within f.
+func replayFile(f *os.File, limit int64, kr *keyring, mode RecoveryMode, joined *chunks, fn func(*Record) error) (int, segmentStats, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, segmentStats{}, err
+	}
+	return replayPrefix(f, info.Size(), limit, kr, mode, joined, fn)
+}
+
+// replayPrefix is replayFile for the first size bytes of f.
+func replayPrefix(f *os.File, size, limit int64, kr *keyring, mode RecoveryMode, joined *chunks, fn func(*Record) error) (int, segmentStats, error) {
+	if joined == nil {
+		joined = new(chunks)
+	}
+	stats := segmentStats{marker: -1}
+	_, offset, err := readSegmentHeader(f, size)
+	if errors.Is(err, ErrCorruptHeader) && mode == RecoverySalvage {
+		// the records after it may well be intact
+		stats.corruptBytes += offset
+		stats.resyncs++
+		err = nil
+	}
+	if err != nil {
+		return 0, stats, err
+	}
+	stats.end = offset
+	count := 0
 
 	for {
-		// read magic
-		magic, err := readUint32At(f, offset)
+		rec, n, err := readRecordAt(f, offset, size, limit, kr)
 		if err != nil {
+			if !errors.Is(err, errBadFrame) {
+				return count, stats, err
+			}
+			if offset >= size {
+				break
+			}
+			if mode == RecoverySalvage {
+				// skip to the next intact record, if there is one
+				if next := resync(f, offset+1, size); next < size {
+					stats.corruptBytes += next - offset
+					stats.resyncs++
+					offset = next
+					continue
+				}
+			}
+			if errors.Is(err, errUnused) {
+				stats.unused = size - offset
+			}
+			// partial write or corruption: the rest is dropped here, and
+			// cut off the active segment by RepairTail
 			break
 		}
 
-		if magic != recordMagic {
-			// garbage or corruption
-			f.Truncate(offset)
-			break
+		stats.marker = -1
+		if rec, err = joined.next(rec, limit, kr); err != nil {
+			return count, stats, err
+		}
+		switch {
+		case rec == nil:
+			// a chunk of a record not yet whole
+		case rec.Op == OpShutdown:
+			stats.marker = offset // Close's, not a record to replay
+		default:
+			if err := fn(rec); err != nil {
+				return count, stats, err
+			}
+			count++
 		}
+		offset += n
+		stats.validBytes += n
+		stats.end = offset
+	}
 
-		offset += 4
+	// everything from the first record that fails validation on is
+	// skipped, and counts as corrupt unless it was never written
+	stats.corruptBytes += size - offset - stats.unused
 
-		// read length
-		length, err := readUint32At(f, offset)
-		if err != nil {
-			f.Truncate(offset - 4)
-			break
-		}
+	return count, stats, nil
+}
 
-		offset += 4
+// errBadFrame is readRecordAt's error at the end of a segment and for
+// anything that fails validation. The errors wrapping it say why, for
+// InspectSegment.
+var (
+	errBadFrame = errors.New("no valid record")
+
+	errBadMagic  = fmt.Errorf("%w: bad magic", errBadFrame)
+	errUnused    = fmt.Errorf("%w: preallocated space, never written", errBadFrame)
+	errTorn      = fmt.Errorf("%w: runs past the end of the segment", errBadFrame)
+	errOversized = fmt.Errorf("%w: length over MaxRecordSize", errBadFrame)
+	errChecksum  = fmt.Errorf("%w: checksum mismatch", errBadFrame)
+	errUndecoded = fmt.Errorf("%w: checksum matches but the record doesn't decode", errBadFrame)
+)
 
-		// read checksum
-		expectedChecksum, err := readUint32At(f, offset)
-		if err != nil {
-			f.Truncate(offset - 8)
-			break
-		}
+// readRecordAt reads the record framed at start in a segment of size
+// bytes and returns it with its framed length. A frame claiming more
+// than limit bytes of data isn't read into memory, 0 taking only the
+// file's size as the limit: if its checksum holds it fails with
+// ErrRecordTooLarge, as it is a record written under a higher limit
+// rather than a torn one, and must not be cut off, and otherwise with
+// errOversized. The length is returned with ErrUnknownKey, ErrDecrypt
+// and ErrRecordTooLarge too, as the frame itself is intact. A chunk
+// comes back as an OpChunk record, for chunks.next to join.
+func readRecordAt(f *os.File, start, size, limit int64, kr *keyring) (*Record, int64, error) {
+	// read magic
+	magic, err := readUint32At(f, start)
+	if err != nil {
+		return nil, 0, errTorn
+	}
+	if magic == 0 {
+		return nil, 0, errUnused // see Options.Preallocate
+	}
+	if !validMagic(magic) && magic != recordMagicChunk {
+		return nil, 0, errBadMagic
+	}
 
-		offset += 4
+	// read length
+	length, err := readUint32At(f, start+4)
+	if err != nil {
+		return nil, 0, errTorn
+	}
 
-		// read data
-		data := make([]byte, length)
-		n, err := f.ReadAt(data, offset)
-		if err != nil || n != int(length) {
-			// partial write or corruption
-			// truncate file to last good offset
-			f.Truncate(offset - 12)
-			break
+	// a torn or corrupt length can claim gigabytes; never allocate
+	// more than a record may take or the file could hold
+	if limit > 0 && int64(length) > limit {
+		if int64(length) <= size-start-12 && frameIntact(f, start, magic, length) {
+			return nil, 12 + int64(length), tooLarge(f, start, int64(length), limit)
 		}
+		return nil, 0, errOversized
+	}
+	if int64(length) > size-start-12 {
+		return nil, 0, errTorn
+	}
 
-		offset += int64(length)
+	// read checksum
+	expectedChecksum, err := readUint32At(f, start+8)
+	if err != nil {
+		return nil, 0, errTorn
+	}
 
-		// verify checksum
-		actualChecksum := crc32.ChecksumIEEE(data)
-		if actualChecksum != expectedChecksum {
-			f.Truncate(offset - int64(length) - 12)
-			break
-		}
+	// read data
+	data := make([]byte, length)
+	n, err := f.ReadAt(data, start+12)
+	if err != nil || n != int(length) {
+		return nil, 0, errTorn
+	}
 
-		rec, err := decodeRecord(data)
-		if err != nil {
-			// corrupt record -> truncate to before this record
-			f.Truncate(offset - int64(length) - 12)
-			break
+	// verify checksum
+	if frameChecksum(magic, length, data) != expectedChecksum {
+		return nil, 0, errChecksum
+	}
+	if magic == recordMagicChunk {
+		if length < chunkHeader {
+			return nil, 0, errUndecoded
 		}
+		return &Record{Op: OpChunk, Value: data}, 12 + int64(length), nil
+	}
 
-		records = append(records, rec)
+	rec, err := decodeFrame(magic, data, kr)
+	if errors.Is(err, ErrUnknownKey) || errors.Is(err, ErrDecrypt) {
+		return nil, 12 + int64(length), err
+	}
+	if err != nil {
+		return nil, 0, errUndecoded
+	}
+
+	return rec, 12 + int64(length), nil
+}
+
+// frameIntact reports whether the checksum of the frame at start holds,
+// reading its data a piece at a time rather than all at once.
+func frameIntact(f *os.File, start int64, magic, length uint32) bool {
+	expected, err := readUint32At(f, start+8)
+	if err != nil {
+		return false
+	}
+	h := crc32.NewIEEE()
+	if magic != legacyMagic && magic != legacyMagicFlagged {
+		var hdr [8]byte
+		binary.BigEndian.PutUint32(hdr[0:4], magic)
+		binary.BigEndian.PutUint32(hdr[4:8], length)
+		h.Write(hdr[:])
 	}
+	if _, err := io.Copy(h, io.NewSectionReader(f, start+12, int64(length))); err != nil {
+		return false
+	}
+	return h.Sum32() == expected
+}
 
-	return records, nil
+// tooLarge is the error for an intact record of length bytes at offset
+// in f, over a limit of limit.
+func tooLarge(f *os.File, offset, length, limit int64) error {
+	return fmt.Errorf("%w: an intact %d byte record at offset %d of %s is over MaxRecordSize (%d); raise it to read the log",
+		ErrRecordTooLarge, length, offset, filepath.Base(f.Name()), limit)
 }
 
 func readUint32At(f *os.File, offset int64) (uint32, error) {
@@ -201,14 +838,50 @@ func (w *WAL) Close() error {
 	}
 	w.closed = true
 	w.mu.Unlock()
+	if !w.readOnly {
+		w.lsns.leave()
+	}
+
+	// once removed, no flush pass can touch w again
+	w.reloadMu.Lock()
+	if w.scheduler != nil {
+		w.scheduler.remove(w)
+		if w.shared {
+			releaseShared(w.scheduler)
+		}
+	}
+	w.reloadMu.Unlock()
 
-	close(w.stopCh)
-	<-w.stoppedCh
+	w.flushOnce()
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	// released last, once nothing more is written
+	if w.lock != nil {
+		defer w.lock.Close()
+	}
+
 	if w.file != nil {
+		// the marker follows everything else, so at the end of the log it
+		// tells Open that nothing was lost; never encrypted, so Repair can
+		// tell it apart from a record without the keys
+		w.buffer = appendFrame(w.buffer, &Record{Op: OpShutdown, Timestamp: time.Now().UnixNano()})
+		if err := w.writeBufferLocked(); err != nil {
+			w.file.Close()
+			w.file = nil
+			return err
+		}
+
+		// a clean close always leaves the log on disk, whatever the policy
+		if w.unsynced > 0 {
+			if err := w.syncLocked(); err != nil {
+				w.file.Close()
+				w.file = nil
+				return err
+			}
+		}
+
 		err := w.file.Close()
 		w.file = nil
 		return err
@@ -221,25 +894,18 @@ func (w *WAL) Flush() {
 	w.flushOnce()
 }
 
-// flush every n ms -> on stop, flush and exit
-func (w *WAL) flushLoop() {
-	ticker := time.NewTicker(w.flushEvery)
-	defer ticker.Stop()
-	defer close(w.stoppedCh)
-
-	for {
-		select {
-		case <-ticker.C:
-			w.flushOnce()
-
-		case <-w.stopCh:
-			w.flushOnce()
-			return
-		}
+func (w *WAL) flushOnce() {
+	if w.readOnly {
+		return // nothing is ever buffered
 	}
+	w.writeBuffer()
+	w.syncIfDue()
 }
 
-func (w *WAL) flushOnce() {
+// writeBuffer hands the buffer to the OS, rotating first if the segment
+// would outgrow maxSize or has been written to for maxAge. It does not
+// fsync; see syncIfDue.
+func (w *WAL) writeBuffer() {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -247,38 +913,115 @@ func (w *WAL) flushOnce() {
 		panic("flushOnce called with nil file")
 	}
 
-	if len(w.buffer) == 0 {
-		return
+	if err := w.writeBufferLocked(); err != nil {
+		panic(err) // panic cause this shit is not recoverable
 	}
+}
 
-	info, err := w.file.Stat()
-	if err != nil {
-		panic(err)
+// writeBufferLocked is writeBuffer for callers that hold w.mu and want
+// the error back.
+func (w *WAL) writeBufferLocked() error {
+	// checked on every flush pass, so an idle segment is closed on time
+	if w.segmentExpired() {
+		if err := w.rotateLocked(); err != nil {
+			return err
+		}
 	}
-	if info.Size()+int64(len(w.buffer)) > w.maxSize {
-		if err := w.file.Sync(); err != nil {
-			panic(err)
+	if len(w.buffer) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	total := int64(len(w.buffer))
+	for len(w.buffer) > 0 {
+		n, err := w.fitLocked()
+		if err != nil {
+			return err
 		}
-		if err := w.file.Close(); err != nil {
-			panic(err)
+
+		// at the offset rather than appended, as a preallocated segment
+		// runs on past its last record
+		w.faults.delay(w.faults.WriteLatency)
+		if _, err := w.file.WriteAt(w.buffer[:n], w.offset); err != nil {
+			return err
 		}
-		w.file = nil
+		w.offset += int64(n)
+		if w.segmentStart.IsZero() {
+			w.segmentStart = time.Now()
+		}
+		w.unsynced += int64(n)
+		w.written += int64(n)
+		w.buffer = w.buffer[:copy(w.buffer, w.buffer[n:])]
+	}
+	w.counters.flushes++
+	w.counters.lastFlush = time.Now()
+	took := w.counters.lastFlush.Sub(start)
+	w.counters.flushLatency.observe(took)
+	w.counters.slow("flush", start, took, total)
 
-		w.segmentID++
-		if err := w.openSegment(); err != nil {
-			panic(err)
+	w.buffered.Store(0)
+	return nil
+}
+
+// fitLocked rotates if the buffer doesn't fit the rest of the active
+// segment and returns how much of it to write there. A buffer that fits
+// a new segment goes into one whole; a bigger one is split between
+// segments at frame boundaries, which the chunks of a big record allow.
+// Caller holds w.mu.
+func (w *WAL) fitLocked() (int, error) {
+	room := w.maxSize - w.offset
+	if int64(len(w.buffer)) <= room {
+		return len(w.buffer), nil
+	}
+
+	fresh := w.offset <= headerSize
+	if !fresh && int64(len(w.buffer)) <= w.maxSize-headerSize {
+		return len(w.buffer), w.rotateLocked()
+	}
+	n := framesWithin(w.buffer, room)
+	if n > 0 {
+		return n, nil
+	}
+	if !fresh {
+		if err := w.rotateLocked(); err != nil {
+			return 0, err
 		}
+		return w.fitLocked()
 	}
+	// a frame bigger than a segment, which only MaxSegmentSize below
+	// the smallest chunk makes
+	return 12 + int(binary.BigEndian.Uint32(w.buffer[4:8])), nil
+}
 
-	if _, err := w.file.Write(w.buffer); err != nil {
-		panic(err) // panic cause this shit is not recoverable
+// framesWithin returns the bytes of the whole frames at the start of
+// buf that fit in room.
+func framesWithin(buf []byte, room int64) int {
+	n := 0
+	for n+12 <= len(buf) {
+		next := n + 12 + int(binary.BigEndian.Uint32(buf[n+4:n+8]))
+		if int64(next) > room {
+			break
+		}
+		n = next
 	}
+	return n
+}
+
+// syncIfDue fsyncs written data when the sync policy asks for it,
+// letting Appends carry on meanwhile.
+func (w *WAL) syncIfDue() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	if err := w.file.Sync(); err != nil {
-		panic(err)
+	if w.file == nil {
+		panic("flushOnce called with nil file")
 	}
 
-	w.buffer = w.buffer[:0]
+	if w.shouldSync() {
+		if err := w.syncUnlocked(); err != nil {
+			panic(err)
+		}
+	}
 }
 
 func (w *WAL) ForceFlush() {
@@ -288,28 +1031,44 @@ func (w *WAL) ForceFlush() {
 func (w *WAL) openSegment() error {
 	path := filepath.Join(w.dir, fmt.Sprintf("wal-%04d.log", w.segmentID))
 
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	// a reopened segment's end is found by RepairTail
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	offset := int64(0)
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = w.createSegment(path)
+		offset = headerSize
+	}
 	if err != nil {
 		return err
 	}
 
-	w.file = f
+	w.file, w.offset = f, offset
 	return nil
 }
 
 func (w *WAL) segmentFiles() ([]string, error) {
-	entries, err := os.ReadDir(w.dir)
+	return segmentFilesIn(w.dir)
+}
+
+// segmentFilesIn returns the paths of the segments in dir, oldest first.
+func segmentFilesIn(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
 
 	var files []string
 	for _, e := range entries {
-		if !e.IsDir() && strings.HasPrefix(e.Name(), "wal-") {
-			files = append(files, filepath.Join(w.dir, e.Name()))
+		if _, ok := segmentID(e.Name()); ok && !e.IsDir() {
+			files = append(files, filepath.Join(dir, e.Name()))
 		}
 	}
 
-	sort.Strings(files)
+	// by id, so wal-10000.log sorts after wal-9999.log
+	sort.Slice(files, func(i, j int) bool {
+		a, _ := segmentID(files[i])
+		b, _ := segmentID(files[j])
+		return a < b
+	})
 	return files, nil
 }
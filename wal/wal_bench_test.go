@@ -2,6 +2,7 @@ package wal
 
 import (
 	"os"
+	"slices"
 	"testing"
 	"time"
 )
@@ -23,7 +24,12 @@ func benchmarkBufferSize(b *testing.B, bufferSize int) {
 	}
 	defer os.RemoveAll(dir)
 
-	w, err := openWithBufferSize(dir, 100*time.Millisecond, 100*1024*1024, bufferSize)
+	w, err := OpenWithOptions(Options{
+		Dir:            dir,
+		FlushEvery:     100 * time.Millisecond,
+		MaxSegmentSize: 100 * 1024 * 1024,
+		BufferSize:     bufferSize,
+	})
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -39,7 +45,7 @@ func benchmarkBufferSize(b *testing.B, bufferSize int) {
 	b.ReportAllocs()
 
 	for i := 0; i < b.N; i++ {
-		if err := w.Append(r); err != nil {
+		if _, err := w.Append(r); err != nil {
 			b.Fatal(err)
 		}
 
@@ -52,30 +58,6 @@ func benchmarkBufferSize(b *testing.B, bufferSize int) {
 	w.Flush() // Final flush
 }
 
-// Helper to create WAL with custom buffer size
-func openWithBufferSize(dir string, flushEvery time.Duration, maxSize int64, bufferSize int) (*WAL, error) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, err
-	}
-
-	w := &WAL{
-		dir:        dir,
-		buffer:     make([]byte, 0, bufferSize),
-		segmentID:  1,
-		maxSize:    maxSize,
-		flushEvery: flushEvery,
-		stopCh:     make(chan struct{}),
-		stoppedCh:  make(chan struct{}),
-	}
-
-	if err := w.openSegment(); err != nil {
-		return nil, err
-	}
-
-	go w.flushLoop()
-	return w, nil
-}
-
 // Benchmark write throughput with different batch sizes
 func BenchmarkBatchSize1(b *testing.B)    { benchmarkBatchSize(b, 1) }
 func BenchmarkBatchSize10(b *testing.B)   { benchmarkBatchSize(b, 10) }
@@ -105,7 +87,7 @@ func benchmarkBatchSize(b *testing.B, batchSize int) {
 	b.ReportAllocs()
 
 	for i := 0; i < b.N; i++ {
-		if err := w.Append(r); err != nil {
+		if _, err := w.Append(r); err != nil {
 			b.Fatal(err)
 		}
 
@@ -142,7 +124,7 @@ func BenchmarkConcurrentWrites(b *testing.B) {
 
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			if err := w.Append(r); err != nil {
+			if _, err := w.Append(r); err != nil {
 				b.Fatal(err)
 			}
 		}
@@ -193,3 +175,121 @@ func BenchmarkRecordDecode(b *testing.B) {
 		}
 	}
 }
+
+// Benchmark write throughput by value size
+func BenchmarkWriteValue64B(b *testing.B)   { benchmarkWriteValue(b, 64) }
+func BenchmarkWriteValue1KB(b *testing.B)   { benchmarkWriteValue(b, 1024) }
+func BenchmarkWriteValue16KB(b *testing.B)  { benchmarkWriteValue(b, 16*1024) }
+func BenchmarkWriteValue256KB(b *testing.B) { benchmarkWriteValue(b, 256*1024) }
+
+func benchmarkWriteValue(b *testing.B, size int) {
+	w, err := Open(b.TempDir(), 100*time.Millisecond, 100*1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	r := &Record{
+		Op:    OpSet,
+		Key:   []byte("benchmark-key"),
+		Value: make([]byte, size),
+	}
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Append(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	w.Flush()
+}
+
+// Benchmark flushing under each sync policy. Every append is flushed so
+// the cost of the policy's fsyncs shows up per op.
+func BenchmarkSyncAlways(b *testing.B) {
+	benchmarkSyncPolicy(b, SyncPolicy{Mode: SyncAlways})
+}
+
+func BenchmarkSyncEveryBytes(b *testing.B) {
+	benchmarkSyncPolicy(b, SyncPolicy{Mode: SyncEveryBytes, Bytes: 64 * 1024})
+}
+
+func BenchmarkSyncInterval(b *testing.B) {
+	benchmarkSyncPolicy(b, SyncPolicy{Mode: SyncInterval, Interval: 10 * time.Millisecond})
+}
+
+func BenchmarkSyncNever(b *testing.B) {
+	benchmarkSyncPolicy(b, SyncPolicy{Mode: SyncNever})
+}
+
+func benchmarkSyncPolicy(b *testing.B, policy SyncPolicy) {
+	w, err := OpenWithOptions(Options{
+		Dir:            b.TempDir(),
+		FlushEvery:     1 * time.Second,
+		MaxSegmentSize: 100 * 1024 * 1024,
+		SyncPolicy:     policy,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	r := &Record{
+		Op:    OpSet,
+		Key:   []byte("key"),
+		Value: []byte("value"),
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Append(r); err != nil {
+			b.Fatal(err)
+		}
+		w.Flush()
+	}
+}
+
+// Benchmark Append latency while the flusher fsyncs a slow disk, with
+// appends spaced out the way requests arrive. The fsync runs outside the
+// WAL's lock, so appends don't wait for it and p99 stays near the median
+// rather than at the sync latency.
+func BenchmarkAppendDuringSync(b *testing.B) {
+	w, err := OpenWithOptions(Options{
+		Dir:            b.TempDir(),
+		FlushEvery:     time.Millisecond,
+		MaxSegmentSize: 100 * 1024 * 1024,
+		Faults:         Faults{SyncLatency: 5 * time.Millisecond},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	r := &Record{
+		Op:    OpSet,
+		Key:   []byte("key"),
+		Value: []byte("value"),
+	}
+	took := make([]time.Duration, 0, b.N)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		if _, err := w.Append(r); err != nil {
+			b.Fatal(err)
+		}
+		took = append(took, time.Since(start))
+		time.Sleep(50 * time.Microsecond)
+	}
+	b.StopTimer()
+
+	slices.Sort(took)
+	b.ReportMetric(float64(took[len(took)/2].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(took[len(took)*99/100].Nanoseconds()), "p99-ns")
+}
@@ -1,9 +1,17 @@
 package wal
 
 import (
+	"archive/tar"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -47,11 +55,11 @@ func TestAppendAndReadAll(t *testing.T) {
 		Value: []byte("2"),
 	}
 
-	if err := w.Append(r1); err != nil {
+	if _, err := w.Append(r1); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := w.Append(r2); err != nil {
+	if _, err := w.Append(r2); err != nil {
 		t.Fatal(err)
 	}
 
@@ -121,7 +129,7 @@ func TestPartialWriteTruncation(t *testing.T) {
 		Value: []byte("1"),
 	}
 
-	if err := w.Append(r1); err != nil {
+	if _, err := w.Append(r1); err != nil {
 		t.Fatal(err)
 	}
 
@@ -135,12 +143,12 @@ func TestPartialWriteTruncation(t *testing.T) {
 	// Write bad magic number to simulate corruption
 	var buf [4]byte
 	binary.BigEndian.PutUint32(buf[:], 0xDEADBEEF) // wrong magic
-	f.Write(buf[:])
+	f.WriteAt(buf[:], w.offset)
 	f.Sync()
 	w.mu.Unlock()
 
 	// now read
-	records, err := w.ReadAll()
+	records, stats, err := w.ReadAllWithStats()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -149,6 +157,10 @@ func TestPartialWriteTruncation(t *testing.T) {
 		t.Fatalf("expected 1 valid record after truncation, got %d", len(records))
 	}
 
+	if stats.CorruptBytes != 4 {
+		t.Fatalf("expected 4 corrupt bytes reported, got %d", stats.CorruptBytes)
+	}
+
 	if string(records[0].Key) != "a" {
 		t.Fatal("valid record was corrupted by partial write")
 	}
@@ -166,7 +178,7 @@ func TestBuffering(t *testing.T) {
 	}
 
 	// Append but don't flush
-	if err := w.Append(r1); err != nil {
+	if _, err := w.Append(r1); err != nil {
 		t.Fatal(err)
 	}
 
@@ -238,7 +250,7 @@ func TestBackgroundFlush(t *testing.T) {
 	}
 
 	// Append without manual flush
-	if err := w.Append(r1); err != nil {
+	if _, err := w.Append(r1); err != nil {
 		t.Fatal(err)
 	}
 
@@ -271,7 +283,7 @@ func TestForceFlush(t *testing.T) {
 		Value: []byte("now"),
 	}
 
-	if err := w.Append(r1); err != nil {
+	if _, err := w.Append(r1); err != nil {
 		t.Fatal(err)
 	}
 
@@ -308,7 +320,7 @@ func TestCloseFlushes(t *testing.T) {
 		Value: []byte("test"),
 	}
 
-	if err := w.Append(r1); err != nil {
+	if _, err := w.Append(r1); err != nil {
 		t.Fatal(err)
 	}
 
@@ -361,7 +373,7 @@ func TestConcurrentAppends(t *testing.T) {
 					Value: []byte("data"),
 				}
 
-				if err := w.Append(r); err != nil {
+				if _, err := w.Append(r); err != nil {
 					t.Errorf("goroutine %d: append failed: %v", id, err)
 					return
 				}
@@ -397,7 +409,7 @@ func TestChecksumValidation(t *testing.T) {
 		Value: []byte("checksum"),
 	}
 
-	if err := w.Append(r1); err != nil {
+	if _, err := w.Append(r1); err != nil {
 		t.Fatal(err)
 	}
 
@@ -406,6 +418,10 @@ func TestChecksumValidation(t *testing.T) {
 	// Corrupt the data by modifying a byte in the file
 	// Note: Can't use WriteAt on O_APPEND file, so we'll close and reopen without append
 	dir := w.dir
+	stat, err := w.file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
 	w.Close()
 
 	// Reopen the segment file for writing
@@ -415,13 +431,8 @@ func TestChecksumValidation(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	stat, err := f.Stat()
-	if err != nil {
-		f.Close()
-		t.Fatal(err)
-	}
-
-	// Corrupt last byte (in the data section)
+	// Corrupt the record's last byte (in the data section), before the
+	// marker Close left
 	corruptByte := []byte{0xFF}
 	_, err = f.WriteAt(corruptByte, stat.Size()-1)
 	if err != nil {
@@ -510,3 +521,2184 @@ func BenchmarkImmediateWrites(b *testing.B) {
 		w.Flush() // Flush every record (no batching)
 	}
 }
+
+// Test that tunables can be changed on a live WAL
+func TestReload(t *testing.T) {
+	dir, err := os.MkdirTemp("", "walrus-wal-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Start with an interval that would never fire during the test
+	w, err := Open(dir, 1*time.Hour, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.Reload(Tunables{FlushEvery: 10 * time.Millisecond, MaxSegmentSize: 2 * 1024 * 1024}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := w.Tunables()
+	if got.FlushEvery != 10*time.Millisecond || got.MaxSegmentSize != 2*1024*1024 {
+		t.Fatalf("tunables not applied: %+v", got)
+	}
+
+	if _, err := w.Append(&Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new interval should flush without an explicit Flush
+	time.Sleep(100 * time.Millisecond)
+
+	records, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record after reloaded flush interval, got %d", len(records))
+	}
+
+	if err := w.Reload(Tunables{FlushEvery: -time.Millisecond, MaxSegmentSize: 1024}); err == nil {
+		t.Fatal("expected error for negative flush interval")
+	}
+}
+
+// Test that the sync policy decides when flushed data is fsynced
+func TestSyncPolicy(t *testing.T) {
+	w, cleanup := newTestWAL(t)
+	defer cleanup()
+
+	r := &Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")}
+
+	tun := w.Tunables()
+	tun.SyncPolicy = SyncPolicy{Mode: SyncNever}
+	if err := w.Reload(tun); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Append(r)
+	w.Flush()
+
+	w.mu.Lock()
+	unsynced := w.unsynced
+	w.mu.Unlock()
+
+	if unsynced == 0 {
+		t.Fatal("expected unsynced bytes with SyncNever")
+	}
+
+	// a byte threshold below what is already pending syncs on the next flush
+	tun.SyncPolicy = SyncPolicy{Mode: SyncEveryBytes, Bytes: 1}
+	if err := w.Reload(tun); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Append(r)
+	w.Flush()
+
+	w.mu.Lock()
+	unsynced = w.unsynced
+	w.mu.Unlock()
+
+	if unsynced != 0 {
+		t.Fatalf("expected fsync once threshold reached, %d bytes unsynced", unsynced)
+	}
+
+	tun.SyncPolicy = SyncPolicy{Mode: SyncInterval}
+	if err := w.Reload(tun); err == nil {
+		t.Fatal("expected error for interval policy without interval")
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, s := range []string{"always", "never", "bytes:4096", "interval:250ms"} {
+		p, err := ParseSyncPolicy(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+
+		if p.String() != s {
+			t.Fatalf("expected %q to round-trip, got %q", s, p.String())
+		}
+	}
+
+	if _, err := ParseSyncPolicy("bytes:-1"); err == nil {
+		t.Fatal("expected error for negative byte threshold")
+	}
+}
+
+// Test OpenWithOptions defaults and validation
+func TestOpenWithOptions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "walrus-wal-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := OpenWithOptions(Options{Dir: dir, FlushEvery: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if got := w.Tunables().MaxSegmentSize; got != DefaultMaxSegmentSize {
+		t.Fatalf("expected default max segment size, got %d", got)
+	}
+
+	if cap(w.buffer) != DefaultBufferSize {
+		t.Fatalf("expected default buffer size, got %d", cap(w.buffer))
+	}
+
+	if _, err := OpenWithOptions(Options{FlushEvery: time.Second}); err == nil {
+		t.Fatal("expected error without a directory")
+	}
+
+	if _, err := OpenWithOptions(Options{Dir: dir, FlushEvery: -time.Second}); err == nil {
+		t.Fatal("expected error for a negative flush interval")
+	}
+}
+
+// Test that a shared scheduler flushes every WAL registered with it
+func TestScheduler(t *testing.T) {
+	sched, err := NewScheduler(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sched.Stop()
+
+	var wals []*WAL
+	for i := 0; i < 3; i++ {
+		w, err := OpenWithOptions(Options{Dir: t.TempDir(), Scheduler: sched})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+
+		w.Append(&Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")})
+		wals = append(wals, w)
+	}
+
+	if sched.Len() != 3 {
+		t.Fatalf("expected 3 registered WALs, got %d", sched.Len())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	for i, w := range wals {
+		records, err := w.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(records) != 1 {
+			t.Fatalf("wal %d: expected 1 record after scheduled flush, got %d", i, len(records))
+		}
+	}
+
+	wals[0].Close()
+	if sched.Len() != 2 {
+		t.Fatalf("expected Close to unregister, %d still registered", sched.Len())
+	}
+}
+
+func TestEncodeDecodeBatch(t *testing.T) {
+	in := []*Record{
+		{Op: OpSet, Key: []byte("a"), Value: []byte("1")},
+		{Op: OpDelete, Key: []byte("b")},
+	}
+
+	data, err := EncodeBatch(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := DecodeBatch(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) != 2 || string(out[0].Key) != "a" || out[1].Op != OpDelete {
+		t.Fatalf("batch did not round-trip: %+v", out)
+	}
+
+	if _, err := DecodeBatch(data[:len(data)-1]); err == nil {
+		t.Fatal("expected error for truncated batch")
+	}
+
+	if _, err := EncodeBatch([]*Record{{Op: OpBatch}}); err == nil {
+		t.Fatal("expected error for nested batch")
+	}
+}
+
+// Test that WALs with the same interval share one flush goroutine
+func TestSharedScheduler(t *testing.T) {
+	const every = 7 * time.Millisecond
+
+	w1, err := Open(t.TempDir(), every, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := Open(t.TempDir(), every, 1*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w1.scheduler != w2.scheduler {
+		t.Fatal("expected WALs with the same interval to share a scheduler")
+	}
+
+	// moving one WAL to a new interval leaves the other in place
+	if err := w2.Reload(Tunables{FlushEvery: 2 * every, MaxSegmentSize: 1024 * 1024}); err != nil {
+		t.Fatal(err)
+	}
+	if w1.scheduler == w2.scheduler {
+		t.Fatal("expected reload to move the WAL to another scheduler")
+	}
+
+	w1.Close()
+	w2.Close()
+
+	shared.Lock()
+	_, ok := shared.byInterval[every]
+	shared.Unlock()
+
+	if ok {
+		t.Fatal("expected shared scheduler to be released after its last WAL closed")
+	}
+}
+
+// Test that injected latency slows flushes and can be switched off
+func TestFaultLatency(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := OpenWithOptions(Options{
+		Dir:        dir,
+		FlushEvery: time.Hour,
+		Faults:     Faults{WriteLatency: 20 * time.Millisecond, SyncLatency: 20 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	r := &Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")}
+
+	w.Append(r)
+	start := time.Now()
+	w.Flush()
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("expected flush to take at least 40ms, took %v", elapsed)
+	}
+
+	if err := w.SetFaults(Faults{SyncLatency: -time.Second}); err == nil {
+		t.Fatal("expected negative latency to be rejected")
+	}
+	if err := w.SetFaults(Faults{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Append(r)
+	start = time.Now()
+	w.Flush()
+	if elapsed := time.Since(start); elapsed >= 40*time.Millisecond {
+		t.Fatalf("expected faults to be cleared, flush took %v", elapsed)
+	}
+
+	if _, err := OpenWithOptions(Options{Dir: dir, FlushEvery: time.Second, Faults: Faults{Jitter: -1}}); err == nil {
+		t.Fatal("expected negative jitter to be rejected")
+	}
+}
+
+// Test that injected flush errors fail the flushes callers wait on,
+// logging nothing for a write-through Append and keeping what Sync would
+// have flushed for the next one
+func TestFaultFlushErrors(t *testing.T) {
+	w, err := OpenWithOptions(Options{Dir: t.TempDir(), Faults: Faults{FlushErrors: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	r := &Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")}
+	if _, err := w.Append(r); !errors.Is(err, ErrInjected) {
+		t.Fatalf("expected the write-through to fail with ErrInjected, got %v", err)
+	}
+	if w.LastLSN() != 0 {
+		t.Fatalf("expected nothing logged, got LSN %d", w.LastLSN())
+	}
+	if err := w.SetFaults(Faults{FlushErrors: 1.5}); err == nil {
+		t.Fatal("expected a rate over 1 to be rejected")
+	}
+
+	w, err = OpenWithOptions(Options{Dir: t.TempDir(), FlushEvery: time.Hour, Faults: Faults{FlushErrors: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := w.Append(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Sync(); !errors.Is(err, ErrInjected) {
+		t.Fatalf("expected Sync to fail with ErrInjected, got %v", err)
+	}
+	if err := w.WaitDurable(w.Position()); !errors.Is(err, ErrInjected) {
+		t.Fatalf("expected WaitDurable to fail with ErrInjected, got %v", err)
+	}
+
+	w.SetFaults(Faults{})
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	records, err := w.ReadAll()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected the record kept for the next flush, got %d, %v", len(records), err)
+	}
+}
+
+// Test that a record written through but not synced keeps its LSN and
+// fails with ErrDurabilityUnknown, so the next one doesn't reuse it
+func TestWriteThroughSyncFailure(t *testing.T) {
+	w, err := OpenWithOptions(Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// writes go through to /dev/null, whose fsync fails
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	if null.Sync() == nil {
+		null.Close()
+		t.Skip("fsync of /dev/null succeeds here")
+	}
+	w.mu.Lock()
+	file := w.file
+	w.file = null
+	w.mu.Unlock()
+
+	lsn, err := w.Append(&Record{Op: OpSet, Key: []byte("a"), Value: []byte("1")})
+	if !errors.Is(err, ErrDurabilityUnknown) || !Logged(err) || lsn != 1 {
+		t.Fatalf("expected LSN 1 with ErrDurabilityUnknown, got %d, %v", lsn, err)
+	}
+
+	w.mu.Lock()
+	w.file = file
+	w.mu.Unlock()
+	null.Close()
+	if lsn, err := w.Append(&Record{Op: OpSet, Key: []byte("b"), Value: []byte("1")}); err != nil || lsn != 2 {
+		t.Fatalf("expected the next record at LSN 2, got %d, %v", lsn, err)
+	}
+}
+
+// Test that flushes and syncs over SlowOpThreshold are listed in Stats
+func TestSlowOps(t *testing.T) {
+	w, err := OpenWithOptions(Options{
+		Dir:        t.TempDir(),
+		FlushEvery: time.Hour,
+		Faults:     Faults{SyncLatency: SlowOpThreshold},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Append(&Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")})
+	w.Flush()
+
+	st, _ := w.Stats()
+	if len(st.SlowOps) != 1 || st.SlowOps[0].Op != "sync" || st.SlowOps[0].Bytes == 0 {
+		t.Fatalf("expected one slow sync, got %+v", st.SlowOps)
+	}
+
+	for i := 0; i < maxSlowOps; i++ {
+		w.Append(&Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")})
+		w.Flush()
+	}
+	if st, _ := w.Stats(); len(st.SlowOps) != maxSlowOps {
+		t.Fatalf("expected the list to be capped at %d, got %d", maxSlowOps, len(st.SlowOps))
+	}
+}
+
+// Test that a full buffer starts a flush, and that Append gives up with
+// ErrWriteStall when the disk is too slow to drain it in time
+func TestWriteStall(t *testing.T) {
+	w, err := OpenWithOptions(Options{
+		Dir:              t.TempDir(),
+		FlushEvery:       time.Hour,
+		MaxBufferedBytes: 100,
+		StallTimeout:     time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	r := &Record{Op: OpSet, Key: []byte("key"), Value: []byte("value")}
+
+	// a healthy disk only costs the full appends one early flush
+	for i := 0; i < 50; i++ {
+		if _, err := w.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, _ := w.Stats()
+	if st.Stalls == 0 || st.StallTimeouts != 0 || st.BufferedBytes >= 100 {
+		t.Fatalf("expected stalls that all got room, got %+v", st)
+	}
+
+	w.SetFaults(Faults{WriteLatency: 500 * time.Millisecond})
+	w.stallTimeout = 50 * time.Millisecond
+	for w.buffered.Load() < 100 {
+		w.Append(r)
+	}
+	start := time.Now()
+	if _, err := w.Append(r); !errors.Is(err, ErrWriteStall) {
+		t.Fatalf("expected ErrWriteStall, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("expected the stall to give up after its timeout, took %v", elapsed)
+	}
+	if st, _ := w.Stats(); st.StallTimeouts == 0 || st.StallTime <= 0 {
+		t.Fatalf("expected a stall timeout to be counted, got %+v", st)
+	}
+}
+
+// Test that with a full buffer BufferBlock and no StallTimeout waits out a
+// slow flush however long it takes, and BufferFail turns the write away
+// at once while the flush it started drains the buffer
+func TestBufferPolicy(t *testing.T) {
+	r := &Record{Op: OpSet, Key: []byte("key"), Value: []byte("value")}
+	open := func(policy BufferPolicy) *WAL {
+		w, err := OpenWithOptions(Options{
+			Dir:              t.TempDir(),
+			FlushEvery:       time.Hour,
+			MaxBufferedBytes: 100,
+			BufferPolicy:     policy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { w.Close() })
+		for w.buffered.Load() < 100 {
+			if _, err := w.Append(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.SetFaults(Faults{WriteLatency: 200 * time.Millisecond})
+		return w
+	}
+
+	t.Run("block", func(t *testing.T) {
+		w := open(BufferBlock)
+		start := time.Now()
+		if _, err := w.Append(r); err != nil {
+			t.Fatalf("expected the write to wait for room, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Fatalf("expected the write to wait for the flush, took %v", elapsed)
+		}
+		if st, _ := w.Stats(); st.Stalls == 0 || st.StallTimeouts != 0 {
+			t.Fatalf("expected a stall that got room, got %+v", st)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		w := open(BufferFail)
+		start := time.Now()
+		if _, err := w.Append(r); !errors.Is(err, ErrBufferFull) {
+			t.Fatalf("expected ErrBufferFull, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Fatalf("expected the write to fail at once, took %v", elapsed)
+		}
+		if st, _ := w.Stats(); st.Stalls != 1 || st.StallTimeouts != 1 {
+			t.Fatalf("expected one stall given up, got %+v", st)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for w.buffered.Load() >= 100 {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the failed write to have started a flush")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, err := w.Append(r); err != nil {
+			t.Fatalf("expected room once flushed, got %v", err)
+		}
+	})
+
+	for _, s := range []string{"block", "fail"} {
+		if p, err := ParseBufferPolicy(s); err != nil || p.String() != s {
+			t.Fatalf("ParseBufferPolicy(%q) = %v, %v", s, p, err)
+		}
+	}
+	if _, err := ParseBufferPolicy("drop"); err == nil {
+		t.Fatal("expected an unknown policy to be rejected")
+	}
+	if _, err := OpenWithOptions(Options{Dir: t.TempDir(), BufferPolicy: BufferFail + 1}); err == nil {
+		t.Fatal("expected an unknown policy to be rejected by Open")
+	}
+}
+
+// Test that Replay streams records, stops on a callback error and never
+// trusts a record length larger than the file
+func TestReplay(t *testing.T) {
+	w, cleanup := newTestWAL(t)
+	defer cleanup()
+
+	for _, k := range []string{"a", "b", "c"} {
+		w.Append(&Record{Op: OpSet, Key: []byte(k), Value: []byte("v")})
+	}
+	w.Flush()
+
+	// a header claiming a 3GB record, as a torn write might leave behind
+	w.mu.Lock()
+	var buf [12]byte
+	binary.BigEndian.PutUint32(buf[0:4], recordMagic)
+	binary.BigEndian.PutUint32(buf[4:8], 3<<30)
+	w.file.WriteAt(buf[:], w.offset)
+	w.mu.Unlock()
+
+	var keys []string
+	stats, err := w.Replay(func(rec *Record) error {
+		keys = append(keys, string(rec.Key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, "") != "abc" || stats.Records != 3 || stats.CorruptBytes != 12 {
+		t.Fatalf("unexpected replay: keys %v, stats %+v", keys, stats)
+	}
+
+	stop := errors.New("stop")
+	seen := 0
+	_, err = w.Replay(func(rec *Record) error {
+		seen++
+		if seen == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || seen != 2 {
+		t.Fatalf("expected replay to stop after 2 records, got %d (%v)", seen, err)
+	}
+}
+
+// Test rotation, segment removal and that reopening appends to the
+// newest segment rather than the first
+func TestRotateAndRemoveSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Append(&Record{Op: OpSet, Key: []byte("a"), Value: []byte("1")})
+	id, err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 2 {
+		t.Fatalf("expected segment 2 after rotating, got %d", id)
+	}
+	w.Append(&Record{Op: OpSet, Key: []byte("b"), Value: []byte("2")})
+	w.Close()
+
+	w, err = Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Append(&Record{Op: OpSet, Key: []byte("c"), Value: []byte("3")})
+	w.Flush()
+
+	records, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys string
+	for _, r := range records {
+		keys += string(r.Key)
+	}
+	if keys != "abc" {
+		t.Fatalf("expected records in order abc, got %q", keys)
+	}
+
+	if err := w.RemoveSegmentsBefore(2); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(files) != 1 || filepath.Base(files[0]) != "wal-0002.log" {
+		t.Fatalf("expected only wal-0002.log to remain, got %v", files)
+	}
+
+	// the active segment is never removed
+	if err := w.RemoveSegmentsBefore(100); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "wal-*.log")); len(files) != 1 {
+		t.Fatalf("expected the active segment to survive, got %v", files)
+	}
+}
+
+// Test that concurrent durable writers share fsyncs
+func TestGroupCommit(t *testing.T) {
+	w, err := OpenWithOptions(Options{
+		Dir:        t.TempDir(),
+		FlushEvery: time.Hour,
+		SyncPolicy: SyncPolicy{Mode: SyncNever},
+		Faults:     Faults{SyncLatency: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	const writers = 50
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w.Append(&Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")})
+			if err := w.WaitDurable(w.Position()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// one fsync each would take writers * 10ms
+	if elapsed := time.Since(start); elapsed >= writers*10*time.Millisecond/2 {
+		t.Fatalf("expected writers to share fsyncs, took %v", elapsed)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.durable != w.written || len(w.buffer) != 0 {
+		t.Fatal("expected every appended byte to be durable")
+	}
+}
+
+// Test that the WAL's origin is stamped on records that don't carry one
+// and that replay can filter by origin
+func TestRecordOrigin(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := OpenWithOptions(Options{Dir: dir, FlushEvery: time.Hour, Origin: "node-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local := &Record{Op: OpSet, Key: []byte("local"), Value: []byte("1")}
+	w.Append(local)
+	w.Append(&Record{Op: OpSet, Key: []byte("merged"), Value: []byte("2"), Origin: "node-b"})
+	w.Flush()
+
+	if local.Origin != "" {
+		t.Fatal("Append should not modify the caller's record")
+	}
+
+	records, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Origin != "node-a" || records[1].Origin != "node-b" {
+		t.Fatalf("unexpected origins: %+v", records)
+	}
+
+	var kept []string
+	_, err = w.Replay(ExcludeOrigins(func(r *Record) error {
+		kept = append(kept, string(r.Key))
+		return nil
+	}, "node-b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 || kept[0] != "local" {
+		t.Fatalf("expected only the local record, got %v", kept)
+	}
+
+	// unknown extension tags from newer writers are skipped
+	data, _ := encodeRecord(&Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")})
+	data = appendExt(data, 200, []byte("future"))
+	rec, err := decodeRecord(data)
+	if err != nil || string(rec.Value) != "v" {
+		t.Fatalf("expected unknown extension to be ignored, got %v %v", rec, err)
+	}
+}
+
+func TestWriteReadRecords(t *testing.T) {
+	var buf bytes.Buffer
+
+	in := []*Record{
+		{Op: OpSet, Key: []byte("a"), Value: []byte("1")},
+		{Op: OpDelete, Key: []byte("b"), Origin: "node-a"},
+	}
+	for _, r := range in {
+		if err := WriteRecord(&buf, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full := buf.Bytes()
+
+	var out []*Record
+	if err := ReadRecords(bytes.NewReader(full), func(r *Record) error {
+		out = append(out, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || string(out[0].Value) != "1" || out[1].Op != OpDelete || out[1].Origin != "node-a" {
+		t.Fatalf("unexpected records %+v", out)
+	}
+
+	err := ReadRecords(bytes.NewReader(full[:len(full)-1]), func(*Record) error { return nil })
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected ErrUnexpectedEOF for a truncated stream, got %v", err)
+	}
+}
+
+func TestTruncateWithRetention(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := OpenWithOptions(Options{
+		Dir:        dir,
+		FlushEvery: time.Hour,
+		Retention:  Retention{KeepSegments: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	segments := func() []string {
+		files, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+		for i, f := range files {
+			files[i] = filepath.Base(f)
+		}
+		return files
+	}
+
+	// segments 1-4 hold LSNs 1-4, with 5 active
+	for i := 0; i < 4; i++ {
+		w.Append(&Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")})
+		if _, err := w.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := segments(); len(got) != 5 {
+		t.Fatalf("expected 5 segments before truncating, got %v", got)
+	}
+
+	// segments 1-3 are obsolete but retention keeps the newest three
+	if err := w.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(segments(), " "); got != "wal-0003.log wal-0004.log wal-0005.log" {
+		t.Fatalf("unexpected segments after truncating: %s", got)
+	}
+
+	// rotating pushes 3 out of the window
+	if _, err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(segments(), " "); got != "wal-0004.log wal-0005.log wal-0006.log" {
+		t.Fatalf("unexpected segments after rotating: %s", got)
+	}
+
+	// but nothing newer than the truncation point goes
+	for i := 0; i < 2; i++ {
+		if _, err := w.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := segments(); len(got) != 5 || got[0] != "wal-0004.log" {
+		t.Fatalf("expected segments from 4 on to survive, got %v", got)
+	}
+
+	if _, err := OpenWithOptions(Options{Dir: dir, FlushEvery: time.Hour, Retention: Retention{KeepBytes: -1}}); err == nil {
+		t.Fatal("expected negative retention to be rejected")
+	}
+}
+
+func TestLSN(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &Record{Op: OpSet, Key: []byte("a"), Value: []byte("1")}
+	for want := uint64(1); want <= 3; want++ {
+		lsn, err := w.Append(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lsn != want {
+			t.Fatalf("expected LSN %d, got %d", want, lsn)
+		}
+	}
+	if rec.LSN != 0 {
+		t.Fatal("Append should not modify the caller's record")
+	}
+	w.Rotate()
+	w.Close()
+
+	// a reopened WAL carries on from the last LSN, even past an empty segment
+	w, err = Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if w.LastLSN() != 3 {
+		t.Fatalf("expected last LSN 3 after reopening, got %d", w.LastLSN())
+	}
+	if lsn, _ := w.Append(rec); lsn != 4 {
+		t.Fatalf("expected LSN 4, got %d", lsn)
+	}
+	w.Flush()
+
+	records, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range records {
+		if r.LSN != uint64(i+1) {
+			t.Fatalf("record %d: expected LSN %d, got %d", i, i+1, r.LSN)
+		}
+	}
+
+	// segment 1 holds LSNs 1-3, so it only becomes obsolete past 3
+	if err := w.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "wal-0001.log")); err != nil {
+		t.Fatal("segment 1 still holds LSN 3")
+	}
+	if err := w.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "wal-0001.log")); !os.IsNotExist(err) {
+		t.Fatal("expected segment 1 to be deleted")
+	}
+}
+
+// Test that a directory can only be open in one WAL at a time, naming
+// the pid holding it, and that Close releases it
+func TestDirectoryLock(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(dir, time.Hour, 1024*1024)
+	if !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), "pid "+strconv.Itoa(os.Getpid())) {
+		t.Fatalf("expected ErrLocked naming this pid, got %v", err)
+	}
+
+	// reading only doesn't need the lock
+	ro, err := OpenReadOnly(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro.Close()
+
+	w.Close()
+	w, err = Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("expected Close to release the lock, got %v", err)
+	}
+	w.Close()
+}
+
+// Test that InspectSegment reports each frame, says why a corrupt one is
+// unreadable and leaves the file as it was
+func TestInspectSegment(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal-0001.log")
+
+	w, err := Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		w.Append(&Record{Op: OpSet, Key: []byte(k), Value: []byte("v")})
+	}
+	w.Close()
+
+	inspect := func() []Frame {
+		var frames []Frame
+		if err := InspectSegment(path, nil, func(f Frame) error {
+			frames = append(frames, f)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return frames
+	}
+
+	frames := inspect()
+	if len(frames) != 4 || frames[1].Offset != frames[0].Offset+frames[0].Size || string(frames[2].Record.Key) != "c" || frames[3].Record.Op != OpShutdown {
+		t.Fatalf("expected 3 back-to-back frames and Close's marker, got %+v", frames)
+	}
+
+	info, _ := os.Stat(path)
+	f, _ := os.OpenFile(path, os.O_RDWR, 0)
+	f.WriteAt([]byte{0xff}, frames[1].Offset+12)
+	f.Close()
+
+	frames = inspect()
+	if len(frames) != 2 || frames[0].Err != nil || !errors.Is(frames[1].Err, errChecksum) {
+		t.Fatalf("expected a checksum mismatch in the second frame, got %+v", frames)
+	}
+	if frames[1].Offset+frames[1].Size != info.Size() {
+		t.Fatal("expected the bad frame to cover the rest of the file")
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Fatal("expected InspectSegment to leave the file alone")
+	}
+}
+
+// Test that Repair keeps the records after a corrupt one, which replay
+// would drop, and leaves the damaged log alone
+func TestRepair(t *testing.T) {
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "repaired")
+	path := filepath.Join(src, "wal-0001.log")
+
+	w, err := Open(src, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		w.Append(&Record{Op: OpSet, Key: []byte(k), Value: []byte("value")})
+	}
+	w.Close()
+
+	var frames []Frame
+	InspectSegment(path, nil, func(f Frame) error {
+		frames = append(frames, f)
+		return nil
+	})
+	f, _ := os.OpenFile(path, os.O_RDWR, 0)
+	f.WriteAt([]byte{0xff}, frames[1].Offset+14)
+	f.Close()
+	info, _ := os.Stat(path)
+
+	report, err := Repair(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 1 || report[0].Records != 3 || report[0].Regions != 1 || report[0].Skipped != frames[1].Size {
+		t.Fatalf("expected 3 records kept around one bad frame, got %+v", report)
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Fatal("expected Repair to leave the source alone")
+	}
+
+	w, err = Open(dst, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := w.ReadAll()
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range records {
+		got = append(got, fmt.Sprintf("%s@%d", r.Key, r.LSN))
+	}
+	if strings.Join(got, " ") != "a@1 c@3 d@4" {
+		t.Fatalf("expected a, c and d with their LSNs, got %v", got)
+	}
+
+	if _, err := Repair(src, dst); err == nil {
+		t.Fatal("expected Repair to refuse a directory holding a log")
+	}
+}
+
+// Test that RecoverySalvage replays the records after a corrupt one,
+// where RecoveryStrict stops at it
+func TestRecoverySalvage(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal-0001.log")
+
+	w, err := Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		w.Append(&Record{Op: OpSet, Key: []byte(k), Value: []byte("value")})
+	}
+	w.Close()
+
+	var frames []Frame
+	InspectSegment(path, nil, func(f Frame) error {
+		frames = append(frames, f)
+		return nil
+	})
+	f, _ := os.OpenFile(path, os.O_RDWR, 0)
+	f.WriteAt([]byte{0xff}, frames[1].Offset+14)
+	f.Close()
+
+	keys := func(r *Reader) string {
+		var got []string
+		for {
+			rec, err := r.Next()
+			if err != nil {
+				break
+			}
+			got = append(got, string(rec.Key))
+		}
+		r.Close()
+		return strings.Join(got, " ")
+	}
+
+	ro, err := OpenReadOnly(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _ := ro.ReadAll()
+	ro.Close()
+	if len(records) != 1 {
+		t.Fatalf("expected strict replay to stop at the corrupt record, got %d records", len(records))
+	}
+
+	w, err = OpenWithOptions(Options{Dir: dir, Recovery: RecoverySalvage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var got []string
+	stats, err := w.Replay(func(r *Record) error {
+		got = append(got, string(r.Key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, " ") != "a c d" || stats.Resyncs != 1 || stats.CorruptBytes != frames[1].Size {
+		t.Fatalf("expected a, c and d past one corrupt record, got %v, %+v", got, stats)
+	}
+	if w.LastLSN() != 4 {
+		t.Fatalf("expected the LSNs past the corruption to count, got %d", w.LastLSN())
+	}
+
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(r); got != "a c d" {
+		t.Fatalf("expected the Reader to skip the corrupt record too, got %q", got)
+	}
+}
+
+// Test that replay leaves a torn tail on disk, and that opening the log
+// cuts it off so records appended after it replay
+func TestRepairTail(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal-0001.log")
+
+	w, err := Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(&Record{Op: OpSet, Key: []byte("a"), Value: []byte("1")})
+	w.Close()
+
+	info, _ := os.Stat(path)
+	valid := info.Size()
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{0xca, 0xfe, 0xba, 0xbe, 0, 0})
+	f.Close()
+
+	ro, err := OpenReadOnly(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, stats, _ := ro.ReadAllWithStats()
+	ro.Close()
+	if info, _ := os.Stat(path); info.Size() != valid+6 || stats.CorruptBytes != 6 {
+		t.Fatalf("expected reading to skip the torn tail and leave it, got size %d, %+v", info.Size(), stats)
+	}
+
+	w, err = Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep := w.TailRepaired(); rep != (TailRepair{Segment: "wal-0001.log", Offset: valid, Dropped: 6}) {
+		t.Fatalf("expected the torn tail cut on open, got %+v", rep)
+	}
+	w.Append(&Record{Op: OpSet, Key: []byte("b"), Value: []byte("2")})
+	if rep, err := w.RepairTail(); err != nil || rep.Dropped != 0 {
+		t.Fatalf("expected an intact tail after the cut, got %+v, %v", rep, err)
+	}
+	w.Close()
+
+	w, _ = Open(dir, time.Hour, 1024*1024)
+	defer w.Close()
+	records, err := w.ReadAll()
+	if err != nil || len(records) != 2 || string(records[1].Key) != "b" {
+		t.Fatalf("expected the record appended after the cut to replay, got %d records, %v", len(records), err)
+	}
+}
+
+// Test that Close leaves a marker that Open removes, and that a log
+// ending without one reads as a crash
+func TestCrashed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal-0001.log")
+
+	w, err := Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Crashed() {
+		t.Fatal("expected a new log not to have crashed")
+	}
+	w.Append(&Record{Op: OpSet, Key: []byte("a"), Value: []byte("1")})
+	w.Close()
+
+	var frames []Frame
+	InspectSegment(path, nil, func(f Frame) error {
+		frames = append(frames, f)
+		return nil
+	})
+	if len(frames) != 2 || frames[1].Record.Op != OpShutdown {
+		t.Fatalf("expected the record and a shutdown marker, got %+v", frames)
+	}
+
+	w, err = Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Crashed() {
+		t.Fatal("expected a clean shutdown")
+	}
+	if info, _ := os.Stat(path); info.Size() != frames[1].Offset {
+		t.Fatalf("expected Open to remove the marker, got %d bytes", info.Size())
+	}
+	records, _ := w.ReadAll()
+	if len(records) != 1 {
+		t.Fatalf("expected the marker not to be replayed, got %d records", len(records))
+	}
+	w.Close()
+
+	// a log cut off before its marker is what a crash leaves
+	os.Truncate(path, frames[1].Offset)
+	w, err = Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if !w.Crashed() {
+		t.Fatal("expected a log without a marker to have crashed")
+	}
+}
+
+// Test that a read-only WAL reads a log another WAL has open and changes
+// nothing on disk
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := OpenReadOnly(Options{Dir: filepath.Join(dir, "missing")}); err == nil {
+		t.Fatal("expected an error for a missing directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatal("expected OpenReadOnly not to create the directory")
+	}
+
+	w, err := Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, k := range []string{"a", "b"} {
+		w.Append(&Record{Op: OpSet, Key: []byte(k), Value: []byte("v")})
+	}
+	w.Flush()
+
+	before, _ := os.ReadDir(dir)
+	ro, err := OpenReadOnly(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ro.ReadAll()
+	if err != nil || len(records) != 2 || ro.LastLSN() != 2 {
+		t.Fatalf("expected both records up to LSN 2, got %d records, LSN %d, %v", len(records), ro.LastLSN(), err)
+	}
+	if _, err := ro.Append(&Record{Op: OpSet, Key: []byte("c")}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from Append, got %v", err)
+	}
+	if _, err := ro.Rotate(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from Rotate, got %v", err)
+	}
+	if err := ro.Sync(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from Sync, got %v", err)
+	}
+	ro.Flush()
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, _ := os.ReadDir(dir)
+	if len(after) != len(before) {
+		t.Fatalf("expected no files created, had %d, now %d", len(before), len(after))
+	}
+
+	// the owner carries on
+	if _, err := w.Append(&Record{Op: OpSet, Key: []byte("c"), Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that Append stamps records with the time they were logged, keeps a
+// timestamp already set, and that it survives a batch
+func TestRecordTimestamp(t *testing.T) {
+	w, cleanup := newTestWAL(t)
+	defer cleanup()
+
+	before := time.Now().UnixNano()
+	rec := &Record{Op: OpSet, Key: []byte("a"), Value: []byte("1")}
+	w.Append(rec)
+	w.Append(&Record{Op: OpSet, Key: []byte("b"), Value: []byte("2"), Timestamp: 42})
+	w.Flush()
+
+	if rec.Timestamp != 0 {
+		t.Fatal("Append should not modify the caller's record")
+	}
+
+	records, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Timestamp < before || records[0].Timestamp > time.Now().UnixNano() {
+		t.Fatalf("expected the first record stamped at append time, got %+v", records)
+	}
+	if records[1].Timestamp != 42 {
+		t.Fatalf("expected a set timestamp to be kept, got %d", records[1].Timestamp)
+	}
+
+	data, err := EncodeBatch([]*Record{{Op: OpSet, Key: []byte("c"), Timestamp: 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := DecodeBatch(data)
+	if err != nil || len(batch) != 1 || batch[0].Timestamp != 7 {
+		t.Fatalf("expected the timestamp to survive a batch, got %+v, %v", batch, err)
+	}
+}
+
+func TestReaderAndReadFrom(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// LSNs 1-3 in segment 1, 4-6 in segment 2
+	for i := 0; i < 6; i++ {
+		if i == 3 {
+			w.Rotate()
+		}
+		w.Append(&Record{Op: OpSet, Key: []byte{byte('a' + i)}, Value: []byte("v")})
+	}
+	w.Flush()
+
+	read := func(r *Reader) string {
+		t.Helper()
+		defer r.Close()
+
+		var keys string
+		for {
+			rec, err := r.Next()
+			if err == io.EOF {
+				return keys
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys += string(rec.Key)
+		}
+	}
+
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(r); got != "abcdef" {
+		t.Fatalf("expected every record, got %q", got)
+	}
+
+	for lsn, want := range map[uint64]string{2: "bcdef", 4: "def", 5: "ef", 7: ""} {
+		r, err := w.ReadFrom(lsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := read(r); got != want {
+			t.Fatalf("ReadFrom(%d): expected %q, got %q", lsn, want, got)
+		}
+	}
+
+	r, _ = w.ReadFrom(5)
+	if len(r.files) != 1 {
+		t.Fatalf("expected segment 1 to be skipped, still have %d segments", len(r.files))
+	}
+	r.Close()
+}
+
+// Test that a tailing Reader picks up records written after it reached
+// the end, in the active segment and across rotation, and that Tail
+// refuses an LSN whose segment is gone
+func TestTail(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWithOptions(Options{Dir: dir, MaxSegmentSize: 4096, Preallocate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	set := func(keys string) {
+		for _, k := range keys {
+			w.Append(&Record{Op: OpSet, Key: []byte(string(k)), Value: []byte("v")})
+		}
+	}
+	r, err := w.Tail(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	read := func() string {
+		t.Helper()
+
+		var keys string
+		for {
+			rec, err := r.Next()
+			if err == io.EOF {
+				return keys
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys += string(rec.Key)
+		}
+	}
+
+	set("ab")
+	w.Flush()
+	if got := read(); got != "ab" {
+		t.Fatalf("expected ab, got %q", got)
+	}
+	if got := read(); got != "" {
+		t.Fatalf("expected nothing new, got %q", got)
+	}
+	set("c")
+	w.Flush()
+	if got := read(); got != "c" {
+		t.Fatalf("expected c written since, got %q", got)
+	}
+
+	// d lands in the segment the Reader is at the end of, after which
+	// the log moves on
+	set("d")
+	w.Rotate()
+	set("e")
+	w.Flush()
+	if got := read(); got != "de" {
+		t.Fatalf("expected de across the rotation, got %q", got)
+	}
+
+	// the finished segment can be the spare, the one being read can't
+	if err := w.RemoveSegmentsBefore(w.segmentID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spareName)); err != nil {
+		t.Fatalf("expected the finished segment kept as the spare, got %v", err)
+	}
+	if len(w.tailing) != 1 {
+		t.Fatalf("expected the active segment held, got %v", w.tailing)
+	}
+	set("f")
+	w.Flush()
+	if got := read(); got != "f" {
+		t.Fatalf("expected f, got %q", got)
+	}
+
+	for _, lsn := range []uint64{0, 1, 4} {
+		if _, err := w.Tail(lsn); !errors.Is(err, ErrTruncated) {
+			t.Fatalf("Tail(%d): expected ErrTruncated, got %v", lsn, err)
+		}
+	}
+	r2, err := w.Tail(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2.Close()
+
+	r.Close()
+	if len(w.tailing) != 0 || w.readers != 0 {
+		t.Fatalf("expected Close to release the segment, got %v and %d readers", w.tailing, w.readers)
+	}
+}
+
+func TestAppendReplicatedKeepsLSN(t *testing.T) {
+	w, cleanup := newTestWAL(t)
+	defer cleanup()
+
+	if err := w.AppendReplicated(&Record{Op: OpSet, Key: []byte("a"), LSN: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if w.LastLSN() != 10 {
+		t.Fatalf("expected last LSN 10, got %d", w.LastLSN())
+	}
+	if err := w.AppendReplicated(&Record{Op: OpSet, Key: []byte("b"), LSN: 10}); err == nil {
+		t.Fatal("expected a repeated LSN to be rejected")
+	}
+	if err := w.AppendReplicated(&Record{Op: OpSet, Key: []byte("b")}); err != nil || w.LastLSN() != 10 {
+		t.Fatalf("expected a record without an LSN to leave the last LSN at 10, got %d, %v", w.LastLSN(), err)
+	}
+	if lsn, _ := w.Append(&Record{Op: OpSet, Key: []byte("c")}); lsn != 11 {
+		t.Fatalf("expected local appends to carry on at 11, got %d", lsn)
+	}
+}
+
+// Test that WALs sharing LSNs number their records in one sequence, and
+// that reopening one picks up where the others' counter had got to
+func TestSharedLSNs(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	a, err := OpenWithOptions(Options{Dir: dirA, FlushEvery: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Append(&Record{Op: OpSet, Key: []byte("a1")})
+	b, err := OpenWithOptions(Options{Dir: dirB, FlushEvery: time.Hour, LSNs: a.LSNs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Append(&Record{Op: OpSet, Key: []byte("b2")})
+	a.Append(&Record{Op: OpSet, Key: []byte("a3")})
+	if err := b.AppendReplicated(&Record{Op: OpSet, Key: []byte("b9"), LSN: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if lsn, _ := a.Append(&Record{Op: OpSet, Key: []byte("a10")}); lsn != 10 || a.LSNs().Last() != 10 {
+		t.Fatalf("expected a to carry on at 10, got %d", lsn)
+	}
+	if a.LastLSN() != 10 || b.LastLSN() != 9 {
+		t.Fatalf("expected each log's own last LSN, got %d and %d", a.LastLSN(), b.LastLSN())
+	}
+	a.Close()
+	b.Close()
+
+	// b alone, then a with b's counter: the counter is the higher
+	b, err = OpenWithOptions(Options{Dir: dirB, FlushEvery: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	records, _ := b.ReadAll()
+	if len(records) != 2 || records[0].LSN != 2 || records[1].LSN != 9 {
+		t.Fatalf("expected b to hold LSNs 2 and 9, got %v", records)
+	}
+	a, err = OpenWithOptions(Options{Dir: dirA, FlushEvery: time.Hour, LSNs: b.LSNs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if lsn, _ := b.Append(&Record{Op: OpSet, Key: []byte("b11")}); lsn != 11 {
+		t.Fatalf("expected b to carry on at 11, got %d", lsn)
+	}
+
+	// a counter two logs share can't be streamed, nor one streamed shared
+	if err := b.LSNs().Stream(); !errors.Is(err, ErrLSNsShared) {
+		t.Fatalf("expected ErrLSNsShared streaming a shared counter, got %v", err)
+	}
+	a.Close()
+	if err := b.LSNs().Stream(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWithOptions(Options{Dir: dirA, FlushEvery: time.Hour, LSNs: b.LSNs()}); !errors.Is(err, ErrLSNsShared) {
+		t.Fatalf("expected ErrLSNsShared opening with a streamed counter, got %v", err)
+	}
+}
+
+func TestRestoreRejectsOtherFiles(t *testing.T) {
+	for _, name := range []string{"../wal-0001.log", "a/b/wal-0001.log", "a/../../wal-0001.log"} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 0})
+		tw.Close()
+
+		dir := t.TempDir()
+		if err := RestoreInto(dir, &buf); err == nil {
+			t.Fatalf("expected %q to be rejected", name)
+		}
+		if files, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), "wal-*.log")); len(files) != 0 {
+			t.Fatalf("restore wrote outside its directory: %v", files)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	doc := []byte(strings.Repeat(`{"user":"ann","roles":["admin","dev"],"active":true},`, 50))
+
+	for _, c := range []Compression{CompressionSnappy, CompressionZstd} {
+		t.Run(c.String(), func(t *testing.T) {
+			dir := t.TempDir()
+
+			// start plain, then reopen compressed: the log mixes both
+			w, err := Open(dir, time.Hour, 1024*1024)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Append(&Record{Op: OpSet, Key: []byte("plain"), Value: doc})
+			w.Close()
+
+			w, err = OpenWithOptions(Options{Dir: dir, FlushEvery: time.Hour, Compression: c})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Append(&Record{Op: OpSet, Key: []byte("packed"), Value: doc})
+			w.Append(&Record{Op: OpSet, Key: []byte("tiny"), Value: []byte("v")})
+			w.Close()
+
+			info, _ := os.Stat(filepath.Join(dir, "wal-0001.log"))
+			if info.Size() > int64(2*len(doc)) {
+				t.Fatalf("expected the second document to be compressed, log is %d bytes", info.Size())
+			}
+
+			w, err = Open(dir, time.Hour, 1024*1024)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+
+			records, err := w.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 3 || !bytes.Equal(records[1].Value, doc) || string(records[2].Value) != "v" || records[1].LSN != 2 {
+				t.Fatalf("unexpected records after replaying a mixed log: %d", len(records))
+			}
+		})
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	secret := []byte("session-token-" + strings.Repeat("x", 200))
+	k1 := EncryptionKey{ID: 1, Key: bytes.Repeat([]byte{1}, 32)}
+	k2 := EncryptionKey{ID: 2, Key: bytes.Repeat([]byte{2}, 16)}
+
+	open := func(keys ...EncryptionKey) (*WAL, error) {
+		return OpenWithOptions(Options{Dir: dir, FlushEvery: time.Hour, Compression: CompressionZstd, EncryptionKeys: keys})
+	}
+
+	w, err := open(k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(&Record{Op: OpSet, Key: []byte("a"), Value: secret})
+	w.Close()
+
+	// rotate: k2 encrypts new records, k1 still reads the old ones
+	w, err = open(k2, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(&Record{Op: OpSet, Key: []byte("b"), Value: []byte("v")})
+	w.Close()
+
+	data, _ := os.ReadFile(filepath.Join(dir, "wal-0001.log"))
+	if bytes.Contains(data, []byte("session-token")) {
+		t.Fatal("plaintext value found in the segment")
+	}
+
+	w, err = open(k2, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := w.ReadAll()
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || !bytes.Equal(records[0].Value, secret) || string(records[1].Value) != "v" || records[1].LSN != 2 {
+		t.Fatalf("unexpected records after rotation: %d", len(records))
+	}
+
+	// a missing or wrong key is an error, never a silently dropped tail
+	if _, err := open(k2); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey without key 1, got %v", err)
+	}
+	if _, err := open(k2, EncryptionKey{ID: 1, Key: bytes.Repeat([]byte{9}, 32)}); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt with the wrong key 1, got %v", err)
+	}
+	if _, err := Open(dir, time.Hour, 1024*1024); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey without keys, got %v", err)
+	}
+
+	keys, err := ParseEncryptionKeys("2:" + strings.Repeat("ab", 16) + ", 1:" + strings.Repeat("cd", 32))
+	if err != nil || len(keys) != 2 || keys[0].ID != 2 || len(keys[1].Key) != 32 {
+		t.Fatalf("ParseEncryptionKeys: %v %v", keys, err)
+	}
+	if _, err := OpenWithOptions(Options{Dir: t.TempDir(), FlushEvery: time.Hour, EncryptionKeys: []EncryptionKey{{ID: 1, Key: []byte("short")}}}); err == nil {
+		t.Fatal("expected an invalid key size to be rejected")
+	}
+}
+
+func TestStats(t *testing.T) {
+	w, cleanup := newTestWAL(t)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		w.Append(&Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")})
+	}
+
+	st, err := w.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Appends != 3 || st.BufferedBytes == 0 || st.Segments != 1 {
+		t.Fatalf("before flush: %+v", st)
+	}
+
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	st, _ = w.Stats()
+	if st.BufferedBytes != 0 || st.BytesWritten == 0 || st.Flushes == 0 || st.Syncs == 0 || st.LastFlush.IsZero() {
+		t.Fatalf("after sync: %+v", st)
+	}
+
+	var n uint64
+	for _, c := range st.FlushLatency.Counts {
+		n += c
+	}
+	if n != st.FlushLatency.Count || n != st.Flushes || len(st.FlushLatency.Counts) != len(st.FlushLatency.Bounds)+1 {
+		t.Fatalf("flush histogram doesn't add up: %+v", st.FlushLatency)
+	}
+}
+
+// Test that with no flush interval every Append is on disk when it returns
+func TestSynchronousAppend(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := OpenWithOptions(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.Append(&Record{Op: OpSet, Key: []byte("a"), Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	w.mu.Lock()
+	buffered, unsynced := len(w.buffer), w.unsynced
+	w.mu.Unlock()
+	if buffered != 0 || unsynced != 0 {
+		t.Fatalf("expected the record written and synced, %d bytes buffered and %d unsynced", buffered, unsynced)
+	}
+
+	// moving to a flush interval buffers again, and back to 0 writes
+	// out what was buffered
+	if err := w.Reload(Tunables{FlushEvery: time.Hour, MaxSegmentSize: DefaultMaxSegmentSize}); err != nil {
+		t.Fatal(err)
+	}
+	w.Append(&Record{Op: OpSet, Key: []byte("b"), Value: []byte("2")})
+	if records, _ := w.ReadAll(); len(records) != 1 {
+		t.Fatalf("expected the second record to be buffered, read %d", len(records))
+	}
+
+	if err := w.Reload(Tunables{MaxSegmentSize: DefaultMaxSegmentSize}); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := w.ReadAll(); len(records) != 2 {
+		t.Fatalf("expected both records on disk, read %d", len(records))
+	}
+}
+
+// Test that a segment older than MaxSegmentAge is rotated even when idle,
+// and that an empty one is never rotated
+func TestMaxSegmentAge(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := OpenWithOptions(Options{Dir: dir, FlushEvery: 5 * time.Millisecond, MaxSegmentAge: 30 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	time.Sleep(60 * time.Millisecond)
+	if files, _ := w.segmentFiles(); len(files) != 1 {
+		t.Fatalf("expected an empty segment to stay active, got %d segments", len(files))
+	}
+
+	w.Append(&Record{Op: OpSet, Key: []byte("k"), Value: []byte("v")})
+	time.Sleep(80 * time.Millisecond)
+
+	files, _ := w.segmentFiles()
+	if len(files) != 2 {
+		t.Fatalf("expected the written segment to be rotated out, got %d segments", len(files))
+	}
+	if records, _ := w.ReadAll(); len(records) != 1 {
+		t.Fatalf("expected 1 record after rotation, got %d", len(records))
+	}
+}
+
+// Test that preallocated segments read back as their records alone, and
+// that a segment retention deletes is reused as the next one
+func TestPreallocate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal-0001.log")
+	opts := Options{Dir: dir, MaxSegmentSize: 4096, Preallocate: true}
+
+	w, err := OpenWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); info.Size() != 4096 {
+		t.Fatalf("expected the segment preallocated to 4096 bytes, got %d", info.Size())
+	}
+	for _, k := range []string{"a", "b"} {
+		w.Append(&Record{Op: OpSet, Key: []byte(k), Value: []byte("1")})
+	}
+	w.Close()
+
+	var frames []Frame
+	InspectSegment(path, nil, func(f Frame) error {
+		frames = append(frames, f)
+		return nil
+	})
+	if len(frames) != 3 || frames[2].Record.Op != OpShutdown {
+		t.Fatalf("expected two records and a marker before the zeros, got %+v", frames)
+	}
+
+	// a torn write in the preallocated space is cut, and the space kept
+	f, _ := os.OpenFile(path, os.O_WRONLY, 0)
+	f.WriteAt([]byte{0xca, 0xfe, 0xba, 0xbe, 0, 0}, frames[2].Offset+frames[2].Size)
+	f.Close()
+
+	w, err = OpenWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep := w.TailRepaired(); rep.Dropped == 0 || !w.Crashed() {
+		t.Fatalf("expected the torn write cut off as a crash's, got %+v", rep)
+	}
+	if info, _ := os.Stat(path); info.Size() != 4096 {
+		t.Fatalf("expected the cut to keep the preallocation, got %d bytes", info.Size())
+	}
+	w.Append(&Record{Op: OpSet, Key: []byte("c"), Value: []byte("1")})
+	w.Flush()
+
+	records, stats, err := w.ReadAllWithStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || string(records[2].Key) != "c" || stats.CorruptBytes != 0 {
+		t.Fatalf("expected a, b and c and nothing corrupt, got %d records, %+v", len(records), stats)
+	}
+
+	// retention's deletion leaves the spare, which the next rotation takes
+	w.Rotate()
+	w.Append(&Record{Op: OpSet, Key: []byte("d"), Value: []byte("1")})
+	if err := w.Truncate(w.LastLSN()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spareName)); err != nil {
+		t.Fatalf("expected the deleted segment kept as the spare: %v", err)
+	}
+	id, err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spareName)); !os.IsNotExist(err) {
+		t.Fatalf("expected the spare reused, got %v", err)
+	}
+	w.Append(&Record{Op: OpSet, Key: []byte("e"), Value: []byte("1")})
+	w.Close()
+
+	// and the log reads the same without preallocation
+	w, err = Open(dir, time.Hour, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Crashed() {
+		t.Fatal("expected a clean shutdown")
+	}
+	records, _ = w.ReadAll()
+	if len(records) != 2 || string(records[0].Key) != "d" || string(records[1].Key) != "e" || w.segmentID != id {
+		t.Fatalf("expected d and e after the truncation, got %d records", len(records))
+	}
+}
+
+// Test that with preallocation, snapshots and stats see the records and
+// not the zeros after them, and that a segment a reader may hold isn't
+// reused
+func TestPreallocateReaders(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWithOptions(Options{Dir: dir, MaxSegmentSize: 4096, Preallocate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Append(&Record{Op: OpSet, Key: []byte("a"), Value: []byte("1")})
+	w.Flush()
+	snap, err := w.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := snap.segments[0].size; size != w.offset {
+		t.Fatalf("expected the active segment captured up to %d, got %d", w.offset, size)
+	}
+	if stats, _ := w.Stats(); stats.SegmentBytes != w.offset {
+		t.Fatalf("expected SegmentBytes %d, got %d", w.offset, stats.SegmentBytes)
+	}
+
+	// a write after the capture isn't in it
+	w.Append(&Record{Op: OpSet, Key: []byte("b"), Value: []byte("1")})
+	w.Flush()
+	var keys []string
+	snap.Replay(func(r *Record) error {
+		keys = append(keys, string(r.Key))
+		return nil
+	})
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("expected the snapshot to hold a alone, got %v", keys)
+	}
+
+	// rotation cuts the sealed segment back, and retention deletes it
+	// rather than leave it as the spare while the snapshot is open
+	end := w.offset
+	w.Rotate()
+	if info, _ := os.Stat(filepath.Join(dir, "wal-0001.log")); info.Size() != end {
+		t.Fatalf("expected the sealed segment cut to %d bytes, got %d", end, info.Size())
+	}
+	w.Append(&Record{Op: OpSet, Key: []byte("c"), Value: []byte("1")})
+	if err := w.Truncate(w.LastLSN()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spareName)); !os.IsNotExist(err) {
+		t.Fatalf("expected no spare while a snapshot is open, got %v", err)
+	}
+	keys = nil
+	snap.Replay(func(r *Record) error {
+		keys = append(keys, string(r.Key))
+		return nil
+	})
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("expected the snapshot unchanged, got %v", keys)
+	}
+	snap.Close()
+
+	w.Rotate()
+	w.Append(&Record{Op: OpSet, Key: []byte("d"), Value: []byte("1")})
+	if err := w.Truncate(w.LastLSN()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spareName)); err != nil {
+		t.Fatalf("expected the spare kept once no reader is open: %v", err)
+	}
+}
+
+// Test that segments start with a header that is checked on read, and
+// that files from before headers still read and take appends
+func TestSegmentHeader(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, 0, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		w.Append(&Record{Op: OpSet, Key: []byte(k), Value: []byte("1")})
+	}
+	id, _ := w.Rotate()
+	next := filepath.Join(dir, fmt.Sprintf("wal-%04d.log", id))
+
+	hdr, err := ReadSegmentHeader(filepath.Join(dir, "wal-0001.log"))
+	if err != nil || hdr.Version != segmentFormat || hdr.FirstLSN != 1 || time.Since(hdr.Created) > time.Minute {
+		t.Fatalf("expected a version %d header from LSN 1, got %+v, %v", segmentFormat, hdr, err)
+	}
+	if hdr, _ := ReadSegmentHeader(next); hdr.FirstLSN != 4 {
+		t.Fatalf("expected the next segment to start at LSN 4, got %+v", hdr)
+	}
+
+	// with the records truncated away, the empty segment's header keeps
+	// LSNs going up
+	w.Truncate(w.LastLSN() + 1)
+	w.Close()
+	if w, err = Open(dir, 0, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if w.LastLSN() != 3 {
+		t.Fatalf("expected LSNs to resume after 3, got %d", w.LastLSN())
+	}
+	w.Close()
+
+	// a format from a newer build is refused rather than taken for damage
+	data, _ := os.ReadFile(next)
+	newer := appendSegmentHeader(nil, SegmentHeader{Version: segmentFormat + 1, Created: time.Now()})
+	os.WriteFile(next, append(newer, data[headerSize:]...), 0644)
+	if _, err := Open(dir, 0, 1024*1024); !errors.Is(err, ErrSegmentFormat) {
+		t.Fatalf("expected ErrSegmentFormat, got %v", err)
+	}
+
+	// a damaged header fails the read, unless salvaging
+	data[10] ^= 0xff
+	os.WriteFile(next, data, 0644)
+	if _, err := ReadSegmentHeader(next); !errors.Is(err, ErrCorruptHeader) {
+		t.Fatalf("expected ErrCorruptHeader, got %v", err)
+	}
+	if _, err := OpenReadOnly(Options{Dir: dir}); !errors.Is(err, ErrCorruptHeader) {
+		t.Fatalf("expected strict replay to refuse the header, got %v", err)
+	}
+	ro, err := OpenReadOnly(Options{Dir: dir, Recovery: RecoverySalvage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, stats, err := ro.ReadAllWithStats(); err != nil || stats.CorruptBytes != headerSize {
+		t.Fatalf("expected salvage to skip the header, got %+v, %v", stats, err)
+	}
+
+	// a headerless segment, as written before headers, reads as it is
+	legacy := t.TempDir()
+	var frames []byte
+	frames = appendFrame(frames, &Record{Op: OpSet, Key: []byte("old"), Value: []byte("1"), LSN: 1})
+	os.WriteFile(filepath.Join(legacy, "wal-0001.log"), frames, 0644)
+	if w, err = Open(legacy, 0, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Append(&Record{Op: OpSet, Key: []byte("new"), Value: []byte("1")})
+	records, err := w.ReadAll()
+	if err != nil || len(records) != 2 || string(records[1].Key) != "new" || records[1].LSN != 2 {
+		t.Fatalf("expected the legacy record and the new one, got %d, %v", len(records), err)
+	}
+	if hdr, err := ReadSegmentHeader(filepath.Join(legacy, "wal-0001.log")); err != nil || hdr.Version != 0 {
+		t.Fatalf("expected no header on the legacy segment, got %+v, %v", hdr, err)
+	}
+}
+
+// Test that the checksum covers a frame's magic and length, that
+// lengths over MaxRecordSize are refused both ways, and that frames
+// from before either still read
+func TestFrameChecksumAndRecordLimit(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWithOptions(Options{Dir: dir, MaxRecordSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.Append(&Record{Op: OpSet, Key: []byte("big"), Value: make([]byte, 300)}); !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("expected ErrRecordTooLarge, got %v", err)
+	}
+	if w.LastLSN() != 0 {
+		t.Fatalf("expected nothing logged, got LSN %d", w.LastLSN())
+	}
+
+	// a legacy frame, checksummed over its data alone
+	legacy := appendFrame(nil, &Record{Op: OpSet, Key: []byte("old"), Value: []byte("1"), LSN: 1})
+	binary.BigEndian.PutUint32(legacy[0:4], legacyMagic)
+	binary.BigEndian.PutUint32(legacy[8:12], crc32.ChecksumIEEE(legacy[12:]))
+	w.mu.Lock()
+	w.buffer = append(w.buffer, legacy...)
+	w.lsn = 1
+	w.mu.Unlock()
+	w.Append(&Record{Op: OpSet, Key: []byte("new"), Value: []byte("2")})
+	w.Flush()
+
+	records, err := w.ReadAll()
+	if err != nil || len(records) != 2 || string(records[0].Key) != "old" {
+		t.Fatalf("expected the legacy record and the new one, got %d, %v", len(records), err)
+	}
+	var stream bytes.Buffer
+	stream.Write(legacy)
+	WriteRecord(&stream, records[1])
+	n := 0
+	if err := ReadRecords(&stream, func(*Record) error { n++; return nil }); err != nil || n != 2 {
+		t.Fatalf("expected ReadRecords to read both kinds, got %d, %v", n, err)
+	}
+
+	// flipping a new frame between plain and flagged now fails its
+	// checksum, and a length over the limit is refused before reading
+	second := int64(headerSize + len(legacy))
+	w.mu.Lock()
+	w.file.WriteAt([]byte{0xc1}, second+3)
+	_, _, err = readRecordAt(w.file, second, w.offset, w.maxRecord, nil)
+	if !errors.Is(err, errChecksum) {
+		w.mu.Unlock()
+		t.Fatalf("expected a changed magic to fail the checksum, got %v", err)
+	}
+	w.file.WriteAt([]byte{0xc0, 0x7f, 0xff, 0xff, 0xff}, second+3)
+	_, _, err = readRecordAt(w.file, second, w.offset, w.maxRecord, nil)
+	w.mu.Unlock()
+	if !errors.Is(err, errOversized) {
+		t.Fatalf("expected errOversized, got %v", err)
+	}
+}
+
+// Test that a record logged under a higher MaxRecordSize fails Open
+// once the limit is lowered, instead of being cut off as a torn tail
+func TestLoweredRecordLimit(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWithOptions(Options{Dir: dir, MaxRecordSize: 1024, MaxSegmentSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(&Record{Op: OpSet, Key: []byte("big"), Value: make([]byte, 500)})
+	w.Append(&Record{Op: OpSet, Key: []byte("after"), Value: []byte("1")})
+	path := w.file.Name()
+	w.Close()
+	info, _ := os.Stat(path)
+
+	if _, err := OpenWithOptions(Options{Dir: dir, MaxRecordSize: 256, MaxSegmentSize: 1 << 20}); !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("expected ErrRecordTooLarge, got %v", err)
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Fatalf("expected the segment left at %d bytes, got %d", info.Size(), after.Size())
+	}
+
+	w, err = OpenWithOptions(Options{Dir: dir, MaxRecordSize: 1024, MaxSegmentSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if records, _ := w.ReadAll(); len(records) != 2 {
+		t.Fatalf("expected both records back under the old limit, got %d", len(records))
+	}
+}
+
+// Test that records bigger than a segment are split into chunks across
+// segments and joined again by every reader, and that a big record torn
+// by a crash is dropped while the records around it survive
+func TestChunkedRecords(t *testing.T) {
+	dir := t.TempDir()
+	const maxSize = 4096
+	w, err := OpenWithOptions(Options{Dir: dir, MaxSegmentSize: maxSize, Compression: CompressionSnappy})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, 5*maxSize)
+	x := uint32(1)
+	for i := range big {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		big[i] = byte(x) // so compression won't fit it in a frame
+	}
+	values := [][]byte{[]byte("small"), big, bytes.Repeat([]byte("ab"), 1500), big[:3000], []byte("last")}
+	for i, v := range values {
+		if _, err := w.Append(&Record{Op: OpSet, Key: []byte{byte('a' + i)}, Value: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+
+	check := func(what string, records []*Record) {
+		t.Helper()
+		if len(records) != len(values) {
+			t.Fatalf("%s: expected %d records, got %d", what, len(values), len(records))
+		}
+		for i, r := range records {
+			if !bytes.Equal(r.Value, values[i]) || r.LSN != uint64(i+1) {
+				t.Fatalf("%s: record %d came back as %d bytes, LSN %d", what, i, len(r.Value), r.LSN)
+			}
+		}
+	}
+	records, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("ReadAll", records)
+
+	files, _ := w.segmentFiles()
+	if len(files) < 5 {
+		t.Fatalf("expected the big record to span segments, got %d", len(files))
+	}
+	chunked := 0
+	for _, path := range files {
+		info, _ := os.Stat(path)
+		if info.Size() > maxSize {
+			t.Fatalf("expected segments of at most %d bytes, %s has %d", maxSize, path, info.Size())
+		}
+		InspectSegment(path, nil, func(f Frame) error {
+			if f.Record != nil && f.Record.Op == OpChunk {
+				chunked++
+			}
+			return nil
+		})
+	}
+	if chunked == 0 {
+		t.Fatal("expected InspectSegment to report chunks")
+	}
+
+	// read through a Reader from the big record's LSN, and a snapshot
+	r, err := w.ReadFrom(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := r.Next()
+	r.Close()
+	if err != nil || rec.LSN != 2 || !bytes.Equal(rec.Value, big) {
+		t.Fatalf("expected the Reader to join the big record, got %v, %v", rec, err)
+	}
+	snap, err := w.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = nil
+	snap.Replay(func(r *Record) error { records = append(records, r); return nil })
+	snap.Close()
+	check("Snapshot", records)
+
+	// a big record cut short before its last chunk
+	w.Append(&Record{Op: OpSet, Key: []byte("torn"), Value: big})
+	w.Close()
+	files, _ = segmentFilesIn(dir)
+	os.Remove(files[len(files)-1])
+
+	w, err = OpenWithOptions(Options{Dir: dir, MaxSegmentSize: maxSize, Compression: CompressionSnappy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Append(&Record{Op: OpSet, Key: []byte("after"), Value: []byte("1")})
+	w.Flush()
+
+	records, err = w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(records); n != len(values)+1 || string(records[n-1].Key) != "after" {
+		t.Fatalf("expected the torn record dropped and the next one read, got %d records", n)
+	}
+	check("after the crash", records[:len(values)])
+}